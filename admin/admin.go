@@ -0,0 +1,406 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Backends is what the admin API needs from the plugin's backends, as implemented by *backends.Backends.
+type Backends interface {
+	AuthUnpwdCheck(ctx context.Context, username, password, clientid string) (bool, error)
+	AuthAclCheck(ctx context.Context, clientid, username, topic string, acc int) (bool, error)
+	Checkers() map[string][]string
+	Health(ctx context.Context) map[string]error
+}
+
+// Cache is what the admin API needs from the plugin's cache, as implemented by cache.Store.
+type Cache interface {
+	Flush(ctx context.Context) error
+	FlushUser(ctx context.Context, username string) error
+}
+
+// Unlocker is what the admin API needs from the login throttler, as implemented by *throttle.Throttler.
+type Unlocker interface {
+	Unlock(ctx context.Context, key, value string) error
+}
+
+// Target holds the backends, cache and throttler requests act on.
+// Cache and Throttle are nil when the cache or throttling are disabled.
+type Target struct {
+	Backends Backends
+	Cache    Cache
+	Throttle Unlocker
+}
+
+// AcquireFunc returns the target to use for a request and a function to call once the request is done with it,
+// so the plugin instance isn't halted by a reload while a request uses it.
+type AcquireFunc func() (Target, func())
+
+// CheckRequest is the body of a dry-run check.
+type CheckRequest struct {
+	Check    string `json:"check"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	ClientID string `json:"clientid"`
+	Topic    string `json:"topic,omitempty"`
+	Acc      int    `json:"acc,omitempty"`
+	// Address is the client's remote address network rules are applied to, none when empty.
+	Address string `json:"address,omitempty"`
+}
+
+// CheckResponse tells how a dry-run check was decided.
+type CheckResponse struct {
+	Result    string `json:"result"`
+	Backend   string `json:"backend,omitempty"`
+	Superuser bool   `json:"superuser,omitempty"`
+	Denied    bool   `json:"denied,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// defaultReadyzTTL is how long readiness results are reused for unless admin_readyz_ttl says otherwise.
+const defaultReadyzTTL = 5
+
+type handler struct {
+	token   []byte
+	acquire AcquireFunc
+
+	// readyz answers from the last health results for readyzTTL, so unauthenticated requests can't flood the backends.
+	readyzTTL time.Duration
+	healthMu  sync.Mutex
+	health    healthResults
+}
+
+// healthResults are the health of the backends as of at.
+type healthResults struct {
+	backends Backends
+	at       time.Time
+	errs     map[string]error
+}
+
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+// NewHandler returns the admin API handler. Every endpoint but /healthz and /readyz needs the
+// admin_token option to be given as a bearer token.
+func NewHandler(authOpts map[string]string, acquire AcquireFunc) (http.Handler, error) {
+	token := authOpts["admin_token"]
+	if token == "" {
+		return nil, errors.New("admin error: missing options: admin_token")
+	}
+
+	ttl := defaultReadyzTTL
+	if readyzTTL, ok := authOpts["admin_readyz_ttl"]; ok {
+		parsed, err := strconv.Atoi(readyzTTL)
+		if err != nil || parsed < 0 {
+			log.Warningf("couldn't parse admin_readyz_ttl %s, defaulting to %d", readyzTTL, defaultReadyzTTL)
+		} else {
+			ttl = parsed
+		}
+	}
+
+	h := &handler{
+		token:     []byte(token),
+		acquire:   acquire,
+		readyzTTL: time.Duration(ttl) * time.Second,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.HandleFunc("/checkers", h.authorized(http.MethodGet, h.checkers))
+	mux.HandleFunc("/cache/flush", h.authorized(http.MethodPost, h.flush))
+	mux.HandleFunc("/check", h.authorized(http.MethodPost, h.check))
+	mux.HandleFunc("/throttle/unlock", h.authorized(http.MethodPost, h.unlock))
+
+	return mux, nil
+}
+
+// Start serves the admin API on the address given by admin_listen until Stop is called,
+// over TLS when admin_tls_cert and admin_tls_key are given.
+func Start(authOpts map[string]string, acquire AcquireFunc) error {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server != nil {
+		return nil
+	}
+
+	handler, err := NewHandler(authOpts, acquire)
+	if err != nil {
+		return err
+	}
+
+	certFile, keyFile := authOpts["admin_tls_cert"], authOpts["admin_tls_key"]
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("admin error: admin_tls_cert and admin_tls_key must be given together")
+	}
+
+	// Listen right away so a wrong address is reported to the caller.
+	listener, err := net.Listen("tcp", authOpts["admin_listen"])
+	if err != nil {
+		return err
+	}
+
+	server = &http.Server{Handler: handler}
+
+	go func(srv *http.Server) {
+		var err error
+		if certFile != "" {
+			err = srv.ServeTLS(listener, certFile, keyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin server error: %s", err)
+		}
+	}(server)
+
+	log.Infof("serving admin API on %s", listener.Addr())
+
+	return nil
+}
+
+// Stop shuts the admin server down, waiting a few seconds for requests in flight.
+func Stop() {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("admin server shutdown error: %s", err)
+	}
+
+	server = nil
+}
+
+// isAuthorized tells whether the request carries the admin token, comparing it in constant time.
+func (h *handler) isAuthorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), h.token) == 1
+}
+
+// authorized wraps next so it's only reached with the given method and the admin token.
+func (h *handler) authorized(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.isAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// healthz tells the plugin is alive.
+func (h *handler) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz pings the backends and answers 503 if any of them is unhealthy.
+// Errors are only detailed to authorized requests.
+func (h *handler) readyz(w http.ResponseWriter, r *http.Request) {
+	target, release := h.acquire()
+	defer release()
+
+	status := http.StatusOK
+	backends := make(map[string]string)
+	for name, err := range h.backendsHealth(target.Backends) {
+		if err == nil {
+			backends[name] = "ok"
+			continue
+		}
+
+		log.Warnf("admin: backend %s is unhealthy: %s", name, err)
+		status = http.StatusServiceUnavailable
+		backends[name] = "unhealthy"
+		if h.isAuthorized(r) {
+			backends[name] = err.Error()
+		}
+	}
+
+	result := "ok"
+	if status != http.StatusOK {
+		result = "unhealthy"
+	}
+
+	writeJSON(w, status, map[string]interface{}{"status": result, "backends": backends})
+}
+
+// backendsHealth returns the health of backends, pinging them only when the last results are older than readyzTTL
+// or were for other backends, e.g. before a reload. Concurrent requests wait for a single round of pings, which isn't
+// bound to any of them so a client going away doesn't leave canceled pings cached.
+func (h *handler) backendsHealth(backends Backends) map[string]error {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+
+	if h.health.backends == backends && time.Since(h.health.at) < h.readyzTTL {
+		return h.health.errs
+	}
+
+	errs := backends.Health(context.Background())
+	h.health = healthResults{backends: backends, at: time.Now(), errs: errs}
+
+	return errs
+}
+
+// checkers lists the backends registered for each check type.
+func (h *handler) checkers(w http.ResponseWriter, r *http.Request) {
+	target, release := h.acquire()
+	defer release()
+
+	writeJSON(w, http.StatusOK, target.Backends.Checkers())
+}
+
+// flush removes every cached record, or only those of the user given in the username parameter.
+func (h *handler) flush(w http.ResponseWriter, r *http.Request) {
+	target, release := h.acquire()
+	defer release()
+
+	if target.Cache == nil {
+		writeError(w, http.StatusConflict, "cache is disabled")
+		return
+	}
+
+	var err error
+	username := r.FormValue("username")
+	if username != "" {
+		log.Infof("admin: flushing cache for user %s", username)
+		err = target.Cache.FlushUser(r.Context(), username)
+	} else {
+		log.Info("admin: flushing cache")
+		err = target.Cache.Flush(r.Context())
+	}
+
+	if err != nil {
+		log.Errorf("admin: cache flush error: %s", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "flushed"})
+}
+
+// unlock forgets the login failures of the username, clientid and ip parameters given.
+func (h *handler) unlock(w http.ResponseWriter, r *http.Request) {
+	target, release := h.acquire()
+	defer release()
+
+	if target.Throttle == nil {
+		writeError(w, http.StatusConflict, "throttling is disabled")
+		return
+	}
+
+	unlocked := 0
+	for _, key := range []string{"username", "clientid", "ip"} {
+		value := r.FormValue(key)
+		if value == "" {
+			continue
+		}
+
+		if err := target.Throttle.Unlock(r.Context(), key, value); err != nil {
+			log.Errorf("admin: couldn't unlock %s %s: %s", key, value, err)
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		unlocked++
+	}
+
+	if unlocked == 0 {
+		writeError(w, http.StatusBadRequest, "give a username, clientid or ip to unlock")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "unlocked"})
+}
+
+// check runs a user or acl check against the backends as a dry run, without reading or updating the cache,
+// circuit breakers, the superuser error policy or metrics.
+func (h *handler) check(w http.ResponseWriter, r *http.Request) {
+	var req CheckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid check request: "+err.Error())
+		return
+	}
+
+	target, release := h.acquire()
+	defer release()
+
+	ctx, decision := bes.WithDecision(bes.WithDryRun(r.Context()))
+	if req.Address != "" {
+		ctx = bes.WithAddress(ctx, req.Address)
+	}
+
+	var granted bool
+	var err error
+	switch req.Check {
+	case "user":
+		granted, err = target.Backends.AuthUnpwdCheck(ctx, req.Username, req.Password, req.ClientID)
+	case "acl":
+		if req.Topic == "" || req.Acc < 1 {
+			writeError(w, http.StatusBadRequest, "acl checks need a topic and acc")
+			return
+		}
+		granted, err = target.Backends.AuthAclCheck(ctx, req.ClientID, req.Username, req.Topic, req.Acc)
+	default:
+		writeError(w, http.StatusBadRequest, "check must be user or acl")
+		return
+	}
+
+	resp := CheckResponse{
+		Result:    metrics.Result(granted, err),
+		Backend:   decision.Backend,
+		Superuser: decision.Superuser,
+		Denied:    decision.Denied,
+		Reason:    decision.Reason,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin: couldn't write response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
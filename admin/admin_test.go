@@ -0,0 +1,266 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeBackends grants test1 with password test1, and acls on test/topic to test1 from the files backend.
+// It keeps whether the last user check was a dry run and the address it was made for.
+type fakeBackends struct {
+	down    bool
+	pinged  int
+	dryRun  bool
+	address string
+}
+
+func (o *fakeBackends) AuthUnpwdCheck(ctx context.Context, username, password, clientid string) (bool, error) {
+	o.dryRun = bes.DryRunFrom(ctx)
+	o.address = bes.AddressFrom(ctx)
+
+	if o.down {
+		return false, errors.New("backend is down")
+	}
+
+	if username == "test1" && password == "test1" {
+		bes.DecisionFrom(ctx).Backend = "files"
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (o *fakeBackends) AuthAclCheck(ctx context.Context, clientid, username, topic string, acc int) (bool, error) {
+	if username == "test1" && topic == "test/topic" {
+		bes.DecisionFrom(ctx).Backend = "files"
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (o *fakeBackends) Checkers() map[string][]string {
+	return map[string][]string{
+		"user":      {"files"},
+		"superuser": {},
+		"acl":       {"files", "redis"},
+	}
+}
+
+func (o *fakeBackends) Health(ctx context.Context) map[string]error {
+	o.pinged++
+	health := map[string]error{"files": nil, "redis": nil}
+	if o.down {
+		health["redis"] = errors.New("connection refused")
+	}
+
+	return health
+}
+
+type fakeCache struct {
+	flushed     bool
+	flushedUser string
+}
+
+func (o *fakeCache) Flush(ctx context.Context) error {
+	o.flushed = true
+	return nil
+}
+
+func (o *fakeCache) FlushUser(ctx context.Context, username string) error {
+	o.flushedUser = username
+	return nil
+}
+
+type fakeThrottle struct {
+	unlocked map[string]string
+}
+
+func (o *fakeThrottle) Unlock(ctx context.Context, key, value string) error {
+	o.unlocked[key] = value
+	return nil
+}
+
+func TestAdmin(t *testing.T) {
+	Convey("Given an admin API", t, func() {
+		backends := &fakeBackends{}
+		cache := &fakeCache{}
+		throttle := &fakeThrottle{unlocked: make(map[string]string)}
+		target := Target{Backends: backends, Cache: cache, Throttle: throttle}
+		acquired := 0
+
+		handler, err := NewHandler(map[string]string{"admin_token": "secret"}, func() (Target, func()) {
+			acquired++
+			return target, func() { acquired-- }
+		})
+		So(err, ShouldBeNil)
+
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		do := func(method, path, token string, body []byte) (*http.Response, map[string]interface{}) {
+			req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+			So(err, ShouldBeNil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			var decoded map[string]interface{}
+			So(json.NewDecoder(resp.Body).Decode(&decoded), ShouldBeNil)
+
+			return resp, decoded
+		}
+
+		Convey("Liveness and readiness shouldn't need the token", func() {
+			resp, _ := do(http.MethodGet, "/healthz", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+
+			resp, body := do(http.MethodGet, "/readyz", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(body["backends"], ShouldResemble, map[string]interface{}{"files": "ok", "redis": "ok"})
+			So(acquired, ShouldEqual, 0)
+		})
+
+		Convey("Readiness should fail when a backend is unhealthy, detailing the error only with the token", func() {
+			backends.down = true
+
+			resp, body := do(http.MethodGet, "/readyz", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusServiceUnavailable)
+			So(body["backends"].(map[string]interface{})["redis"], ShouldEqual, "unhealthy")
+
+			_, body = do(http.MethodGet, "/readyz", "secret", nil)
+			So(body["backends"].(map[string]interface{})["redis"], ShouldEqual, "connection refused")
+		})
+
+		Convey("Readiness should reuse the health results for a while, unless the backends changed", func() {
+			do(http.MethodGet, "/readyz", "", nil)
+			do(http.MethodGet, "/readyz", "", nil)
+			So(backends.pinged, ShouldEqual, 1)
+
+			reloaded := &fakeBackends{}
+			target.Backends = reloaded
+			do(http.MethodGet, "/readyz", "", nil)
+			So(reloaded.pinged, ShouldEqual, 1)
+
+			handler, err := NewHandler(map[string]string{"admin_token": "secret", "admin_readyz_ttl": "0"}, func() (Target, func()) {
+				return target, func() {}
+			})
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 2; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			}
+			So(reloaded.pinged, ShouldEqual, 3)
+		})
+
+		Convey("Other endpoints should need the right token", func() {
+			resp, _ := do(http.MethodGet, "/checkers", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			resp, _ = do(http.MethodGet, "/checkers", "wrong", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+
+			resp, _ = do(http.MethodPost, "/cache/flush", "", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusUnauthorized)
+			So(cache.flushed, ShouldBeFalse)
+		})
+
+		Convey("It should list the checkers", func() {
+			resp, body := do(http.MethodGet, "/checkers", "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(body["acl"], ShouldResemble, []interface{}{"files", "redis"})
+
+			resp, _ = do(http.MethodPost, "/checkers", "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusMethodNotAllowed)
+		})
+
+		Convey("It should flush the whole cache or a single user's records", func() {
+			resp, _ := do(http.MethodPost, "/cache/flush?"+url.Values{"username": {"test1"}}.Encode(), "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(cache.flushedUser, ShouldEqual, "test1")
+			So(cache.flushed, ShouldBeFalse)
+
+			resp, _ = do(http.MethodPost, "/cache/flush", "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(cache.flushed, ShouldBeTrue)
+
+			Convey("Flushing should fail when the cache is disabled", func() {
+				target.Cache = nil
+
+				resp, _ := do(http.MethodPost, "/cache/flush", "secret", nil)
+				So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+			})
+		})
+
+		Convey("It should unlock throttled logins", func() {
+			resp, _ := do(http.MethodPost, "/throttle/unlock?"+url.Values{"username": {"test1"}, "ip": {"10.0.0.1"}}.Encode(), "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(throttle.unlocked, ShouldResemble, map[string]string{"username": "test1", "ip": "10.0.0.1"})
+
+			resp, _ = do(http.MethodPost, "/throttle/unlock", "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			target.Throttle = nil
+			resp, _ = do(http.MethodPost, "/throttle/unlock?username=test1", "secret", nil)
+			So(resp.StatusCode, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("It should run dry-run checks", func() {
+			check := func(req CheckRequest) (*http.Response, map[string]interface{}) {
+				body, err := json.Marshal(req)
+				So(err, ShouldBeNil)
+
+				return do(http.MethodPost, "/check", "secret", body)
+			}
+
+			resp, body := check(CheckRequest{Check: "user", Username: "test1", Password: "test1", ClientID: "client1"})
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			So(body["result"], ShouldEqual, "granted")
+			So(body["backend"], ShouldEqual, "files")
+			So(backends.dryRun, ShouldBeTrue)
+			So(backends.address, ShouldEqual, "")
+
+			_, body = check(CheckRequest{Check: "user", Username: "test1", Password: "test1", ClientID: "client1", Address: "10.0.0.1"})
+			So(body["result"], ShouldEqual, "granted")
+			So(backends.address, ShouldEqual, "10.0.0.1")
+
+			_, body = check(CheckRequest{Check: "user", Username: "test1", Password: "wrong", ClientID: "client1"})
+			So(body["result"], ShouldEqual, "rejected")
+
+			_, body = check(CheckRequest{Check: "acl", Username: "test1", ClientID: "client1", Topic: "test/topic", Acc: 1})
+			So(body["result"], ShouldEqual, "granted")
+
+			backends.down = true
+			_, body = check(CheckRequest{Check: "user", Username: "test1", Password: "test1", ClientID: "client1"})
+			So(body["result"], ShouldEqual, "error")
+			So(body["error"], ShouldEqual, "backend is down")
+
+			resp, _ = check(CheckRequest{Check: "superuser", Username: "test1"})
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			resp, _ = check(CheckRequest{Check: "acl", Username: "test1"})
+			So(resp.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+			So(cache.flushed, ShouldBeFalse)
+			So(acquired, ShouldEqual, 0)
+		})
+	})
+
+	Convey("A missing token should be reported", t, func() {
+		_, err := NewHandler(map[string]string{}, nil)
+		So(err, ShouldNotBeNil)
+	})
+}
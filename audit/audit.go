@@ -0,0 +1,353 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultBufferSize = 1024
+
+// Checks of the events recorded when the plugin is started, opening a chain, or its configuration reloaded.
+const (
+	CheckStart  = "start"
+	CheckReload = "reload"
+)
+
+// Event is the record of a single decision. Events are chained: every event holds the hash of the previous one,
+// and its own hash is the HMAC-SHA256 of its JSON encoding without the hash field, keyed with audit_key,
+// so removing or changing an event breaks the chain and it can't be mended without the key.
+type Event struct {
+	Seq       uint64        `json:"seq"`
+	Time      time.Time     `json:"time"`
+	Check     string        `json:"check"`
+	Username  string        `json:"username"`
+	ClientID  string        `json:"clientid"`
+	Topic     string        `json:"topic,omitempty"`
+	Acc       int           `json:"acc,omitempty"`
+	Result    string        `json:"result"`
+	Backend   string        `json:"backend,omitempty"`
+	Superuser bool          `json:"superuser,omitempty"`
+	Denied    bool          `json:"denied,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	Cached    bool          `json:"cached"`
+	Latency   time.Duration `json:"-"`
+	LatencyMs float64       `json:"latency_ms"`
+	Error     string        `json:"error,omitempty"`
+	PrevHash  string        `json:"prev_hash"`
+	Hash      string        `json:"hash,omitempty"`
+}
+
+// Sink stores audit events. line is the event's JSON encoding, without a trailing newline.
+type Sink interface {
+	Write(e *Event, line []byte) error
+	Close() error
+}
+
+// Logger records events to its sinks from a single goroutine, so slow sinks don't hold checks up.
+// When its buffer is full events are dropped and counted in the metrics.
+type Logger struct {
+	sinks      []Sink
+	sampleRate float64
+	results    map[string]bool
+	checks     map[string]bool
+
+	mu     sync.RWMutex
+	closed bool
+	events chan *Event
+	done   chan struct{}
+
+	key      []byte
+	seq      uint64
+	lastHash string
+}
+
+// New builds a logger with the sinks given in the audit_sinks option, or returns nil when there are none.
+// The chain it writes opens with a start event, which follows the last event of the audit file when there's one,
+// so events removed from the end of the previous chain are noticed.
+func New(authOpts map[string]string) (*Logger, error) {
+	sinkNames := splitList(authOpts["audit_sinks"])
+	if len(sinkNames) == 0 {
+		return nil, nil
+	}
+
+	key, ok := authOpts["audit_key"]
+	if !ok || key == "" {
+		return nil, errors.New("audit error: missing options: audit_key")
+	}
+
+	l := &Logger{
+		key:        []byte(key),
+		sampleRate: 1,
+		results:    toSet(splitList(authOpts["audit_results"])),
+		checks:     toSet(splitList(authOpts["audit_checks"])),
+	}
+
+	if rate, ok := authOpts["audit_sample_rate"]; ok {
+		sampleRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			return nil, errors.Errorf("audit error: audit_sample_rate must be between 0 and 1, got %s", rate)
+		}
+		l.sampleRate = sampleRate
+	}
+
+	bufferSize := defaultBufferSize
+	if size, ok := authOpts["audit_buffer_size"]; ok {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 1 {
+			log.Warningf("couldn't parse audit_buffer_size %s, defaulting to %d", size, defaultBufferSize)
+		} else {
+			bufferSize = parsed
+		}
+	}
+
+	for _, name := range sinkNames {
+		var sink Sink
+		var err error
+
+		switch name {
+		case "file":
+			sink, err = newFileSink(authOpts)
+		case "syslog":
+			sink, err = newSyslogSink(authOpts)
+		case "webhook":
+			sink, err = newWebhookSink(authOpts)
+		case "clickhouse":
+			sink, err = newClickhouseSink(authOpts)
+		default:
+			err = errors.Errorf("audit error: unknown sink %s", name)
+		}
+
+		if err != nil {
+			l.closeSinks()
+			return nil, err
+		}
+
+		l.sinks = append(l.sinks, sink)
+		log.Infof("audit sink registered: %s", name)
+
+		if file, ok := sink.(*fileSink); ok {
+			last, err := file.lastEvent()
+			if err != nil {
+				l.closeSinks()
+				return nil, err
+			}
+			if last != nil {
+				l.lastHash = last.Hash
+			}
+		}
+	}
+
+	l.events = make(chan *Event, bufferSize)
+	l.done = make(chan struct{})
+
+	// Not subject to filters nor sampling, so every chain can be told apart from a forged one.
+	l.events <- &Event{Check: CheckStart}
+
+	go l.run()
+
+	return l, nil
+}
+
+// Record queues an event if it passes the filters and sampling. It's safe to call on a nil logger.
+func (l *Logger) Record(e *Event) {
+	if l == nil || !l.wants(e) {
+		return
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.events <- e:
+	default:
+		log.Warnf("audit buffer full, dropping %s event for %s", e.Check, e.Username)
+		metrics.ObserveAuditDropped()
+	}
+}
+
+// Reloaded records that the configuration was reloaded, regardless of filters and sampling.
+// It's safe to call on a nil logger.
+func (l *Logger) Reloaded() {
+	if l == nil {
+		return
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.closed {
+		l.events <- &Event{Check: CheckReload}
+	}
+}
+
+// Close waits for queued events to be written and closes the sinks. It's safe to call on a nil logger.
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.events)
+	l.mu.Unlock()
+
+	<-l.done
+	l.closeSinks()
+}
+
+func (l *Logger) wants(e *Event) bool {
+	if len(l.results) > 0 && !l.results[e.Result] {
+		return false
+	}
+
+	if len(l.checks) > 0 && !l.checks[e.Check] {
+		return false
+	}
+
+	return l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+
+	for e := range l.events {
+		line, err := l.chain(e)
+		if err != nil {
+			log.Errorf("audit error: couldn't encode event: %s", err)
+			continue
+		}
+
+		for _, sink := range l.sinks {
+			if err := sink.Write(e, line); err != nil {
+				log.Errorf("audit error: %s", err)
+			}
+		}
+	}
+}
+
+// chain numbers and hashes the event, returning its JSON encoding.
+func (l *Logger) chain(e *Event) ([]byte, error) {
+	l.seq++
+	e.Seq = l.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.LatencyMs = float64(e.Latency) / float64(time.Millisecond)
+	e.PrevHash = l.lastHash
+
+	hash, err := hashEvent(e, l.key)
+	if err != nil {
+		return nil, err
+	}
+	e.Hash = hash
+	l.lastHash = hash
+
+	return json.Marshal(e)
+}
+
+func (l *Logger) closeSinks() {
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			log.Errorf("audit error: couldn't close sink: %s", err)
+		}
+	}
+}
+
+func hashEvent(e *Event, key []byte) (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verify checks the chain of events read from r, one JSON event per line, as written by the file sink with the given key.
+// The first event must follow the one with the given seq and hash, 0 and empty when r starts with the first event ever written.
+// The seq and hash of the last event are returned, so rotated files may be verified in order, from the oldest one,
+// each one following the previous one. Only start events may start a new chain, with seq 1, and they still hold
+// the hash of the event before them.
+func Verify(r io.Reader, key []byte, seq uint64, prevHash string) (uint64, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	lastSeq := seq
+	lastHash := prevHash
+	for n := 1; scanner.Scan(); n++ {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return lastSeq, lastHash, errors.Wrapf(err, "line %d", n)
+		}
+
+		if e.Seq == 1 && e.Check != CheckStart {
+			return lastSeq, lastHash, fmt.Errorf("line %d: event starts a new chain but isn't a start one", n)
+		}
+
+		if (e.Seq != 1 && e.Seq != lastSeq+1) || e.PrevHash != lastHash {
+			return lastSeq, lastHash, fmt.Errorf("line %d: event doesn't follow the previous one, events are missing or were changed", n)
+		}
+
+		hash, err := hashEvent(&e, key)
+		if err != nil {
+			return lastSeq, lastHash, errors.Wrapf(err, "line %d", n)
+		}
+
+		if !hmac.Equal([]byte(hash), []byte(e.Hash)) {
+			return lastSeq, lastHash, fmt.Errorf("line %d: hash doesn't match, the event was changed", n)
+		}
+
+		lastSeq = e.Seq
+		lastHash = e.Hash
+	}
+
+	return lastSeq, lastHash, scanner.Err()
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+
+	return set
+}
@@ -0,0 +1,356 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func readEvents(path string) []Event {
+	data, err := ioutil.ReadFile(path)
+	So(err, ShouldBeNil)
+
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e Event
+		So(json.Unmarshal([]byte(line), &e), ShouldBeNil)
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func TestFileAudit(t *testing.T) {
+	Convey("Given an audit logger writing to a file", t, func() {
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "audit.log")
+
+		key := []byte("audit-key")
+		authOpts := map[string]string{
+			"audit_sinks": "file",
+			"audit_file":  path,
+			"audit_key":   string(key),
+		}
+
+		Convey("It should write chained events", func() {
+			l, err := New(authOpts)
+			So(err, ShouldBeNil)
+
+			l.Record(&Event{Check: "user", Username: "test1", ClientID: "client1", Result: "granted", Backend: "files", Latency: 1500 * time.Microsecond})
+			l.Record(&Event{Check: "acl", Username: "test1", ClientID: "client1", Topic: "test/topic", Acc: 1, Result: "rejected", Cached: true})
+			l.Close()
+
+			events := readEvents(path)
+			So(len(events), ShouldEqual, 3)
+
+			So(events[0].Seq, ShouldEqual, 1)
+			So(events[0].Check, ShouldEqual, CheckStart)
+			So(events[0].PrevHash, ShouldEqual, "")
+			So(events[1].Seq, ShouldEqual, 2)
+			So(events[1].Username, ShouldEqual, "test1")
+			So(events[1].Backend, ShouldEqual, "files")
+			So(events[1].LatencyMs, ShouldEqual, 1.5)
+			So(events[1].PrevHash, ShouldEqual, events[0].Hash)
+			So(events[2].Seq, ShouldEqual, 3)
+			So(events[2].Topic, ShouldEqual, "test/topic")
+			So(events[2].Cached, ShouldBeTrue)
+			So(events[2].PrevHash, ShouldEqual, events[1].Hash)
+
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			seq, hash, err := Verify(bytes.NewReader(data), key, 0, "")
+			So(err, ShouldBeNil)
+			So(seq, ShouldEqual, 3)
+			So(hash, ShouldEqual, events[2].Hash)
+
+			Convey("Verifying should catch changed or missing events", func() {
+				changed := strings.Replace(string(data), `"result":"rejected"`, `"result":"granted"`, 1)
+				_, _, err := Verify(strings.NewReader(changed), key, 0, "")
+				So(err, ShouldNotBeNil)
+
+				lines := strings.SplitN(string(data), "\n", 2)
+				_, _, err = Verify(strings.NewReader(lines[1]), key, 0, "")
+				So(err, ShouldNotBeNil)
+
+				_, _, err = Verify(bytes.NewReader(data), []byte("other-key"), 0, "")
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("Verifying should continue from the given event", func() {
+				lines := strings.SplitN(string(data), "\n", 2)
+				_, _, err := Verify(strings.NewReader(lines[1]), key, events[0].Seq, events[0].Hash)
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Events restarting the chain should be rejected unless they open it", func() {
+				forged := Event{Seq: 1, Check: "user", Username: "test1", Result: "granted"}
+				forged.Hash, err = hashEvent(&forged, key)
+				So(err, ShouldBeNil)
+				line, err := json.Marshal(&forged)
+				So(err, ShouldBeNil)
+
+				_, _, err = Verify(strings.NewReader(string(data)+string(line)+"\n"), key, 0, "")
+				So(err, ShouldNotBeNil)
+
+				forged = Event{Seq: 1, Check: CheckStart}
+				forged.Hash, err = hashEvent(&forged, key)
+				So(err, ShouldBeNil)
+				line, err = json.Marshal(&forged)
+				So(err, ShouldBeNil)
+
+				_, _, err = Verify(strings.NewReader(string(data)+string(line)+"\n"), key, 0, "")
+				So(err, ShouldNotBeNil)
+			})
+
+			Convey("A restarted logger should start a new chain following the file's last event", func() {
+				l, err := New(authOpts)
+				So(err, ShouldBeNil)
+
+				l.Reloaded()
+				l.Record(&Event{Check: "user", Username: "test2", Result: "error", Error: "backend is down"})
+				l.Close()
+
+				events := readEvents(path)
+				So(len(events), ShouldEqual, 6)
+				So(events[3].Seq, ShouldEqual, 1)
+				So(events[3].Check, ShouldEqual, CheckStart)
+				So(events[3].PrevHash, ShouldEqual, events[2].Hash)
+				So(events[4].Seq, ShouldEqual, 2)
+				So(events[4].Check, ShouldEqual, CheckReload)
+
+				data, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				_, _, err = Verify(bytes.NewReader(data), key, 0, "")
+				So(err, ShouldBeNil)
+			})
+
+			Convey("Events removed before a restart should be noticed", func() {
+				lines := strings.SplitAfter(string(data), "\n")
+				So(ioutil.WriteFile(path, []byte(strings.Join(lines[:2], "")), 0600), ShouldBeNil)
+
+				l, err := New(authOpts)
+				So(err, ShouldBeNil)
+				l.Close()
+
+				data, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				_, _, err = Verify(bytes.NewReader(data), key, 0, "")
+				So(err, ShouldBeNil)
+
+				// The rest of the previous chain can't be put back after the start event.
+				_, _, err = Verify(strings.NewReader(strings.Join(lines[:2], "")+lines[2]+strings.Join(strings.SplitAfter(string(data), "\n")[2:], "")), key, 0, "")
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("It should only record events passing the filters", func() {
+			authOpts["audit_results"] = "rejected, error"
+			authOpts["audit_checks"] = "acl"
+
+			l, err := New(authOpts)
+			So(err, ShouldBeNil)
+
+			l.Record(&Event{Check: "acl", Username: "test1", Result: "granted"})
+			l.Record(&Event{Check: "acl", Username: "test2", Result: "rejected"})
+			l.Record(&Event{Check: "user", Username: "test3", Result: "rejected"})
+			l.Close()
+
+			// The start event isn't filtered.
+			events := readEvents(path)
+			So(len(events), ShouldEqual, 2)
+			So(events[0].Check, ShouldEqual, CheckStart)
+			So(events[1].Username, ShouldEqual, "test2")
+		})
+
+		Convey("A sample rate of 0 should record nothing", func() {
+			authOpts["audit_sample_rate"] = "0"
+
+			l, err := New(authOpts)
+			So(err, ShouldBeNil)
+
+			l.Record(&Event{Check: "acl", Username: "test1", Result: "granted"})
+			l.Close()
+
+			events := readEvents(path)
+			So(len(events), ShouldEqual, 1)
+			So(events[0].Check, ShouldEqual, CheckStart)
+		})
+
+		Convey("It should rotate the file when it gets too big", func() {
+			l, err := New(authOpts)
+			So(err, ShouldBeNil)
+
+			sink := l.sinks[0].(*fileSink)
+			sink.maxSize = 600
+			sink.maxBackups = 2
+
+			for i := 0; i < 20; i++ {
+				l.Record(&Event{Check: "user", Username: "test1", Result: "granted"})
+			}
+			l.Close()
+
+			_, err = os.Stat(backupName(path, 1))
+			So(err, ShouldBeNil)
+			_, err = os.Stat(backupName(path, 2))
+			So(err, ShouldBeNil)
+			_, err = os.Stat(backupName(path, 3))
+			So(os.IsNotExist(err), ShouldBeTrue)
+
+			info, err := os.Stat(path)
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldBeLessThanOrEqualTo, 600)
+
+			// Rotated files verify in order, each following the previous one.
+			var seq uint64
+			var hash string
+			for _, name := range []string{backupName(path, 2), backupName(path, 1), path} {
+				file, err := os.Open(name)
+				So(err, ShouldBeNil)
+				first := readEvents(name)[0]
+				if name == backupName(path, 2) {
+					seq, hash = first.Seq-1, first.PrevHash
+				}
+				seq, hash, err = Verify(file, key, seq, hash)
+				file.Close()
+				So(err, ShouldBeNil)
+			}
+			So(seq, ShouldEqual, 21)
+		})
+
+		Convey("Wrong options should be reported", func() {
+			_, err := New(map[string]string{"audit_sinks": "file", "audit_key": "audit-key"})
+			So(err, ShouldNotBeNil)
+
+			_, err = New(map[string]string{"audit_sinks": "unknown", "audit_key": "audit-key"})
+			So(err, ShouldNotBeNil)
+
+			delete(authOpts, "audit_key")
+			_, err = New(authOpts)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "audit_key")
+
+			authOpts["audit_key"] = string(key)
+			authOpts["audit_sample_rate"] = "2"
+			_, err = New(authOpts)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Without sinks there should be no logger, and a nil one should be usable", t, func() {
+		l, err := New(map[string]string{})
+		So(err, ShouldBeNil)
+		So(l, ShouldBeNil)
+
+		l.Record(&Event{Check: "user"})
+		l.Close()
+	})
+}
+
+func TestWebhookAudit(t *testing.T) {
+	Convey("Given an audit logger posting to a webhook", t, func() {
+		var mu sync.Mutex
+		var received []Event
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var e Event
+			if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&e) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			mu.Lock()
+			received = append(received, e)
+			mu.Unlock()
+		}))
+		defer server.Close()
+
+		l, err := New(map[string]string{
+			"audit_sinks":       "webhook",
+			"audit_webhook_url": server.URL,
+			"audit_key":         "audit-key",
+		})
+		So(err, ShouldBeNil)
+
+		l.Record(&Event{Check: "acl", Username: "test1", ClientID: "client1", Topic: "test/topic", Acc: 2, Result: "granted"})
+		l.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		So(len(received), ShouldEqual, 2)
+		So(received[0].Check, ShouldEqual, CheckStart)
+		So(received[1].Topic, ShouldEqual, "test/topic")
+		So(received[1].Acc, ShouldEqual, 2)
+		So(received[1].Hash, ShouldNotBeEmpty)
+	})
+}
+
+func TestClickhouseBatches(t *testing.T) {
+	Convey("Given a clickhouse sink", t, func() {
+		var mu sync.Mutex
+		var batches [][]Event
+		var insertErr error
+
+		s := &clickhouseSink{}
+		s.start(3, 50*time.Millisecond, func(events []Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			batches = append(batches, events)
+			return insertErr
+		})
+
+		inserted := func() [][]Event {
+			mu.Lock()
+			defer mu.Unlock()
+
+			return batches
+		}
+
+		Convey("Events should be inserted once a batch is full, every interval and on close", func() {
+			for i := 1; i <= 4; i++ {
+				So(s.Write(&Event{Seq: uint64(i), Check: "acl"}, nil), ShouldBeNil)
+			}
+			So(inserted(), ShouldHaveLength, 1)
+			So(inserted()[0], ShouldHaveLength, 3)
+
+			time.Sleep(150 * time.Millisecond)
+			So(inserted(), ShouldHaveLength, 2)
+			So(inserted()[1][0].Seq, ShouldEqual, 4)
+
+			So(s.Write(&Event{Seq: 5, Check: "acl"}, nil), ShouldBeNil)
+			So(s.Close(), ShouldBeNil)
+			So(inserted(), ShouldHaveLength, 3)
+			So(inserted()[2][0].Seq, ShouldEqual, 5)
+		})
+
+		Convey("Events failing to be inserted should be dropped", func() {
+			insertErr = errors.New("clickhouse is down")
+
+			s.Write(&Event{Seq: 1}, nil)
+			s.Write(&Event{Seq: 2}, nil)
+			So(s.Write(&Event{Seq: 3}, nil), ShouldNotBeNil)
+			So(s.pending, ShouldBeEmpty)
+
+			So(s.Close(), ShouldBeNil)
+			So(inserted(), ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultClickhouseTable         = "mosquitto_auth_audit"
+	defaultClickhouseBatchSize     = 1000
+	defaultClickhouseFlushInterval = 5
+)
+
+// clickhouseSink inserts events into a ClickHouse table, through the same driver the clickhouse backend uses.
+// ClickHouse copes badly with many small inserts, so events are inserted in batches: once batchSize of them
+// are pending, every flush interval and on Close.
+type clickhouseSink struct {
+	db        *sqlx.DB
+	query     string
+	batchSize int
+	// insert writes a batch of events, it's insertEvents unless testing.
+	insert func(events []Event) error
+
+	mu      sync.Mutex
+	pending []Event
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newClickhouseSink(authOpts map[string]string) (*clickhouseSink, error) {
+	dsn, ok := authOpts["audit_clickhouse_dsn"]
+	if !ok {
+		dsn, ok = authOpts["clickhouse_dsn"]
+	}
+	if !ok || dsn == "" {
+		return nil, errors.New("audit error: missing options: audit_clickhouse_dsn")
+	}
+
+	table := defaultClickhouseTable
+	if clickhouseTable, ok := authOpts["audit_clickhouse_table"]; ok {
+		table = clickhouseTable
+	}
+
+	batchSize := defaultClickhouseBatchSize
+	if size, ok := authOpts["audit_clickhouse_batch_size"]; ok {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < 1 {
+			log.Warningf("couldn't parse audit_clickhouse_batch_size %s, defaulting to %d", size, defaultClickhouseBatchSize)
+		} else {
+			batchSize = parsed
+		}
+	}
+
+	flushInterval := defaultClickhouseFlushInterval
+	if interval, ok := authOpts["audit_clickhouse_flush_seconds"]; ok {
+		parsed, err := strconv.Atoi(interval)
+		if err != nil || parsed < 1 {
+			log.Warningf("couldn't parse audit_clickhouse_flush_seconds %s, defaulting to %d", interval, defaultClickhouseFlushInterval)
+		} else {
+			flushInterval = parsed
+		}
+	}
+
+	db, err := bes.OpenDatabase(dsn, "clickhouse", 1)
+	if err != nil {
+		return nil, errors.Wrap(err, "audit error: couldn't open clickhouse db")
+	}
+
+	s := &clickhouseSink{
+		db: db,
+		query: fmt.Sprintf("INSERT INTO %s (seq, time, check_type, username, clientid, topic, acc, result, backend, superuser, denied, reason, cached, latency_ms, error, prev_hash, hash) "+
+			"VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", table),
+	}
+	s.start(batchSize, time.Duration(flushInterval)*time.Second, s.insertEvents)
+
+	return s, nil
+}
+
+// start sets batching up and flushes pending events every interval until Close is called.
+func (s *clickhouseSink) start(batchSize int, interval time.Duration, insert func(events []Event) error) {
+	s.batchSize = batchSize
+	s.insert = insert
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.mu.Lock()
+				err := s.flush()
+				s.mu.Unlock()
+
+				if err != nil {
+					log.Errorf("audit error: %s", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *clickhouseSink) Write(e *Event, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, *e)
+	if len(s.pending) < s.batchSize {
+		return nil
+	}
+
+	return s.flush()
+}
+
+// flush inserts the pending events. They're dropped when that fails, and counted in the metrics,
+// so they don't pile up while ClickHouse is down. Callers must hold mu.
+func (s *clickhouseSink) flush() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	events := s.pending
+	s.pending = nil
+
+	if err := s.insert(events); err != nil {
+		for range events {
+			metrics.ObserveAuditDropped()
+		}
+		return errors.Wrapf(err, "clickhouse error, dropped %d events", len(events))
+	}
+
+	return nil
+}
+
+func (s *clickhouseSink) insertEvents(events []Event) error {
+	// The clickhouse driver only inserts within a transaction, through a prepared statement,
+	// and sends the rows of a transaction as a single block.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(s.query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range events {
+		e := &events[i]
+		_, err = stmt.Exec(e.Seq, e.Time, e.Check, e.Username, e.ClientID, e.Topic, int32(e.Acc), e.Result, e.Backend,
+			boolToUint8(e.Superuser), boolToUint8(e.Denied), e.Reason, boolToUint8(e.Cached), e.LatencyMs, e.Error, e.PrevHash, e.Hash)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Close flushes the pending events and closes the db.
+func (s *clickhouseSink) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	err := s.flush()
+	s.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("audit error: %s", err)
+	}
+
+	if s.db == nil {
+		return nil
+	}
+
+	return s.db.Close()
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
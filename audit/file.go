@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFileMaxSizeMB  = 100
+	defaultFileMaxBackups = 5
+
+	// maxEventSize bounds how much of the file's end is read to find its last event.
+	maxEventSize = 64 * 1024
+)
+
+// fileSink writes one event per line, rotating the file once it reaches maxSize:
+// path is renamed to path.1, path.1 to path.2 and so on, keeping up to maxBackups old files.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+func newFileSink(authOpts map[string]string) (*fileSink, error) {
+	path, ok := authOpts["audit_file"]
+	if !ok || path == "" {
+		return nil, errors.New("audit error: missing options: audit_file")
+	}
+
+	s := &fileSink{
+		path:       path,
+		maxSize:    defaultFileMaxSizeMB * 1024 * 1024,
+		maxBackups: defaultFileMaxBackups,
+	}
+
+	if maxSize, ok := authOpts["audit_file_max_size_mb"]; ok {
+		size, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || size < 1 {
+			log.Warningf("couldn't parse audit_file_max_size_mb %s, defaulting to %d", maxSize, defaultFileMaxSizeMB)
+		} else {
+			s.maxSize = size * 1024 * 1024
+		}
+	}
+
+	if maxBackups, ok := authOpts["audit_file_max_backups"]; ok {
+		backups, err := strconv.Atoi(maxBackups)
+		if err != nil || backups < 0 {
+			log.Warningf("couldn't parse audit_file_max_backups %s, defaulting to %d", maxBackups, defaultFileMaxBackups)
+		} else {
+			s.maxBackups = backups
+		}
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "audit error: couldn't open audit file")
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "audit error: couldn't stat audit file")
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+func (s *fileSink) Write(e *Event, line []byte) error {
+	if s.size > 0 && s.size+int64(len(line))+1 > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		log.Errorf("audit error: couldn't close audit file: %s", err)
+	}
+
+	if s.maxBackups == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "audit error: couldn't rotate audit file")
+		}
+		return s.open()
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backupName(s.path, i), backupName(s.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "audit error: couldn't rotate audit file")
+		}
+	}
+
+	if err := os.Rename(s.path, backupName(s.path, 1)); err != nil {
+		return errors.Wrap(err, "audit error: couldn't rotate audit file")
+	}
+
+	return s.open()
+}
+
+// lastEvent returns the last event written to the file, or to the last rotated one if the file is empty,
+// or nil if there are none.
+func (s *fileSink) lastEvent() (*Event, error) {
+	for _, name := range []string{s.path, backupName(s.path, 1)} {
+		e, err := readLastEvent(name)
+		if err != nil || e != nil {
+			return e, err
+		}
+	}
+
+	return nil, nil
+}
+
+func readLastEvent(name string) (*Event, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "audit error: couldn't read audit file")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "audit error: couldn't stat audit file")
+	}
+
+	offset := info.Size() - maxEventSize
+	if offset < 0 {
+		offset = 0
+	}
+
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "audit error: couldn't read audit file")
+	}
+
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var e Event
+	if err := json.Unmarshal(data[bytes.LastIndexByte(data, '\n')+1:], &e); err != nil {
+		return nil, errors.Wrapf(err, "audit error: couldn't read the last event of %s", name)
+	}
+
+	return &e, nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
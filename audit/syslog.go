@@ -0,0 +1,36 @@
+package audit
+
+import (
+	"log/syslog"
+
+	"github.com/pkg/errors"
+)
+
+const defaultSyslogTag = "mosquitto-go-auth"
+
+// syslogSink sends events to syslog with the auth facility, to the local daemon unless an address is given.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(authOpts map[string]string) (*syslogSink, error) {
+	tag := defaultSyslogTag
+	if syslogTag, ok := authOpts["audit_syslog_tag"]; ok {
+		tag = syslogTag
+	}
+
+	writer, err := syslog.Dial(authOpts["audit_syslog_network"], authOpts["audit_syslog_address"], syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "audit error: couldn't connect to syslog")
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(e *Event, line []byte) error {
+	return s.writer.Info(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultWebhookTimeout = 5
+
+// webhookSink POSTs every event as JSON to a URL, expecting a 2xx response.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(authOpts map[string]string) (*webhookSink, error) {
+	url, ok := authOpts["audit_webhook_url"]
+	if !ok || url == "" {
+		return nil, errors.New("audit error: missing options: audit_webhook_url")
+	}
+
+	timeout := defaultWebhookTimeout
+	if webhookTimeout, ok := authOpts["audit_webhook_timeout"]; ok {
+		parsed, err := strconv.Atoi(webhookTimeout)
+		if err != nil || parsed < 1 {
+			log.Warningf("couldn't parse audit_webhook_timeout %s, defaulting to %d", webhookTimeout, defaultWebhookTimeout)
+		} else {
+			timeout = parsed
+		}
+	}
+
+	return &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}, nil
+}
+
+func (s *webhookSink) Write(e *Event, line []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(line))
+	if err != nil {
+		return errors.Wrap(err, "webhook error")
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection may be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook error: wrong http status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -7,17 +7,29 @@
 #include <mosquitto_plugin.h>
 #include <mosquitto.h>
 
+#ifdef WITH_TLS
+#include <openssl/x509.h>
+#endif
 
 #if MOSQ_AUTH_PLUGIN_VERSION >= 3
 # define mosquitto_auth_opt mosquitto_opt
 #endif
 
+// Mosquitto 2.x headers define the generic plugin interface version, older ones only the auth plugin one.
+#if defined(MOSQ_PLUGIN_VERSION) && MOSQ_PLUGIN_VERSION >= 5
+# define GO_AUTH_PLUGIN_V5
+#elif defined(MOSQ_AUTH_PLUGIN_VERSION) && MOSQ_AUTH_PLUGIN_VERSION >= 5
+# define GO_AUTH_PLUGIN_V5
+#endif
+
 #include "go-auth.h"
 
 // Same constant as one in go-auth.go.
 #define AuthRejected 0
 #define AuthGranted 1
 #define AuthError 2
+#define AuthContinue 3
+#define AuthDefer 4
 
 int mosquitto_auth_plugin_version(void) {
   #ifdef MOSQ_AUTH_PLUGIN_VERSION
@@ -31,7 +43,9 @@ int mosquitto_auth_plugin_version(void) {
   #endif
 }
 
-int mosquitto_auth_plugin_init(void **user_data, struct mosquitto_auth_opt *auth_opts, int auth_opt_count) {
+typedef void (*go_opts_func)(GoSlice, GoSlice, GoInt);
+
+static void pass_opts_to_go(go_opts_func go_func, struct mosquitto_auth_opt *auth_opts, int auth_opt_count) {
   /*
     Pass auth_opts hash as keys and values char* arrays to Go in order to initialize them there.
   */
@@ -52,7 +66,11 @@ int mosquitto_auth_plugin_init(void **user_data, struct mosquitto_auth_opt *auth
   GoSlice keysSlice = {keys, auth_opt_count, auth_opt_count};
   GoSlice valuesSlice = {values, auth_opt_count, auth_opt_count};
 
-  AuthPluginInit(keysSlice, valuesSlice, opts_count);
+  go_func(keysSlice, valuesSlice, opts_count);
+}
+
+int mosquitto_auth_plugin_init(void **user_data, struct mosquitto_auth_opt *auth_opts, int auth_opt_count) {
+  pass_opts_to_go(AuthPluginInit, auth_opts, auth_opt_count);
   return MOSQ_ERR_SUCCESS;
 }
 
@@ -62,6 +80,10 @@ int mosquitto_auth_plugin_cleanup(void *user_data, struct mosquitto_auth_opt *au
 }
 
 int mosquitto_auth_security_init(void *user_data, struct mosquitto_auth_opt *auth_opts, int auth_opt_count, bool reload) {
+  // On reload mosquitto passes the options read from the new configuration.
+  if (reload) {
+    pass_opts_to_go(AuthPluginReload, auth_opts, auth_opt_count);
+  }
   return MOSQ_ERR_SUCCESS;
 }
 
@@ -69,6 +91,65 @@ int mosquitto_auth_security_cleanup(void *user_data, struct mosquitto_auth_opt *
   return MOSQ_ERR_SUCCESS;
 }
 
+#if defined(GO_AUTH_PLUGIN_V5) || MOSQ_AUTH_PLUGIN_VERSION >= 4
+
+static const char *or_empty(const char *s) {
+  return s == NULL ? "" : s;
+}
+
+/*
+  Fill the client context passed to Go. The certificate, when present and checks use it (see
+  AuthCertificateNeeded), is handed over DER encoded and must be released with free_client_cert
+  once the check is done. Brokers older than 2.x don't tell the listener's port, which is then 0.
+*/
+static void client_context(struct mosquitto *client, GoString *address, GoInt *protocol_version, GoInt *listener_port, GoSlice *cert) {
+  const char *client_address = mosquitto_client_address(client);
+  if (client_address == NULL) {
+    client_address = "";
+  }
+
+  address->p = client_address;
+  address->n = strlen(client_address);
+  *protocol_version = mosquitto_client_protocol_version(client);
+#ifdef GO_AUTH_PLUGIN_V5
+  *listener_port = mosquitto_client_port(client);
+#else
+  *listener_port = 0;
+#endif
+
+  cert->data = NULL;
+  cert->len = 0;
+  cert->cap = 0;
+
+#ifdef WITH_TLS
+  if (!AuthCertificateNeeded()) {
+    return;
+  }
+
+  X509 *x509 = (X509 *)mosquitto_client_certificate(client);
+  if (x509 != NULL) {
+    unsigned char *der = NULL;
+    int der_len = i2d_X509(x509, &der);
+    if (der_len > 0) {
+      cert->data = der;
+      cert->len = der_len;
+      cert->cap = der_len;
+    }
+    X509_free(x509);
+  }
+#endif
+}
+
+static void free_client_cert(GoSlice *cert) {
+#ifdef WITH_TLS
+  if (cert->data != NULL) {
+    OPENSSL_free(cert->data);
+  }
+#endif
+}
+
+#endif
+
 #if MOSQ_AUTH_PLUGIN_VERSION >= 4
 int mosquitto_auth_unpwd_check(void *user_data, struct mosquitto *client, const char *username, const char *password)
 #elif MOSQ_AUTH_PLUGIN_VERSION >=3
@@ -82,6 +163,22 @@ int mosquitto_auth_unpwd_check(void *userdata, const char *username, const char
   #else
     const char* clientid = "";
   #endif
+
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 4
+    GoString go_address;
+    GoInt go_protocol_version;
+    GoInt go_listener_port;
+    GoSlice go_cert;
+
+    client_context(client, &go_address, &go_protocol_version, &go_listener_port, &go_cert);
+
+    // Clients with a certificate may log in without a username or password.
+    if (go_cert.data != NULL) {
+      username = or_empty(username);
+      password = or_empty(password);
+    }
+  #endif
+
   if (username == NULL || password == NULL) {
     printf("error: received null username or password for unpwd check\n");
     fflush(stdout);
@@ -92,7 +189,12 @@ int mosquitto_auth_unpwd_check(void *userdata, const char *username, const char
   GoString go_password = {password, strlen(password)};
   GoString go_clientid = {clientid, strlen(clientid)};
 
-  GoUint8 ret = AuthUnpwdCheck(go_username, go_password, go_clientid);
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 4
+    GoUint8 ret = AuthUnpwdCheckV5(go_username, go_password, go_clientid, go_address, go_protocol_version, go_listener_port, go_cert);
+    free_client_cert(&go_cert);
+  #else
+    GoUint8 ret = AuthUnpwdCheck(go_username, go_password, go_clientid);
+  #endif
 
   switch (ret)
   {
@@ -123,10 +225,36 @@ int mosquitto_auth_acl_check(void *userdata, const char *clientid, const char *u
     const char* clientid = mosquitto_client_id(client);
     const char* username = mosquitto_client_username(client);
     const char* topic = msg->topic;
+    GoInt64 go_payload_len = msg->payloadlen;
+    GoInt32 go_qos = msg->qos;
+    GoUint8 go_retain = msg->retain;
+  #else
+    // No message details before version 3, a negative payload length tells Go so.
+    GoInt64 go_payload_len = -1;
+    GoInt32 go_qos = 0;
+    GoUint8 go_retain = 0;
+  #endif
+
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 4
+    GoString go_address;
+    GoInt go_protocol_version;
+    GoInt go_listener_port;
+    GoSlice go_cert;
+
+    client_context(client, &go_address, &go_protocol_version, &go_listener_port, &go_cert);
+
+    // Clients that logged in with a certificate and no username are known by the one it maps to in Go.
+    if (go_cert.data != NULL) {
+      username = or_empty(username);
+    }
   #endif
+
   if (clientid == NULL || username == NULL || topic == NULL || access < 1) {
     printf("error: received null username, clientid or topic, or access is equal or less than 0 for acl check\n");
     fflush(stdout);
+    #if MOSQ_AUTH_PLUGIN_VERSION >= 4
+      free_client_cert(&go_cert);
+    #endif
     return MOSQ_ERR_ACL_DENIED;
   }
 
@@ -135,7 +263,12 @@ int mosquitto_auth_acl_check(void *userdata, const char *clientid, const char *u
   GoString go_topic = {topic, strlen(topic)};
   GoInt32 go_access = access;
 
-  GoUint8 ret = AuthAclCheck(go_clientid, go_username, go_topic, go_access);
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 4
+    GoUint8 ret = AuthAclCheckV5(go_clientid, go_username, go_topic, go_access, go_payload_len, go_qos, go_retain, go_address, go_protocol_version, go_listener_port, go_cert);
+    free_client_cert(&go_cert);
+  #else
+    GoUint8 ret = AuthAclCheck(go_clientid, go_username, go_topic, go_access, go_payload_len, go_qos, go_retain);
+  #endif
 
   switch (ret)
   {
@@ -154,6 +287,41 @@ int mosquitto_auth_acl_check(void *userdata, const char *clientid, const char *u
   }
 }
 
+/*
+  Ask Go for the hex encoded key of a TLS-PSK identity. Go writes the NUL terminated key
+  straight into mosquitto's buffer, which is passed as a slice of max_key_len bytes.
+*/
+static int psk_key_get(const char *hint, const char *identity, char *key, int max_key_len) {
+  if (identity == NULL || key == NULL || max_key_len < 1) {
+    printf("error: received null identity or key buffer for psk key get\n");
+    fflush(stdout);
+    return MOSQ_ERR_AUTH;
+  }
+
+  if (hint == NULL) {
+    hint = "";
+  }
+
+  GoString go_hint = {hint, strlen(hint)};
+  GoString go_identity = {identity, strlen(identity)};
+  GoSlice go_key = {key, max_key_len, max_key_len};
+
+  GoUint8 ret = AuthPskKeyGet(go_hint, go_identity, go_key);
+
+  switch (ret)
+  {
+  case AuthGranted:
+    return MOSQ_ERR_SUCCESS;
+  case AuthRejected:
+    return MOSQ_ERR_AUTH;
+  case AuthError:
+    return MOSQ_ERR_UNKNOWN;
+  default:
+    fprintf(stderr, "unknown plugin error: %d\n", ret);
+    return MOSQ_ERR_UNKNOWN;
+  }
+}
+
 #if MOSQ_AUTH_PLUGIN_VERSION >= 4
 int mosquitto_auth_psk_key_get(void *user_data, struct mosquitto *client, const char *hint, const char *identity, char *key, int max_key_len)
 #elif MOSQ_AUTH_PLUGIN_VERSION >= 3
@@ -162,5 +330,303 @@ int mosquitto_auth_psk_key_get(void *userdata, const struct mosquitto *client, c
 int mosquitto_auth_psk_key_get(void *userdata, const char *hint, const char *identity, char *key, int max_key_len)
 #endif
 {
-  return MOSQ_ERR_AUTH;
+  return psk_key_get(hint, identity, key, max_key_len);
+}
+
+#ifdef GO_AUTH_PLUGIN_V5
+
+/*
+  Mosquitto 2.x looks for mosquitto_plugin_version before falling back to mosquitto_auth_plugin_version,
+  so a plugin built against 2.x headers exposes both interfaces and the broker picks the v5 one.
+*/
+
+static mosquitto_plugin_id_t *plugin_id = NULL;
+
+static int basic_auth_callback(int event, void *event_data, void *userdata) {
+  struct mosquitto_evt_basic_auth *ed = event_data;
+  const char *username = ed->username;
+  const char *password = ed->password;
+
+  GoString go_address;
+  GoInt go_protocol_version;
+  GoInt go_listener_port;
+  GoSlice go_cert;
+
+  client_context(ed->client, &go_address, &go_protocol_version, &go_listener_port, &go_cert);
+
+  // Clients with a certificate may log in without a username or password.
+  if (go_cert.data != NULL) {
+    username = or_empty(username);
+    password = or_empty(password);
+  }
+
+  if (username == NULL || password == NULL) {
+    printf("error: received null username or password for basic auth\n");
+    fflush(stdout);
+    return MOSQ_ERR_AUTH;
+  }
+
+  const char *clientid = mosquitto_client_id(ed->client);
+  if (clientid == NULL) {
+    clientid = "";
+  }
+
+  GoString go_username = {username, strlen(username)};
+  GoString go_password = {password, strlen(password)};
+  GoString go_clientid = {clientid, strlen(clientid)};
+
+  GoUint8 ret = AuthUnpwdCheckV5(go_username, go_password, go_clientid, go_address, go_protocol_version, go_listener_port, go_cert);
+
+  free_client_cert(&go_cert);
+
+  switch (ret)
+  {
+  case AuthGranted:
+    return MOSQ_ERR_SUCCESS;
+  case AuthRejected:
+    return MOSQ_ERR_AUTH;
+  case AuthError:
+    return MOSQ_ERR_UNKNOWN;
+  default:
+    fprintf(stderr, "unknown plugin error: %d\n", ret);
+    return MOSQ_ERR_UNKNOWN;
+  }
+}
+
+static int acl_check_callback(int event, void *event_data, void *userdata) {
+  struct mosquitto_evt_acl_check *ed = event_data;
+
+#ifdef MOSQ_ACL_UNSUBSCRIBE
+  // Unsubscribing was never checked by the legacy interface, keep it that way.
+  if (ed->access == MOSQ_ACL_UNSUBSCRIBE) {
+    return MOSQ_ERR_SUCCESS;
+  }
+#endif
+
+  const char *clientid = mosquitto_client_id(ed->client);
+  const char *username = mosquitto_client_username(ed->client);
+  const char *topic = ed->topic;
+
+  GoString go_address;
+  GoInt go_protocol_version;
+  GoInt go_listener_port;
+  GoSlice go_cert;
+
+  client_context(ed->client, &go_address, &go_protocol_version, &go_listener_port, &go_cert);
+
+  // Clients that logged in with a certificate and no username are known by the one it maps to in Go.
+  if (go_cert.data != NULL) {
+    username = or_empty(username);
+  }
+
+  if (clientid == NULL || username == NULL || topic == NULL || ed->access < 1) {
+    printf("error: received null username, clientid or topic, or access is equal or less than 0 for acl check\n");
+    fflush(stdout);
+    free_client_cert(&go_cert);
+    return MOSQ_ERR_ACL_DENIED;
+  }
+
+  GoString go_clientid = {clientid, strlen(clientid)};
+  GoString go_username = {username, strlen(username)};
+  GoString go_topic = {topic, strlen(topic)};
+  GoInt32 go_access = ed->access;
+  GoInt64 go_payload_len = ed->payloadlen;
+  GoInt32 go_qos = ed->qos;
+  GoUint8 go_retain = ed->retain;
+
+  GoUint8 ret = AuthAclCheckV5(go_clientid, go_username, go_topic, go_access, go_payload_len, go_qos, go_retain, go_address, go_protocol_version, go_listener_port, go_cert);
+
+  free_client_cert(&go_cert);
+
+  switch (ret)
+  {
+  case AuthGranted:
+    return MOSQ_ERR_SUCCESS;
+  case AuthRejected:
+    return MOSQ_ERR_ACL_DENIED;
+  case AuthError:
+    return MOSQ_ERR_UNKNOWN;
+  default:
+    fprintf(stderr, "unknown plugin error: %d\n", ret);
+    return MOSQ_ERR_UNKNOWN;
+  }
+}
+
+static int disconnect_callback(int event, void *event_data, void *userdata) {
+  struct mosquitto_evt_disconnect *ed = event_data;
+
+  const char *clientid = mosquitto_client_id(ed->client);
+  const char *username = mosquitto_client_username(ed->client);
+  if (clientid == NULL) {
+    clientid = "";
+  }
+  if (username == NULL) {
+    username = "";
+  }
+
+  GoString go_clientid = {clientid, strlen(clientid)};
+  GoString go_username = {username, strlen(username)};
+  GoInt32 go_reason = ed->reason;
+
+  AuthClientDisconnect(go_clientid, go_username, go_reason);
+
+  return MOSQ_ERR_SUCCESS;
+}
+
+static int psk_key_callback(int event, void *event_data, void *userdata) {
+  struct mosquitto_evt_psk_key *ed = event_data;
+
+  return psk_key_get(ed->hint, ed->identity, ed->key, ed->max_key_len);
 }
+
+/*
+  Handles both MOSQ_EVT_EXT_AUTH_START and MOSQ_EVT_EXT_AUTH_CONTINUE. Go returns the outgoing
+  authentication data and, once the exchange succeeds, the authenticated username, both allocated
+  with malloc. They're copied into broker owned memory and released here.
+*/
+static int ext_auth_callback(int event, void *event_data, void *userdata) {
+  struct mosquitto_evt_extended_auth *ed = event_data;
+
+  if (ed->auth_method == NULL) {
+    return MOSQ_ERR_PLUGIN_DEFER;
+  }
+
+  const char *clientid = mosquitto_client_id(ed->client);
+  if (clientid == NULL) {
+    clientid = "";
+  }
+
+  // The address is given so failures may be throttled by IP, and the network rules applied.
+  const char *address = or_empty(mosquitto_client_address(ed->client));
+
+  GoString go_clientid = {clientid, strlen(clientid)};
+  GoString go_method = {ed->auth_method, strlen(ed->auth_method)};
+  GoString go_address = {address, strlen(address)};
+  GoSlice go_data_in = {(void *)ed->data_in, ed->data_in_len, ed->data_in_len};
+
+  struct AuthExtAuth_return ret = AuthExtAuth(event == MOSQ_EVT_EXT_AUTH_START, go_clientid, go_method, go_address, go_data_in);
+  // cgo names the results r0 to r3, in the order AuthExtAuth returns them.
+  GoUint8 status = ret.r0;
+  void *data_out = ret.r1;
+  GoInt data_out_len = ret.r2;
+  char *username = ret.r3;
+
+  int rc;
+  switch (status)
+  {
+  case AuthGranted:
+    rc = MOSQ_ERR_SUCCESS;
+    break;
+  case AuthContinue:
+    rc = MOSQ_ERR_AUTH_CONTINUE;
+    break;
+  case AuthRejected:
+    rc = MOSQ_ERR_AUTH;
+    break;
+  case AuthError:
+    rc = MOSQ_ERR_UNKNOWN;
+    break;
+  case AuthDefer:
+    rc = MOSQ_ERR_PLUGIN_DEFER;
+    break;
+  default:
+    fprintf(stderr, "unknown plugin error: %d\n", status);
+    rc = MOSQ_ERR_UNKNOWN;
+  }
+
+  if (data_out != NULL) {
+    if ((rc == MOSQ_ERR_SUCCESS || rc == MOSQ_ERR_AUTH_CONTINUE) && data_out_len > 0 && data_out_len <= UINT16_MAX) {
+      ed->data_out = mosquitto_malloc(data_out_len);
+      if (ed->data_out == NULL) {
+        rc = MOSQ_ERR_NOMEM;
+      } else {
+        memcpy(ed->data_out, data_out, data_out_len);
+        ed->data_out_len = data_out_len;
+      }
+    }
+    free(data_out);
+  }
+
+  if (username != NULL) {
+    if (rc == MOSQ_ERR_SUCCESS) {
+      rc = mosquitto_set_username(ed->client, username);
+    }
+    free(username);
+  }
+
+  return rc;
+}
+
+static int reload_callback(int event, void *event_data, void *userdata) {
+  struct mosquitto_evt_reload *ed = event_data;
+
+  pass_opts_to_go(AuthPluginReload, ed->options, ed->option_count);
+
+  return MOSQ_ERR_SUCCESS;
+}
+
+int mosquitto_plugin_version(int supported_version_count, const int *supported_versions) {
+  int i;
+  for (i = 0; i < supported_version_count; i++) {
+    if (supported_versions[i] == 5) {
+      return 5;
+    }
+  }
+
+  return 4;
+}
+
+int mosquitto_plugin_init(mosquitto_plugin_id_t *identifier, void **user_data, struct mosquitto_opt *opts, int opt_count) {
+  plugin_id = identifier;
+
+  pass_opts_to_go(AuthPluginInit, opts, opt_count);
+
+  int rc;
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_BASIC_AUTH, basic_auth_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_ACL_CHECK, acl_check_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_DISCONNECT, disconnect_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_RELOAD, reload_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_PSK_KEY, psk_key_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_EXT_AUTH_START, ext_auth_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+  rc = mosquitto_callback_register(plugin_id, MOSQ_EVT_EXT_AUTH_CONTINUE, ext_auth_callback, NULL, NULL);
+  if (rc != MOSQ_ERR_SUCCESS) {
+    return rc;
+  }
+
+  return MOSQ_ERR_SUCCESS;
+}
+
+int mosquitto_plugin_cleanup(void *user_data, struct mosquitto_opt *opts, int opt_count) {
+  if (plugin_id != NULL) {
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_BASIC_AUTH, basic_auth_callback, NULL);
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_ACL_CHECK, acl_check_callback, NULL);
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_DISCONNECT, disconnect_callback, NULL);
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_RELOAD, reload_callback, NULL);
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_PSK_KEY, psk_key_callback, NULL);
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_EXT_AUTH_START, ext_auth_callback, NULL);
+    mosquitto_callback_unregister(plugin_id, MOSQ_EVT_EXT_AUTH_CONTINUE, ext_auth_callback, NULL);
+  }
+
+  AuthPluginCleanup();
+  return MOSQ_ERR_SUCCESS;
+}
+
+#endif
@@ -1,14 +1,22 @@
 package backends
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/iegomez/mosquitto-go-auth/tracing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Backend is the original backend interface. Backends implementing only this one, such as custom plugins,
+// still work through an adapter, but they can't be cancelled when a check times out.
 type Backend interface {
 	GetUser(username, password, clientid string) (bool, error)
 	GetSuperuser(username string) (bool, error)
@@ -17,17 +25,77 @@ type Backend interface {
 	Halt()
 }
 
+// ContextBackend is the v2 backend interface. Checks get a context that's done when the check times out
+// or is abandoned, and backends should pass it along to any request or query they make.
+type ContextBackend interface {
+	GetUserContext(ctx context.Context, username, password, clientid string) (bool, error)
+	GetSuperuserContext(ctx context.Context, username string) (bool, error)
+	CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error)
+	GetName() string
+	Halt()
+}
+
+// PskKeyGetter is implemented by backends that can look up TLS-PSK keys.
+// GetPskKey returns the hex encoded key for the given identity, or an empty string when the identity is unknown.
+type PskKeyGetter interface {
+	GetPskKey(ctx context.Context, hint, identity string) (string, error)
+}
+
+// AclMessage holds the details mosquitto gives about the message an acl check is made for.
+type AclMessage struct {
+	PayloadLen int64
+	Qos        int32
+	Retain     bool
+}
+
+// MessageAclChecker is implemented by backends that can take the message details into account when checking acls.
+// msg is nil when mosquitto didn't give any.
+type MessageAclChecker interface {
+	CheckAclMessage(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (bool, error)
+}
+
+// PasswordHashGetter is implemented by backends that can hand out the stored password hash for a user,
+// which is needed for challenge/response mechanisms such as SCRAM.
+type PasswordHashGetter interface {
+	GetPasswordHash(ctx context.Context, username string) (string, error)
+}
+
+// Pinger is implemented by backends that can tell whether their database or server is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
 type Backends struct {
-	backends map[string]Backend
+	backends map[string]ContextBackend
+	breakers map[string]*breaker
+	timeouts map[string]time.Duration
+
+	// superuserPolicy tells what superuser checks answer when backends fail.
+	superuserPolicy *ErrorPolicy
 
 	aclCheckers       []string
 	userCheckers      []string
 	superuserCheckers []string
 
-	checkPrefix bool
-	prefixes    map[string]string
+	// strategies combine the answers of the backends registered for each check.
+	strategies map[string]strategy
+	// deniers are the checks each backend may deny explicitly, by backend name.
+	deniers map[string]map[string]bool
+
+	// routes send the checks of the clients they match to a single backend, in order, and defaultRoute
+	// those of clients matching none of them when it's set.
+	routes       []route
+	defaultRoute string
 
 	disableSuperuser bool
+
+	// certRules map client certificates to usernames when cert_auth is enabled, and are nil otherwise.
+	certRules []certRule
+	// certPlaceholders tells acl checks need the client certificate for its placeholders even without cert_auth.
+	certPlaceholders bool
+
+	// networkRules are the global network_allow and network_deny ranges every login is held to.
+	networkRules networks.Rules
 }
 
 const (
@@ -51,32 +119,16 @@ const (
 	superuserCheck = "superuser"
 )
 
-// AllowedBackendsOptsPrefix serves as a check for allowed backends and a map from backend to expected opts prefix.
-var allowedBackendsOptsPrefix = map[string]string{
-	postgresBackend: "pg",
-	jwtBackend:      "jwt",
-	redisBackend:    "redis",
-	httpBackend:     "http",
-	filesBackend:    "files",
-	mysqlBackend:    "mysql",
-	sqliteBackend:   "sqlite",
-	mongoBackend:    "mongo",
-	pluginBackend:   "plugin",
-	grpcBackend:     "grpc",
-	jsBackend:       "js",
-	clickhouseBackend:       "clickhouse",
-}
-
 // Initialize sets general options, tries to build the backends and register their checkers.
 func Initialize(authOpts map[string]string, logLevel log.Level) (*Backends, error) {
 
 	b := &Backends{
-		backends:          make(map[string]Backend),
+		backends:          make(map[string]ContextBackend),
+		breakers:          make(map[string]*breaker),
+		timeouts:          make(map[string]time.Duration),
 		aclCheckers:       make([]string, 0),
 		userCheckers:      make([]string, 0),
 		superuserCheckers: make([]string, 0),
-		checkPrefix:       false,
-		prefixes:          make(map[string]string),
 	}
 
 	//Disable superusers for all backends if option is set.
@@ -96,148 +148,113 @@ func Initialize(authOpts map[string]string, logLevel log.Level) (*Backends, erro
 	}
 
 	for _, backend := range backends {
-		if _, ok := allowedBackendsOptsPrefix[backend]; !ok {
-			return nil, fmt.Errorf("unknown backend %s", backend)
+		if err := checkName(backend); err != nil {
+			return nil, err
 		}
 	}
 
+	if err := b.setCertRules(authOpts); err != nil {
+		return nil, err
+	}
+
+	if err := b.setNetworkRules(authOpts); err != nil {
+		return nil, err
+	}
+
+	// Halt the backends that did start on errors, as on reload the plugin keeps running with its previous configuration.
 	err := b.addBackends(authOpts, logLevel, backends)
 	if err != nil {
+		b.Halt()
+		return nil, err
+	}
+
+	err = b.setCheckers(authOpts, backends)
+	if err != nil {
+		b.Halt()
+		return nil, err
+	}
+
+	err = b.setDeniers(authOpts)
+	if err != nil {
+		b.Halt()
+		return nil, err
+	}
+
+	err = b.setStrategies(authOpts)
+	if err != nil {
+		b.Halt()
 		return nil, err
 	}
 
-	err = b.setCheckers(authOpts)
+	err = b.setRoutes(authOpts, backends)
 	if err != nil {
+		b.Halt()
 		return nil, err
 	}
 
-	b.setPrefixes(authOpts, backends)
+	b.setBreakers(authOpts)
+	b.setTimeouts(authOpts)
+
+	b.superuserPolicy = NewErrorPolicy(authOpts, "superuser")
 
 	return b, nil
 }
 
 func (b *Backends) addBackends(authOpts map[string]string, logLevel log.Level, backends []string) error {
 	for _, bename := range backends {
-		var beIface Backend
-		var err error
+		if _, ok := b.backends[bename]; ok {
+			continue
+		}
 
-		hasher := hashing.NewHasher(authOpts, allowedBackendsOptsPrefix[bename])
-		switch bename {
-		case postgresBackend:
-			beIface, err = NewPostgres(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("backend registered: %s", beIface.GetName())
-				b.backends[postgresBackend] = beIface.(Postgres)
-			}
-		case jwtBackend:
-			beIface, err = NewJWT(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[jwtBackend] = beIface.(*JWT)
-			}
-		case filesBackend:
-			beIface, err = NewFiles(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[filesBackend] = beIface.(*Files)
-			}
-		case redisBackend:
-			beIface, err = NewRedis(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[redisBackend] = beIface.(Redis)
-			}
-		case mysqlBackend:
-			beIface, err = NewMysql(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[mysqlBackend] = beIface.(Mysql)
-			}
-		case httpBackend:
-			beIface, err = NewHTTP(authOpts, logLevel)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[httpBackend] = beIface.(HTTP)
-			}
-		case sqliteBackend:
-			beIface, err = NewSqlite(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[sqliteBackend] = beIface.(Sqlite)
-			}
-		case mongoBackend:
-			beIface, err = NewMongo(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[mongoBackend] = beIface.(Mongo)
-			}
-		case grpcBackend:
-			beIface, err = NewGRPC(authOpts, logLevel)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[grpcBackend] = beIface.(GRPC)
-			}
-		case jsBackend:
-			beIface, err = NewJavascript(authOpts, logLevel)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[jsBackend] = beIface.(*Javascript)
-			}
-		case clickhouseBackend:
-			beIface, err = NewClickhouse(authOpts, logLevel, hasher)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[clickhouseBackend] = beIface.(Clickhouse)
-			}
-		case pluginBackend:
-			beIface, err = NewCustomPlugin(authOpts, logLevel)
-			if err != nil {
-				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, err)
-			} else {
-				log.Infof("Backend registered: %s", beIface.GetName())
-				b.backends[pluginBackend] = beIface.(*CustomPlugin)
-			}
-		default:
-			return fmt.Errorf("unkown backend %s", bename)
+		r, ok := lookupBackend(backendType(bename))
+		if !ok {
+			return fmt.Errorf("unknown backend %s", bename)
 		}
+
+		// Named instances are built from their own options, and so is their hasher.
+		opts := instanceOptions(authOpts, bename)
+
+		var hasher hashing.HashComparer
+		if r.NeedsHasher {
+			hasher = hashing.NewHasher(opts, r.prefix)
+		}
+
+		backend, err := r.factory(opts, logLevel, hasher)
+		if err != nil {
+			return fmt.Errorf("backend register error: couldn't initialize %s backend with error %s", bename, err)
+		}
+
+		log.Infof("backend registered: %s", backend.GetName())
+		b.backends[bename] = backend
 	}
 
 	return nil
 }
 
-func (b *Backends) setCheckers(authOpts map[string]string) error {
+func (b *Backends) setCheckers(authOpts map[string]string, backends []string) error {
 	// We'll register which plugins will perform checks for user, superuser and acls.
 	// At least one backend must be registered for user and acl checks.
 	// When option auth_opt_backend_register is missing for the backend, we register all checks.
-	for name := range b.backends {
-		opt := fmt.Sprintf("%s_register", allowedBackendsOptsPrefix[name])
+	// Backends are registered in the order of the backends option, which is the order they're asked in
+	// unless the check's <check>_order option says otherwise.
+	registered := make(map[string]bool)
+	for _, name := range backends {
+		if registered[name] {
+			continue
+		}
+		registered[name] = true
+
+		r, _ := lookupBackend(backendType(name))
+		opt := fmt.Sprintf("%s_register", OptsPrefix(name))
 		options, ok := authOpts[opt]
 
 		if ok {
 			checkers := strings.Split(strings.Replace(options, " ", "", -1), ",")
 			for _, check := range checkers {
+				if !r.supports(check) {
+					return fmt.Errorf("backend %s doesn't support %s checks", name, check)
+				}
+
 				switch check {
 				case aclCheck:
 					b.aclCheckers = append(b.aclCheckers, name)
@@ -255,12 +272,16 @@ func (b *Backends) setCheckers(authOpts map[string]string) error {
 				}
 			}
 		} else {
-			b.aclCheckers = append(b.aclCheckers, name)
-			log.Infof("registered acl checker: %s", name)
-			b.userCheckers = append(b.userCheckers, name)
-			log.Infof("registered user checker: %s", name)
+			if r.supports(aclCheck) {
+				b.aclCheckers = append(b.aclCheckers, name)
+				log.Infof("registered acl checker: %s", name)
+			}
+			if r.supports(userCheck) {
+				b.userCheckers = append(b.userCheckers, name)
+				log.Infof("registered user checker: %s", name)
+			}
 
-			if !b.disableSuperuser {
+			if !b.disableSuperuser && r.supports(superuserCheck) {
 				b.superuserCheckers = append(b.superuserCheckers, name)
 				log.Infof("registered superuser checker: %s", name)
 			}
@@ -271,65 +292,58 @@ func (b *Backends) setCheckers(authOpts map[string]string) error {
 		return errors.New("no backends registered")
 	}
 
-	return nil
-}
-
-// setPrefixes sets options for prefixes handling.
-func (b *Backends) setPrefixes(authOpts map[string]string, backends []string) {
-	checkPrefix, ok := authOpts["check_prefix"]
-
-	if !ok || strings.Replace(checkPrefix, " ", "", -1) != "true" {
-		b.checkPrefix = false
-
-		return
-	}
-
-	prefixesStr, ok := authOpts["prefixes"]
-
-	if !ok {
-		log.Warn("Error: prefixes enabled but no options given, defaulting to prefixes disabled.")
-		b.checkPrefix = false
-
-		return
+	var err error
+	if b.userCheckers, err = orderCheckers(authOpts, userCheck, b.userCheckers); err != nil {
+		return err
 	}
-
-	prefixes := strings.Split(strings.Replace(prefixesStr, " ", "", -1), ",")
-
-	if len(prefixes) != len(backends) {
-		log.Errorf("Error: got %d backends and %d prefixes, defaulting to prefixes disabled.", len(backends), len(prefixes))
-		b.checkPrefix = false
-
-		return
+	if b.superuserCheckers, err = orderCheckers(authOpts, superuserCheck, b.superuserCheckers); err != nil {
+		return err
 	}
-
-	for i, backend := range backends {
-		b.prefixes[prefixes[i]] = backend
+	if b.aclCheckers, err = orderCheckers(authOpts, aclCheck, b.aclCheckers); err != nil {
+		return err
 	}
 
-	log.Infof("prefixes enabled for backends %s with prefixes %s.", authOpts["backends"], authOpts["prefixes"])
-	b.checkPrefix = true
+	return nil
 }
 
-// checkPrefix checks if a username contains a valid prefix. If so, returns ok and the suitable backend name; else, !ok and empty string.
-func (b *Backends) lookupPrefix(username string) (bool, string) {
-	if strings.Index(username, "_") > 0 {
-		userPrefix := username[0:strings.Index(username, "_")]
-		if prefix, ok := b.prefixes[userPrefix]; ok {
-			log.Debugf("Found prefix for user %s, using backend %s.", username, prefix)
-			return true, prefix
+// orderCheckers sorts the backends registered for check as given by the <check>_order option, e.g. acl_order.
+// Registered backends the option leaves out are asked after the listed ones, in their current order.
+// Listing a backend that isn't registered for the check, or listing one twice, is an error.
+func orderCheckers(authOpts map[string]string, check string, checkers []string) ([]string, error) {
+	opt := fmt.Sprintf("%s_order", check)
+	option, ok := authOpts[opt]
+	if !ok || strings.TrimSpace(option) == "" {
+		return checkers, nil
+	}
+
+	ordered := make([]string, 0, len(checkers))
+	listed := make(map[string]bool)
+	for _, name := range strings.Split(strings.Replace(option, " ", "", -1), ",") {
+		if name == "" {
+			continue
+		}
+
+		if listed[name] {
+			return nil, fmt.Errorf("backend %s given more than once in %s", name, opt)
 		}
+
+		if !checkRegistered(name, checkers) {
+			return nil, fmt.Errorf("backend %s in %s is not registered for %s checks", name, opt, check)
+		}
+
+		listed[name] = true
+		ordered = append(ordered, name)
 	}
-	return false, ""
-}
 
-// getPrefixForBackend retrieves the user provided prefix for a given backend.
-func (b *Backends) getPrefixForBackend(backend string) string {
-	for k, v := range b.prefixes {
-		if v == backend {
-			return k
+	for _, name := range checkers {
+		if !listed[name] {
+			ordered = append(ordered, name)
 		}
 	}
-	return ""
+
+	log.Infof("%s checkers order: %s", check, strings.Join(ordered, ", "))
+
+	return ordered, nil
 }
 
 func checkRegistered(bename string, checkers []string) bool {
@@ -343,100 +357,95 @@ func checkRegistered(bename string, checkers []string) bool {
 }
 
 // AuthUnpwdCheck checks user authentication.
-func (b *Backends) AuthUnpwdCheck(username, password, clientid string) (bool, error) {
+func (b *Backends) AuthUnpwdCheck(ctx context.Context, username, password, clientid string) (bool, error) {
 	var authenticated bool
 	var err error
 
-	// If prefixes are enabled, check if username has a valid prefix and use the correct backend if so.
-	if !b.checkPrefix {
-		return b.checkAuth(username, password, clientid)
+	if !b.checkGlobalNetworks(ctx, username) {
+		return false, nil
 	}
 
-	validPrefix, bename := b.lookupPrefix(username)
+	// Clients with a certificate may log in without a password, their identity being taken from it.
+	if cert := CertificateFrom(ctx); cert != nil && password == "" && b.CertificateAuth() {
+		return b.checkCertificate(ctx, username, cert), nil
+	}
 
-	if !validPrefix {
-		return b.checkAuth(username, password, clientid)
+	// If the client matches a route, check it with the route's backend only, else check every backend.
+	bename, username := b.lookupRoute(ctx, username, clientid)
+	if bename == "" {
+		return b.checkAuth(ctx, username, password, clientid)
 	}
 
 	if !checkRegistered(bename, b.userCheckers) {
 		return false, fmt.Errorf("backend %s not registered to check users", bename)
 	}
 
-	// If the backend is JWT and the token was prefixed, then strip the token. If the token was passed without a prefix it will be handled in the common case.
-	if bename == jwtBackend {
-		prefix := b.getPrefixForBackend(bename)
-		username = strings.TrimPrefix(username, prefix+"_")
-	}
 	var backend = b.backends[bename]
 
-	authenticated, err = backend.GetUser(username, password, clientid)
-	if authenticated && err == nil {
+	result, err := b.getUser(ctx, bename, username, password, clientid)
+	authenticated = result.Verdict == Allow && err == nil
+	if authenticated {
 		log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
 	}
 
+	if err == nil {
+		decideResult(ctx, bename, result)
+	}
+
 	return authenticated, err
 }
 
-func (b *Backends) checkAuth(username, password, clientid string) (bool, error) {
-	var err error
-	authenticated := false
+func (b *Backends) checkAuth(ctx context.Context, username, password, clientid string) (bool, error) {
+	result, bename, err := b.combine(userCheck, b.userCheckers, func(bename string) (Result, error) {
+		log.Debugf("checking user %s with backend %s", username, b.backends[bename].GetName())
+		return b.getUser(ctx, bename, username, password, clientid)
+	})
 
-	for _, bename := range b.userCheckers {
-		var backend = b.backends[bename]
-
-		log.Debugf("checking user %s with backend %s", username, backend.GetName())
-
-		if ok, getUserErr := backend.GetUser(username, password, clientid); ok && getUserErr == nil {
-			authenticated = true
-			log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
-			break
-		} else if getUserErr != nil && err == nil {
-			err = getUserErr
-		}
+	if bename != "" {
+		decideResult(ctx, bename, result)
 	}
 
-	// If authenticated is true, it means at least one backend didn't fail and
-	// accepted the user. If so, honor the backend and clear the error.
+	authenticated := result.Verdict == Allow
 	if authenticated {
-		err = nil
+		log.Debugf("user %s authenticated with strategy %s", username, b.strategies[userCheck])
 	}
 
 	return authenticated, err
 }
 
 // AuthAclCheck checks user/topic/acc authorization.
-func (b *Backends) AuthAclCheck(clientid, username, topic string, acc int) (bool, error) {
+func (b *Backends) AuthAclCheck(ctx context.Context, clientid, username, topic string, acc int) (bool, error) {
+	return b.AuthAclCheckMessage(ctx, clientid, username, topic, acc, nil)
+}
+
+// AuthAclCheckMessage checks user/topic/acc authorization, passing the message details along to backends that support them.
+func (b *Backends) AuthAclCheckMessage(ctx context.Context, clientid, username, topic string, acc int, msg *AclMessage) (bool, error) {
 	var aclCheck bool
 	var err error
 
-	// If prefixes are enabled, check if username has a valid prefix and use the correct backend if so.
+	// If the client matches a route, check it with the route's backend only.
 	// Else, check all backends.
-	if !b.checkPrefix {
-		return b.checkAcl(username, topic, clientid, acc)
+	bename, username := b.lookupRoute(ctx, username, clientid)
+	if bename == "" {
+		return b.checkAcl(ctx, username, topic, clientid, acc, msg)
 	}
 
-	validPrefix, bename := b.lookupPrefix(username)
-
-	if !validPrefix {
-		return b.checkAcl(username, topic, clientid, acc)
-	}
-
-	// If the backend is JWT and the token was prefixed, then strip the token. If the token was passed without a prefix then let it be handled in the common case.
-	if bename == jwtBackend {
-		prefix := b.getPrefixForBackend(bename)
-		username = strings.TrimPrefix(username, prefix+"_")
-	}
 	var backend = b.backends[bename]
 
 	// Short circuit checks when superusers are disabled.
 	if !b.disableSuperuser && checkRegistered(bename, b.superuserCheckers) {
 		log.Debugf("Superuser check with backend %s", backend.GetName())
 
-		aclCheck, err = backend.GetSuperuser(username)
+		var result Result
+		result, err = b.getSuperuser(ctx, bename, username)
+		aclCheck = result.Verdict == Allow
 
 		if aclCheck && err == nil {
+			decide(ctx, bename, true)
 			log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
 		}
+
+		aclCheck, err = b.superuserDecision(ctx, username, aclCheck, err)
 	}
 	// If not superuser, check acl.
 	if !aclCheck {
@@ -445,59 +454,479 @@ func (b *Backends) AuthAclCheck(clientid, username, topic string, acc int) (bool
 		}
 
 		log.Debugf("Acl check with backend %s", backend.GetName())
-		if ok, checkACLErr := backend.CheckAcl(username, topic, clientid, int32(acc)); ok && checkACLErr == nil {
+		result, checkACLErr := b.checkBackendAcl(ctx, bename, username, topic, clientid, acc, msg)
+		if result.Verdict == Allow && checkACLErr == nil {
 			aclCheck = true
 			log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
 		} else if checkACLErr != nil && err == nil {
 			err = checkACLErr
 		}
+
+		if err == nil {
+			decideResult(ctx, bename, result)
+		}
 	}
 
 	log.Debugf("Acl is %t for user %s", aclCheck, username)
 	return aclCheck, err
 }
 
-func (b *Backends) checkAcl(username, topic, clientid string, acc int) (bool, error) {
+func (b *Backends) checkAcl(ctx context.Context, username, topic, clientid string, acc int, msg *AclMessage) (bool, error) {
 	// Check superusers first
 	var err error
-	aclCheck := false
+	granted := false
 	if !b.disableSuperuser {
-		for _, bename := range b.superuserCheckers {
-			var backend = b.backends[bename]
-
-			log.Debugf("Superuser check with backend %s", backend.GetName())
-			if ok, getSuperuserErr := backend.GetSuperuser(username); ok && getSuperuserErr == nil {
-				log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
-				aclCheck = true
-				break
-			} else if getSuperuserErr != nil && err == nil {
-				err = getSuperuserErr
-			}
+		result, bename, superuserErr := b.combine(superuserCheck, b.superuserCheckers, func(bename string) (Result, error) {
+			log.Debugf("Superuser check with backend %s", b.backends[bename].GetName())
+			return b.getSuperuser(ctx, bename, username)
+		})
+
+		// A backend denying the user is a superuser only stops the superuser check, acls are checked still.
+		granted, err = result.Verdict == Allow, superuserErr
+		if granted {
+			log.Debugf("superuser %s acl authenticated with strategy %s", username, b.strategies[superuserCheck])
+			decide(ctx, bename, true)
 		}
+
+		granted, err = b.superuserDecision(ctx, username, granted, err)
 	}
 
-	if !aclCheck {
-		for _, bename := range b.aclCheckers {
-			var backend = b.backends[bename]
-
-			log.Debugf("Acl check with backend %s", backend.GetName())
-			if ok, checkACLErr := backend.CheckAcl(username, topic, clientid, int32(acc)); ok && checkACLErr == nil {
-				log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
-				aclCheck = true
-				break
-			} else if checkACLErr != nil && err == nil {
-				err = checkACLErr
-			}
+	if !granted {
+		result, bename, checkACLErr := b.combine(aclCheck, b.aclCheckers, func(bename string) (Result, error) {
+			log.Debugf("Acl check with backend %s", b.backends[bename].GetName())
+			return b.checkBackendAcl(ctx, bename, username, topic, clientid, acc, msg)
+		})
+
+		if bename != "" {
+			decideResult(ctx, bename, result)
+		}
+
+		granted = result.Verdict == Allow
+
+		if granted {
+			log.Debugf("user %s acl authenticated with strategy %s", username, b.strategies[aclCheck])
+		} else if checkACLErr != nil && err == nil {
+			err = checkACLErr
 		}
 	}
 
-	// If aclCheck is true, it means at least one backend didn't fail and
-	// accepted the access. In this case trust this backend and clear the error.
-	if aclCheck {
+	// If granted is true, it means the backends granted the access. In this case trust them and clear the error.
+	if granted {
 		err = nil
 	}
 
-	return aclCheck, err
+	return granted, err
+}
+
+// superuserDecision applies the superuser error policy when no backend said username is a superuser and some failed.
+// Otherwise the decision is kept for the policy in case backends fail later on, unless the check is a dry run.
+func (b *Backends) superuserDecision(ctx context.Context, username string, superuser bool, err error) (bool, error) {
+	key := PolicyKey("superuser", username)
+
+	if err == nil || superuser {
+		if !DryRunFrom(ctx) {
+			b.superuserPolicy.Remember(key, superuser)
+		}
+		return superuser, nil
+	}
+
+	return b.superuserPolicy.Resolve(key, err)
+}
+
+func checkBackendAcl(ctx context.Context, backend ContextBackend, username, topic, clientid string, acc int, msg *AclMessage) (bool, error) {
+	if checker, ok := backend.(MessageAclChecker); ok {
+		return checker.CheckAclMessage(ctx, username, topic, clientid, int32(acc), msg)
+	}
+
+	return backend.CheckAclContext(ctx, username, topic, clientid, int32(acc))
+}
+
+// backendIntOption returns the backend's own option if given (e.g. pg_check_timeout), else the general one, else the default.
+func backendIntOption(authOpts map[string]string, prefix, name string, def int) int {
+	value, ok := authOpts[fmt.Sprintf("%s_%s", prefix, name)]
+	if !ok {
+		value, ok = authOpts[name]
+	}
+
+	if !ok {
+		return def
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warningf("couldn't parse %s for %s (err: %s), defaulting to %d", name, prefix, err, def)
+		return def
+	}
+
+	return parsed
+}
+
+// setTimeouts sets how long each backend may take to answer a check, given in milliseconds
+// by check_timeout or the backend's own prefixed option. No timeout is set by default.
+func (b *Backends) setTimeouts(authOpts map[string]string) {
+	for name := range b.backends {
+		timeout := backendIntOption(authOpts, OptsPrefix(name), "check_timeout", 0)
+		if timeout > 0 {
+			b.timeouts[name] = time.Duration(timeout) * time.Millisecond
+			log.Infof("check timeout for backend %s set to %s", name, b.timeouts[name])
+		}
+	}
+}
+
+// observeBackendCheck counts a backend check in the metrics, unless it's a dry run.
+func observeBackendCheck(ctx context.Context, bename, check string, latency time.Duration, granted bool, err error) {
+	if !DryRunFrom(ctx) {
+		metrics.ObserveBackendCheck(bename, check, latency, granted, err)
+	}
+}
+
+// callBackend runs call against the named backend with a context bounded by the backend's check timeout,
+// through its circuit breaker if it has one.
+func (b *Backends) callBackend(ctx context.Context, bename string, call func(ctx context.Context) error) error {
+	if timeout, ok := b.timeouts[bename]; ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return b.guard(bename, DryRunFrom(ctx), func() error {
+		return call(ctx)
+	})
+}
+
+func (b *Backends) getUser(ctx context.Context, bename, username, password, clientid string) (Result, error) {
+	var result Result
+	var blocked bool
+	ctx, span := tracing.StartBackend(ctx, bename, "user")
+	start := time.Now()
+	err := b.callBackend(ctx, bename, func(ctx context.Context) error {
+		var err error
+		if b.denies(bename, userCheck) {
+			result, err = b.backends[bename].(VerdictBackend).UserVerdict(ctx, username, password, clientid)
+		} else {
+			result, err = resultOf(b.backends[bename].GetUserContext(ctx, username, password, clientid))
+		}
+		if result.Verdict != Allow || err != nil {
+			return err
+		}
+
+		// Right credentials still need the client's address to be allowed by the backend's network rules.
+		result, err = resultOf(b.checkBackendNetworks(ctx, bename, username))
+		blocked = result.Verdict != Allow && err == nil
+		return err
+	})
+	ok := result.Verdict == Allow
+	observeBackendCheck(ctx, bename, "user", time.Since(start), ok, err)
+	tracing.End(span, ok, err)
+	b.explainStep(ctx, userCheck, bename, username, "", clientid, 0, result, err, time.Since(start))
+	if blocked {
+		explainNetworks(ctx, bename)
+	}
+
+	return result, err
+}
+
+func (b *Backends) getSuperuser(ctx context.Context, bename, username string) (Result, error) {
+	var result Result
+	ctx, span := tracing.StartBackend(ctx, bename, "superuser")
+	start := time.Now()
+	err := b.callBackend(ctx, bename, func(ctx context.Context) error {
+		var err error
+		if b.denies(bename, superuserCheck) {
+			result, err = b.backends[bename].(VerdictBackend).SuperuserVerdict(ctx, username)
+		} else {
+			result, err = resultOf(b.backends[bename].GetSuperuserContext(ctx, username))
+		}
+		return err
+	})
+	ok := result.Verdict == Allow
+	observeBackendCheck(ctx, bename, "superuser", time.Since(start), ok, err)
+	tracing.End(span, ok, err)
+	b.explainStep(ctx, superuserCheck, bename, username, "", "", 0, result, err, time.Since(start))
+
+	return result, err
+}
+
+func (b *Backends) checkBackendAcl(ctx context.Context, bename, username, topic, clientid string, acc int, msg *AclMessage) (Result, error) {
+	var result Result
+	ctx, span := tracing.StartBackend(ctx, bename, "acl")
+	start := time.Now()
+	err := b.callBackend(ctx, bename, func(ctx context.Context) error {
+		var err error
+		if b.denies(bename, aclCheck) {
+			result, err = b.backends[bename].(VerdictBackend).AclVerdict(ctx, username, topic, clientid, int32(acc), msg)
+		} else {
+			result, err = resultOf(checkBackendAcl(ctx, b.backends[bename], username, topic, clientid, acc, msg))
+		}
+		return err
+	})
+	ok := result.Verdict == Allow
+	observeBackendCheck(ctx, bename, "acl", time.Since(start), ok, err)
+	tracing.End(span, ok, err)
+	b.explainStep(ctx, aclCheck, bename, username, topic, clientid, acc, result, err, time.Since(start))
+
+	return result, err
+}
+
+func (b *Backends) getPskKey(ctx context.Context, getter PskKeyGetter, bename, hint, identity string) (string, error) {
+	var key string
+	ctx, span := tracing.StartBackend(ctx, bename, "psk")
+	start := time.Now()
+	err := b.callBackend(ctx, bename, func(ctx context.Context) error {
+		var err error
+		key, err = getter.GetPskKey(ctx, hint, identity)
+		return err
+	})
+	observeBackendCheck(ctx, bename, "psk", time.Since(start), key != "", err)
+	tracing.End(span, key != "", err)
+
+	return key, err
+}
+
+func (b *Backends) getPasswordHash(ctx context.Context, getter PasswordHashGetter, bename, username string) (string, error) {
+	var passwordHash string
+	ctx, span := tracing.StartBackend(ctx, bename, "scram")
+	start := time.Now()
+	err := b.callBackend(ctx, bename, func(ctx context.Context) error {
+		var err error
+		passwordHash, err = getter.GetPasswordHash(ctx, username)
+		return err
+	})
+	observeBackendCheck(ctx, bename, "scram", time.Since(start), passwordHash != "", err)
+	tracing.End(span, passwordHash != "", err)
+
+	return passwordHash, err
+}
+
+// ChecksMessages tells whether any backend registered to check acls takes message details into account.
+func (b *Backends) ChecksMessages() bool {
+	for _, bename := range b.aclCheckers {
+		if _, ok := b.backends[bename].(MessageAclChecker); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checkers returns the backends registered for each check type (user, superuser and acl), in the order they're asked.
+func (b *Backends) Checkers() map[string][]string {
+	return map[string][]string{
+		userCheck:      append([]string{}, b.userCheckers...),
+		superuserCheck: append([]string{}, b.superuserCheckers...),
+		aclCheck:       append([]string{}, b.aclCheckers...),
+	}
+}
+
+// Health pings every backend that supports it, bounded by the backend's check timeout, and returns
+// the error of those that are unhealthy, or nil for healthy ones. Backends with an open circuit breaker
+// are reported as unhealthy without being pinged, and pings don't count towards the breakers.
+func (b *Backends) Health(ctx context.Context) map[string]error {
+	health := make(map[string]error, len(b.backends))
+	for name, backend := range b.backends {
+		if cb, ok := b.breakers[name]; ok && cb.getState() == breakerOpen {
+			health[name] = errBreakerOpen{name: name}
+			continue
+		}
+
+		pinger, ok := backend.(Pinger)
+		if !ok {
+			health[name] = nil
+			continue
+		}
+
+		pingCtx := ctx
+		cancel := func() {}
+		if timeout, ok := b.timeouts[name]; ok {
+			pingCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		health[name] = pinger.Ping(pingCtx)
+		cancel()
+	}
+
+	return health
+}
+
+// AuthPskKeyGet looks up the hex encoded key for a TLS-PSK identity in user checkers that know about keys.
+// An empty key and nil error means no backend knows the identity.
+func (b *Backends) AuthPskKeyGet(ctx context.Context, hint, identity string) (string, error) {
+	// If the identity matches a route, look the key up with the route's backend only. There's no clientid to route on.
+	if bename, routed := b.lookupRoute(ctx, identity, ""); bename != "" {
+		if !checkRegistered(bename, b.userCheckers) {
+			return "", fmt.Errorf("backend %s not registered to check users", bename)
+		}
+
+		getter, ok := b.backends[bename].(PskKeyGetter)
+		if !ok {
+			return "", fmt.Errorf("backend %s doesn't support psk keys", bename)
+		}
+
+		return b.getPskKey(ctx, getter, bename, hint, routed)
+	}
+
+	var err error
+
+	for _, bename := range b.userCheckers {
+		var backend = b.backends[bename]
+
+		getter, ok := backend.(PskKeyGetter)
+		if !ok {
+			continue
+		}
+
+		log.Debugf("getting psk key for identity %s with backend %s", identity, backend.GetName())
+
+		key, getKeyErr := b.getPskKey(ctx, getter, bename, hint, identity)
+		if getKeyErr == nil && key != "" {
+			log.Debugf("psk key for identity %s found with backend %s", identity, backend.GetName())
+			return key, nil
+		} else if getKeyErr != nil && err == nil {
+			err = getKeyErr
+		}
+	}
+
+	return "", err
+}
+
+// AuthScramVerifierGet returns the SCRAM verifier stored for username for the given mechanism.
+// Hashes that aren't SCRAM verifiers for that mechanism are ignored, and a nil verifier is returned if there's none.
+// As with password logins, the client carried by ctx is held to the global network rules and to those of the backend
+// the verifier is found with, and users denied explicitly by a backend asked get no verifier, so the exchange fails.
+// Only one verifier can check the client's proof, so unless the login is routed to a single backend, SCRAM logins
+// are refused with an error when user_strategy isn't any.
+func (b *Backends) AuthScramVerifierGet(ctx context.Context, mechanism, username string) (*hashing.ScramVerifier, error) {
+	if !b.checkGlobalNetworks(ctx, username) {
+		return nil, nil
+	}
+
+	// If the username matches a route, look the hash up with the route's backend only. There's no clientid to route on.
+	if bename, routed := b.lookupRoute(ctx, username, ""); bename != "" {
+		if !checkRegistered(bename, b.userCheckers) {
+			return nil, fmt.Errorf("backend %s not registered to check users", bename)
+		}
+
+		getter, ok := b.backends[bename].(PasswordHashGetter)
+		if !ok {
+			return nil, fmt.Errorf("backend %s doesn't support password hash lookups", bename)
+		}
+
+		if denied, err := b.scramDenied(ctx, []string{bename}, routed); denied || err != nil {
+			return nil, err
+		}
+
+		passwordHash, err := b.getPasswordHash(ctx, getter, bename, routed)
+		if err != nil {
+			return nil, err
+		}
+
+		verifier := scramVerifier(mechanism, passwordHash)
+		if verifier == nil {
+			return nil, nil
+		}
+
+		allowed, err := b.checkBackendNetworks(ctx, bename, routed)
+		if !allowed || err != nil {
+			return nil, err
+		}
+
+		return verifier, nil
+	}
+
+	if s, ok := b.strategies[userCheck]; ok && s.name != anyStrategy {
+		return nil, fmt.Errorf("SCRAM logins aren't supported with user_strategy %s", s)
+	}
+
+	denied, err := b.scramDenied(ctx, b.userCheckers, username)
+	if denied || err != nil {
+		return nil, err
+	}
+
+	for _, bename := range b.userCheckers {
+		var backend = b.backends[bename]
+
+		getter, ok := backend.(PasswordHashGetter)
+		if !ok {
+			continue
+		}
+
+		log.Debugf("getting %s verifier for user %s with backend %s", mechanism, username, backend.GetName())
+
+		passwordHash, getHashErr := b.getPasswordHash(ctx, getter, bename, username)
+		if getHashErr != nil {
+			if err == nil {
+				err = getHashErr
+			}
+			continue
+		}
+
+		verifier := scramVerifier(mechanism, passwordHash)
+		if verifier == nil {
+			continue
+		}
+
+		log.Debugf("%s verifier for user %s found with backend %s", mechanism, username, backend.GetName())
+
+		allowed, networksErr := b.checkBackendNetworks(ctx, bename, username)
+		if networksErr != nil {
+			if err == nil {
+				err = networksErr
+			}
+			continue
+		}
+
+		if allowed {
+			return verifier, nil
+		}
+	}
+
+	return nil, err
+}
+
+// scramDenied asks the backends among checkers that may deny users whether they deny username, as a password login
+// would. Only backends whose denies don't depend on the password can tell, any other one fails the lookup with an error.
+func (b *Backends) scramDenied(ctx context.Context, checkers []string, username string) (bool, error) {
+	for _, bename := range checkers {
+		if !b.denies(bename, userCheck) {
+			continue
+		}
+
+		denier, ok := b.backends[bename].(UserDenier)
+		if !ok {
+			return false, fmt.Errorf("backend %s may deny users but needs their password to do so, which SCRAM logins don't give", bename)
+		}
+
+		var result Result
+		err := b.callBackend(ctx, bename, func(ctx context.Context) error {
+			var err error
+			result, err = denier.UserDenied(ctx, username)
+			return err
+		})
+		if err != nil {
+			return false, err
+		}
+
+		if result.Verdict == Deny {
+			log.Debugf("user %s denied by backend %s: %s", username, bename, result.Reason)
+			decideResult(ctx, bename, result)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func scramVerifier(mechanism, passwordHash string) *hashing.ScramVerifier {
+	if !strings.HasPrefix(passwordHash, mechanism+"$") {
+		return nil
+	}
+
+	verifier, err := hashing.ParseScramVerifier(passwordHash)
+	if err != nil {
+		log.Errorf("invalid %s verifier: %s", mechanism, err)
+		return nil
+	}
+
+	return verifier
 }
 
 func (b *Backends) Halt() {
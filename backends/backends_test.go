@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	log "github.com/sirupsen/logrus"
@@ -94,8 +95,8 @@ func TestBackends(t *testing.T) {
 
 		// Redis only contains test1, while files has a bunch of more users.
 		// Since Files only registers acl checks, those users should fail.
-		tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
-		tt2, err2 := b.AuthUnpwdCheck("test2", "test2", clientid)
+		tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
+		tt2, err2 := b.AuthUnpwdCheck(ctx, "test2", "test2", clientid)
 
 		So(err1, ShouldBeNil)
 		So(tt1, ShouldBeTrue)
@@ -116,11 +117,11 @@ func TestBackends(t *testing.T) {
 
 		redis.conn.SAdd(ctx, username+":racls", "test/redis")
 
-		aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+		aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 		So(err, ShouldBeNil)
 		So(aclCheck, ShouldBeFalse)
 
-		aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 2)
+		aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 2)
 		So(err, ShouldBeNil)
 		So(aclCheck, ShouldBeTrue)
 
@@ -143,8 +144,8 @@ func TestBackends(t *testing.T) {
 		b, err := Initialize(authOpts, log.DebugLevel)
 		So(err, ShouldBeNil)
 
-		tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
-		tt2, err2 := b.AuthUnpwdCheck("test2", "test2", clientid)
+		tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
+		tt2, err2 := b.AuthUnpwdCheck(ctx, "test2", "test2", clientid)
 
 		So(err1, ShouldBeNil)
 		So(tt1, ShouldBeTrue)
@@ -165,11 +166,11 @@ func TestBackends(t *testing.T) {
 
 		redis.conn.SAdd(ctx, username+":racls", "test/redis")
 
-		aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+		aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 		So(err, ShouldBeNil)
 		So(aclCheck, ShouldBeTrue)
 
-		aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 2)
+		aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 2)
 		So(err, ShouldBeNil)
 		So(aclCheck, ShouldBeTrue)
 
@@ -200,7 +201,7 @@ func TestBackends(t *testing.T) {
 			b, err := Initialize(authOpts, log.DebugLevel)
 			So(err, ShouldBeNil)
 
-			tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
+			tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -211,11 +212,11 @@ func TestBackends(t *testing.T) {
 
 			So(b.disableSuperuser, ShouldBeFalse)
 
-			aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+			aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
-			aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 1)
+			aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeFalse)
 
@@ -245,7 +246,7 @@ func TestBackends(t *testing.T) {
 			b, err := Initialize(authOpts, log.DebugLevel)
 			So(err, ShouldBeNil)
 
-			tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
+			tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -256,11 +257,11 @@ func TestBackends(t *testing.T) {
 
 			So(b.disableSuperuser, ShouldBeTrue)
 
-			aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+			aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
-			aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 1)
+			aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeFalse)
 
@@ -290,7 +291,7 @@ func TestBackends(t *testing.T) {
 			b, err := Initialize(authOpts, log.DebugLevel)
 			So(err, ShouldBeNil)
 
-			tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
+			tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -298,11 +299,11 @@ func TestBackends(t *testing.T) {
 			// Set a topic and check an unregistered one, they should both pass.
 			redis.conn.SAdd(ctx, username+":racls", "test/redis")
 
-			aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+			aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
-			aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 1)
+			aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
@@ -334,7 +335,7 @@ func TestBackends(t *testing.T) {
 			b, err := Initialize(authOpts, log.DebugLevel)
 			So(err, ShouldBeNil)
 
-			tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
+			tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -345,11 +346,11 @@ func TestBackends(t *testing.T) {
 
 			So(b.disableSuperuser, ShouldBeFalse)
 
-			aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+			aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
-			aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 1)
+			aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeFalse)
 
@@ -379,7 +380,7 @@ func TestBackends(t *testing.T) {
 			b, err := Initialize(authOpts, log.DebugLevel)
 			So(err, ShouldBeNil)
 
-			tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
+			tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -390,11 +391,11 @@ func TestBackends(t *testing.T) {
 
 			So(b.disableSuperuser, ShouldBeTrue)
 
-			aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+			aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
-			aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 1)
+			aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeFalse)
 
@@ -424,7 +425,7 @@ func TestBackends(t *testing.T) {
 			b, err := Initialize(authOpts, log.DebugLevel)
 			So(err, ShouldBeNil)
 
-			tt1, err1 := b.AuthUnpwdCheck(username, password, clientid)
+			tt1, err1 := b.AuthUnpwdCheck(ctx, username, password, clientid)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -432,15 +433,250 @@ func TestBackends(t *testing.T) {
 			// Set a topic and check an unregistered one, they should both pass.
 			redis.conn.SAdd(ctx, username+":racls", "test/redis")
 
-			aclCheck, err := b.AuthAclCheck(clientid, username, "test/redis", 1)
+			aclCheck, err := b.AuthAclCheck(ctx, clientid, username, "test/redis", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
-			aclCheck, err = b.AuthAclCheck(clientid, username, "test/topic/1", 1)
+			aclCheck, err = b.AuthAclCheck(ctx, clientid, username, "test/topic/1", 1)
 			So(err, ShouldBeNil)
 			So(aclCheck, ShouldBeTrue)
 
 			redis.Halt()
 		})
 	})
+
+	Convey("Psk keys should only be looked up in backends registered to check users", t, func() {
+		pskPath, _ := filepath.Abs("../test-files/psk")
+
+		authOpts["backends"] = "files, redis"
+		authOpts["files_register"] = "user"
+		authOpts["files_psk_path"] = pskPath
+		authOpts["redis_register"] = "acl"
+
+		redis, err := NewRedis(authOpts, log.DebugLevel, hashing.NewHasher(authOpts, "redis"))
+		assert.Nil(t, err)
+
+		ctx := context.Background()
+
+		redis.conn.Set(ctx, "redis-device:psk", "cafe", 0)
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		key, err := b.AuthPskKeyGet(ctx, "hint", "device1")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "0123456789abcdef")
+
+		// Redis knows this identity but isn't registered to check users.
+		key, err = b.AuthPskKeyGet(ctx, "hint", "redis-device")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "")
+
+		Convey("Registering redis to check users too should find its keys", func() {
+			authOpts["redis_register"] = "user, acl"
+
+			b, err := Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			key, err := b.AuthPskKeyGet(ctx, "hint", "redis-device")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "cafe")
+		})
+
+		delete(authOpts, "files_psk_path")
+		redis.Halt()
+	})
+
+	Convey("SCRAM verifiers should be looked up in backends registered to check users", t, func() {
+		authOpts["backends"] = "files, redis"
+		authOpts["files_register"] = "user"
+		authOpts["redis_register"] = "user, acl"
+
+		redis, err := NewRedis(authOpts, log.DebugLevel, hashing.NewHasher(authOpts, "redis"))
+		assert.Nil(t, err)
+
+		ctx := context.Background()
+
+		verifier, err := hashing.NewScramHasher(16, 4096, hashing.SHA256).Hash("scram-password")
+		So(err, ShouldBeNil)
+
+		redis.conn.Set(ctx, "scram-user", verifier, 0)
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		scramVerifier, err := b.AuthScramVerifierGet(ctx, hashing.ScramSHA256, "scram-user")
+		So(err, ShouldBeNil)
+		So(scramVerifier, ShouldNotBeNil)
+		So(scramVerifier.String(), ShouldEqual, verifier)
+
+		// The stored verifier is for a different mechanism.
+		scramVerifier, err = b.AuthScramVerifierGet(ctx, hashing.ScramSHA512, "scram-user")
+		So(err, ShouldBeNil)
+		So(scramVerifier, ShouldBeNil)
+
+		// Files knows test1 but its password isn't stored as a SCRAM verifier.
+		scramVerifier, err = b.AuthScramVerifierGet(ctx, hashing.ScramSHA256, "test1")
+		So(err, ShouldBeNil)
+		So(scramVerifier, ShouldBeNil)
+
+		redis.conn.FlushDB(ctx)
+		redis.Halt()
+	})
+}
+
+// pingBackend is a context aware backend whose pings fail while it's down.
+type pingBackend struct {
+	down bool
+}
+
+func (o *pingBackend) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return false, nil
+}
+
+func (o *pingBackend) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return false, nil
+}
+
+func (o *pingBackend) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return false, nil
+}
+
+func (o *pingBackend) Ping(ctx context.Context) error {
+	if o.down {
+		return fmt.Errorf("backend is down")
+	}
+	return nil
+}
+
+func (o *pingBackend) GetName() string {
+	return "Ping"
+}
+
+func (o *pingBackend) Halt() {}
+
+func TestCheckersOrder(t *testing.T) {
+	newBackends := func() *Backends {
+		return &Backends{
+			aclCheckers:       make([]string, 0),
+			userCheckers:      make([]string, 0),
+			superuserCheckers: make([]string, 0),
+		}
+	}
+
+	backends := []string{httpBackend, filesBackend, redisBackend, postgresBackend}
+
+	Convey("Checkers should be asked in the order of the backends option, every time", t, func() {
+		authOpts := map[string]string{
+			"files_register": "user, acl",
+			"pg_register":    "superuser",
+		}
+
+		for i := 0; i < 20; i++ {
+			b := newBackends()
+			So(b.setCheckers(authOpts, backends), ShouldBeNil)
+
+			So(b.Checkers(), ShouldResemble, map[string][]string{
+				userCheck:      {httpBackend, filesBackend, redisBackend},
+				superuserCheck: {httpBackend, redisBackend, postgresBackend},
+				aclCheck:       {httpBackend, filesBackend, redisBackend},
+			})
+		}
+	})
+
+	Convey("Backends given twice should only be registered once", t, func() {
+		b := newBackends()
+		So(b.setCheckers(map[string]string{}, []string{filesBackend, redisBackend, filesBackend}), ShouldBeNil)
+		So(b.Checkers()[userCheck], ShouldResemble, []string{filesBackend, redisBackend})
+	})
+
+	Convey("Per check orders should be honored, leaving the backends they don't list after the listed ones", t, func() {
+		authOpts := map[string]string{
+			"user_order":      "files",
+			"superuser_order": "postgres, redis, http, files",
+			"acl_order":       "files, redis, http",
+		}
+
+		for i := 0; i < 20; i++ {
+			b := newBackends()
+			So(b.setCheckers(authOpts, backends), ShouldBeNil)
+
+			So(b.Checkers(), ShouldResemble, map[string][]string{
+				userCheck:      {filesBackend, httpBackend, redisBackend, postgresBackend},
+				superuserCheck: {postgresBackend, redisBackend, httpBackend, filesBackend},
+				aclCheck:       {filesBackend, redisBackend, httpBackend, postgresBackend},
+			})
+		}
+	})
+
+	Convey("Orders listing backends that aren't registered for the check should be rejected", t, func() {
+		b := newBackends()
+		err := b.setCheckers(map[string]string{"files_register": "user", "acl_order": "files, redis"}, backends)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "backend files in acl_order is not registered for acl checks")
+
+		b = newBackends()
+		err = b.setCheckers(map[string]string{"user_order": "mongo"}, backends)
+		So(err, ShouldNotBeNil)
+
+		b = newBackends()
+		err = b.setCheckers(map[string]string{"user_order": "redis, files, redis"}, backends)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "backend redis given more than once in user_order")
+	})
+
+	Convey("Orders should be checked on initialization", t, func() {
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+
+		_, err := Initialize(map[string]string{
+			"backends":            "files",
+			"files_password_path": pwPath,
+			"files_register":      "user",
+			"acl_order":           "files",
+		}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestHealth(t *testing.T) {
+	Convey("Given backends that can and can't be pinged", t, func() {
+		pinged := &pingBackend{}
+		flaky := &flakyBackend{}
+		b := &Backends{
+			backends: map[string]ContextBackend{
+				"ping":  pinged,
+				"flaky": NewLegacyBackend(flaky),
+			},
+			breakers:          map[string]*breaker{"flaky": newBreaker("flaky", 1, time.Hour, 1)},
+			timeouts:          map[string]time.Duration{"ping": time.Second},
+			userCheckers:      []string{"ping", "flaky"},
+			superuserCheckers: []string{"flaky"},
+			aclCheckers:       []string{"ping"},
+		}
+
+		Convey("Checkers should be listed by check type", func() {
+			So(b.Checkers(), ShouldResemble, map[string][]string{
+				"user":      {"ping", "flaky"},
+				"superuser": {"flaky"},
+				"acl":       {"ping"},
+			})
+		})
+
+		Convey("Healthy backends and backends without pings should be reported as healthy", func() {
+			health := b.Health(context.Background())
+			So(health, ShouldHaveLength, 2)
+			So(health["ping"], ShouldBeNil)
+			So(health["flaky"], ShouldBeNil)
+		})
+
+		Convey("Failed pings and open breakers should be reported", func() {
+			pinged.down = true
+			b.breakers["flaky"].record(false)
+
+			health := b.Health(context.Background())
+			So(health["ping"], ShouldNotBeNil)
+			So(health["flaky"], ShouldNotBeNil)
+			So(flaky.calls, ShouldEqual, 0)
+		})
+	})
 }
@@ -0,0 +1,235 @@
+package backends
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	defaultBreakerTimeout   = 30
+	defaultBreakerSuccesses = 1
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker for a single backend. It opens after threshold consecutive errors,
+// so the backend is skipped right away instead of being hit by every check, and after timeout lets
+// a single probe through (half-open). It closes again after the given number of successful probes,
+// while a failed probe opens it again.
+type breaker struct {
+	sync.Mutex
+	name      string
+	threshold int
+	timeout   time.Duration
+	successes int
+
+	state     breakerState
+	failures  int
+	succeeded int
+	probing   bool
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+// errBreakerOpen is returned instead of calling a backend whose breaker is open.
+type errBreakerOpen struct {
+	name string
+}
+
+func (e errBreakerOpen) Error() string {
+	return fmt.Sprintf("backend %s is unavailable (circuit breaker open)", e.name)
+}
+
+func newBreaker(name string, threshold int, timeout time.Duration, successes int) *breaker {
+	if successes < 1 {
+		successes = 1
+	}
+
+	metrics.SetCircuitState(name, int(breakerClosed))
+
+	return &breaker{
+		name:      name,
+		threshold: threshold,
+		timeout:   timeout,
+		successes: successes,
+		now:       time.Now,
+	}
+}
+
+// allow tells whether a call to the backend may go through.
+func (c *breaker) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case breakerOpen:
+		if c.now().Sub(c.openedAt) < c.timeout {
+			return false
+		}
+		c.setState(breakerHalfOpen)
+		c.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only one probe at a time.
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// wouldAllow tells whether allow would let a call through, without changing the breaker's state.
+func (c *breaker) wouldAllow() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case breakerOpen:
+		return c.now().Sub(c.openedAt) >= c.timeout
+	case breakerHalfOpen:
+		return !c.probing
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call that was allowed through.
+func (c *breaker) record(success bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case breakerClosed:
+		if success {
+			c.failures = 0
+			return
+		}
+		c.failures++
+		if c.failures >= c.threshold {
+			c.open()
+		}
+	case breakerHalfOpen:
+		c.probing = false
+		if !success {
+			c.open()
+			return
+		}
+		c.succeeded++
+		if c.succeeded >= c.successes {
+			c.failures = 0
+			c.setState(breakerClosed)
+		}
+	}
+}
+
+// open trips the breaker. Caller must hold the lock.
+func (c *breaker) open() {
+	c.openedAt = c.now()
+	c.succeeded = 0
+	c.setState(breakerOpen)
+}
+
+// setState moves the breaker to the given state and logs the change. Caller must hold the lock.
+func (c *breaker) setState(state breakerState) {
+	if c.state == state {
+		return
+	}
+	c.state = state
+	metrics.SetCircuitState(c.name, int(state))
+
+	switch state {
+	case breakerOpen:
+		log.Warnf("circuit breaker for backend %s opened, skipping it for %s", c.name, c.timeout)
+	case breakerHalfOpen:
+		log.Infof("circuit breaker for backend %s is half-open, probing the backend", c.name)
+	case breakerClosed:
+		log.Infof("circuit breaker for backend %s closed, backend is available again", c.name)
+	}
+}
+
+func (c *breaker) getState() breakerState {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.state
+}
+
+// setBreakers creates a circuit breaker for every backend that has a failure threshold set,
+// either with the general breaker_threshold option or its own prefixed one, e.g. pg_breaker_threshold.
+func (b *Backends) setBreakers(authOpts map[string]string) {
+	for name := range b.backends {
+		prefix := OptsPrefix(name)
+
+		threshold := backendIntOption(authOpts, prefix, "breaker_threshold", 0)
+		if threshold <= 0 {
+			continue
+		}
+
+		timeout := backendIntOption(authOpts, prefix, "breaker_timeout", defaultBreakerTimeout)
+		successes := backendIntOption(authOpts, prefix, "breaker_successes", defaultBreakerSuccesses)
+
+		b.breakers[name] = newBreaker(name, threshold, time.Duration(timeout)*time.Second, successes)
+		log.Infof("circuit breaker enabled for backend %s: threshold %d, timeout %ds, successes %d", name, threshold, timeout, successes)
+	}
+}
+
+// guard runs call against the named backend through its circuit breaker, if it has one.
+// Only errors count as failures, a denied check is a perfectly healthy answer. Dry runs are held to
+// the breaker too, but neither take a probe's place nor count towards it.
+func (b *Backends) guard(bename string, dryRun bool, call func() error) error {
+	cb, ok := b.breakers[bename]
+	if !ok {
+		return call()
+	}
+
+	if dryRun {
+		if !cb.wouldAllow() {
+			return errBreakerOpen{name: bename}
+		}
+		return call()
+	}
+
+	if !cb.allow() {
+		log.Debugf("skipping backend %s, circuit breaker is open", bename)
+		return errBreakerOpen{name: bename}
+	}
+
+	err := call()
+	cb.record(err == nil)
+
+	return err
+}
+
+// BreakerStates returns the state (closed, open or half-open) of every backend with a circuit breaker.
+func (b *Backends) BreakerStates() map[string]string {
+	states := make(map[string]string, len(b.breakers))
+	for name, cb := range b.breakers {
+		states[name] = cb.getState().String()
+	}
+
+	return states
+}
@@ -0,0 +1,156 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// flakyBackend grants test1 and fails every check while down.
+type flakyBackend struct {
+	down  bool
+	calls int
+}
+
+func (o *flakyBackend) GetUser(username, password, clientid string) (bool, error) {
+	o.calls++
+	if o.down {
+		return false, errors.New("backend is down")
+	}
+	return username == "test1", nil
+}
+
+func (o *flakyBackend) GetSuperuser(username string) (bool, error) {
+	return false, nil
+}
+
+func (o *flakyBackend) CheckAcl(username, topic, clientId string, acc int32) (bool, error) {
+	return false, nil
+}
+
+func (o *flakyBackend) GetName() string {
+	return "Flaky"
+}
+
+func (o *flakyBackend) Halt() {}
+
+func TestBreaker(t *testing.T) {
+	Convey("Given a breaker with a threshold of 2 and 2 successes to close", t, func() {
+		now := time.Now()
+		cb := newBreaker("test", 2, 10*time.Second, 2)
+		cb.now = func() time.Time { return now }
+
+		Convey("It should open after 2 consecutive errors", func() {
+			So(cb.allow(), ShouldBeTrue)
+			cb.record(false)
+			So(cb.getState(), ShouldEqual, breakerClosed)
+
+			cb.record(true)
+			cb.record(false)
+			So(cb.getState(), ShouldEqual, breakerClosed)
+
+			cb.record(false)
+			So(cb.getState(), ShouldEqual, breakerOpen)
+			So(cb.allow(), ShouldBeFalse)
+
+			Convey("After the timeout it should let a single probe through", func() {
+				now = now.Add(11 * time.Second)
+
+				So(cb.allow(), ShouldBeTrue)
+				So(cb.getState(), ShouldEqual, breakerHalfOpen)
+				So(cb.allow(), ShouldBeFalse)
+
+				Convey("A failed probe should open it again", func() {
+					cb.record(false)
+					So(cb.getState(), ShouldEqual, breakerOpen)
+					So(cb.allow(), ShouldBeFalse)
+				})
+
+				Convey("Enough successful probes should close it", func() {
+					cb.record(true)
+					So(cb.getState(), ShouldEqual, breakerHalfOpen)
+
+					So(cb.allow(), ShouldBeTrue)
+					cb.record(true)
+					So(cb.getState(), ShouldEqual, breakerClosed)
+					So(cb.allow(), ShouldBeTrue)
+				})
+			})
+		})
+	})
+
+	Convey("Breaker options should fall back from the backend's own to the general ones", t, func() {
+		authOpts := map[string]string{
+			"breaker_threshold":  "5",
+			"pg_breaker_timeout": "60",
+			"breaker_successes":  "wrong",
+		}
+
+		So(backendIntOption(authOpts, "pg", "breaker_threshold", 0), ShouldEqual, 5)
+		So(backendIntOption(authOpts, "pg", "breaker_timeout", defaultBreakerTimeout), ShouldEqual, 60)
+		So(backendIntOption(authOpts, "redis", "breaker_timeout", defaultBreakerTimeout), ShouldEqual, defaultBreakerTimeout)
+		So(backendIntOption(authOpts, "pg", "breaker_successes", defaultBreakerSuccesses), ShouldEqual, defaultBreakerSuccesses)
+	})
+
+	Convey("A backend with an open breaker should be skipped", t, func() {
+		flaky := &flakyBackend{down: true}
+		b := &Backends{
+			backends:     map[string]ContextBackend{"flaky": NewLegacyBackend(flaky)},
+			breakers:     map[string]*breaker{"flaky": newBreaker("flaky", 2, time.Hour, 1)},
+			userCheckers: []string{"flaky"},
+		}
+
+		for i := 0; i < 5; i++ {
+			authenticated, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+			So(authenticated, ShouldBeFalse)
+			So(err, ShouldNotBeNil)
+		}
+
+		So(flaky.calls, ShouldEqual, 2)
+		So(b.BreakerStates(), ShouldResemble, map[string]string{"flaky": "open"})
+
+		// Once the breaker lets a probe through and it succeeds, checks work again.
+		flaky.down = false
+		b.breakers["flaky"].openedAt = time.Now().Add(-2 * time.Hour)
+
+		authenticated, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(authenticated, ShouldBeTrue)
+		So(err, ShouldBeNil)
+		So(b.BreakerStates(), ShouldResemble, map[string]string{"flaky": "closed"})
+	})
+	Convey("Dry runs should leave breakers untouched", t, func() {
+		flaky := &flakyBackend{down: true}
+		b := &Backends{
+			backends:     map[string]ContextBackend{"flaky": NewLegacyBackend(flaky)},
+			breakers:     map[string]*breaker{"flaky": newBreaker("flaky", 2, time.Hour, 1)},
+			userCheckers: []string{"flaky"},
+		}
+		ctx := WithDryRun(context.Background())
+
+		for i := 0; i < 3; i++ {
+			_, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldNotBeNil)
+		}
+		So(flaky.calls, ShouldEqual, 3)
+		So(b.BreakerStates(), ShouldResemble, map[string]string{"flaky": "closed"})
+
+		// An open breaker skips dry runs too, but they don't take the probe's place once it may go through.
+		b.breakers["flaky"].record(false)
+		b.breakers["flaky"].record(false)
+		_, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+		So(err, ShouldResemble, errBreakerOpen{name: "flaky"})
+		So(flaky.calls, ShouldEqual, 3)
+
+		flaky.down = false
+		b.breakers["flaky"].openedAt = time.Now().Add(-2 * time.Hour)
+
+		authenticated, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+		So(authenticated, ShouldBeTrue)
+		So(err, ShouldBeNil)
+		So(b.BreakerStates(), ShouldResemble, map[string]string{"flaky": "open"})
+		So(b.breakers["flaky"].allow(), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,264 @@
+package backends
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/backends/topics"
+	log "github.com/sirupsen/logrus"
+)
+
+// certificateBackend is the decision backend of logins granted by the client's certificate.
+const certificateBackend = "certificate"
+
+type certificateKey struct{}
+
+// Certificate holds the identity fields of the TLS certificate a client connected with.
+type Certificate struct {
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	IPAddresses    []string
+	// Fingerprint is the hex encoded SHA-256 of the DER certificate.
+	Fingerprint string
+	// Issuer is the issuer's distinguished name, and IssuerCommonName its common name.
+	Issuer           string
+	IssuerCommonName string
+}
+
+// NewCertificate takes the identity fields out of a parsed client certificate.
+func NewCertificate(cert *x509.Certificate) *Certificate {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	c := &Certificate{
+		CommonName:       cert.Subject.CommonName,
+		DNSNames:         cert.DNSNames,
+		EmailAddresses:   cert.EmailAddresses,
+		Fingerprint:      hex.EncodeToString(fingerprint[:]),
+		Issuer:           cert.Issuer.String(),
+		IssuerCommonName: cert.Issuer.CommonName,
+	}
+
+	for _, uri := range cert.URIs {
+		c.URIs = append(c.URIs, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		c.IPAddresses = append(c.IPAddresses, ip.String())
+	}
+
+	return c
+}
+
+// WithCertificate returns a copy of ctx carrying the certificate of the client a check is made for.
+func WithCertificate(ctx context.Context, cert *Certificate) context.Context {
+	return context.WithValue(ctx, certificateKey{}, cert)
+}
+
+// CertificateFrom returns the client certificate carried by ctx, or nil if there's none.
+func CertificateFrom(ctx context.Context) *Certificate {
+	cert, _ := ctx.Value(certificateKey{}).(*Certificate)
+	return cert
+}
+
+// values returns every value of the field with the given name, SANs possibly having many.
+func (c *Certificate) values(field string) []string {
+	switch field {
+	case "cn":
+		return []string{c.CommonName}
+	case "san_dns":
+		return c.DNSNames
+	case "san_email":
+		return c.EmailAddresses
+	case "san_uri":
+		return c.URIs
+	case "san_ip":
+		return c.IPAddresses
+	case "fingerprint":
+		return []string{c.Fingerprint}
+	case "issuer":
+		return []string{c.Issuer}
+	case "issuer_cn":
+		return []string{c.IssuerCommonName}
+	}
+
+	return nil
+}
+
+var certificateFields = []string{"cn", "san_dns", "san_email", "san_uri", "san_ip", "fingerprint", "issuer", "issuer_cn"}
+
+// Fields returns the certificate's fields by name, as used by acl placeholders. SANs give their first value.
+func (c *Certificate) Fields() map[string]string {
+	if c == nil {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, field := range certificateFields {
+		if values := c.values(field); len(values) > 0 && values[0] != "" {
+			fields[field] = values[0]
+		}
+	}
+
+	return fields
+}
+
+// replacePlaceholders replaces the placeholders of an acl topic, including those of the certificate carried by ctx.
+// ok is false when the acl can't match, see topics.Replace.
+func replacePlaceholders(ctx context.Context, acl, username, clientid string) (string, bool) {
+	return topics.Replace(acl, username, clientid, CertificateFrom(ctx).Fields())
+}
+
+// certRule maps a certificate field to a username. Without a regexp the field's value is the username,
+// otherwise it's the first group the regexp captures, or the whole match if it has no groups.
+type certRule struct {
+	field  string
+	regexp *regexp.Regexp
+}
+
+// parseCertRules parses a comma separated list of rules in the field or field:regexp form.
+func parseCertRules(option string) ([]certRule, error) {
+	var rules []certRule
+
+	for _, rule := range strings.Split(option, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		field, expr := rule, ""
+		if i := strings.Index(rule, ":"); i >= 0 {
+			field, expr = rule[:i], rule[i+1:]
+		}
+
+		if !knownCertificateField(field) {
+			return nil, fmt.Errorf("unknown certificate field %s in cert_username, must be one of %s", field, strings.Join(certificateFields, ", "))
+		}
+
+		r := certRule{field: field}
+		if expr != "" {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cert_username regexp for %s: %s", field, err)
+			}
+			r.regexp = re
+		}
+
+		rules = append(rules, r)
+	}
+
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("cert_username has no rules")
+	}
+
+	return rules, nil
+}
+
+func knownCertificateField(field string) bool {
+	for _, known := range certificateFields {
+		if field == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// username returns the username the rule maps cert to, or an empty string when it doesn't apply.
+func (r certRule) username(cert *Certificate) string {
+	for _, value := range cert.values(r.field) {
+		if r.regexp == nil {
+			if value != "" {
+				return value
+			}
+			continue
+		}
+
+		match := r.regexp.FindStringSubmatch(value)
+		switch {
+		case match == nil:
+			continue
+		case len(match) > 1 && match[1] != "":
+			return match[1]
+		case len(match) == 1 && match[0] != "":
+			return match[0]
+		}
+	}
+
+	return ""
+}
+
+func (b *Backends) setCertRules(authOpts map[string]string) error {
+	b.certPlaceholders = authOpts["cert_placeholders"] == "true"
+
+	if authOpts["cert_auth"] != "true" {
+		return nil
+	}
+
+	option, ok := authOpts["cert_username"]
+	if !ok {
+		option = "cn"
+	}
+
+	rules, err := parseCertRules(option)
+	if err != nil {
+		return err
+	}
+
+	b.certRules = rules
+	log.Infof("certificate authentication enabled, usernames taken from %s", option)
+
+	return nil
+}
+
+// CertificateAuth tells whether clients with a certificate may log in without a password.
+func (b *Backends) CertificateAuth() bool {
+	return b.certRules != nil
+}
+
+// CertificateNeeded tells whether checks use the client certificate, either to log clients in with it or for acl
+// placeholders. Mosquitto only hands it over when they do, as encoding and parsing it on every check isn't free.
+func (b *Backends) CertificateNeeded() bool {
+	return b.certRules != nil || b.certPlaceholders
+}
+
+// CertificateUsername maps cert to a username with the first cert_username rule that applies to it.
+// ok is false when certificate authentication is disabled or no rule applies.
+func (b *Backends) CertificateUsername(cert *Certificate) (string, bool) {
+	if b.certRules == nil || cert == nil {
+		return "", false
+	}
+
+	for _, rule := range b.certRules {
+		if username := rule.username(cert); username != "" {
+			return username, true
+		}
+	}
+
+	return "", false
+}
+
+// checkCertificate grants a password-less login when cert maps to a username and the client gave
+// either no username or that same one.
+func (b *Backends) checkCertificate(ctx context.Context, username string, cert *Certificate) bool {
+	identity, ok := b.CertificateUsername(cert)
+	if !ok {
+		log.Debugf("no cert_username rule applies to certificate %s (cn %s)", cert.Fingerprint, cert.CommonName)
+		return false
+	}
+
+	if username != "" && username != identity {
+		log.Debugf("user %s doesn't match certificate identity %s", username, identity)
+		return false
+	}
+
+	log.Debugf("user %s authenticated with certificate %s", identity, cert.Fingerprint)
+	decide(ctx, certificateBackend, false)
+
+	return true
+}
@@ -0,0 +1,196 @@
+package backends
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri, _ := url.Parse("spiffe://example.com/sensor")
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "sensor-1", Organization: []string{"Example"}},
+		Issuer:         pkix.Name{CommonName: "sensor-1", Organization: []string{"Example"}},
+		DNSNames:       []string{"sensor-1.devices.example.com"},
+		EmailAddresses: []string{"sensor-1@example.com"},
+		URIs:           []*url.URL{uri},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestCertificate(t *testing.T) {
+	x509Cert := newTestCertificate(t)
+	fingerprint := sha256.Sum256(x509Cert.Raw)
+
+	Convey("The certificate's identity fields should be taken out", t, func() {
+		cert := NewCertificate(x509Cert)
+
+		So(cert.CommonName, ShouldEqual, "sensor-1")
+		So(cert.DNSNames, ShouldResemble, []string{"sensor-1.devices.example.com"})
+		So(cert.EmailAddresses, ShouldResemble, []string{"sensor-1@example.com"})
+		So(cert.URIs, ShouldResemble, []string{"spiffe://example.com/sensor"})
+		So(cert.IPAddresses, ShouldResemble, []string{"10.0.0.1"})
+		So(cert.Fingerprint, ShouldEqual, hex.EncodeToString(fingerprint[:]))
+		So(cert.Issuer, ShouldEqual, "CN=sensor-1,O=Example")
+		So(cert.IssuerCommonName, ShouldEqual, "sensor-1")
+
+		fields := cert.Fields()
+		So(fields["cn"], ShouldEqual, "sensor-1")
+		So(fields["san_dns"], ShouldEqual, "sensor-1.devices.example.com")
+		So(fields["fingerprint"], ShouldEqual, cert.Fingerprint)
+	})
+
+	Convey("Invalid cert_username rules should be rejected", t, func() {
+		_, err := parseCertRules("serial")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown certificate field serial")
+
+		_, err = parseCertRules("cn:(")
+		So(err, ShouldNotBeNil)
+
+		_, err = parseCertRules(" , ")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given backends with certificate authentication", t, func() {
+		authOpts := make(map[string]string)
+
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+		aclPath, _ := filepath.Abs("../test-files/acls")
+
+		authOpts["backends"] = "files"
+		authOpts["files_password_path"] = pwPath
+		authOpts["files_acl_path"] = aclPath
+		authOpts["cert_auth"] = "true"
+		authOpts["cert_username"] = `san_email:^(.+)@other\.com$, san_dns:^([^.]+)\.devices\.example\.com$, cn`
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		cert := NewCertificate(x509Cert)
+		ctx := WithCertificate(context.Background(), cert)
+
+		Convey("Checks should need the certificate", func() {
+			So(b.CertificateNeeded(), ShouldBeTrue)
+		})
+
+		Convey("The first rule that applies should give the username", func() {
+			username, ok := b.CertificateUsername(cert)
+			So(ok, ShouldBeTrue)
+			So(username, ShouldEqual, "sensor-1")
+
+			b.certRules, _ = parseCertRules("san_uri:^spiffe://example.com/(.+)$")
+			username, ok = b.CertificateUsername(cert)
+			So(ok, ShouldBeTrue)
+			So(username, ShouldEqual, "sensor")
+
+			b.certRules, _ = parseCertRules(`san_email:^(.+)@other\.com$`)
+			_, ok = b.CertificateUsername(cert)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Clients with a certificate should log in without a password", func() {
+			ctx, decision := WithDecision(ctx)
+
+			granted, err := b.AuthUnpwdCheck(ctx, "", "", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldEqual, "certificate")
+
+			granted, err = b.AuthUnpwdCheck(ctx, "sensor-1", "", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+		})
+
+		Convey("Usernames not matching the certificate identity should be rejected", func() {
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+		})
+
+		Convey("Logins with a password should still be checked by the backends", func() {
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+
+			granted, err = b.AuthUnpwdCheck(ctx, "sensor-1", "wrong", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+		})
+
+		Convey("Clients without a certificate should need a password", func() {
+			granted, err := b.AuthUnpwdCheck(context.Background(), "sensor-1", "", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+		})
+
+		Convey("Acls should be able to refer to certificate fields", func() {
+			granted, err := b.AuthAclCheck(ctx, "clientid", "sensor-1", "cert/sensor-1", 1)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+
+			granted, err = b.AuthAclCheck(context.Background(), "clientid", "sensor-1", "cert/sensor-1", 1)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+		})
+	})
+
+	Convey("Checks should only need the certificate when certificate rules are in use", t, func() {
+		authOpts := make(map[string]string)
+
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+		aclPath, _ := filepath.Abs("../test-files/acls")
+
+		authOpts["backends"] = "files"
+		authOpts["files_password_path"] = pwPath
+		authOpts["files_acl_path"] = aclPath
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(b.CertificateNeeded(), ShouldBeFalse)
+		b.Halt()
+
+		authOpts["cert_placeholders"] = "true"
+
+		b, err = Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(b.CertificateNeeded(), ShouldBeTrue)
+		So(b.CertificateAuth(), ShouldBeFalse)
+		b.Halt()
+	})
+}
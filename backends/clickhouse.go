@@ -1,10 +1,11 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"strconv"
-	"strings"
 
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/jmoiron/sqlx"
@@ -21,10 +22,18 @@ type Clickhouse struct {
 	UserQuery	string
 	SuperuserQuery	string
 	AclQuery	string
+	PskQuery	string
+	NetworkQuery	string
     
 	connectTries int
 }
 
+func init() {
+	Register(clickhouseBackend, "clickhouse", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewClickhouse(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 func NewClickhouse(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (Clickhouse, error) {
 
 	log.SetLevel(logLevel)
@@ -61,6 +70,14 @@ func NewClickhouse(authOpts map[string]string, logLevel log.Level, hasher hashin
 		ch.AclQuery = aclQuery
 	}
 
+	if pskQuery, ok := authOpts["clickhouse_pskquery"]; ok {
+		ch.PskQuery = pskQuery
+	}
+
+	if networkQuery, ok := authOpts["clickhouse_networkquery"]; ok {
+		ch.NetworkQuery = networkQuery
+	}
+
 	//Exit if any mandatory option is missing.
 	if !chOk {
 		return ch, errors.Errorf("Clickhouse backend error: missing options: %s", missingOptions)
@@ -89,9 +106,14 @@ func NewClickhouse(authOpts map[string]string, logLevel log.Level, hasher hashin
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Clickhouse) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding its queries.
+func (o Clickhouse) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
 
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -118,6 +140,11 @@ func (o Clickhouse) GetUser(username, password, clientid string) (bool, error) {
 
 //GetSuperuser checks that the username meets the superuser query.
 func (o Clickhouse) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding its queries.
+func (o Clickhouse) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
 
 	//If there's no superuser query, return false.
 	if o.SuperuserQuery == "" {
@@ -125,7 +152,7 @@ func (o Clickhouse) GetSuperuser(username string) (bool, error) {
 	}
 
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.DB.GetContext(ctx, &count, o.SuperuserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -152,6 +179,11 @@ func (o Clickhouse) GetSuperuser(username string) (bool, error) {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Clickhouse) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclContext(context.Background(), username, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding its queries.
+func (o Clickhouse) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
 
 	//If there's no acl query, assume all privileges for all users.
 	if o.AclQuery == "" {
@@ -160,7 +192,7 @@ func (o Clickhouse) CheckAcl(username, topic, clientid string, acc int32) (bool,
 
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.DB.SelectContext(ctx, &acls, o.AclQuery, username, acc)
 
 	if err != nil {
 		log.Debugf("PG check acl error: %s", err)
@@ -168,9 +200,8 @@ func (o Clickhouse) CheckAcl(username, topic, clientid string, acc int32) (bool,
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if topics.Match(aclTopic, topic) {
+		aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+		if ok && topics.Match(aclTopic, topic) {
 			return true, nil
 		}
 	}
@@ -179,6 +210,84 @@ func (o Clickhouse) CheckAcl(username, topic, clientid string, acc int32) (bool,
 
 }
 
+//Explain tells what the superuser query returned, or the row returned by the acl query that matched the topic.
+func (o Clickhouse) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	return explainQueries(ctx, o.DB, "clickhouse", o.SuperuserQuery, o.AclQuery, check, username, topic, clientid, acc)
+}
+
+//GetPskKey returns the hex encoded pre-shared key for the given identity using the psk query.
+func (o Clickhouse) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+
+	//If there's no psk query, there are no keys to look for.
+	if o.PskQuery == "" {
+		return "", nil
+	}
+
+	var key sql.NullString
+	err := o.DB.GetContext(ctx, &key, o.PskQuery, identity)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("Clickhouse get psk key error: %s", err)
+		return "", err
+	}
+
+	if !key.Valid {
+		log.Debugf("Clickhouse get psk key error: identity %s not found", identity)
+		return "", nil
+	}
+
+	return key.String, nil
+
+}
+
+//GetPasswordHash returns the stored password hash for the given user using the user query.
+func (o Clickhouse) GetPasswordHash(ctx context.Context, username string) (string, error) {
+
+	var pwHash sql.NullString
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("Clickhouse get password hash error: %s", err)
+		return "", err
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("Clickhouse get password hash error: user %s not found", username)
+		return "", nil
+	}
+
+	return pwHash.String, nil
+
+}
+
+//ChecksNetworks tells whether there's a network query to keep users to some networks.
+func (o Clickhouse) ChecksNetworks() bool {
+	return o.NetworkQuery != ""
+}
+
+//GetNetworkRules returns the networks the user may log in from using the network query.
+func (o Clickhouse) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	rules, err := queryNetworks(ctx, o.DB, "clickhouse", o.NetworkQuery, username)
+	if err != nil {
+		log.Debugf("Clickhouse get network rules error: %s", err)
+	}
+
+	return rules, err
+}
+
+//Ping checks that the database can be reached.
+func (o Clickhouse) Ping(ctx context.Context) error {
+	return o.DB.PingContext(ctx)
+}
+
 //GetName returns the backend's name
 func (o Clickhouse) GetName() string {
 	return "Clickhouse"
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"plugin"
 
+	"github.com/iegomez/mosquitto-go-auth/hashing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,6 +18,16 @@ type CustomPlugin struct {
 	halt         func()
 }
 
+func init() {
+	Register(pluginBackend, "plugin", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		custom, err := NewCustomPlugin(authOpts, logLevel)
+		if err != nil {
+			return nil, err
+		}
+		return NewLegacyBackend(custom), nil
+	}, Metadata{})
+}
+
 func NewCustomPlugin(authOpts map[string]string, logLevel log.Level) (*CustomPlugin, error) {
 	plug, err := plugin.Open(authOpts["plugin_path"])
 	if err != nil {
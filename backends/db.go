@@ -1,9 +1,13 @@
 package backends
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
 	"time"
 
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
+	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -43,3 +47,124 @@ func OpenDatabase(dsn, engine string, tries int) (*sqlx.DB, error) {
 
 	return db, nil
 }
+
+// explainQueries tells what the superuser query returned for superuser checks, and the row returned by the acl query
+// that matched the topic for acl checks, for backends configured with <prefix>_superquery and <prefix>_aclquery.
+func explainQueries(ctx context.Context, db *sqlx.DB, prefix, superuserQuery, aclQuery, check, username, topic, clientid string, acc int32) (string, error) {
+	switch check {
+	case superuserCheck:
+		if superuserQuery == "" {
+			return fmt.Sprintf("no %s_superquery, there are no superusers", prefix), nil
+		}
+
+		var count sql.NullInt64
+		err := db.GetContext(ctx, &count, superuserQuery, username)
+		if err == sql.ErrNoRows {
+			return fmt.Sprintf("%s_superquery returned no rows", prefix), nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if !count.Valid {
+			return fmt.Sprintf("%s_superquery returned NULL", prefix), nil
+		}
+
+		return fmt.Sprintf("%s_superquery returned %d", prefix, count.Int64), nil
+	case aclCheck:
+		if aclQuery == "" {
+			return fmt.Sprintf("no %s_aclquery, every topic is allowed", prefix), nil
+		}
+
+		var acls []string
+		if err := db.SelectContext(ctx, &acls, aclQuery, username, acc); err != nil {
+			return "", err
+		}
+
+		for i, acl := range acls {
+			aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+			if ok && topics.Match(aclTopic, topic) {
+				return fmt.Sprintf("row %d returned by %s_aclquery matches: %s", i+1, prefix, acl), nil
+			}
+		}
+
+		return fmt.Sprintf("none of the %d rows returned by %s_aclquery matches", len(acls), prefix), nil
+	}
+
+	return "", nil
+}
+
+// queryNetworks returns the network rules of username as returned by a <prefix>_networkquery, whose rows hold
+// the rule, allow or deny, and the CIDR range or single address it applies to, in that order.
+func queryNetworks(ctx context.Context, db *sqlx.DB, prefix, networkQuery, username string) ([]networks.Rules, error) {
+	if networkQuery == "" {
+		return nil, nil
+	}
+
+	rows, err := db.QueryContext(ctx, networkQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules networks.Rules
+	for rows.Next() {
+		var rule, cidr string
+		if err := rows.Scan(&rule, &cidr); err != nil {
+			return nil, err
+		}
+
+		if err := rules.Add(rule, cidr); err != nil {
+			return nil, fmt.Errorf("%s_networkquery returned an invalid rule for user %s: %s", prefix, username, err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return []networks.Rules{rules}, nil
+}
+
+// queryUserDeny denies username when a <prefix>_userdenyquery returns a row for it, whose only column tells why,
+// or is NULL when there's nothing to tell. It abstains when there's no such query or it returns no rows.
+func queryUserDeny(ctx context.Context, db *sqlx.DB, prefix, userDenyQuery, username string) (Result, error) {
+	if userDenyQuery == "" {
+		return Result{Verdict: Abstain}, nil
+	}
+
+	var reason sql.NullString
+	err := db.GetContext(ctx, &reason, userDenyQuery, username)
+	if err == sql.ErrNoRows {
+		return Result{Verdict: Abstain}, nil
+	} else if err != nil {
+		return Result{}, err
+	}
+
+	if !reason.Valid || reason.String == "" {
+		return denied(fmt.Sprintf("%s_userdenyquery returned a row", prefix)), nil
+	}
+
+	return denied(reason.String), nil
+}
+
+// queryAclDeny denies topics matching a row returned by a <prefix>_acldenyquery, which is given the username and acc
+// and may return topics with placeholders just like <prefix>_aclquery. It abstains when there's no such query or no row matches.
+func queryAclDeny(ctx context.Context, db *sqlx.DB, prefix, aclDenyQuery, username, topic, clientid string, acc int32) (Result, error) {
+	if aclDenyQuery == "" {
+		return Result{Verdict: Abstain}, nil
+	}
+
+	var acls []string
+	if err := db.SelectContext(ctx, &acls, aclDenyQuery, username, acc); err != nil {
+		return Result{}, err
+	}
+
+	for i, acl := range acls {
+		aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+		if ok && topics.Match(aclTopic, topic) {
+			return denied(fmt.Sprintf("row %d returned by %s_acldenyquery matches: %s", i+1, prefix, acl)), nil
+		}
+	}
+
+	return Result{Verdict: Abstain}, nil
+}
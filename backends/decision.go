@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"context"
+)
+
+type decisionKey struct{}
+
+type dryRunKey struct{}
+
+// Decision tells how a check was decided. Backends fill it in when the check's context carries one.
+type Decision struct {
+	// Backend is the backend whose answer alone decided the check: the one granting it, the one rejecting it
+	// with the all strategy or when it was the only one asked, and the one answering with first-match.
+	// It's empty when no single backend decided it, e.g. when every backend rejected it or with the quorum strategy.
+	Backend string
+	// Superuser is set when the acl check was granted because the user is a superuser.
+	Superuser bool
+	// Denied is set when Backend denied the check explicitly, and Reason is why, when it told.
+	Denied bool
+	Reason string
+	// Cached is set when the decision came from the cache instead of the backends.
+	Cached bool
+}
+
+// WithDecision returns a copy of ctx carrying a Decision to be filled in by the check it's used for.
+func WithDecision(ctx context.Context) (context.Context, *Decision) {
+	decision := &Decision{}
+	return context.WithValue(ctx, decisionKey{}, decision), decision
+}
+
+// DecisionFrom returns the Decision carried by ctx, or nil if there's none.
+func DecisionFrom(ctx context.Context) *Decision {
+	decision, _ := ctx.Value(decisionKey{}).(*Decision)
+	return decision
+}
+
+// decide records the backend that made the check's decision, if ctx carries a Decision.
+func decide(ctx context.Context, bename string, superuser bool) {
+	if decision := DecisionFrom(ctx); decision != nil {
+		decision.Backend = bename
+		decision.Superuser = superuser
+	}
+}
+
+// decideResult records the backend whose result decided a check other than a superuser one, along with whether
+// it denied the check explicitly and why, if ctx carries a Decision.
+func decideResult(ctx context.Context, bename string, result Result) {
+	if decision := DecisionFrom(ctx); decision != nil {
+		decision.Backend = bename
+		decision.Superuser = false
+		decision.Denied = result.Verdict == Deny
+		decision.Reason = result.Reason
+	}
+}
+
+// WithDryRun returns a copy of ctx marking the check it's used for as a dry run: backends are asked as usual,
+// but circuit breakers, the superuser error policy and metrics are left untouched.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// DryRunFrom tells whether ctx is that of a dry-run check.
+func DryRunFrom(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
@@ -0,0 +1,52 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDecision(t *testing.T) {
+	Convey("Given backends checking superusers, users and acls", t, func() {
+		b := &Backends{
+			backends: map[string]ContextBackend{
+				"slow":  NewLegacyBackend(slowBackend{}),
+				"flaky": NewLegacyBackend(&flakyBackend{}),
+			},
+			breakers:          make(map[string]*breaker),
+			timeouts:          make(map[string]time.Duration),
+			userCheckers:      []string{"flaky", "slow"},
+			superuserCheckers: []string{"slow"},
+			aclCheckers:       []string{"flaky"},
+		}
+
+		Convey("The backend granting a user should be recorded", func() {
+			ctx, decision := WithDecision(context.Background())
+
+			authenticated, err := b.AuthUnpwdCheck(ctx, "test2", "test2", "clientid")
+			So(authenticated, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(decision.Backend, ShouldEqual, "slow")
+			So(decision.Superuser, ShouldBeFalse)
+		})
+
+		Convey("Superusers should be recorded as such", func() {
+			ctx, decision := WithDecision(context.Background())
+
+			granted, err := b.AuthAclCheck(ctx, "clientid", "test1", "test/topic", 1)
+			So(granted, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(decision.Backend, ShouldEqual, "slow")
+			So(decision.Superuser, ShouldBeTrue)
+		})
+
+		Convey("Checks without a decision in their context should work as usual", func() {
+			authenticated, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+			So(authenticated, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(DecisionFrom(context.Background()), ShouldBeNil)
+		})
+	})
+}
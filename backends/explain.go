@@ -0,0 +1,94 @@
+package backends
+
+import (
+	"context"
+	"time"
+)
+
+// Explainer is implemented by backends that can tell which of their rules decided a check, such as the acl file
+// line or the database row that matched. check is "superuser" or "acl", and the other arguments are the check's.
+// Explain returns an empty string when there's nothing to tell beyond the check's result.
+type Explainer interface {
+	Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error)
+}
+
+type explanationKey struct{}
+
+// Explanation traces how a check was evaluated. Backends fill it in when the check's context carries one.
+type Explanation struct {
+	// Routes is set when checks may be routed to a single backend.
+	Routes bool
+	// Route tells the rule that routed the check to RouteBackend, e.g. the username's prefix, both empty when none
+	// matched and every backend was asked. Username is the one given to RouteBackend, which may have its prefix stripped.
+	Route        string
+	RouteBackend string
+	Username     string
+	// Steps holds every backend asked, in order.
+	Steps []Step
+}
+
+// Step is a backend asked during a check.
+type Step struct {
+	// Check is user, superuser or acl.
+	Check   string
+	Backend string
+	Granted bool
+	// Denied is set when the backend denied the check explicitly, and Reason is why, when it told.
+	Denied   bool
+	Reason   string
+	Err      error
+	Duration time.Duration
+	// Rule describes what decided the step when the backend implements Explainer, e.g. the acl file line that matched.
+	Rule string
+	// RuleErr is set when the backend failed to tell the rule.
+	RuleErr error
+}
+
+// WithExplanation returns a copy of ctx carrying an Explanation to be filled in by the checks it's used for.
+func WithExplanation(ctx context.Context) (context.Context, *Explanation) {
+	explanation := &Explanation{}
+	return context.WithValue(ctx, explanationKey{}, explanation), explanation
+}
+
+// ExplanationFrom returns the Explanation carried by ctx, or nil if there's none.
+func ExplanationFrom(ctx context.Context) *Explanation {
+	explanation, _ := ctx.Value(explanationKey{}).(*Explanation)
+	return explanation
+}
+
+// explainRoute records the routing result of a check, if ctx carries an Explanation.
+func explainRoute(ctx context.Context, bename, rule, username string) {
+	explanation := ExplanationFrom(ctx)
+	if explanation == nil {
+		return
+	}
+
+	explanation.Routes = true
+	explanation.Route = rule
+	explanation.RouteBackend = bename
+	explanation.Username = username
+}
+
+// explainStep records a backend asked for a check, along with the rule that decided it, if ctx carries an Explanation.
+func (b *Backends) explainStep(ctx context.Context, check, bename, username, topic, clientid string, acc int, result Result, err error, duration time.Duration) {
+	explanation := ExplanationFrom(ctx)
+	if explanation == nil {
+		return
+	}
+
+	step := Step{
+		Check:    check,
+		Backend:  bename,
+		Granted:  result.Verdict == Allow,
+		Denied:   result.Verdict == Deny,
+		Reason:   result.Reason,
+		Err:      err,
+		Duration: duration,
+	}
+
+	if explainer, ok := b.backends[bename].(Explainer); ok && err == nil && check != userCheck {
+		step.Rule, step.RuleErr = explainer.Explain(ctx, check, username, topic, clientid, int32(acc))
+	}
+
+	explanation.Steps = append(explanation.Steps, step)
+}
@@ -0,0 +1,112 @@
+package backends
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// ruleBackend has admin as its only superuser and grants topics under rules/, telling so when explaining.
+type ruleBackend struct{}
+
+func (o ruleBackend) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return false, nil
+}
+
+func (o ruleBackend) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return strings.HasSuffix(username, "admin"), nil
+}
+
+func (o ruleBackend) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return strings.HasPrefix(topic, "rules/"), nil
+}
+
+func (o ruleBackend) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	if check == superuserCheck {
+		return "admin is the only superuser", nil
+	}
+
+	if strings.HasPrefix(topic, "rules/") {
+		return "rule rules/# matches", nil
+	}
+
+	return "", nil
+}
+
+func (o ruleBackend) GetName() string {
+	return "Rule"
+}
+
+func (o ruleBackend) Halt() {}
+
+func TestExplanation(t *testing.T) {
+	Convey("Given backends checking superusers, users and acls", t, func() {
+		b := &Backends{
+			backends: map[string]ContextBackend{
+				"rule":  ruleBackend{},
+				"flaky": NewLegacyBackend(&flakyBackend{}),
+			},
+			breakers:          make(map[string]*breaker),
+			timeouts:          make(map[string]time.Duration),
+			userCheckers:      []string{"rule", "flaky"},
+			superuserCheckers: []string{"rule"},
+			aclCheckers:       []string{"flaky", "rule"},
+		}
+
+		Convey("Every backend asked should be recorded in order", func() {
+			ctx, explanation := WithExplanation(context.Background())
+
+			authenticated, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(authenticated, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(explanation.Routes, ShouldBeFalse)
+			So(explanation.Steps, ShouldHaveLength, 2)
+			So(explanation.Steps[0].Backend, ShouldEqual, "rule")
+			So(explanation.Steps[0].Granted, ShouldBeFalse)
+			So(explanation.Steps[1].Backend, ShouldEqual, "flaky")
+			So(explanation.Steps[1].Granted, ShouldBeTrue)
+		})
+
+		Convey("The rules told by backends should be recorded for superuser and acl checks", func() {
+			ctx, explanation := WithExplanation(context.Background())
+
+			granted, err := b.AuthAclCheck(ctx, "clientid", "test1", "rules/1", 1)
+			So(granted, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(explanation.Steps, ShouldHaveLength, 3)
+			So(explanation.Steps[0].Check, ShouldEqual, "superuser")
+			So(explanation.Steps[0].Rule, ShouldEqual, "admin is the only superuser")
+			So(explanation.Steps[1].Check, ShouldEqual, "acl")
+			So(explanation.Steps[1].Backend, ShouldEqual, "flaky")
+			So(explanation.Steps[1].Rule, ShouldBeEmpty)
+			So(explanation.Steps[2].Backend, ShouldEqual, "rule")
+			So(explanation.Steps[2].Rule, ShouldEqual, "rule rules/# matches")
+		})
+
+		Convey("Prefix routing should be recorded", func() {
+			b.routes = []route{{backend: "rule", prefixes: []string{"rule"}, separator: "_"}}
+
+			ctx, explanation := WithExplanation(context.Background())
+
+			granted, err := b.AuthAclCheck(ctx, "clientid", "rule_admin", "other/1", 1)
+			So(granted, ShouldBeTrue)
+			So(err, ShouldBeNil)
+			So(explanation.Routes, ShouldBeTrue)
+			So(explanation.Route, ShouldEqual, "prefix rule")
+			So(explanation.Username, ShouldEqual, "rule_admin")
+			So(explanation.RouteBackend, ShouldEqual, "rule")
+			So(explanation.Steps, ShouldHaveLength, 1)
+			So(explanation.Steps[0].Granted, ShouldBeTrue)
+
+			ctx, explanation = WithExplanation(context.Background())
+
+			_, err = b.AuthAclCheck(ctx, "clientid", "other_admin", "other/1", 1)
+			So(err, ShouldBeNil)
+			So(explanation.Routes, ShouldBeTrue)
+			So(explanation.RouteBackend, ShouldBeEmpty)
+		})
+	})
+}
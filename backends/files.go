@@ -1,9 +1,11 @@
 package backends
 
 import (
+	"context"
 	"strings"
 
 	"github.com/iegomez/mosquitto-go-auth/backends/files"
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +16,12 @@ type Files struct {
 	checker *files.Checker
 }
 
+func init() {
+	Register(filesBackend, "files", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewFiles(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 // NewFiles initializes a files backend.
 func NewFiles(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (*Files, error) {
 
@@ -38,11 +46,33 @@ func NewFiles(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 		return nil, err
 	}
 
+	if pskPath := authOpts["files_psk_path"]; pskPath != "" {
+		if err := checker.LoadPsks(pskPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if networksPath := authOpts["files_network_path"]; networksPath != "" {
+		if err := checker.LoadNetworks(networksPath); err != nil {
+			return nil, err
+		}
+	}
+
 	return &Files{
 		checker: checker,
 	}, nil
 }
 
+// ChecksNetworks tells whether a networks file was given.
+func (o *Files) ChecksNetworks() bool {
+	return o.checker.ChecksNetworks()
+}
+
+// GetNetworkRules returns the rules of the networks file that apply to username.
+func (o *Files) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	return o.checker.GetNetworkRules(username), nil
+}
+
 // GetUser checks that user exists and password is correct.
 func (o *Files) GetUser(username, password, clientid string) (bool, error) {
 	return o.checker.GetUser(username, password, clientid)
@@ -58,6 +88,66 @@ func (o *Files) CheckAcl(username, topic, clientid string, acc int32) (bool, err
 	return o.checker.CheckAcl(username, topic, clientid, acc)
 }
 
+// GetUserContext is GetUser, files are loaded in memory so there's nothing to cancel.
+func (o *Files) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return o.GetUser(username, password, clientid)
+}
+
+// GetSuperuserContext is GetSuperuser.
+func (o *Files) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return o.GetSuperuser(username)
+}
+
+// CheckAclContext is CheckAcl, files are loaded in memory so there's nothing to cancel.
+// Pattern acls may refer to the fields of the client certificate carried by ctx.
+func (o *Files) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return o.checker.CheckAclFields(username, topic, clientid, acc, CertificateFrom(ctx).Fields())
+}
+
+// UserDenied abstains, the passwords file can't deny users explicitly.
+func (o *Files) UserDenied(ctx context.Context, username string) (Result, error) {
+	return Result{Verdict: Abstain}, nil
+}
+
+// UserVerdict is GetUser, the passwords file can't deny users explicitly.
+func (o *Files) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+	return resultOf(o.GetUser(username, password, clientid))
+}
+
+// SuperuserVerdict abstains, there are no files superusers.
+func (o *Files) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return Result{Verdict: Abstain}, nil
+}
+
+// AclVerdict denies topics matching a deny line of the acl file, telling the line as the reason, and is CheckAclContext otherwise.
+func (o *Files) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+	fields := CertificateFrom(ctx).Fields()
+	if reason := o.checker.DenyingAcl(username, topic, clientid, acc, fields); reason != "" {
+		return denied(reason), nil
+	}
+
+	return resultOf(o.checker.CheckAclFields(username, topic, clientid, acc, fields))
+}
+
+// GetPskKey returns the hex key for the given identity from the psk file.
+func (o *Files) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+	return o.checker.GetPskKey(hint, identity)
+}
+
+// GetPasswordHash returns the stored password hash for the given user from the passwords file.
+func (o *Files) GetPasswordHash(ctx context.Context, username string) (string, error) {
+	return o.checker.GetPasswordHash(username)
+}
+
+// Explain tells the acl file line deciding acl checks. Files has no superusers, so there's nothing to tell about them.
+func (o *Files) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	if check != aclCheck {
+		return "", nil
+	}
+
+	return o.checker.ExplainAcl(username, topic, clientid, acc, CertificateFrom(ctx).Fields()), nil
+}
+
 // GetName returns the backend's name
 func (o *Files) GetName() string {
 	return "Files"
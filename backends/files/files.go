@@ -10,6 +10,7 @@ import (
 	"syscall"
 
 	. "github.com/iegomez/mosquitto-go-auth/backends/constants"
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/pkg/errors"
@@ -38,10 +39,12 @@ type staticFileUser struct {
 	aclRecords []aclRecord
 }
 
-// aclRecord holds a topic and access privileges.
+// aclRecord holds a topic and access privileges, along with the acl file line it was read from.
 type aclRecord struct {
 	topic string
 	acc   byte //None 0x00, Read 0x01, Write 0x02, ReadWrite: Read | Write : 0x03, Subscribe 0x04, Deny 0x11
+	line  int
+	text  string
 }
 
 // Checker holds paths to static files, list of file users and general (no user or pattern) acl records.
@@ -49,13 +52,20 @@ type Checker struct {
 	sync.Mutex
 	pwPath          string
 	aclPath         string
+	pskPath         string
+	networksPath    string
 	checkACLs       bool
 	checkUsers      bool
 	users           map[string]*staticFileUser //users keeps a registry of username/staticFileUser pairs, holding a user's password and Acl records.
 	aclRecords      []aclRecord
+	psks            map[string]string //psks keeps a registry of identity/hex key pairs read from the psk file.
+	globalNetworks  networks.Rules    //globalNetworks are the network rules every user of the networks file is held to.
+	userNetworks    map[string]networks.Rules
 	staticFilesOnly bool
 	hasher          hashing.HashComparer
 	signals         chan os.Signal
+	stop            chan struct{}
+	stopOnce        sync.Once
 }
 
 // NewCheckers initializes a static files checker.
@@ -69,9 +79,11 @@ func NewChecker(backends, passwordPath, aclPath string, logLevel log.Level, hash
 		checkACLs:       true,
 		users:           make(map[string]*staticFileUser),
 		aclRecords:      make([]aclRecord, 0),
+		psks:            make(map[string]string),
 		staticFilesOnly: true,
 		hasher:          hasher,
 		signals:         make(chan os.Signal, 1),
+		stop:            make(chan struct{}),
 		checkUsers:      true,
 	}
 
@@ -109,6 +121,9 @@ func (o *Checker) watchSignals() {
 				log.Debugln("[StaticFiles] got SIGHUP, reloading static files")
 				o.loadStaticFiles()
 			}
+		case <-o.stop:
+			signal.Stop(o.signals)
+			return
 		}
 	}
 }
@@ -135,6 +150,60 @@ func (o *Checker) loadStaticFiles() error {
 		log.Debugf("got %d lines from acl file", count)
 	}
 
+	if o.pskPath != "" {
+		count, err := o.readPsks()
+		if err != nil {
+			return errors.Errorf("read psks: %s", err)
+		}
+
+		log.Debugf("got %d identities from psk file", count)
+	}
+
+	if o.networksPath != "" {
+		count, err := o.readNetworks()
+		if err != nil {
+			return errors.Errorf("read networks: %s", err)
+		}
+
+		log.Debugf("got %d users from networks file", count)
+	}
+
+	return nil
+}
+
+// LoadPsks sets the path to a mosquitto style psk file (identity:hexkey lines) and reads it.
+// The file is read again along with the others on SIGHUP.
+func (o *Checker) LoadPsks(pskPath string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.pskPath = pskPath
+
+	count, err := o.readPsks()
+	if err != nil {
+		return errors.Errorf("read psks: %s", err)
+	}
+
+	log.Debugf("got %d identities from psk file", count)
+
+	return nil
+}
+
+// LoadNetworks sets the path to a network rules file and reads it. The file is read again along with the others on SIGHUP.
+// Its lines are either "allow cidr" or "deny cidr", those before any "user username" line applying to every user.
+func (o *Checker) LoadNetworks(networksPath string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	o.networksPath = networksPath
+
+	count, err := o.readNetworks()
+	if err != nil {
+		return errors.Errorf("read networks: %s", err)
+	}
+
+	log.Debugf("got %d users from networks file", count)
+
 	return nil
 }
 
@@ -161,7 +230,8 @@ func (o *Checker) readPasswords() (int, error) {
 			continue
 		}
 
-		lineArr := strings.Split(text, ":")
+		// Split only on the first colon since some hashes, e.g. SCRAM verifiers, contain colons.
+		lineArr := strings.SplitN(text, ":", 2)
 		if len(lineArr) != 2 {
 			log.Errorf("Read passwords error: line %d is not well formatted", index)
 			continue
@@ -186,6 +256,96 @@ func (o *Checker) readPasswords() (int, error) {
 
 }
 
+// readPsks reads the psk file and replaces known identities and keys. Returns amount of identities seen and possible error.
+func (o *Checker) readPsks() (int, error) {
+	file, err := os.Open(o.pskPath)
+	if err != nil {
+		return 0, fmt.Errorf("[StaticFiles] error: couldn't open psk file: %s", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	psks := make(map[string]string)
+
+	index := 0
+	for scanner.Scan() {
+		index++
+
+		text := scanner.Text()
+
+		if checkCommentOrEmpty(text) {
+			continue
+		}
+
+		lineArr := strings.Split(text, ":")
+		if len(lineArr) != 2 || lineArr[0] == "" || lineArr[1] == "" {
+			log.Errorf("Read psks error: line %d is not well formatted", index)
+			continue
+		}
+
+		psks[lineArr[0]] = strings.TrimSpace(lineArr[1])
+	}
+
+	o.psks = psks
+
+	return len(psks), nil
+}
+
+// readNetworks reads the networks file and replaces known network rules. Returns amount of users seen and possible error.
+// Malformed lines are errors, so that a broken file never lets users in from anywhere.
+func (o *Checker) readNetworks() (int, error) {
+	file, err := os.Open(o.networksPath)
+	if err != nil {
+		return 0, fmt.Errorf("[StaticFiles] error: couldn't open networks file: %s", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	var global networks.Rules
+	users := make(map[string]networks.Rules)
+	username := ""
+
+	index := 0
+	for scanner.Scan() {
+		index++
+
+		text := scanner.Text()
+
+		if checkCommentOrEmpty(text) {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return 0, fmt.Errorf("[StaticFiles] error: networks file line %d is not well formatted", index)
+		}
+
+		if fields[0] == "user" {
+			username = fields[1]
+			continue
+		}
+
+		if username == "" {
+			err = global.Add(fields[0], fields[1])
+		} else {
+			rules := users[username]
+			err = rules.Add(fields[0], fields[1])
+			users[username] = rules
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("[StaticFiles] error: networks file line %d: %s", index, err)
+		}
+	}
+
+	o.globalNetworks = global
+	o.userNetworks = users
+
+	return len(users), nil
+}
+
 // readAcls reads the Acl file and associates them to existing users. It omits any non existing users.
 func (o *Checker) readAcls() (int, error) {
 	linesCount := 0
@@ -249,6 +409,8 @@ func (o *Checker) readAcls() (int, error) {
 			var aclRecord = aclRecord{
 				topic: "",
 				acc:   MOSQ_ACL_NONE,
+				line:  index,
+				text:  line,
 			}
 
 			/*	If len is 2, then we assume ReadWrite privileges.
@@ -368,62 +530,109 @@ func (o *Checker) GetSuperuser(username string) (bool, error) {
 
 // CheckAcl checks that the topic may be read/written by the given user/clientid.
 func (o *Checker) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclFields(username, topic, clientid, acc, nil)
+}
+
+// CheckAclFields is CheckAcl with the fields %{name} placeholders of pattern topics are replaced by,
+// such as those of the client's certificate.
+func (o *Checker) CheckAclFields(username, topic, clientid string, acc int32, fields map[string]string) (bool, error) {
 	// If there are no acls and StaticFiles is the only backend, all access is allowed.
 	// If there are other backends, then we can't blindly grant access.
 	if !o.checkACLs {
 		return o.staticFilesOnly, nil
 	}
 
+	granted, _ := o.matchAcl(username, topic, clientid, acc, fields)
+
+	return granted, nil
+}
+
+// ExplainAcl describes the acl file line that decides CheckAclFields for the given user/topic/clientid/acc/fields.
+func (o *Checker) ExplainAcl(username, topic, clientid string, acc int32, fields map[string]string) string {
+	if !o.checkACLs {
+		if o.staticFilesOnly {
+			return "no acl file, every topic is allowed as files is the only backend"
+		}
+		return "no acl file"
+	}
+
+	granted, record := o.matchAcl(username, topic, clientid, acc, fields)
+	if record == nil {
+		return fmt.Sprintf("no line of acl file %s matches", o.aclPath)
+	}
+
+	verb := "denies"
+	if granted {
+		verb = "allows"
+	}
+
+	return fmt.Sprintf("acl file %s line %d %s: %s", o.aclPath, record.line, verb, record.text)
+}
+
+// DenyingAcl describes the deny line of the acl file matching the given user/topic/clientid/fields, if any,
+// returning an empty string when the check isn't denied explicitly.
+func (o *Checker) DenyingAcl(username, topic, clientid string, acc int32, fields map[string]string) string {
+	if !o.checkACLs {
+		return ""
+	}
+
+	_, record := o.matchAcl(username, topic, clientid, acc, fields)
+	if record == nil || record.acc != MOSQ_ACL_DENY {
+		return ""
+	}
+
+	return fmt.Sprintf("acl file %s line %d denies: %s", o.aclPath, record.line, record.text)
+}
+
+// matchAcl checks the topic against the user's acls and the general ones, returning the decision
+// and the record that made it, which is nil when no record matched.
+func (o *Checker) matchAcl(username, topic, clientid string, acc int32, fields map[string]string) (bool, *aclRecord) {
 	fileUser, ok := o.users[username]
 
 	// Check if the topic was explicitly denied and refuse to authorize if so.
 	if ok {
-		for _, aclRecord := range fileUser.aclRecords {
+		for i, aclRecord := range fileUser.aclRecords {
 			match := topics.Match(aclRecord.topic, topic)
 
 			if match {
 				if aclRecord.acc == MOSQ_ACL_DENY {
-					return false, nil
+					return false, &fileUser.aclRecords[i]
 				}
 			}
 		}
 	}
 
-	for _, aclRecord := range o.aclRecords {
-		aclTopic := strings.Replace(aclRecord.topic, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-
-		match := topics.Match(aclTopic, topic)
+	for i, aclRecord := range o.aclRecords {
+		aclTopic, replaced := topics.Replace(aclRecord.topic, username, clientid, fields)
+		match := replaced && topics.Match(aclTopic, topic)
 
 		if match {
 			if aclRecord.acc == MOSQ_ACL_DENY {
-				return false, nil
+				return false, &o.aclRecords[i]
 			}
 		}
 	}
 
 	// No denials, check against user's acls and common ones. If not authorized, check against pattern acls.
 	if ok {
-		for _, aclRecord := range fileUser.aclRecords {
+		for i, aclRecord := range fileUser.aclRecords {
 			match := topics.Match(aclRecord.topic, topic)
 
 			if match {
 				if acc == int32(aclRecord.acc) || int32(aclRecord.acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.acc) == MOSQ_ACL_READ || int32(aclRecord.acc) == MOSQ_ACL_SUBSCRIBE)) {
-					return true, nil
+					return true, &fileUser.aclRecords[i]
 				}
 			}
 		}
 	}
-	for _, aclRecord := range o.aclRecords {
-		// Replace all occurrences of %c for clientid and %u for username
-		aclTopic := strings.Replace(aclRecord.topic, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-
-		match := topics.Match(aclTopic, topic)
+	for i, aclRecord := range o.aclRecords {
+		// Replace all occurrences of %c for clientid, %u for username and %{name} for the named fields.
+		aclTopic, replaced := topics.Replace(aclRecord.topic, username, clientid, fields)
+		match := replaced && topics.Match(aclTopic, topic)
 
 		if match {
 			if acc == int32(aclRecord.acc) || int32(aclRecord.acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.acc) == MOSQ_ACL_READ || int32(aclRecord.acc) == MOSQ_ACL_SUBSCRIBE)) {
-				return true, nil
+				return true, &o.aclRecords[i]
 			}
 		}
 	}
@@ -432,7 +641,52 @@ func (o *Checker) CheckAcl(username, topic, clientid string, acc int32) (bool, e
 
 }
 
-// Halt does nothing for static files as there's no cleanup needed.
+// GetPskKey returns the hex encoded key for the given identity, or an empty string when the identity is unknown.
+func (o *Checker) GetPskKey(hint, identity string) (string, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.psks[identity], nil
+}
+
+// GetPasswordHash returns the stored password hash for the given user, or an empty string when the user is unknown.
+func (o *Checker) GetPasswordHash(username string) (string, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	fileUser, ok := o.users[username]
+	if !ok {
+		return "", nil
+	}
+
+	return fileUser.password, nil
+}
+
+// ChecksNetworks tells whether a networks file was loaded.
+func (o *Checker) ChecksNetworks() bool {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.networksPath != ""
+}
+
+// GetNetworkRules returns the global rules of the networks file along with those of the given user.
+func (o *Checker) GetNetworkRules(username string) []networks.Rules {
+	o.Lock()
+	defer o.Unlock()
+
+	return []networks.Rules{o.globalNetworks, o.userNetworks[username]}
+}
+
+// Halt stops the SIGHUP watcher.
 func (o *Checker) Halt() {
-	// NO-OP
+	// Failed initializations leave no checker behind.
+	if o == nil {
+		return
+	}
+
+	// Stop watching signals so a checker discarded on reload doesn't keep reloading files.
+	o.stopOnce.Do(func() {
+		close(o.stop)
+	})
 }
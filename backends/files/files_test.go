@@ -62,6 +62,7 @@ func TestFiles(t *testing.T) {
 
 			pattern read test/%u
 			pattern read test/%c
+			pattern read cert/%{cn}
 		*/
 
 		// passwords are the same as users,
@@ -300,10 +301,73 @@ func TestFiles(t *testing.T) {
 			So(tt1, ShouldBeTrue)
 		})
 
+		Convey("Given a topic that mentions a certificate field, acl check should pass only with that field", func() {
+			tt1, err1 := files.CheckAclFields(user1, "cert/sensor-1", clientID, 1, map[string]string{"cn": "sensor-1"})
+			So(err1, ShouldBeNil)
+			So(tt1, ShouldBeTrue)
+
+			tt2, err2 := files.CheckAclFields(user1, "cert/sensor-2", clientID, 1, map[string]string{"cn": "sensor-1"})
+			So(err2, ShouldBeNil)
+			So(tt2, ShouldBeFalse)
+
+			tt3, err3 := files.CheckAcl(user1, "cert/%{cn}", clientID, 1)
+			So(err3, ShouldBeNil)
+			So(tt3, ShouldBeFalse)
+		})
+
+		Convey("The acl line deciding a check should be explained", func() {
+			So(files.ExplainAcl(user1, "test/topic/1", clientID, 2, nil), ShouldEqual, fmt.Sprintf("acl file %s line 5 allows: topic write test/topic/1", aclPath))
+			So(files.ExplainAcl(user3, "test/denied", clientID, 1, nil), ShouldEqual, fmt.Sprintf("acl file %s line 14 denies: topic deny test/denied", aclPath))
+			So(files.ExplainAcl(user1, "test/test_client", clientID, 1, nil), ShouldEqual, fmt.Sprintf("acl file %s line 25 allows: pattern read test/%%c", aclPath))
+			So(files.ExplainAcl(user1, "other/topic", clientID, 1, nil), ShouldEqual, fmt.Sprintf("no line of acl file %s matches", aclPath))
+		})
+
+		Convey("Deny lines matching a check should be told apart", func() {
+			So(files.DenyingAcl(user3, "test/denied", clientID, 1, nil), ShouldEqual, fmt.Sprintf("acl file %s line 14 denies: topic deny test/denied", aclPath))
+			So(files.DenyingAcl(user1, "test/general_denied", clientID, 1, nil), ShouldEqual, fmt.Sprintf("acl file %s line 2 denies: topic deny test/general_denied", aclPath))
+			So(files.DenyingAcl(user1, "test/topic/1", clientID, 2, nil), ShouldBeEmpty)
+			So(files.DenyingAcl(user1, "other/topic", clientID, 1, nil), ShouldBeEmpty)
+		})
+
 		//Halt files
 		files.Halt()
 	})
 
+	Convey("Given a SCRAM verifier in the passwords file the checker should return it and authenticate with it", t, func() {
+		pwFile, err := os.Create("test-files/test-scram-passwords")
+		So(err, ShouldBeNil)
+
+		pwPath, err := filepath.Abs("test-files/test-scram-passwords")
+		So(err, ShouldBeNil)
+
+		defer os.Remove(pwPath)
+
+		hasher := hashing.NewHasher(map[string]string{"hasher": hashing.ScramOpt}, "")
+
+		verifier, err := hasher.Hash("scram-password")
+		So(err, ShouldBeNil)
+
+		pwFile.WriteString(fmt.Sprintf("scram-user:%s\n", verifier))
+		pwFile.Sync()
+
+		files, err := NewChecker("files", pwPath, "", log.DebugLevel, hasher)
+		So(err, ShouldBeNil)
+
+		passwordHash, err := files.GetPasswordHash("scram-user")
+		So(err, ShouldBeNil)
+		So(passwordHash, ShouldEqual, verifier)
+
+		passwordHash, err = files.GetPasswordHash("unknown")
+		So(err, ShouldBeNil)
+		So(passwordHash, ShouldEqual, "")
+
+		authenticated, err := files.GetUser("scram-user", "scram-password", "")
+		So(err, ShouldBeNil)
+		So(authenticated, ShouldBeTrue)
+
+		files.Halt()
+	})
+
 	Convey("On SIGHUP files should be reloaded", t, func() {
 		pwFile, err := os.Create("test-files/test-passwords")
 		So(err, ShouldBeNil)
@@ -369,4 +433,48 @@ func TestFiles(t *testing.T) {
 		So(record.acc, ShouldEqual, MOSQ_ACL_WRITE)
 		So(record.topic, ShouldEqual, "test/#")
 	})
+
+	Convey("On SIGHUP the networks file should be reloaded, keeping the previous rules when it's malformed", t, func() {
+		networksFile, err := os.Create("test-files/test-networks")
+		So(err, ShouldBeNil)
+
+		networksPath, err := filepath.Abs("test-files/test-networks")
+		So(err, ShouldBeNil)
+
+		defer os.Remove(networksPath)
+
+		networksFile.WriteString("user test1\nallow 10.0.0.0/8\n")
+		networksFile.Sync()
+
+		files, err := NewChecker("files", "", "", log.DebugLevel, hashing.NewHasher(authOpts, "files"))
+		So(err, ShouldBeNil)
+		defer files.Halt()
+
+		So(files.ChecksNetworks(), ShouldBeFalse)
+		So(files.LoadNetworks(networksPath), ShouldBeNil)
+		So(files.ChecksNetworks(), ShouldBeTrue)
+
+		rules := files.GetNetworkRules("test1")
+		So(rules[1].Allows("10.1.1.1"), ShouldBeTrue)
+		So(rules[1].Allows("192.168.1.1"), ShouldBeFalse)
+
+		networksFile.WriteString("deny 10.1.0.0/16\n")
+		networksFile.Sync()
+
+		files.signals <- syscall.SIGHUP
+		time.Sleep(200 * time.Millisecond)
+
+		rules = files.GetNetworkRules("test1")
+		So(rules[1].Allows("10.1.1.1"), ShouldBeFalse)
+
+		networksFile.WriteString("allow everywhere\n")
+		networksFile.Sync()
+
+		files.signals <- syscall.SIGHUP
+		time.Sleep(200 * time.Millisecond)
+
+		rules = files.GetNetworkRules("test1")
+		So(rules[1].Allows("10.1.1.1"), ShouldBeFalse)
+		So(rules[1].Allows("10.2.1.1"), ShouldBeTrue)
+	})
 }
@@ -1,6 +1,9 @@
 package backends
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -99,4 +102,81 @@ func TestFilesBackend(t *testing.T) {
 		So(err, ShouldBeNil)
 		So(granted, ShouldBeTrue)
 	})
+
+	Convey("When a psk path is given, keys should be returned for known identities", t, func() {
+		pskPath, err := filepath.Abs("../test-files/psk")
+		So(err, ShouldBeNil)
+
+		authOpts["backends"] = "files"
+		authOpts["files_register"] = "user"
+		authOpts["files_psk_path"] = pskPath
+		authOpts["files_password_path"], err = filepath.Abs("../test-files/passwords")
+		So(err, ShouldBeNil)
+
+		f, err := NewFiles(authOpts, logLevel, hasher)
+		So(err, ShouldBeNil)
+
+		key, err := f.GetPskKey(context.Background(), "hint", "device1")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "0123456789abcdef")
+
+		key, err = f.GetPskKey(context.Background(), "hint", "device2")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "deadbeef")
+
+		key, err = f.GetPskKey(context.Background(), "hint", "unknown")
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "")
+
+		Convey("A missing psk file should make NewFiles fail", func() {
+			authOpts["files_psk_path"] = "../test-files/missing-psk"
+
+			_, err := NewFiles(authOpts, logLevel, hasher)
+			So(err, ShouldNotBeNil)
+		})
+
+		delete(authOpts, "files_psk_path")
+	})
+
+	Convey("When a networks path is given, network rules should be returned for every user", t, func() {
+		networksPath, err := filepath.Abs("../test-files/networks")
+		So(err, ShouldBeNil)
+
+		authOpts["backends"] = "files"
+		authOpts["files_register"] = "user"
+		authOpts["files_network_path"] = networksPath
+		authOpts["files_password_path"], err = filepath.Abs("../test-files/passwords")
+		So(err, ShouldBeNil)
+
+		f, err := NewFiles(authOpts, logLevel, hasher)
+		So(err, ShouldBeNil)
+		So(f.ChecksNetworks(), ShouldBeTrue)
+
+		rules, err := f.GetNetworkRules(context.Background(), "test1")
+		So(err, ShouldBeNil)
+		So(rules, ShouldHaveLength, 2)
+		So(rules[0].Allows("192.168.100.1"), ShouldBeFalse)
+		So(rules[1].Allows("10.2.0.1"), ShouldBeTrue)
+		So(rules[1].Allows("2001:db8::1"), ShouldBeTrue)
+		So(rules[1].Allows("10.1.0.1"), ShouldBeFalse)
+		So(rules[1].Allows("172.16.0.10"), ShouldBeFalse)
+
+		rules, err = f.GetNetworkRules(context.Background(), "test3")
+		So(err, ShouldBeNil)
+		So(rules[0].Allows("192.168.100.1"), ShouldBeFalse)
+		So(rules[1].Empty(), ShouldBeTrue)
+
+		Convey("A malformed networks file should make NewFiles fail", func() {
+			badPath := filepath.Join(os.TempDir(), "mosquitto-go-auth-networks")
+			So(ioutil.WriteFile(badPath, []byte("user test1\nallow datacenter\n"), 0600), ShouldBeNil)
+			defer os.Remove(badPath)
+
+			authOpts["files_network_path"] = badPath
+
+			_, err := NewFiles(authOpts, logLevel, hasher)
+			So(err, ShouldNotBeNil)
+		})
+
+		delete(authOpts, "files_network_path")
+	})
 }
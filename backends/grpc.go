@@ -10,10 +10,14 @@ import (
 	"github.com/golang/protobuf/ptypes/empty"
 	grpc_logrus "github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus"
 	gs "github.com/iegomez/mosquitto-go-auth/grpc"
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	"github.com/iegomez/mosquitto-go-auth/tracing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
 // GRPC holds a client for the service and implements the Backend interface.
@@ -23,6 +27,12 @@ type GRPC struct {
 	disableSuperuser bool
 }
 
+func init() {
+	Register(grpcBackend, "grpc", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewGRPC(authOpts, logLevel)
+	}, Metadata{})
+}
+
 // NewGRPC tries to connect to the gRPC service at the given host.
 func NewGRPC(authOpts map[string]string, logLevel log.Level) (GRPC, error) {
 	var g GRPC
@@ -53,64 +63,144 @@ func NewGRPC(authOpts map[string]string, logLevel log.Level) (GRPC, error) {
 
 // GetUser checks that the username exists and the given password hashes to the same password.
 func (o GRPC) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+// GetUserContext is GetUser with ctx bounding the call.
+func (o GRPC) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return allowed(o.UserVerdict(ctx, username, password, clientid))
+}
+
+// UserVerdict is GetUserContext telling apart users the service denies explicitly.
+func (o GRPC) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
 
 	req := gs.GetUserRequest{
 		Username: username,
 		Password: password,
 		Clientid: clientid,
+		Ip:       AddressFrom(ctx),
 	}
 
-	resp, err := o.client.GetUser(context.Background(), &req)
+	resp, err := o.client.GetUser(ctx, &req)
 
 	if err != nil {
 		log.Errorf("grpc get user error: %s", err)
-		return false, err
+		return Result{}, err
 	}
 
-	return resp.Ok, nil
+	return verdictOf(resp), nil
 
 }
 
 // GetSuperuser checks that the user is a superuser.
 func (o GRPC) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+// GetSuperuserContext is GetSuperuser with ctx bounding the call.
+func (o GRPC) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return allowed(o.SuperuserVerdict(ctx, username))
+}
+
+// SuperuserVerdict is GetSuperuserContext telling apart superusers the service denies explicitly.
+func (o GRPC) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
 
 	if o.disableSuperuser {
-		return false, nil
+		return Result{Verdict: Abstain}, nil
 	}
 
 	req := gs.GetSuperuserRequest{
 		Username: username,
 	}
 
-	resp, err := o.client.GetSuperuser(context.Background(), &req)
+	resp, err := o.client.GetSuperuser(ctx, &req)
 
 	if err != nil {
 		log.Errorf("grpc get superuser error: %s", err)
-		return false, err
+		return Result{}, err
 	}
 
-	return resp.Ok, nil
+	return verdictOf(resp), nil
 
 }
 
 // CheckAcl checks if the user has access to the given topic.
 func (o GRPC) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclMessage(context.Background(), username, topic, clientid, acc, nil)
+}
+
+// CheckAclContext is CheckAcl with ctx bounding the call.
+func (o GRPC) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclMessage(ctx, username, topic, clientid, acc, nil)
+}
+
+// CheckAclMessage checks if the user has access to the given topic, sending the message details along when they're known.
+func (o GRPC) CheckAclMessage(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (bool, error) {
+	return allowed(o.AclVerdict(ctx, username, topic, clientid, acc, msg))
+}
+
+// AclVerdict is CheckAclMessage telling apart topics the service denies explicitly.
+func (o GRPC) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
 
 	req := gs.CheckAclRequest{
 		Username: username,
 		Topic:    topic,
 		Clientid: clientid,
 		Acc:      acc,
+		Ip:       AddressFrom(ctx),
+	}
+
+	if msg != nil {
+		req.Payloadlen = msg.PayloadLen
+		req.Qos = msg.Qos
+		req.Retain = msg.Retain
 	}
 
-	resp, err := o.client.CheckAcl(context.Background(), &req)
+	resp, err := o.client.CheckAcl(ctx, &req)
 
 	if err != nil {
 		log.Errorf("grpc check acl error: %s", err)
-		return false, err
+		return Result{}, err
+	}
+
+	return verdictOf(resp), nil
+
+}
+
+// verdictOf reads the service's verdict from resp: deny rejects the check explicitly unless ok is set.
+func verdictOf(resp *gs.AuthResponse) Result {
+	if resp.Ok {
+		return Result{Verdict: Allow}
+	}
+
+	if resp.Deny {
+		return denied(resp.Reason)
+	}
+
+	return Result{Verdict: Abstain}
+}
+
+// GetPskKey asks the service for the hex encoded pre-shared key of the given identity.
+// Services that don't implement the call are treated as not knowing any identity.
+func (o GRPC) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+
+	req := gs.GetPskKeyRequest{
+		Hint:     hint,
+		Identity: identity,
+	}
+
+	resp, err := o.client.GetPskKey(ctx, &req)
+
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return "", nil
+		}
+
+		log.Errorf("grpc get psk key error: %s", err)
+		return "", err
 	}
 
-	return resp.Ok, nil
+	return resp.Key, nil
 
 }
 
@@ -139,8 +229,9 @@ func createClient(hostname string, caCert, tlsCert, tlsKey []byte) (*grpc.Client
 
 	nsOpts := []grpc.DialOption{
 		grpc.WithBlock(),
-		grpc.WithUnaryInterceptor(
+		grpc.WithChainUnaryInterceptor(
 			grpc_logrus.UnaryClientInterceptor(logrusEntry, logrusOpts...),
+			tracing.UnaryClientInterceptor(),
 		),
 	}
 
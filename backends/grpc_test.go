@@ -3,6 +3,7 @@ package backends
 import (
 	"context"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/golang/protobuf/ptypes/empty"
@@ -13,12 +14,15 @@ import (
 )
 
 const (
-	grpcUsername  string = "test_user"
-	grpcSuperuser string = "superuser"
-	grpcPassword  string = "test_password"
-	grpcTopic     string = "test/topic"
-	grpcAcc       int32  = 1
-	grpcClientId  string = "test_client"
+	grpcUsername    string = "test_user"
+	grpcSuperuser   string = "superuser"
+	grpcPassword    string = "test_password"
+	grpcTopic       string = "test/topic"
+	grpcDeniedTopic string = "test/denied"
+	grpcAcc         int32  = 1
+	grpcClientId    string = "test_client"
+	grpcIdentity    string = "test_identity"
+	grpcPskKey      string = "0123456789abcdef"
 )
 
 type AuthServiceAPI struct{}
@@ -28,7 +32,8 @@ func NewAuthServiceAPI() *AuthServiceAPI {
 }
 
 func (a *AuthServiceAPI) GetUser(ctx context.Context, req *gs.GetUserRequest) (*gs.AuthResponse, error) {
-	if req.Username == grpcUsername && req.Password == grpcPassword {
+	// Clients from the documentation range are rejected.
+	if req.Username == grpcUsername && req.Password == grpcPassword && !strings.HasPrefix(req.Ip, "192.0.2.") {
 		return &gs.AuthResponse{
 			Ok: true,
 		}, nil
@@ -50,16 +55,32 @@ func (a *AuthServiceAPI) GetSuperuser(ctx context.Context, req *gs.GetSuperuserR
 }
 
 func (a *AuthServiceAPI) CheckAcl(ctx context.Context, req *gs.CheckAclRequest) (*gs.AuthResponse, error) {
-	if req.Username == grpcUsername && req.Topic == grpcTopic && req.Clientid == grpcClientId && req.Acc == grpcAcc {
+	// Only QoS 0 messages are allowed.
+	if req.Username == grpcUsername && req.Topic == grpcTopic && req.Clientid == grpcClientId && req.Acc == grpcAcc && req.Qos == 0 {
 		return &gs.AuthResponse{
 			Ok: true,
 		}, nil
 	}
+	if req.Topic == grpcDeniedTopic {
+		return &gs.AuthResponse{
+			Deny:   true,
+			Reason: "Forbidden topic.",
+		}, nil
+	}
 	return &gs.AuthResponse{
 		Ok: false,
 	}, nil
 }
 
+func (a *AuthServiceAPI) GetPskKey(ctx context.Context, req *gs.GetPskKeyRequest) (*gs.PskKeyResponse, error) {
+	if req.Identity == grpcIdentity {
+		return &gs.PskKeyResponse{
+			Key: grpcPskKey,
+		}, nil
+	}
+	return &gs.PskKeyResponse{}, nil
+}
+
 func (a *AuthServiceAPI) GetName(ctx context.Context, req *empty.Empty) (*gs.NameResponse, error) {
 	return &gs.NameResponse{
 		Name: "MyGRPCBackend",
@@ -101,6 +122,12 @@ func TestGRPC(t *testing.T) {
 					So(err, ShouldBeNil)
 					c.So(auth, ShouldBeTrue)
 
+					Convey("the client's address should be sent to the service", func(c C) {
+						auth, err := g.GetUserContext(WithAddress(context.Background(), "192.0.2.1"), grpcUsername, grpcPassword, grpcClientId)
+						So(err, ShouldBeNil)
+						c.So(auth, ShouldBeFalse)
+					})
+
 					Convey("given a non superuser user the service should respond false", func(c C) {
 						auth, err = g.GetSuperuser(grpcUsername)
 						So(err, ShouldBeNil)
@@ -126,12 +153,42 @@ func TestGRPC(t *testing.T) {
 								So(err, ShouldBeNil)
 								So(auth, ShouldBeFalse)
 
+								Convey("a topic the service denies should be denied telling why", func(c C) {
+									result, err := g.AclVerdict(context.Background(), grpcUsername, grpcDeniedTopic, grpcClientId, grpcAcc, nil)
+									So(err, ShouldBeNil)
+									So(result, ShouldResemble, Result{Verdict: Deny, Reason: "Forbidden topic."})
+
+									result, err = g.AclVerdict(context.Background(), grpcUsername, "wrong/topic", grpcClientId, grpcAcc, nil)
+									So(err, ShouldBeNil)
+									So(result.Verdict, ShouldEqual, Abstain)
+								})
+
 								Convey("switching to a correct one should succedd", func(c C) {
 									auth, err = g.CheckAcl(grpcUsername, grpcTopic, grpcClientId, grpcAcc)
 									So(err, ShouldBeNil)
 									So(auth, ShouldBeTrue)
 
 								})
+
+								Convey("message details should be sent to the service", func(c C) {
+									auth, err = g.CheckAclMessage(context.Background(), grpcUsername, grpcTopic, grpcClientId, grpcAcc, &AclMessage{PayloadLen: 10, Qos: 0})
+									So(err, ShouldBeNil)
+									So(auth, ShouldBeTrue)
+
+									auth, err = g.CheckAclMessage(context.Background(), grpcUsername, grpcTopic, grpcClientId, grpcAcc, &AclMessage{PayloadLen: 10, Qos: 1})
+									So(err, ShouldBeNil)
+									So(auth, ShouldBeFalse)
+								})
+							})
+
+							Convey("the service should return the psk key for a known identity", func(c C) {
+								key, err := g.GetPskKey(context.Background(), "hint", grpcIdentity)
+								So(err, ShouldBeNil)
+								So(key, ShouldEqual, grpcPskKey)
+
+								key, err = g.GetPskKey(context.Background(), "hint", "unknown")
+								So(err, ShouldBeNil)
+								So(key, ShouldEqual, "")
 							})
 
 						})
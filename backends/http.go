@@ -2,6 +2,7 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -9,8 +10,11 @@ import (
 	h "net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	"github.com/iegomez/mosquitto-go-auth/tracing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
@@ -19,6 +23,7 @@ type HTTP struct {
 	UserUri      string
 	SuperuserUri string
 	AclUri       string
+	PskUri       string
 	Host         string
 	Port         string
 	WithTLS      bool
@@ -31,7 +36,15 @@ type HTTP struct {
 
 type HTTPResponse struct {
 	Ok    bool   `json:"ok"`
+	Deny  bool   `json:"deny"`
 	Error string `json:"error"`
+	Key   string `json:"key"`
+}
+
+func init() {
+	Register(httpBackend, "http", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewHTTP(authOpts, logLevel)
+	}, Metadata{})
 }
 
 func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
@@ -79,6 +92,10 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 		missingOpts += " http_aclcheck_uri"
 	}
 
+	if pskUri, ok := authOpts["http_psk_uri"]; ok {
+		http.PskUri = pskUri
+	}
+
 	if host, ok := authOpts["http_host"]; ok {
 		http.Host = host
 	} else {
@@ -123,10 +140,24 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 		http.Client.Transport = tr
 	}
 
+	// Trace requests and propagate the check's trace context to the auth service.
+	http.Client.Transport = tracing.NewTransport(http.Client.Transport)
+
 	return http, nil
 }
 
+// GetUser posts the credentials to the user uri.
 func (o HTTP) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+// GetUserContext is GetUser with ctx bounding the request.
+func (o HTTP) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return allowed(o.UserVerdict(ctx, username, password, clientid))
+}
+
+// UserVerdict is GetUserContext telling apart users the service denies explicitly, see httpRequest.
+func (o HTTP) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
 
 	var dataMap = map[string]interface{}{
 		"username": username,
@@ -140,14 +171,27 @@ func (o HTTP) GetUser(username, password, clientid string) (bool, error) {
 		"clientid": []string{clientid},
 	}
 
-	return o.httpRequest(o.UserUri, username, dataMap, urlValues)
+	addAddress(ctx, dataMap, urlValues)
+
+	return o.httpRequest(ctx, o.UserUri, username, dataMap, urlValues)
 
 }
 
+// GetSuperuser posts the username to the superuser uri, if any.
 func (o HTTP) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+// GetSuperuserContext is GetSuperuser with ctx bounding the request.
+func (o HTTP) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return allowed(o.SuperuserVerdict(ctx, username))
+}
+
+// SuperuserVerdict is GetSuperuserContext telling apart superusers the service denies explicitly, see httpRequest.
+func (o HTTP) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
 
 	if o.SuperuserUri == "" {
-		return false, nil
+		return Result{Verdict: Abstain}, nil
 	}
 
 	var dataMap = map[string]interface{}{
@@ -158,11 +202,27 @@ func (o HTTP) GetSuperuser(username string) (bool, error) {
 		"username": []string{username},
 	}
 
-	return o.httpRequest(o.SuperuserUri, username, dataMap, urlValues)
+	return o.httpRequest(ctx, o.SuperuserUri, username, dataMap, urlValues)
 
 }
 
+// CheckAcl posts the acl check to the acl uri.
 func (o HTTP) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclMessage(context.Background(), username, topic, clientid, acc, nil)
+}
+
+// CheckAclContext is CheckAcl with ctx bounding the request.
+func (o HTTP) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclMessage(ctx, username, topic, clientid, acc, nil)
+}
+
+// CheckAclMessage checks acls sending the message's payload length, qos and retain flag along when they're known.
+func (o HTTP) CheckAclMessage(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (bool, error) {
+	return allowed(o.AclVerdict(ctx, username, topic, clientid, acc, msg))
+}
+
+// AclVerdict is CheckAclMessage telling apart topics the service denies explicitly, see httpRequest.
+func (o HTTP) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
 
 	dataMap := map[string]interface{}{
 		"username": username,
@@ -178,76 +238,103 @@ func (o HTTP) CheckAcl(username, topic, clientid string, acc int32) (bool, error
 		"acc":      []string{strconv.Itoa(int(acc))},
 	}
 
-	return o.httpRequest(o.AclUri, username, dataMap, urlValues)
+	if msg != nil {
+		dataMap["payloadlen"] = msg.PayloadLen
+		dataMap["qos"] = msg.Qos
+		dataMap["retain"] = msg.Retain
 
-}
+		urlValues.Set("payloadlen", strconv.FormatInt(msg.PayloadLen, 10))
+		urlValues.Set("qos", strconv.Itoa(int(msg.Qos)))
+		urlValues.Set("retain", strconv.FormatBool(msg.Retain))
+	}
 
-func (o HTTP) httpRequest(uri, username string, dataMap map[string]interface{}, urlValues map[string][]string) (bool, error) {
+	addAddress(ctx, dataMap, urlValues)
 
-	// Don't do the request if the client is nil.
-	if o.Client == nil {
-		return false, errors.New("http client not initialized")
+	return o.httpRequest(ctx, o.AclUri, username, dataMap, urlValues)
+
+}
+
+// addAddress sends the client's IP address along as ip when it's known.
+func addAddress(ctx context.Context, dataMap map[string]interface{}, urlValues url.Values) {
+	if address := AddressFrom(ctx); address != "" {
+		dataMap["ip"] = address
+		urlValues.Set("ip", address)
 	}
+}
 
-	tlsStr := "http://"
+// GetPskKey asks the psk uri for the hex encoded key of the given identity.
+// In json mode the key is expected at the key field, otherwise the whole response body is taken as the key.
+func (o HTTP) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
 
-	if o.WithTLS {
-		tlsStr = "https://"
+	if o.PskUri == "" {
+		return "", nil
 	}
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, o.Host, uri)
-	if o.Port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, o.Host, o.Port, uri)
+	var dataMap = map[string]interface{}{
+		"hint":     hint,
+		"identity": identity,
 	}
 
-	var resp *h.Response
-	var err error
+	var urlValues = url.Values{
+		"hint":     []string{hint},
+		"identity": []string{identity},
+	}
 
-	if o.ParamsMode == "form" {
-		resp, err = o.Client.PostForm(fullUri, urlValues)
-	} else {
-		var dataJson []byte
-		dataJson, err = json.Marshal(dataMap)
+	statusCode, body, err := o.post(ctx, o.PskUri, dataMap, urlValues)
+	if err != nil {
+		return "", err
+	}
 
-		if err != nil {
-			log.Errorf("marshal error: %s", err)
-			return false, err
+	if statusCode < 200 || statusCode >= 300 {
+		log.Infof("error code: %d", statusCode)
+		if statusCode >= 500 {
+			return "", fmt.Errorf("error code: %d", statusCode)
 		}
+		return "", nil
+	}
 
-		contentReader := bytes.NewReader(dataJson)
-		var req *h.Request
-		req, err = h.NewRequest("POST", fullUri, contentReader)
+	if o.ResponseMode == "json" {
+		response := HTTPResponse{Ok: false, Error: "", Key: ""}
+		err := json.Unmarshal(body, &response)
 
 		if err != nil {
-			log.Errorf("req error: %s", err)
-			return false, err
+			log.Errorf("unmarshal error: %s", err)
+			return "", err
 		}
 
-		req.Header.Set("Content-Type", "application/json")
+		if !response.Ok {
+			log.Infof("api error: %s", response.Error)
+			return "", nil
+		}
 
-		resp, err = o.Client.Do(req)
+		return response.Key, nil
 	}
 
-	if err != nil {
-		log.Errorf("POST error: %s", err)
-		return false, err
-	}
+	return strings.TrimSpace(string(body)), nil
 
-	body, err := ioutil.ReadAll(resp.Body)
+}
+
+// httpRequest posts the check to uri and reads the service's verdict from the response.
+// A 403 status denies the check explicitly in every response mode, the response's body or, in json mode, its error field
+// telling why. In json mode a response with deny set and ok unset denies the check as well.
+func (o HTTP) httpRequest(ctx context.Context, uri, username string, dataMap map[string]interface{}, urlValues map[string][]string) (Result, error) {
 
+	statusCode, body, err := o.post(ctx, uri, dataMap, urlValues)
 	if err != nil {
-		log.Errorf("read error: %s", err)
-		return false, err
+		return Result{}, err
 	}
 
-	defer resp.Body.Close()
+	if statusCode == h.StatusForbidden {
+		log.Infof("http request denied for %s", username)
+		return denied(o.denyReason(body)), nil
+	}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		log.Infof("error code: %d", resp.StatusCode)
-		if resp.StatusCode >= 500 {
-			err = fmt.Errorf("error code: %d", resp.StatusCode)
+	if statusCode < 200 || statusCode >= 300 {
+		log.Infof("error code: %d", statusCode)
+		if statusCode >= 500 {
+			err = fmt.Errorf("error code: %d", statusCode)
 		}
-		return false, err
+		return Result{}, err
 	}
 
 	if o.ResponseMode == "text" {
@@ -255,29 +342,115 @@ func (o HTTP) httpRequest(uri, username string, dataMap map[string]interface{},
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
 			log.Infof("api error: %s", string(body))
-			return false, nil
+			return Result{Verdict: Abstain}, nil
 		}
 
 	} else if o.ResponseMode == "json" {
 
-		//For json response, we expect Ok and Error fields.
+		//For json response, we expect Ok, Deny and Error fields.
 		response := HTTPResponse{Ok: false, Error: ""}
 		err := json.Unmarshal(body, &response)
 
 		if err != nil {
 			log.Errorf("unmarshal error: %s", err)
-			return false, err
+			return Result{}, err
 		}
 
 		if !response.Ok {
 			log.Infof("api error: %s", response.Error)
-			return false, nil
+			if response.Deny {
+				return denied(response.Error), nil
+			}
+			return Result{Verdict: Abstain}, nil
 		}
 
 	}
 
 	log.Debugf("http request approved for %s", username)
-	return true, nil
+	return Result{Verdict: Allow}, nil
+
+}
+
+// denyReason reads why a check was denied from the body of a 403 response.
+func (o HTTP) denyReason(body []byte) string {
+	if o.ResponseMode == "json" {
+		response := HTTPResponse{}
+		if err := json.Unmarshal(body, &response); err == nil {
+			return response.Error
+		}
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+// post sends the params to the given uri as json or form values and returns the response's status code and body.
+func (o HTTP) post(ctx context.Context, uri string, dataMap map[string]interface{}, urlValues map[string][]string) (int, []byte, error) {
+
+	// Don't do the request if the client is nil.
+	if o.Client == nil {
+		return 0, nil, errors.New("http client not initialized")
+	}
+
+	tlsStr := "http://"
+
+	if o.WithTLS {
+		tlsStr = "https://"
+	}
+
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, o.Host, uri)
+	if o.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, o.Host, o.Port, uri)
+	}
+
+	var req *h.Request
+	var err error
+
+	if o.ParamsMode == "form" {
+		req, err = h.NewRequest("POST", fullUri, strings.NewReader(url.Values(urlValues).Encode()))
+
+		if err != nil {
+			log.Errorf("req error: %s", err)
+			return 0, nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		var dataJson []byte
+		dataJson, err = json.Marshal(dataMap)
+
+		if err != nil {
+			log.Errorf("marshal error: %s", err)
+			return 0, nil, err
+		}
+
+		contentReader := bytes.NewReader(dataJson)
+		req, err = h.NewRequest("POST", fullUri, contentReader)
+
+		if err != nil {
+			log.Errorf("req error: %s", err)
+			return 0, nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// The client's timeout still applies, ctx may only cut the request shorter.
+	resp, err := o.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Errorf("POST error: %s", err)
+		return 0, nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		log.Errorf("read error: %s", err)
+		return 0, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return resp.StatusCode, body, nil
 
 }
 
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -21,6 +22,8 @@ func TestHTTPAllJsonServer(t *testing.T) {
 	topic := "test/topic"
 	var acc = int64(1)
 	clientId := "test_client"
+	identity := "test_identity"
+	pskKey := "0123456789abcdef"
 
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -48,9 +51,15 @@ func TestHTTPAllJsonServer(t *testing.T) {
 		log.Debugf("received params %v for path %s", params, r.URL.Path)
 
 		if r.URL.Path == "/user" {
-			if params["username"].(string) == username && params["password"].(string) == password {
+			// The client's address is only sent when known: reject the documentation range.
+			ip, _ := params["ip"].(string)
+			if params["username"].(string) == username && params["password"].(string) == password && !strings.HasPrefix(ip, "192.0.2.") {
 				httpResponse.Ok = true
 				httpResponse.Error = ""
+			} else if params["username"].(string) == "banned_user" {
+				httpResponse.Ok = false
+				httpResponse.Deny = true
+				httpResponse.Error = "Banned."
 			} else {
 				httpResponse.Ok = false
 				httpResponse.Error = "Wrong credentials."
@@ -65,13 +74,25 @@ func TestHTTPAllJsonServer(t *testing.T) {
 			}
 		} else if r.URL.Path == "/acl" {
 			paramsAcc := int64(params["acc"].(float64))
-			if params["username"].(string) == username && params["topic"].(string) == topic && params["clientid"].(string) == clientId && paramsAcc <= acc {
+			// Message details are only sent when known: deny retained messages and payloads over 4 KiB.
+			retained, _ := params["retain"].(bool)
+			payloadLen, _ := params["payloadlen"].(float64)
+			if params["username"].(string) == username && params["topic"].(string) == topic && params["clientid"].(string) == clientId && paramsAcc <= acc && !retained && payloadLen <= 4096 {
 				httpResponse.Ok = true
 				httpResponse.Error = ""
 			} else {
 				httpResponse.Ok = false
 				httpResponse.Error = "Acl check failed."
 			}
+		} else if r.URL.Path == "/psk" {
+			if params["identity"].(string) == identity {
+				httpResponse.Ok = true
+				httpResponse.Error = ""
+				httpResponse.Key = pskKey
+			} else {
+				httpResponse.Ok = false
+				httpResponse.Error = "Unknown identity."
+			}
 		}
 
 		jsonResponse, err := json.Marshal(httpResponse)
@@ -95,6 +116,7 @@ func TestHTTPAllJsonServer(t *testing.T) {
 	authOpts["http_getuser_uri"] = "/user"
 	authOpts["http_superuser_uri"] = "/superuser"
 	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_psk_uri"] = "/psk"
 	authOpts["http_timeout"] = "5"
 
 	Convey("Given correct options an http backend instance should be returned", t, func() {
@@ -117,6 +139,34 @@ func TestHTTPAllJsonServer(t *testing.T) {
 
 		})
 
+		Convey("Given a user the service denies, the user verdict should deny it telling why", func() {
+
+			result, err := hb.UserVerdict(context.Background(), "banned_user", password, clientId)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "Banned."})
+
+			result, err = hb.UserVerdict(context.Background(), username, "wrong_password", clientId)
+			So(err, ShouldBeNil)
+			So(result.Verdict, ShouldEqual, Abstain)
+
+			authenticated, err := hb.GetUser("banned_user", password, clientId)
+			So(err, ShouldBeNil)
+			So(authenticated, ShouldBeFalse)
+
+		})
+
+		Convey("Given the client's address, it should be sent along with the user check", func() {
+
+			authenticated, err := hb.GetUserContext(WithAddress(context.Background(), "198.51.100.1"), username, password, clientId)
+			So(err, ShouldBeNil)
+			So(authenticated, ShouldBeTrue)
+
+			authenticated, err = hb.GetUserContext(WithAddress(context.Background(), "192.0.2.1"), username, password, clientId)
+			So(err, ShouldBeNil)
+			So(authenticated, ShouldBeFalse)
+
+		})
+
 		Convey("Given correct username, get superuser should return true", func() {
 
 			authenticated, err := hb.GetSuperuser(username)
@@ -172,6 +222,38 @@ func TestHTTPAllJsonServer(t *testing.T) {
 
 		})
 
+		Convey("Given message details, they should be sent along with the acl check", func() {
+
+			authenticated, err := hb.CheckAclMessage(context.Background(), username, topic, clientId, MOSQ_ACL_READ, &AclMessage{PayloadLen: 1024, Qos: 1})
+			So(err, ShouldBeNil)
+			So(authenticated, ShouldBeTrue)
+
+			authenticated, err = hb.CheckAclMessage(context.Background(), username, topic, clientId, MOSQ_ACL_READ, &AclMessage{PayloadLen: 1024, Qos: 1, Retain: true})
+			So(err, ShouldBeNil)
+			So(authenticated, ShouldBeFalse)
+
+			authenticated, err = hb.CheckAclMessage(context.Background(), username, topic, clientId, MOSQ_ACL_READ, &AclMessage{PayloadLen: 8192})
+			So(err, ShouldBeNil)
+			So(authenticated, ShouldBeFalse)
+
+		})
+
+		Convey("Given a known identity, get psk key should return its key", func() {
+
+			key, err := hb.GetPskKey(context.Background(), "hint", identity)
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, pskKey)
+
+		})
+
+		Convey("Given an unknown identity, get psk key should return an empty key", func() {
+
+			key, err := hb.GetPskKey(context.Background(), "hint", "unknown")
+			So(err, ShouldBeNil)
+			So(key, ShouldEqual, "")
+
+		})
+
 		hb.Halt()
 
 	})
@@ -206,6 +288,9 @@ func TestHTTPJsonStatusOnlyServer(t *testing.T) {
 		if r.URL.Path == "/user" {
 			if params["username"].(string) == username && params["password"].(string) == password {
 				w.WriteHeader(http.StatusOK)
+			} else if params["username"].(string) == "banned_user" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("Banned."))
 			} else {
 				w.WriteHeader(http.StatusNotFound)
 			}
@@ -260,6 +345,14 @@ func TestHTTPJsonStatusOnlyServer(t *testing.T) {
 
 		})
 
+		Convey("Given a forbidden status, the user verdict should deny the user telling the response body as the reason", func() {
+
+			result, err := hb.UserVerdict(context.Background(), "banned_user", password, clientId)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "Banned."})
+
+		})
+
 		Convey("Given correct username, get superuser should return true", func() {
 
 			authenticated, err := hb.GetSuperuser(username)
@@ -0,0 +1,92 @@
+package backends
+
+import (
+	"fmt"
+	"strings"
+)
+
+// splitName splits the name of a backend as given in the backends option into the registered backend it's an instance of
+// and the name of the instance, which is empty for unnamed ones, e.g. postgres:legacy is the legacy instance of postgres.
+func splitName(name string) (string, string) {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	return name, ""
+}
+
+// backendType returns the registered backend the named one is an instance of.
+func backendType(name string) string {
+	backend, _ := splitName(name)
+	return backend
+}
+
+// checkName returns an error if name isn't the one of a registered backend or of a named instance of one.
+// Instance names may only have letters, digits and underscores, as they're part of the options prefix.
+func checkName(name string) error {
+	backend, instance := splitName(name)
+	if _, ok := lookupBackend(backend); !ok {
+		return fmt.Errorf("unknown backend %s", name)
+	}
+
+	if !strings.Contains(name, ":") {
+		return nil
+	}
+
+	if instance == "" {
+		return fmt.Errorf("missing instance name in backend %s", name)
+	}
+
+	for _, r := range instance {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return fmt.Errorf("invalid instance name in backend %s: only letters, digits and underscores are allowed", name)
+		}
+	}
+
+	return nil
+}
+
+// OptsPrefix returns the prefix of the options of the named backend: the one it was registered with for unnamed
+// instances, e.g. pg for postgres, followed by the instance name for named ones, e.g. pg_legacy for postgres:legacy.
+// It returns an empty string for unknown backends.
+func OptsPrefix(name string) string {
+	backend, instance := splitName(name)
+	r, ok := lookupBackend(backend)
+	if !ok {
+		return ""
+	}
+
+	if instance == "" {
+		return r.prefix
+	}
+
+	return r.prefix + "_" + instance
+}
+
+// instanceOptions returns the options a backend instance is built from. Named instances get their own prefixed options
+// as the ones of their backend, e.g. pg_legacy_host as pg_host for postgres:legacy, in place of those given for the
+// backend, so that each instance only reads its own. Options without the backend's prefix are left as they are.
+func instanceOptions(authOpts map[string]string, name string) map[string]string {
+	backend, instance := splitName(name)
+	if instance == "" {
+		return authOpts
+	}
+
+	r, _ := lookupBackend(backend)
+	backendPrefix, prefix := r.prefix+"_", r.prefix+"_"+instance+"_"
+
+	opts := make(map[string]string, len(authOpts))
+	for key, value := range authOpts {
+		if !strings.HasPrefix(key, backendPrefix) {
+			opts[key] = value
+		}
+	}
+
+	for key, value := range authOpts {
+		if strings.HasPrefix(key, prefix) {
+			opts[backendPrefix+strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+
+	return opts
+}
@@ -0,0 +1,124 @@
+package backends
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInstances(t *testing.T) {
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+
+	Convey("Backend names should be split into the backend and the instance", t, func() {
+		backend, instance := splitName("postgres:legacy")
+		So(backend, ShouldEqual, postgresBackend)
+		So(instance, ShouldEqual, "legacy")
+
+		backend, instance = splitName("postgres")
+		So(backend, ShouldEqual, postgresBackend)
+		So(instance, ShouldBeEmpty)
+
+		So(OptsPrefix("postgres:legacy"), ShouldEqual, "pg_legacy")
+		So(OptsPrefix("postgres"), ShouldEqual, "pg")
+		So(OptsPrefix("ldap:legacy"), ShouldBeEmpty)
+	})
+
+	Convey("Invalid names should be rejected", t, func() {
+		So(checkName("files:users"), ShouldBeNil)
+		So(checkName("files:legacy_2"), ShouldBeNil)
+		So(checkName("ldap:users"), ShouldNotBeNil)
+		So(checkName("files:"), ShouldNotBeNil)
+		So(checkName("files:users-v2"), ShouldNotBeNil)
+
+		_, err := Initialize(map[string]string{"backends": "files, files:"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "missing instance name in backend files:")
+	})
+
+	Convey("Named instances should only get their own options, as the ones of their backend", t, func() {
+		authOpts := map[string]string{
+			"backends":            "postgres, postgres:legacy",
+			"hasher":              "bcrypt",
+			"pg_host":             "platform.local",
+			"pg_port":             "5432",
+			"pg_legacy_host":      "legacy.local",
+			"pg_legacy_hasher":    "pbkdf2",
+			"pg_platform_host":    "platform.local",
+			"redis_host":          "localhost",
+			"check_timeout":       "100",
+			"pg_legacy_userquery": "select password_hash from users where username = $1",
+		}
+
+		So(instanceOptions(authOpts, "postgres"), ShouldResemble, authOpts)
+		So(instanceOptions(authOpts, "postgres:legacy"), ShouldResemble, map[string]string{
+			"backends":      "postgres, postgres:legacy",
+			"hasher":        "bcrypt",
+			"pg_host":       "legacy.local",
+			"pg_hasher":     "pbkdf2",
+			"pg_userquery":  "select password_hash from users where username = $1",
+			"redis_host":    "localhost",
+			"check_timeout": "100",
+		})
+	})
+
+	Convey("Given two instances of the files backend", t, func() {
+		authOpts := map[string]string{
+			"backends":                  "files:users, files:acls",
+			"files_users_register":      "user",
+			"files_users_password_path": pwPath,
+			"files_acls_register":       "acl",
+			"files_acls_acl_path":       aclPath,
+			"files_acls_check_timeout":  "250",
+			"check_prefix":              "true",
+			"prefixes":                  "u, a",
+		}
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		Convey("Each should be registered for its own checks", func() {
+			checkers := b.Checkers()
+			So(checkers[userCheck], ShouldResemble, []string{"files:users"})
+			So(checkers[aclCheck], ShouldResemble, []string{"files:acls"})
+			So(checkers[superuserCheck], ShouldBeEmpty)
+		})
+
+		Convey("Each should get its own check options", func() {
+			So(b.timeouts, ShouldNotContainKey, "files:users")
+			So(b.timeouts["files:acls"], ShouldEqual, 250*time.Millisecond)
+		})
+
+		Convey("Checks should be decided by the instance", func() {
+			ctx, decision := WithDecision(context.Background())
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldEqual, "files:users")
+
+			ctx, decision = WithDecision(context.Background())
+			granted, err = b.AuthAclCheck(ctx, "clientid", "test1", "test/topic/1", 2)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldEqual, "files:acls")
+		})
+
+		Convey("Prefixes should route to instances", func() {
+			bename, username := b.lookupRoute(context.Background(), "u_test1", "clientid")
+			So(bename, ShouldEqual, "files:users")
+			So(username, ShouldEqual, "u_test1")
+
+			bename, _ = b.lookupRoute(context.Background(), "a_test1", "clientid")
+			So(bename, ShouldEqual, "files:acls")
+
+			granted, err := b.AuthUnpwdCheck(context.Background(), "a_test1", "test1", "clientid")
+			So(err, ShouldNotBeNil)
+			So(granted, ShouldBeFalse)
+		})
+	})
+}
@@ -1,10 +1,13 @@
 package backends
 
 import (
+	"context"
 	"strconv"
 
 	"github.com/iegomez/mosquitto-go-auth/backends/js"
+	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/pkg/errors"
+	"github.com/robertkrimen/otto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,6 +22,12 @@ type Javascript struct {
 	runner *js.Runner
 }
 
+func init() {
+	Register(jsBackend, "js", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewJavascript(authOpts, logLevel)
+	}, Metadata{})
+}
+
 func NewJavascript(authOpts map[string]string, logLevel log.Level) (*Javascript, error) {
 
 	log.SetLevel(logLevel)
@@ -96,47 +105,107 @@ func NewJavascript(authOpts map[string]string, logLevel log.Level) (*Javascript,
 }
 
 func (o *Javascript) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+func (o *Javascript) GetSuperuser(username string) (bool, error) {
+	return allowed(o.SuperuserVerdict(context.Background(), username))
+}
+
+func (o *Javascript) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclMessage(context.Background(), username, topic, clientid, acc, nil)
+}
+
+// GetUserContext runs the user script with ip set to the client's address as well, or null when it's unknown.
+// Scripts can't be cancelled, they're bounded by js_max_execution_ms instead.
+func (o *Javascript) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return allowed(o.UserVerdict(ctx, username, password, clientid))
+}
+
+// UserVerdict is GetUserContext telling apart users the script denies explicitly, see js.Runner.RunVerdict.
+func (o *Javascript) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
 	params := map[string]interface{}{
 		"username": username,
 		"password": password,
 		"clientid": clientid,
+		"ip":       addressParam(ctx),
 	}
 
-	granted, err := o.runner.RunScript(o.userScript, params)
-	if err != nil {
-		log.Errorf("js error: %s", err)
-	}
+	return o.run(o.userScript, params)
+}
 
-	return granted, err
+// GetSuperuserContext is GetSuperuser. Scripts are bounded by js_max_execution_ms.
+func (o *Javascript) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return o.GetSuperuser(username)
 }
 
-func (o *Javascript) GetSuperuser(username string) (bool, error) {
+// SuperuserVerdict runs the superuser script telling apart superusers it denies explicitly, see js.Runner.RunVerdict.
+func (o *Javascript) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
 	params := map[string]interface{}{
 		"username": username,
 	}
 
-	granted, err := o.runner.RunScript(o.superuserScript, params)
-	if err != nil {
-		log.Errorf("js error: %s", err)
-	}
+	return o.run(o.superuserScript, params)
+}
 
-	return granted, err
+// CheckAclContext is CheckAcl. Scripts are bounded by js_max_execution_ms.
+func (o *Javascript) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclMessage(ctx, username, topic, clientid, acc, nil)
 }
 
-func (o *Javascript) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+// CheckAclMessage runs the acl script with payloadlen, qos, retain and ip set as well, or null when they're unknown.
+func (o *Javascript) CheckAclMessage(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (bool, error) {
+	return allowed(o.AclVerdict(ctx, username, topic, clientid, acc, msg))
+}
+
+// AclVerdict is CheckAclMessage telling apart topics the script denies explicitly, see js.Runner.RunVerdict.
+func (o *Javascript) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
 	params := map[string]interface{}{
-		"username": username,
-		"topic":    topic,
-		"clientid": clientid,
-		"acc":      acc,
+		"username":   username,
+		"topic":      topic,
+		"clientid":   clientid,
+		"acc":        acc,
+		"payloadlen": otto.NullValue(),
+		"qos":        otto.NullValue(),
+		"retain":     otto.NullValue(),
+		"ip":         addressParam(ctx),
 	}
 
-	granted, err := o.runner.RunScript(o.aclScript, params)
+	if msg != nil {
+		params["payloadlen"] = msg.PayloadLen
+		params["qos"] = msg.Qos
+		params["retain"] = msg.Retain
+	}
+
+	return o.run(o.aclScript, params)
+}
+
+// run runs script with params, turning its verdict into a Result.
+func (o *Javascript) run(script string, params map[string]interface{}) (Result, error) {
+	verdict, err := o.runner.RunVerdict(script, params)
 	if err != nil {
 		log.Errorf("js error: %s", err)
+		return Result{}, err
+	}
+
+	if verdict.Granted {
+		return Result{Verdict: Allow}, nil
+	}
+
+	if verdict.Denied {
+		return denied(verdict.Reason), nil
+	}
+
+	return Result{Verdict: Abstain}, nil
+}
+
+// addressParam returns the client's address carried by ctx, or null when it's unknown.
+func addressParam(ctx context.Context) interface{} {
+	if address := AddressFrom(ctx); address != "" {
+		return address
 	}
 
-	return granted, err
+	return otto.NullValue()
 }
 
 //GetName returns the backend's name
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"testing"
 
 	log "github.com/sirupsen/logrus"
@@ -53,6 +54,30 @@ func TestJavascript(t *testing.T) {
 			So(userResponse, ShouldBeFalse)
 		})
 
+		Convey("User verdicts should tell apart users the script denies", func() {
+			result, err := javascript.UserVerdict(context.Background(), "banned", "good", "some-id")
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "banned user"})
+
+			result, err = javascript.UserVerdict(context.Background(), "wrong", "good", "some-id")
+			So(err, ShouldBeNil)
+			So(result.Verdict, ShouldEqual, Abstain)
+
+			userResponse, err := javascript.GetUser("banned", "good", "some-id")
+			So(err, ShouldBeNil)
+			So(userResponse, ShouldBeFalse)
+		})
+
+		Convey("User checks should get the client's address", func() {
+			userResponse, err := javascript.GetUserContext(WithAddress(context.Background(), "198.51.100.1"), "correct", "good", "some-id")
+			So(err, ShouldBeNil)
+			So(userResponse, ShouldBeTrue)
+
+			userResponse, err = javascript.GetUserContext(WithAddress(context.Background(), "192.0.2.1"), "correct", "good", "some-id")
+			So(err, ShouldBeNil)
+			So(userResponse, ShouldBeFalse)
+		})
+
 		Convey("Superuser checks should work", func() {
 			superuserResponse, err := javascript.GetSuperuser("admin")
 			So(err, ShouldBeNil)
@@ -84,5 +109,19 @@ func TestJavascript(t *testing.T) {
 			So(err, ShouldBeNil)
 			So(aclResponse, ShouldBeFalse)
 		})
+
+		Convey("ACL checks should get message details", func() {
+			aclResponse, err := javascript.CheckAclMessage(context.Background(), "correct", "test/topic", "id", 1, &AclMessage{PayloadLen: 10, Qos: 1})
+			So(err, ShouldBeNil)
+			So(aclResponse, ShouldBeTrue)
+
+			aclResponse, err = javascript.CheckAclMessage(context.Background(), "correct", "test/topic", "id", 1, &AclMessage{PayloadLen: 10, Qos: 2})
+			So(err, ShouldBeNil)
+			So(aclResponse, ShouldBeFalse)
+
+			aclResponse, err = javascript.CheckAclMessage(context.Background(), "correct", "test/topic", "id", 1, &AclMessage{PayloadLen: 10, Retain: true})
+			So(err, ShouldBeNil)
+			So(aclResponse, ShouldBeFalse)
+		})
 	})
 }
@@ -37,7 +37,71 @@ func LoadScript(path string) (string, error) {
 	return string(script), nil
 }
 
+// Verdict is a script's answer to a check.
+type Verdict struct {
+	Granted bool
+	Denied  bool
+	Reason  string
+}
+
 func (o *Runner) RunScript(script string, params map[string]interface{}) (granted bool, err error) {
+	val, err := o.run(script, params)
+	if err != nil {
+		return false, err
+	}
+
+	return val.ToBoolean()
+}
+
+// RunVerdict runs the script reading its verdict from the returned value. Scripts may return a boolean,
+// granting the check when true, or an object with ok, deny and reason fields: ok grants the check,
+// while deny rejects it explicitly when ok isn't set, with reason telling why.
+func (o *Runner) RunVerdict(script string, params map[string]interface{}) (Verdict, error) {
+	val, err := o.run(script, params)
+	if err != nil {
+		return Verdict{}, err
+	}
+
+	if !val.IsObject() {
+		granted, err := val.ToBoolean()
+		return Verdict{Granted: granted}, err
+	}
+
+	result := val.Object()
+
+	ok, err := result.Get("ok")
+	if err != nil {
+		return Verdict{}, err
+	}
+	if granted, err := ok.ToBoolean(); err != nil || granted {
+		return Verdict{Granted: granted}, err
+	}
+
+	deny, err := result.Get("deny")
+	if err != nil {
+		return Verdict{}, err
+	}
+	if denied, err := deny.ToBoolean(); err != nil || !denied {
+		return Verdict{}, err
+	}
+
+	verdict := Verdict{Denied: true}
+
+	reason, err := result.Get("reason")
+	if err != nil {
+		return Verdict{}, err
+	}
+	if reason.IsDefined() && !reason.IsNull() {
+		if verdict.Reason, err = reason.ToString(); err != nil {
+			return Verdict{}, err
+		}
+	}
+
+	return verdict, nil
+}
+
+// run runs the script with params set, returning the value it evaluates to.
+func (o *Runner) run(script string, params map[string]interface{}) (val otto.Value, err error) {
 	// The VM is not thread-safe, so we need to create a new VM on every run.
 	// TODO: This could be enhanced by having a pool of VMs.
 	vm := otto.New()
@@ -47,7 +111,7 @@ func (o *Runner) RunScript(script string, params map[string]interface{}) (grante
 	defer func() {
 		if caught := recover(); caught != nil {
 			if caught == Halt {
-				granted = false
+				val = otto.UndefinedValue()
 				err = Halt
 				return
 			}
@@ -66,15 +130,5 @@ func (o *Runner) RunScript(script string, params map[string]interface{}) (grante
 		vm.Set(k, v)
 	}
 
-	val, err := vm.Run(script)
-	if err != nil {
-		return false, err
-	}
-
-	granted, err = val.ToBoolean()
-	if err != nil {
-		return false, err
-	}
-
-	return
+	return vm.Run(script)
 }
@@ -1,6 +1,8 @@
 package backends
 
 import (
+	"context"
+
 	jwtGo "github.com/dgrijalva/jwt-go"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/pkg/errors"
@@ -21,9 +23,9 @@ type tokenOptions struct {
 }
 
 type jwtChecker interface {
-	GetUser(username string) (bool, error)
-	GetSuperuser(username string) (bool, error)
-	CheckAcl(username, topic, clientid string, acc int32) (bool, error)
+	GetUser(ctx context.Context, username string) (bool, error)
+	GetSuperuser(ctx context.Context, username string) (bool, error)
+	CheckAcl(ctx context.Context, username, topic, clientid string, acc int32) (bool, error)
 	Halt()
 }
 
@@ -42,6 +44,12 @@ const (
 	filesMode  = "files"
 )
 
+func init() {
+	Register(jwtBackend, "jwt", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewJWT(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 func NewJWT(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (*JWT, error) {
 	log.SetLevel(logLevel)
 
@@ -102,17 +110,32 @@ func NewJWT(authOpts map[string]string, logLevel log.Level, hasher hashing.HashC
 
 //GetUser authenticates a given user.
 func (o *JWT) GetUser(token, password, clientid string) (bool, error) {
-	return o.checker.GetUser(token)
+	return o.GetUserContext(context.Background(), token, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding the checker's requests.
+func (o *JWT) GetUserContext(ctx context.Context, token, password, clientid string) (bool, error) {
+	return o.checker.GetUser(ctx, token)
 }
 
 //GetSuperuser checks if the given user is a superuser.
 func (o *JWT) GetSuperuser(token string) (bool, error) {
-	return o.checker.GetSuperuser(token)
+	return o.GetSuperuserContext(context.Background(), token)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding the checker's requests.
+func (o *JWT) GetSuperuserContext(ctx context.Context, token string) (bool, error) {
+	return o.checker.GetSuperuser(ctx, token)
 }
 
 //CheckAcl checks user authorization.
 func (o *JWT) CheckAcl(token, topic, clientid string, acc int32) (bool, error) {
-	return o.checker.CheckAcl(token, topic, clientid, acc)
+	return o.CheckAclContext(context.Background(), token, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding the checker's requests.
+func (o *JWT) CheckAclContext(ctx context.Context, token, topic, clientid string, acc int32) (bool, error) {
+	return o.checker.CheckAcl(ctx, token, topic, clientid, acc)
 }
 
 //GetName returns the backend's name
@@ -1,6 +1,8 @@
 package backends
 
 import (
+	"context"
+
 	"github.com/iegomez/mosquitto-go-auth/backends/files"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/pkg/errors"
@@ -35,15 +37,15 @@ func NewFilesJWTChecker(authOpts map[string]string, logLevel log.Level, hasher h
 	}, nil
 }
 
-func (o *filesJWTChecker) GetUser(token string) (bool, error) {
+func (o *filesJWTChecker) GetUser(ctx context.Context, token string) (bool, error) {
 	return false, nil
 }
 
-func (o *filesJWTChecker) GetSuperuser(token string) (bool, error) {
+func (o *filesJWTChecker) GetSuperuser(ctx context.Context, token string) (bool, error) {
 	return false, nil
 }
 
-func (o *filesJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (bool, error) {
+func (o *filesJWTChecker) CheckAcl(ctx context.Context, token, topic, clientid string, acc int32) (bool, error) {
 	username, err := getUsernameForToken(o.options, token, o.options.skipACLExpiration)
 
 	if err != nil {
@@ -51,7 +53,7 @@ func (o *filesJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (bo
 		return false, err
 	}
 
-	return o.checker.CheckAcl(username, topic, clientid, acc)
+	return o.checker.CheckAclFields(username, topic, clientid, acc, CertificateFrom(ctx).Fields())
 }
 
 func (o *filesJWTChecker) Halt() {
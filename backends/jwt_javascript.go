@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"strconv"
 
 	"github.com/iegomez/mosquitto-go-auth/backends/js"
@@ -84,7 +85,7 @@ func NewJsJWTChecker(authOpts map[string]string, options tokenOptions) (jwtCheck
 	return checker, nil
 }
 
-func (o *jsJWTChecker) GetUser(token string) (bool, error) {
+func (o *jsJWTChecker) GetUser(ctx context.Context, token string) (bool, error) {
 	params := map[string]interface{}{
 		"token": token,
 	}
@@ -108,7 +109,7 @@ func (o *jsJWTChecker) GetUser(token string) (bool, error) {
 	return granted, err
 }
 
-func (o *jsJWTChecker) GetSuperuser(token string) (bool, error) {
+func (o *jsJWTChecker) GetSuperuser(ctx context.Context, token string) (bool, error) {
 	params := map[string]interface{}{
 		"token": token,
 	}
@@ -132,7 +133,7 @@ func (o *jsJWTChecker) GetSuperuser(token string) (bool, error) {
 	return granted, err
 }
 
-func (o *jsJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (bool, error) {
+func (o *jsJWTChecker) CheckAcl(ctx context.Context, token, topic, clientid string, acc int32) (bool, error) {
 	params := map[string]interface{}{
 		"token":    token,
 		"topic":    topic,
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"strings"
 
@@ -77,7 +78,7 @@ func NewLocalJWTChecker(authOpts map[string]string, logLevel log.Level, hasher h
 	return checker, nil
 }
 
-func (o *localJWTChecker) GetUser(token string) (bool, error) {
+func (o *localJWTChecker) GetUser(ctx context.Context, token string) (bool, error) {
 	username, err := getUsernameForToken(o.options, token, o.options.skipUserExpiration)
 
 	if err != nil {
@@ -85,10 +86,10 @@ func (o *localJWTChecker) GetUser(token string) (bool, error) {
 		return false, err
 	}
 
-	return o.getLocalUser(username)
+	return o.getLocalUser(ctx, username)
 }
 
-func (o *localJWTChecker) GetSuperuser(token string) (bool, error) {
+func (o *localJWTChecker) GetSuperuser(ctx context.Context, token string) (bool, error) {
 	username, err := getUsernameForToken(o.options, token, o.options.skipUserExpiration)
 
 	if err != nil {
@@ -97,13 +98,13 @@ func (o *localJWTChecker) GetSuperuser(token string) (bool, error) {
 	}
 
 	if o.db == mysqlDB {
-		return o.mysql.GetSuperuser(username)
+		return o.mysql.GetSuperuserContext(ctx, username)
 	}
 
-	return o.postgres.GetSuperuser(username)
+	return o.postgres.GetSuperuserContext(ctx, username)
 }
 
-func (o *localJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (bool, error) {
+func (o *localJWTChecker) CheckAcl(ctx context.Context, token, topic, clientid string, acc int32) (bool, error) {
 	username, err := getUsernameForToken(o.options, token, o.options.skipACLExpiration)
 
 	if err != nil {
@@ -112,10 +113,10 @@ func (o *localJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (bo
 	}
 
 	if o.db == mysqlDB {
-		return o.mysql.CheckAcl(username, topic, clientid, acc)
+		return o.mysql.CheckAclContext(ctx, username, topic, clientid, acc)
 	}
 
-	return o.postgres.CheckAcl(username, topic, clientid, acc)
+	return o.postgres.CheckAclContext(ctx, username, topic, clientid, acc)
 }
 
 func (o *localJWTChecker) Halt() {
@@ -132,7 +133,7 @@ func (o *localJWTChecker) Halt() {
 	}
 }
 
-func (o *localJWTChecker) getLocalUser(username string) (bool, error) {
+func (o *localJWTChecker) getLocalUser(ctx context.Context, username string) (bool, error) {
 	if o.userQuery == "" {
 		return false, nil
 	}
@@ -140,9 +141,9 @@ func (o *localJWTChecker) getLocalUser(username string) (bool, error) {
 	var count sql.NullInt64
 	var err error
 	if o.db == mysqlDB {
-		err = o.mysql.DB.Get(&count, o.userQuery, username)
+		err = o.mysql.DB.GetContext(ctx, &count, o.userQuery, username)
 	} else {
-		err = o.postgres.DB.Get(&count, o.userQuery, username)
+		err = o.postgres.DB.GetContext(ctx, &count, o.userQuery, username)
 	}
 
 	if err != nil {
@@ -2,6 +2,7 @@ package backends
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/iegomez/mosquitto-go-auth/tracing"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
@@ -115,10 +117,13 @@ func NewRemoteJWTChecker(authOpts map[string]string, options tokenOptions) (jwtC
 		checker.client.Transport = tr
 	}
 
+	// Trace requests and propagate the check's trace context to the auth service.
+	checker.client.Transport = tracing.NewTransport(checker.client.Transport)
+
 	return checker, nil
 }
 
-func (o *remoteJWTChecker) GetUser(token string) (bool, error) {
+func (o *remoteJWTChecker) GetUser(ctx context.Context, token string) (bool, error) {
 	var dataMap map[string]interface{}
 	var urlValues url.Values
 
@@ -139,10 +144,10 @@ func (o *remoteJWTChecker) GetUser(token string) (bool, error) {
 		}
 	}
 
-	return o.jwtRequest(o.host, o.userUri, token, dataMap, urlValues)
+	return o.jwtRequest(ctx, o.host, o.userUri, token, dataMap, urlValues)
 }
 
-func (o *remoteJWTChecker) GetSuperuser(token string) (bool, error) {
+func (o *remoteJWTChecker) GetSuperuser(ctx context.Context, token string) (bool, error) {
 	if o.superuserUri == "" {
 		return false, nil
 	}
@@ -166,10 +171,10 @@ func (o *remoteJWTChecker) GetSuperuser(token string) (bool, error) {
 		}
 	}
 
-	return o.jwtRequest(o.host, o.superuserUri, token, dataMap, urlValues)
+	return o.jwtRequest(ctx, o.host, o.superuserUri, token, dataMap, urlValues)
 }
 
-func (o *remoteJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (bool, error) {
+func (o *remoteJWTChecker) CheckAcl(ctx context.Context, token, topic, clientid string, acc int32) (bool, error) {
 	dataMap := map[string]interface{}{
 		"clientid": clientid,
 		"topic":    topic,
@@ -194,14 +199,14 @@ func (o *remoteJWTChecker) CheckAcl(token, topic, clientid string, acc int32) (b
 		urlValues.Add("username", username)
 	}
 
-	return o.jwtRequest(o.host, o.aclUri, token, dataMap, urlValues)
+	return o.jwtRequest(ctx, o.host, o.aclUri, token, dataMap, urlValues)
 }
 
 func (o *remoteJWTChecker) Halt() {
 	// NO-OP
 }
 
-func (o *remoteJWTChecker) jwtRequest(host, uri, token string, dataMap map[string]interface{}, urlValues url.Values) (bool, error) {
+func (o *remoteJWTChecker) jwtRequest(ctx context.Context, host, uri, token string, dataMap map[string]interface{}, urlValues url.Values) (bool, error) {
 
 	// Don't do the request if the client is nil.
 	if o.client == nil {
@@ -253,7 +258,7 @@ func (o *remoteJWTChecker) jwtRequest(host, uri, token string, dataMap map[strin
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	resp, err = o.client.Do(req)
+	resp, err = o.client.Do(req.WithContext(ctx))
 
 	if err != nil {
 		log.Errorf("error: %v", err)
@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -126,39 +127,39 @@ func TestJsJWTChecker(t *testing.T) {
 		checker, err := NewJsJWTChecker(authOpts, tkOptions)
 		So(err, ShouldBeNil)
 
-		userResponse, err := checker.GetUser("correct")
+		userResponse, err := checker.GetUser(context.Background(), "correct")
 		So(err, ShouldBeNil)
 		So(userResponse, ShouldBeTrue)
 
-		userResponse, err = checker.GetUser("bad")
+		userResponse, err = checker.GetUser(context.Background(), "bad")
 		So(err, ShouldBeNil)
 		So(userResponse, ShouldBeFalse)
 
-		superuserResponse, err := checker.GetSuperuser("admin")
+		superuserResponse, err := checker.GetSuperuser(context.Background(), "admin")
 		So(err, ShouldBeNil)
 		So(superuserResponse, ShouldBeTrue)
 
-		superuserResponse, err = checker.GetSuperuser("non-admin")
+		superuserResponse, err = checker.GetSuperuser(context.Background(), "non-admin")
 		So(err, ShouldBeNil)
 		So(superuserResponse, ShouldBeFalse)
 
-		aclResponse, err := checker.CheckAcl("correct", "test/topic", "id", 1)
+		aclResponse, err := checker.CheckAcl(context.Background(), "correct", "test/topic", "id", 1)
 		So(err, ShouldBeNil)
 		So(aclResponse, ShouldBeTrue)
 
-		aclResponse, err = checker.CheckAcl("incorrect", "test/topic", "id", 1)
+		aclResponse, err = checker.CheckAcl(context.Background(), "incorrect", "test/topic", "id", 1)
 		So(err, ShouldBeNil)
 		So(aclResponse, ShouldBeFalse)
 
-		aclResponse, err = checker.CheckAcl("correct", "bad/topic", "id", 1)
+		aclResponse, err = checker.CheckAcl(context.Background(), "correct", "bad/topic", "id", 1)
 		So(err, ShouldBeNil)
 		So(aclResponse, ShouldBeFalse)
 
-		aclResponse, err = checker.CheckAcl("correct", "test/topic", "wrong-id", 1)
+		aclResponse, err = checker.CheckAcl(context.Background(), "correct", "test/topic", "wrong-id", 1)
 		So(err, ShouldBeNil)
 		So(aclResponse, ShouldBeFalse)
 
-		aclResponse, err = checker.CheckAcl("correct", "test/topic", "id", 2)
+		aclResponse, err = checker.CheckAcl(context.Background(), "correct", "test/topic", "id", 2)
 		So(err, ShouldBeNil)
 		So(aclResponse, ShouldBeFalse)
 
@@ -177,7 +178,7 @@ func TestJsJWTChecker(t *testing.T) {
 			token, err := jwtToken.SignedString([]byte(jwtSecret))
 			So(err, ShouldBeNil)
 
-			userResponse, err := checker.GetUser(token)
+			userResponse, err := checker.GetUser(context.Background(), token)
 			So(err, ShouldBeNil)
 			So(userResponse, ShouldBeTrue)
 		})
@@ -218,15 +219,15 @@ func TestFilesJWTChecker(t *testing.T) {
 		So(err, ShouldBeNil)
 
 		Convey("Access should be granted for ACL mentioned users", func() {
-			tt, err := filesChecker.CheckAcl(token, "test/not_present", "id", 1)
+			tt, err := filesChecker.CheckAcl(context.Background(), token, "test/not_present", "id", 1)
 
 			So(err, ShouldBeNil)
 			So(tt, ShouldBeTrue)
 		})
 
 		Convey("Access should be granted for general ACL rules on non mentioned users", func() {
-			tt1, err1 := filesChecker.CheckAcl(token, "test/general", "id", 1)
-			tt2, err2 := filesChecker.CheckAcl(token, "test/general_denied", "id", 1)
+			tt1, err1 := filesChecker.CheckAcl(context.Background(), token, "test/general", "id", 1)
+			tt2, err2 := filesChecker.CheckAcl(context.Background(), token, "test/general_denied", "id", 1)
 
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeTrue)
@@ -295,7 +296,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 			Convey("Given a correct token, it should correctly authenticate it", func() {
 
-				authenticated, err := jwt.GetUser(token)
+				authenticated, err := jwt.GetUser(context.Background(), token)
 				So(err, ShouldBeNil)
 				So(authenticated, ShouldBeTrue)
 			})
@@ -305,14 +306,14 @@ func TestLocalPostgresJWT(t *testing.T) {
 				wrongToken, err := wrongJwtToken.SignedString([]byte(jwtSecret))
 				So(err, ShouldBeNil)
 
-				authenticated, err := jwt.GetUser(wrongToken)
+				authenticated, err := jwt.GetUser(context.Background(), wrongToken)
 				So(err, ShouldBeNil)
 				So(authenticated, ShouldBeFalse)
 
 			})
 
 			Convey("Given a token that is admin, super user should pass", func() {
-				superuser, err := jwt.GetSuperuser(token)
+				superuser, err := jwt.GetSuperuser(context.Background(), token)
 				So(err, ShouldBeNil)
 				So(superuser, ShouldBeTrue)
 
@@ -321,7 +322,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 					jwt, err := NewLocalJWTChecker(authOpts, log.DebugLevel, hashing.NewHasher(authOpts, ""), tkOptions)
 					So(err, ShouldBeNil)
 
-					superuser, err := jwt.GetSuperuser(token)
+					superuser, err := jwt.GetSuperuser(context.Background(), token)
 					So(err, ShouldBeNil)
 					So(superuser, ShouldBeFalse)
 				})
@@ -345,8 +346,8 @@ func TestLocalPostgresJWT(t *testing.T) {
 				testTopic1 := `test/topic/1`
 				testTopic2 := `test/topic/2`
 
-				tt1, err1 := jwt.CheckAcl(token, testTopic1, clientID, MOSQ_ACL_READ)
-				tt2, err2 := jwt.CheckAcl(token, testTopic2, clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, testTopic1, clientID, MOSQ_ACL_READ)
+				tt2, err2 := jwt.CheckAcl(context.Background(), token, testTopic2, clientID, MOSQ_ACL_READ)
 
 				So(err1, ShouldBeNil)
 				So(err2, ShouldBeNil)
@@ -358,7 +359,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 			Convey("Given read only privileges, a pub check should fail", func() {
 
 				testTopic1 := "test/topic/1"
-				tt1, err1 := jwt.CheckAcl(token, testTopic1, clientID, MOSQ_ACL_WRITE)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, testTopic1, clientID, MOSQ_ACL_WRITE)
 				So(err1, ShouldBeNil)
 				So(tt1, ShouldBeFalse)
 
@@ -366,8 +367,8 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 			Convey("Given wildcard subscriptions against strict db acl, acl checks should fail", func() {
 
-				tt1, err1 := jwt.CheckAcl(token, singleLevelACL, clientID, MOSQ_ACL_READ)
-				tt2, err2 := jwt.CheckAcl(token, hierarchyACL, clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, singleLevelACL, clientID, MOSQ_ACL_READ)
+				tt2, err2 := jwt.CheckAcl(context.Background(), token, hierarchyACL, clientID, MOSQ_ACL_READ)
 
 				So(err1, ShouldBeNil)
 				So(err2, ShouldBeNil)
@@ -382,7 +383,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a db single level wildcard, acl check should pass", func() {
-				tt1, err1 := jwt.CheckAcl(token, "test/topic/whatever", clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, "test/topic/whatever", clientID, MOSQ_ACL_READ)
 				So(err1, ShouldBeNil)
 				So(tt1, ShouldBeTrue)
 			})
@@ -393,7 +394,7 @@ func TestLocalPostgresJWT(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a hierarchy wildcard, acl check should pass", func() {
-				tt1, err1 := jwt.CheckAcl(token, "test/what/ever", clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, "test/what/ever", clientID, MOSQ_ACL_READ)
 				So(err1, ShouldBeNil)
 				So(tt1, ShouldBeTrue)
 			})
@@ -408,15 +409,15 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 				Convey("So checking against them should give false and true for any user", func() {
 
-					tt1, err1 := jwt.CheckAcl(token, singleLevelACL, clientID, MOSQ_ACL_READ)
-					tt2, err2 := jwt.CheckAcl(token, hierarchyACL, clientID, MOSQ_ACL_READ)
+					tt1, err1 := jwt.CheckAcl(context.Background(), token, singleLevelACL, clientID, MOSQ_ACL_READ)
+					tt2, err2 := jwt.CheckAcl(context.Background(), token, hierarchyACL, clientID, MOSQ_ACL_READ)
 
 					So(err1, ShouldBeNil)
 					So(err2, ShouldBeNil)
 					So(tt1, ShouldBeTrue)
 					So(tt2, ShouldBeTrue)
 
-					superuser, err := jwt.GetSuperuser(token)
+					superuser, err := jwt.GetSuperuser(context.Background(), token)
 					So(err, ShouldBeNil)
 					So(superuser, ShouldBeFalse)
 
@@ -498,7 +499,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 			Convey("Given a correct token, it should correctly authenticate it", func() {
 
-				authenticated, err := jwt.GetUser(token)
+				authenticated, err := jwt.GetUser(context.Background(), token)
 				So(err, ShouldBeNil)
 				So(authenticated, ShouldBeTrue)
 
@@ -509,14 +510,14 @@ func TestLocalMysqlJWT(t *testing.T) {
 				wrongToken, err := wrongJwtToken.SignedString([]byte(jwtSecret))
 				So(err, ShouldBeNil)
 
-				authenticated, err := jwt.GetUser(wrongToken)
+				authenticated, err := jwt.GetUser(context.Background(), wrongToken)
 				So(err, ShouldBeNil)
 				So(authenticated, ShouldBeFalse)
 
 			})
 
 			Convey("Given a token that is admin, super user should pass", func() {
-				superuser, err := jwt.GetSuperuser(token)
+				superuser, err := jwt.GetSuperuser(context.Background(), token)
 				So(err, ShouldBeNil)
 				So(superuser, ShouldBeTrue)
 				Convey("But disabling superusers by removing superuri should now return false", func() {
@@ -524,7 +525,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 					jwt, err := NewLocalJWTChecker(authOpts, log.DebugLevel, hashing.NewHasher(authOpts, ""), tkOptions)
 					So(err, ShouldBeNil)
 
-					superuser, err := jwt.GetSuperuser(token)
+					superuser, err := jwt.GetSuperuser(context.Background(), token)
 					So(err, ShouldBeNil)
 					So(superuser, ShouldBeFalse)
 				})
@@ -549,8 +550,8 @@ func TestLocalMysqlJWT(t *testing.T) {
 				testTopic1 := `test/topic/1`
 				testTopic2 := `test/topic/2`
 
-				tt1, err1 := jwt.CheckAcl(token, testTopic1, clientID, MOSQ_ACL_READ)
-				tt2, err2 := jwt.CheckAcl(token, testTopic2, clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, testTopic1, clientID, MOSQ_ACL_READ)
+				tt2, err2 := jwt.CheckAcl(context.Background(), token, testTopic2, clientID, MOSQ_ACL_READ)
 
 				So(err1, ShouldBeNil)
 				So(err2, ShouldBeNil)
@@ -562,7 +563,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 			Convey("Given read only privileges, a pub check should fail", func() {
 
 				testTopic1 := "test/topic/1"
-				tt1, err1 := jwt.CheckAcl(token, testTopic1, clientID, MOSQ_ACL_WRITE)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, testTopic1, clientID, MOSQ_ACL_WRITE)
 				So(err1, ShouldBeNil)
 				So(tt1, ShouldBeFalse)
 
@@ -570,8 +571,8 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 			Convey("Given wildcard subscriptions against strict db acl, acl checks should fail", func() {
 
-				tt1, err1 := jwt.CheckAcl(token, singleLevelACL, clientID, MOSQ_ACL_READ)
-				tt2, err2 := jwt.CheckAcl(token, hierarchyACL, clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, singleLevelACL, clientID, MOSQ_ACL_READ)
+				tt2, err2 := jwt.CheckAcl(context.Background(), token, hierarchyACL, clientID, MOSQ_ACL_READ)
 
 				So(err1, ShouldBeNil)
 				So(err2, ShouldBeNil)
@@ -586,7 +587,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a db single level wildcard, acl check should pass", func() {
-				tt1, err1 := jwt.CheckAcl(token, "test/topic/whatever", clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, "test/topic/whatever", clientID, MOSQ_ACL_READ)
 				So(err1, ShouldBeNil)
 				So(tt1, ShouldBeTrue)
 			})
@@ -597,7 +598,7 @@ func TestLocalMysqlJWT(t *testing.T) {
 			So(err, ShouldBeNil)
 
 			Convey("Given a topic not strictly present that matches a hierarchy wildcard, acl check should pass", func() {
-				tt1, err1 := jwt.CheckAcl(token, "test/what/ever", clientID, MOSQ_ACL_READ)
+				tt1, err1 := jwt.CheckAcl(context.Background(), token, "test/what/ever", clientID, MOSQ_ACL_READ)
 				So(err1, ShouldBeNil)
 				So(tt1, ShouldBeTrue)
 			})
@@ -612,15 +613,15 @@ func TestLocalMysqlJWT(t *testing.T) {
 
 				Convey("So checking against them should give false and true for any user", func() {
 
-					tt1, err1 := jwt.CheckAcl(token, singleLevelACL, clientID, MOSQ_ACL_READ)
-					tt2, err2 := jwt.CheckAcl(token, hierarchyACL, clientID, MOSQ_ACL_READ)
+					tt1, err1 := jwt.CheckAcl(context.Background(), token, singleLevelACL, clientID, MOSQ_ACL_READ)
+					tt2, err2 := jwt.CheckAcl(context.Background(), token, hierarchyACL, clientID, MOSQ_ACL_READ)
 
 					So(err1, ShouldBeNil)
 					So(err2, ShouldBeNil)
 					So(tt1, ShouldBeTrue)
 					So(tt2, ShouldBeTrue)
 
-					superuser, err := jwt.GetSuperuser(token)
+					superuser, err := jwt.GetSuperuser(context.Background(), token)
 					So(err, ShouldBeNil)
 					So(superuser, ShouldBeFalse)
 
@@ -0,0 +1,62 @@
+package backends
+
+import (
+	"context"
+)
+
+// legacyBackend adapts a Backend to the ContextBackend interface. Legacy checks can't be cancelled,
+// so when the context has a deadline the check runs on its own goroutine and is abandoned once the
+// context is done, letting it finish in the background.
+type legacyBackend struct {
+	Backend
+}
+
+// NewLegacyBackend wraps a backend implementing only the original Backend interface.
+func NewLegacyBackend(backend Backend) ContextBackend {
+	return legacyBackend{Backend: backend}
+}
+
+func (o legacyBackend) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return runLegacyCheck(ctx, func() (bool, error) {
+		return o.GetUser(username, password, clientid)
+	})
+}
+
+func (o legacyBackend) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return runLegacyCheck(ctx, func() (bool, error) {
+		return o.GetSuperuser(username)
+	})
+}
+
+func (o legacyBackend) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return runLegacyCheck(ctx, func() (bool, error) {
+		return o.CheckAcl(username, topic, clientid, acc)
+	})
+}
+
+type legacyResult struct {
+	ok  bool
+	err error
+}
+
+func runLegacyCheck(ctx context.Context, check func() (bool, error)) (bool, error) {
+	// Without a deadline or cancellation there's nothing to wait for.
+	if ctx.Done() == nil {
+		return check()
+	}
+
+	// Buffered so an abandoned check doesn't block forever.
+	done := make(chan legacyResult, 1)
+
+	go func() {
+		ok, err := check()
+		done <- legacyResult{ok: ok, err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.ok, result.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
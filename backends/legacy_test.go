@@ -0,0 +1,98 @@
+package backends
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/iegomez/mosquitto-go-auth/backends/constants"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// slowBackend only implements the legacy interface and takes delay to answer.
+type slowBackend struct {
+	delay time.Duration
+}
+
+func (o slowBackend) GetUser(username, password, clientid string) (bool, error) {
+	time.Sleep(o.delay)
+	return true, nil
+}
+
+func (o slowBackend) GetSuperuser(username string) (bool, error) {
+	time.Sleep(o.delay)
+	return true, nil
+}
+
+func (o slowBackend) CheckAcl(username, topic, clientId string, acc int32) (bool, error) {
+	time.Sleep(o.delay)
+	return true, nil
+}
+
+func (o slowBackend) GetName() string {
+	return "Slow"
+}
+
+func (o slowBackend) Halt() {}
+
+func TestLegacyBackend(t *testing.T) {
+	Convey("Given a legacy backend wrapped to take a context", t, func() {
+		slow := NewLegacyBackend(slowBackend{delay: 50 * time.Millisecond})
+
+		Convey("Without a deadline it should wait for the answer", func() {
+			ok, err := slow.GetUserContext(context.Background(), "test1", "test1", "clientid")
+			So(ok, ShouldBeTrue)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("It should give up once the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer cancel()
+
+			ok, err := slow.CheckAclContext(ctx, "test1", "test/topic", "clientid", MOSQ_ACL_READ)
+			So(ok, ShouldBeFalse)
+			So(err, ShouldResemble, context.DeadlineExceeded)
+		})
+	})
+
+	Convey("Check timeouts should fall back from the backend's own to the general one", t, func() {
+		b := &Backends{
+			backends: map[string]ContextBackend{
+				postgresBackend: NewLegacyBackend(slowBackend{}),
+				redisBackend:    NewLegacyBackend(slowBackend{}),
+				filesBackend:    NewLegacyBackend(slowBackend{}),
+			},
+			timeouts: make(map[string]time.Duration),
+		}
+
+		b.setTimeouts(map[string]string{
+			"check_timeout":       "200",
+			"pg_check_timeout":    "1000",
+			"files_check_timeout": "0",
+		})
+
+		So(b.timeouts, ShouldResemble, map[string]time.Duration{
+			postgresBackend: time.Second,
+			redisBackend:    200 * time.Millisecond,
+		})
+	})
+
+	Convey("A check taking longer than the backend's timeout should fail", t, func() {
+		b := &Backends{
+			backends:     map[string]ContextBackend{"slow": NewLegacyBackend(slowBackend{delay: 100 * time.Millisecond})},
+			timeouts:     map[string]time.Duration{"slow": 10 * time.Millisecond},
+			breakers:     make(map[string]*breaker),
+			userCheckers: []string{"slow"},
+		}
+
+		authenticated, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(authenticated, ShouldBeFalse)
+		So(err, ShouldNotBeNil)
+
+		b.timeouts["slow"] = time.Second
+
+		authenticated, err = b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(authenticated, ShouldBeTrue)
+		So(err, ShouldBeNil)
+	})
+}
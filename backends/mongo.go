@@ -3,11 +3,11 @@ package backends
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 	"crypto/tls"
 
 	. "github.com/iegomez/mosquitto-go-auth/backends/constants"
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/pkg/errors"
@@ -29,6 +29,7 @@ type Mongo struct {
 	AclsCollection   string
 	Conn             *mongo.Client
 	disableSuperuser bool
+	checkNetworks    bool
 	hasher           hashing.HashComparer
 	withTLS            bool
 	insecureSkipVerify bool
@@ -44,6 +45,17 @@ type MongoUser struct {
 	PasswordHash string     `bson:"password"`
 	Superuser    bool       `bson:"superuser"`
 	Acls         []MongoAcl `bson:"acls"`
+	AllowCidrs   []string   `bson:"allow_cidrs"`
+	DenyCidrs    []string   `bson:"deny_cidrs"`
+	Denied       bool       `bson:"denied"`
+	DenyReason   string     `bson:"deny_reason"`
+	DenyAcls     []string   `bson:"deny_acls"`
+}
+
+func init() {
+	Register(mongoBackend, "mongo", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewMongo(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
 }
 
 func NewMongo(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (Mongo, error) {
@@ -68,6 +80,10 @@ func NewMongo(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 		m.disableSuperuser = true
 	}
 
+	if authOpts["mongo_check_networks"] == "true" {
+		m.checkNetworks = true
+	}
+
 	if mongoHost, ok := authOpts["mongo_host"]; ok {
 		m.Host = mongoHost
 	}
@@ -149,12 +165,17 @@ func NewMongo(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Mongo) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding its queries.
+func (o Mongo) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
 
 	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
 
 	var user MongoUser
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// avoid leaking the fact that user exists or not though error.
@@ -173,8 +194,72 @@ func (o Mongo) GetUser(username, password, clientid string) (bool, error) {
 
 }
 
+//GetPasswordHash returns the stored password hash for the given user.
+func (o Mongo) GetPasswordHash(ctx context.Context, username string) (string, error) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", nil
+		}
+
+		log.Debugf("Mongo get password hash error: %s", err)
+		return "", err
+	}
+
+	return user.PasswordHash, nil
+
+}
+
+//ChecksNetworks tells whether mongo_check_networks is enabled.
+func (o Mongo) ChecksNetworks() bool {
+	return o.checkNetworks
+}
+
+//GetNetworkRules returns the ranges of the user's allow_cidrs and deny_cidrs.
+func (o Mongo) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		log.Debugf("Mongo get network rules error: %s", err)
+		return nil, err
+	}
+
+	var rules networks.Rules
+	for _, cidr := range user.AllowCidrs {
+		if err := rules.Add("allow", cidr); err != nil {
+			return nil, fmt.Errorf("invalid allow_cidrs for user %s: %s", username, err)
+		}
+	}
+	for _, cidr := range user.DenyCidrs {
+		if err := rules.Add("deny", cidr); err != nil {
+			return nil, fmt.Errorf("invalid deny_cidrs for user %s: %s", username, err)
+		}
+	}
+
+	return []networks.Rules{rules}, nil
+
+}
+
 //GetSuperuser checks that the key username:su exists and has value "true".
 func (o Mongo) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding its queries.
+func (o Mongo) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
 
 	if o.disableSuperuser {
 		return false, nil
@@ -184,7 +269,7 @@ func (o Mongo) GetSuperuser(username string) (bool, error) {
 
 	var user MongoUser
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// avoid leaking the fact that user exists or not though error.
@@ -201,13 +286,18 @@ func (o Mongo) GetSuperuser(username string) (bool, error) {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclContext(context.Background(), username, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding its queries.
+func (o Mongo) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
 
 	//Get user and check his acls.
 	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
 
 	var user MongoUser
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			// avoid leaking the fact that user exists or not though error.
@@ -228,22 +318,21 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) (bool, erro
 	//Now check common acls.
 
 	ac := o.Conn.Database(o.DBName).Collection(o.AclsCollection)
-	cur, err := ac.Find(context.TODO(), bson.M{"acc": bson.M{"$in": []int32{acc, 3}}})
+	cur, err := ac.Find(ctx, bson.M{"acc": bson.M{"$in": []int32{acc, 3}}})
 
 	if err != nil {
 		log.Debugf("Mongo check acl error: %s", err)
 		return false, err
 	}
 
-	defer cur.Close(context.TODO())
+	defer cur.Close(ctx)
 
-	for cur.Next(context.TODO()) {
+	for cur.Next(ctx) {
 		var acl MongoAcl
 		err = cur.Decode(&acl)
 		if err == nil {
-			aclTopic := strings.Replace(acl.Topic, "%c", clientid, -1)
-			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if topics.Match(aclTopic, topic) {
+			aclTopic, ok := replacePlaceholders(ctx, acl.Topic, username, clientid)
+			if ok && topics.Match(aclTopic, topic) {
 				return true, nil
 			}
 		} else {
@@ -255,6 +344,99 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) (bool, erro
 
 }
 
+//UserVerdict denies users whose denied field is set, telling their deny_reason, and is GetUserContext otherwise.
+func (o Mongo) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+
+	user, err := o.findUser(ctx, username)
+	if user == nil || err != nil {
+		return Result{Verdict: Abstain}, err
+	}
+
+	if user.Denied {
+		return userDenied(user), nil
+	}
+
+	return resultOf(o.hasher.Compare(password, user.PasswordHash), nil)
+
+}
+
+//UserDenied denies users whose denied field is set, telling their deny_reason, whatever their password.
+func (o Mongo) UserDenied(ctx context.Context, username string) (Result, error) {
+
+	user, err := o.findUser(ctx, username)
+	if user == nil || err != nil || !user.Denied {
+		return Result{Verdict: Abstain}, err
+	}
+
+	return userDenied(user), nil
+
+}
+
+//findUser returns the user's document, or nil if there's none.
+func (o Mongo) findUser(ctx context.Context, username string) (*MongoUser, error) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		log.Debugf("Mongo get user error: %s", err)
+		return nil, err
+	}
+
+	return &user, nil
+
+}
+
+func userDenied(user *MongoUser) Result {
+	if user.DenyReason == "" {
+		return denied(fmt.Sprintf("user %s is denied", user.Username))
+	}
+	return denied(user.DenyReason)
+}
+
+//SuperuserVerdict is GetSuperuserContext, superusers can't be denied explicitly.
+func (o Mongo) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return resultOf(o.GetSuperuserContext(ctx, username))
+}
+
+//AclVerdict denies topics matching the user's deny_acls whatever the access, and is CheckAclContext otherwise.
+func (o Mongo) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return Result{Verdict: Abstain}, nil
+		}
+
+		log.Debugf("Mongo check acl error: %s", err)
+		return Result{}, err
+	}
+
+	for _, denyAcl := range user.DenyAcls {
+		if topics.Match(denyAcl, topic) {
+			return denied(fmt.Sprintf("deny_acls of user %s matches: %s", username, denyAcl)), nil
+		}
+	}
+
+	return resultOf(o.CheckAclContext(ctx, username, topic, clientid, acc))
+
+}
+
+//Ping checks that the mongo server can be reached.
+func (o Mongo) Ping(ctx context.Context) error {
+	return o.Conn.Ping(ctx, nil)
+}
+
 //GetName returns the backend's name
 func (o Mongo) GetName() string {
 	return "Mongo"
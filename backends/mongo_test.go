@@ -197,6 +197,34 @@ func TestMongoRaw(t *testing.T) {
 			So(err1, ShouldBeNil)
 			So(tt1, ShouldBeFalse)
 		})
+		Convey("Given a denied user, verdicts should deny it and the topics of its deny_acls", func() {
+			deniedUser := MongoUser{
+				Username:     "denied_user",
+				PasswordHash: userPassHash1,
+				Acls:         []MongoAcl{{Topic: strictAcl, Acc: 1}},
+				Denied:       true,
+				DenyReason:   "banned",
+				DenyAcls:     []string{"test/denied/#"},
+			}
+			_, err := usersColl.InsertOne(context.TODO(), &deniedUser)
+			So(err, ShouldBeNil)
+
+			result, err := mongo.UserVerdict(context.Background(), "denied_user", userPass1, clientID)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "banned"})
+
+			result, err = mongo.UserVerdict(context.Background(), wrongUsername, userPass1, clientID)
+			So(err, ShouldBeNil)
+			So(result.Verdict, ShouldEqual, Abstain)
+
+			result, err = mongo.AclVerdict(context.Background(), "denied_user", "test/denied/topic", clientID, MOSQ_ACL_READ, nil)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "deny_acls of user denied_user matches: test/denied/#"})
+
+			result, err = mongo.AclVerdict(context.Background(), "denied_user", "test/topic/1", clientID, MOSQ_ACL_READ, nil)
+			So(err, ShouldBeNil)
+			So(result.Verdict, ShouldEqual, Allow)
+		})
 
 		mongoDb.Drop(context.TODO())
 		mongo.Halt()
@@ -1,15 +1,16 @@
 package backends
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
 	"strconv"
-	"strings"
 
 	mq "github.com/go-sql-driver/mysql"
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/jmoiron/sqlx"
@@ -28,6 +29,10 @@ type Mysql struct {
 	UserQuery            string
 	SuperuserQuery       string
 	AclQuery             string
+	PskQuery             string
+	NetworkQuery         string
+	UserDenyQuery        string
+	AclDenyQuery         string
 	SSLMode              string
 	SSLCert              string
 	SSLKey               string
@@ -40,6 +45,12 @@ type Mysql struct {
 	connectTries int
 }
 
+func init() {
+	Register(mysqlBackend, "mysql", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewMysql(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 func NewMysql(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (Mysql, error) {
 
 	log.SetLevel(logLevel)
@@ -111,6 +122,22 @@ func NewMysql(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 		mysql.AclQuery = aclQuery
 	}
 
+	if pskQuery, ok := authOpts["mysql_pskquery"]; ok {
+		mysql.PskQuery = pskQuery
+	}
+
+	if networkQuery, ok := authOpts["mysql_networkquery"]; ok {
+		mysql.NetworkQuery = networkQuery
+	}
+
+	if userDenyQuery, ok := authOpts["mysql_userdenyquery"]; ok {
+		mysql.UserDenyQuery = userDenyQuery
+	}
+
+	if aclDenyQuery, ok := authOpts["mysql_acldenyquery"]; ok {
+		mysql.AclDenyQuery = aclDenyQuery
+	}
+
 	if allowNativePasswords, ok := authOpts["mysql_allow_native_passwords"]; ok && allowNativePasswords == "true" {
 		mysql.AllowNativePasswords = true
 	}
@@ -217,9 +244,14 @@ func NewMysql(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Mysql) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding its queries.
+func (o Mysql) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
 
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -246,6 +278,11 @@ func (o Mysql) GetUser(username, password, clientid string) (bool, error) {
 
 //GetSuperuser checks that the username meets the superuser query.
 func (o Mysql) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding its queries.
+func (o Mysql) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
 
 	//If there's no superuser query, return false.
 	if o.SuperuserQuery == "" {
@@ -253,7 +290,7 @@ func (o Mysql) GetSuperuser(username string) (bool, error) {
 	}
 
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.DB.GetContext(ctx, &count, o.SuperuserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -280,6 +317,11 @@ func (o Mysql) GetSuperuser(username string) (bool, error) {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclContext(context.Background(), username, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding its queries.
+func (o Mysql) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
 	//If there's no acl query, assume all privileges for all users.
 	if o.AclQuery == "" {
 		return true, nil
@@ -287,7 +329,7 @@ func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) (bool, erro
 
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.DB.SelectContext(ctx, &acls, o.AclQuery, username, acc)
 
 	if err != nil {
 		log.Debugf("MySql check acl error: %s", err)
@@ -295,9 +337,8 @@ func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) (bool, erro
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if topics.Match(aclTopic, topic) {
+		aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+		if ok && topics.Match(aclTopic, topic) {
 			return true, nil
 		}
 	}
@@ -306,6 +347,128 @@ func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) (bool, erro
 
 }
 
+//Explain tells what the superuser query returned, or the row returned by the acl query that matched the topic.
+func (o Mysql) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	return explainQueries(ctx, o.DB, "mysql", o.SuperuserQuery, o.AclQuery, check, username, topic, clientid, acc)
+}
+
+//GetPskKey returns the hex encoded pre-shared key for the given identity using the psk query.
+func (o Mysql) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+
+	//If there's no psk query, there are no keys to look for.
+	if o.PskQuery == "" {
+		return "", nil
+	}
+
+	var key sql.NullString
+	err := o.DB.GetContext(ctx, &key, o.PskQuery, identity)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("MySql get psk key error: %s", err)
+		return "", err
+	}
+
+	if !key.Valid {
+		log.Debugf("MySql get psk key error: identity %s not found", identity)
+		return "", nil
+	}
+
+	return key.String, nil
+
+}
+
+//GetPasswordHash returns the stored password hash for the given user using the user query.
+func (o Mysql) GetPasswordHash(ctx context.Context, username string) (string, error) {
+
+	var pwHash sql.NullString
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("MySql get password hash error: %s", err)
+		return "", err
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("MySql get password hash error: user %s not found", username)
+		return "", nil
+	}
+
+	return pwHash.String, nil
+
+}
+
+//ChecksNetworks tells whether there's a network query to keep users to some networks.
+func (o Mysql) ChecksNetworks() bool {
+	return o.NetworkQuery != ""
+}
+
+//GetNetworkRules returns the networks the user may log in from using the network query.
+func (o Mysql) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	rules, err := queryNetworks(ctx, o.DB, "mysql", o.NetworkQuery, username)
+	if err != nil {
+		log.Debugf("Mysql get network rules error: %s", err)
+	}
+
+	return rules, err
+}
+
+//UserDenied denies users the user deny query returns a row for, whatever their password.
+func (o Mysql) UserDenied(ctx context.Context, username string) (Result, error) {
+	result, err := queryUserDeny(ctx, o.DB, "mysql", o.UserDenyQuery, username)
+	if err != nil {
+		log.Debugf("Mysql user deny query error: %s", err)
+	}
+
+	return result, err
+}
+
+//UserVerdict denies users the user deny query returns a row for, and is GetUserContext otherwise.
+func (o Mysql) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+	result, err := o.UserDenied(ctx, username)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Verdict == Deny {
+		return result, nil
+	}
+
+	return resultOf(o.GetUserContext(ctx, username, password, clientid))
+}
+
+//SuperuserVerdict is GetSuperuserContext, there's no query to deny superusers.
+func (o Mysql) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return resultOf(o.GetSuperuserContext(ctx, username))
+}
+
+//AclVerdict denies topics matching a row returned by the acl deny query, and is CheckAclContext otherwise.
+func (o Mysql) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+	result, err := queryAclDeny(ctx, o.DB, "mysql", o.AclDenyQuery, username, topic, clientid, acc)
+	if err != nil {
+		log.Debugf("Mysql acl deny query error: %s", err)
+		return result, err
+	}
+
+	if result.Verdict == Deny {
+		return result, nil
+	}
+
+	return resultOf(o.CheckAclContext(ctx, username, topic, clientid, acc))
+}
+
+//Ping checks that the database can be reached.
+func (o Mysql) Ping(ctx context.Context) error {
+	return o.DB.PingContext(ctx)
+}
+
 //GetName returns the backend's name
 func (o Mysql) GetName() string {
 	return "Mysql"
@@ -0,0 +1,121 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
+	log "github.com/sirupsen/logrus"
+)
+
+// networkBackend is the decision backend of logins rejected by the global network rules.
+const networkBackend = "network"
+
+type addressKey struct{}
+
+// NetworkRuleGetter is implemented by backends that can keep users to the networks they may log in from.
+// ChecksNetworks tells whether the backend is configured to do so, and GetNetworkRules returns the rules
+// the client's address must be allowed by, every one of them, for the user to log in. No rules allow any address.
+type NetworkRuleGetter interface {
+	ChecksNetworks() bool
+	GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error)
+}
+
+// WithAddress returns a copy of ctx carrying the IP address of the client a check is made for.
+func WithAddress(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, addressKey{}, address)
+}
+
+// AddressFrom returns the client's IP address carried by ctx, or an empty string if it's unknown.
+func AddressFrom(ctx context.Context) string {
+	address, _ := ctx.Value(addressKey{}).(string)
+	return address
+}
+
+// parseNetworks adds the comma separated ranges of option to rules as rule ones.
+func parseNetworks(rules *networks.Rules, rule, option string) error {
+	for _, cidr := range strings.Split(option, ",") {
+		if strings.TrimSpace(cidr) == "" {
+			continue
+		}
+
+		if err := rules.Add(rule, cidr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Backends) setNetworkRules(authOpts map[string]string) error {
+	if err := parseNetworks(&b.networkRules, "allow", authOpts["network_allow"]); err != nil {
+		return fmt.Errorf("invalid network_allow: %s", err)
+	}
+
+	if err := parseNetworks(&b.networkRules, "deny", authOpts["network_deny"]); err != nil {
+		return fmt.Errorf("invalid network_deny: %s", err)
+	}
+
+	if !b.networkRules.Empty() {
+		log.Infof("network rules enabled: %d allowed and %d denied ranges", len(b.networkRules.Allow), len(b.networkRules.Deny))
+	}
+
+	return nil
+}
+
+// checkGlobalNetworks tells whether the network_allow and network_deny options let the client carried by ctx log in.
+func (b *Backends) checkGlobalNetworks(ctx context.Context, username string) bool {
+	address := AddressFrom(ctx)
+	if b.networkRules.Allows(address) {
+		return true
+	}
+
+	log.Infof("user %s rejected: address %q not allowed by the global network rules", username, address)
+	decide(ctx, networkBackend, false)
+
+	if explanation := ExplanationFrom(ctx); explanation != nil {
+		explanation.Steps = append(explanation.Steps, Step{
+			Check:   userCheck,
+			Backend: networkBackend,
+			Rule:    fmt.Sprintf("address %q not allowed by network_allow and network_deny", address),
+		})
+	}
+
+	return false
+}
+
+// checkBackendNetworks tells whether the network rules the backend has for username let the client carried by ctx log in.
+func (b *Backends) checkBackendNetworks(ctx context.Context, bename, username string) (bool, error) {
+	getter, ok := b.backends[bename].(NetworkRuleGetter)
+	if !ok || !getter.ChecksNetworks() {
+		return true, nil
+	}
+
+	rules, err := getter.GetNetworkRules(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	address := AddressFrom(ctx)
+	for _, r := range rules {
+		if !r.Allows(address) {
+			log.Infof("user %s rejected: address %q not allowed by the network rules of backend %s", username, address, bename)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// explainNetworks notes on the last step of the explanation carried by ctx, if any, that the backend's
+// network rules rejected the client's address even though its credentials were right.
+func explainNetworks(ctx context.Context, bename string) {
+	explanation := ExplanationFrom(ctx)
+	if explanation == nil || len(explanation.Steps) == 0 {
+		return
+	}
+
+	step := &explanation.Steps[len(explanation.Steps)-1]
+	step.Rule = fmt.Sprintf("address %q not allowed by the network rules of backend %s", AddressFrom(ctx), bename)
+}
@@ -0,0 +1,94 @@
+package networks
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	allow = "allow"
+	deny  = "deny"
+)
+
+// Rules are CIDR ranges a client's address must be in (Allow) or must not be in (Deny).
+// Denies take precedence, and empty Allow ranges allow every address.
+type Rules struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Parse parses a CIDR range, or a single address standing for a range holding only itself.
+func Parse(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", cidr)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR range %q", cidr)
+	}
+
+	return network, nil
+}
+
+// Add parses cidr and adds it to the rules, rule being either allow or deny.
+func (r *Rules) Add(rule, cidr string) error {
+	network, err := Parse(cidr)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(rule)) {
+	case allow:
+		r.Allow = append(r.Allow, network)
+	case deny:
+		r.Deny = append(r.Deny, network)
+	default:
+		return fmt.Errorf("unknown network rule %q, must be allow or deny", rule)
+	}
+
+	return nil
+}
+
+// Empty tells whether there are no rules at all.
+func (r Rules) Empty() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// Allows tells whether the rules let address through. Unknown or unparsable addresses
+// can't be in any range, so they're only let through when there are no Allow ranges.
+func (r Rules) Allows(address string) bool {
+	ip := net.ParseIP(address)
+
+	if ip != nil && contains(r.Deny, ip) {
+		return false
+	}
+
+	if len(r.Allow) == 0 {
+		return true
+	}
+
+	return ip != nil && contains(r.Allow, ip)
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,69 @@
+package networks
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRules(t *testing.T) {
+	Convey("Ranges and single addresses should be parsed", t, func() {
+		network, err := Parse("10.0.0.0/8")
+		So(err, ShouldBeNil)
+		So(network.String(), ShouldEqual, "10.0.0.0/8")
+
+		network, err = Parse(" 192.168.1.10 ")
+		So(err, ShouldBeNil)
+		So(network.String(), ShouldEqual, "192.168.1.10/32")
+
+		network, err = Parse("2001:db8::1")
+		So(err, ShouldBeNil)
+		So(network.String(), ShouldEqual, "2001:db8::1/128")
+
+		_, err = Parse("10.0.0.0/33")
+		So(err, ShouldNotBeNil)
+
+		_, err = Parse("datacenter")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Unknown rules should be rejected", t, func() {
+		var rules Rules
+		So(rules.Add("permit", "10.0.0.0/8"), ShouldNotBeNil)
+		So(rules.Empty(), ShouldBeTrue)
+	})
+
+	Convey("Given allow and deny rules", t, func() {
+		var rules Rules
+		So(rules.Add("allow", "10.0.0.0/8"), ShouldBeNil)
+		So(rules.Add("ALLOW", "2001:db8::/32"), ShouldBeNil)
+		So(rules.Add("deny", "10.1.0.0/16"), ShouldBeNil)
+
+		Convey("Addresses in an allowed range should be allowed", func() {
+			So(rules.Allows("10.2.3.4"), ShouldBeTrue)
+			So(rules.Allows("2001:db8::10"), ShouldBeTrue)
+		})
+
+		Convey("Denied ranges should take precedence", func() {
+			So(rules.Allows("10.1.2.3"), ShouldBeFalse)
+		})
+
+		Convey("Addresses outside the allowed ranges should be rejected", func() {
+			So(rules.Allows("192.168.1.1"), ShouldBeFalse)
+		})
+
+		Convey("Unknown addresses should be rejected", func() {
+			So(rules.Allows(""), ShouldBeFalse)
+			So(rules.Allows("unix-socket"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given only deny rules", t, func() {
+		var rules Rules
+		So(rules.Add("deny", "192.168.0.0/16"), ShouldBeNil)
+
+		So(rules.Allows("192.168.1.1"), ShouldBeFalse)
+		So(rules.Allows("10.0.0.1"), ShouldBeTrue)
+		So(rules.Allows(""), ShouldBeTrue)
+	})
+}
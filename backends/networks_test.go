@@ -0,0 +1,154 @@
+package backends
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNetworks(t *testing.T) {
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+	networksPath, _ := filepath.Abs("../test-files/networks")
+
+	Convey("Invalid global network rules should make Initialize fail", t, func() {
+		authOpts := map[string]string{
+			"backends":            "files",
+			"files_password_path": pwPath,
+			"network_allow":       "10.0.0.0/8, datacenter",
+		}
+
+		_, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "network_allow")
+	})
+
+	Convey("Without network rules logins shouldn't depend on the address", t, func() {
+		authOpts := map[string]string{
+			"backends":            "files",
+			"files_password_path": pwPath,
+		}
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		granted, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+	})
+
+	Convey("Given global and files network rules", t, func() {
+		authOpts := map[string]string{
+			"backends":            "files",
+			"files_password_path": pwPath,
+			"files_acl_path":      aclPath,
+			"files_network_path":  networksPath,
+			"network_allow":       "10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16",
+			"network_deny":        "10.9.9.9",
+		}
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		check := func(username, password, address string) (bool, *Decision) {
+			ctx, decision := WithDecision(WithAddress(context.Background(), address))
+			granted, err := b.AuthUnpwdCheck(ctx, username, password, "clientid")
+			So(err, ShouldBeNil)
+			return granted, decision
+		}
+
+		Convey("Users should log in from the networks they're allowed", func() {
+			granted, decision := check("test1", "test1", "10.2.3.4")
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldEqual, filesBackend)
+
+			granted, _ = check("test2", "test2", "172.16.0.10")
+			So(granted, ShouldBeTrue)
+		})
+
+		Convey("Users without rules of their own should only be held to the global ones", func() {
+			granted, _ := check("test3", "test3", "192.168.1.1")
+			So(granted, ShouldBeTrue)
+		})
+
+		Convey("Addresses outside the global rules should be rejected before asking the backends", func() {
+			granted, decision := check("test1", "test1", "8.8.8.8")
+			So(granted, ShouldBeFalse)
+			So(decision.Backend, ShouldEqual, networkBackend)
+
+			granted, _ = check("test1", "test1", "10.9.9.9")
+			So(granted, ShouldBeFalse)
+
+			granted, _ = check("test1", "test1", "")
+			So(granted, ShouldBeFalse)
+		})
+
+		Convey("Addresses outside the files rules should be rejected even with the right password", func() {
+			granted, _ := check("test1", "test1", "10.1.0.1")
+			So(granted, ShouldBeFalse)
+
+			granted, _ = check("test2", "test2", "172.16.0.11")
+			So(granted, ShouldBeFalse)
+
+			granted, _ = check("test3", "test3", "192.168.100.1")
+			So(granted, ShouldBeFalse)
+		})
+
+		Convey("Rejections by network rules should be explained", func() {
+			ctx, explanation := WithExplanation(WithAddress(context.Background(), "10.1.0.1"))
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+			So(explanation.Steps, ShouldHaveLength, 1)
+			So(explanation.Steps[0].Rule, ShouldContainSubstring, "network rules of backend files")
+
+			ctx, explanation = WithExplanation(WithAddress(context.Background(), "8.8.8.8"))
+			_, err = b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(explanation.Steps, ShouldHaveLength, 1)
+			So(explanation.Steps[0].Backend, ShouldEqual, networkBackend)
+		})
+	})
+
+	Convey("SCRAM logins should be held to the network rules too", t, func() {
+		verifier, err := hashing.NewScramHasher(16, 4096, hashing.SHA256).Hash("test1")
+		So(err, ShouldBeNil)
+
+		scramPath := filepath.Join(os.TempDir(), "mosquitto-go-auth-scram-passwords")
+		So(ioutil.WriteFile(scramPath, []byte("test1:"+verifier+"\n"), 0600), ShouldBeNil)
+		defer os.Remove(scramPath)
+
+		authOpts := map[string]string{
+			"backends":            "files",
+			"files_password_path": scramPath,
+			"files_network_path":  networksPath,
+			"network_allow":       "10.0.0.0/8",
+		}
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		get := func(address string) *hashing.ScramVerifier {
+			scramVerifier, err := b.AuthScramVerifierGet(WithAddress(context.Background(), address), hashing.ScramSHA256, "test1")
+			So(err, ShouldBeNil)
+			return scramVerifier
+		}
+
+		So(get("10.2.3.4"), ShouldNotBeNil)
+
+		// Outside the global rules.
+		So(get("8.8.8.8"), ShouldBeNil)
+
+		// Outside the files rules for test1.
+		So(get("10.1.0.1"), ShouldBeNil)
+	})
+}
@@ -0,0 +1,170 @@
+package backends
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goCache "github.com/patrickmn/go-cache"
+	log "github.com/sirupsen/logrus"
+)
+
+type policyAction int
+
+const (
+	// PolicyError reports the backend error, mosquitto gets MOSQ_ERR_UNKNOWN (the default).
+	PolicyError policyAction = iota
+	// PolicyDeny rejects the check.
+	PolicyDeny
+	// PolicyStale answers with the last decision backends made for the same check, if not too old.
+	PolicyStale
+)
+
+const (
+	defaultStaleMaxAge     = 3600
+	defaultStaleMaxEntries = 100000
+)
+
+func (a policyAction) String() string {
+	switch a {
+	case PolicyDeny:
+		return "deny"
+	case PolicyStale:
+		return "stale"
+	default:
+		return "error"
+	}
+}
+
+// ErrorPolicy tells what a check answers when backends fail to make a decision.
+// With the stale action it keeps the last decision for up to maxEntries checks for up to maxAge.
+type ErrorPolicy struct {
+	check      string
+	action     policyAction
+	maxAge     time.Duration
+	maxEntries int
+
+	// mu makes checking the number of decisions and adding one atomic.
+	mu        sync.Mutex
+	decisions *goCache.Cache
+}
+
+// NewErrorPolicy reads the policy for the given check type (user, acl or superuser) from the
+// <check>_error_policy option, which may be error, deny or stale. The maximum staleness is given in seconds
+// by <check>_stale_max_age, falling back to stale_max_age, and the number of decisions kept likewise by
+// <check>_stale_max_entries and stale_max_entries.
+func NewErrorPolicy(authOpts map[string]string, check string) *ErrorPolicy {
+	p := &ErrorPolicy{
+		check:  check,
+		action: PolicyError,
+	}
+
+	if action, ok := authOpts[fmt.Sprintf("%s_error_policy", check)]; ok {
+		switch strings.Replace(action, " ", "", -1) {
+		case "error":
+			p.action = PolicyError
+		case "deny":
+			p.action = PolicyDeny
+		case "stale":
+			p.action = PolicyStale
+		default:
+			log.Warningf("%s_error_policy unknown, defaulting to error", check)
+		}
+	}
+
+	if p.action != PolicyStale {
+		return p
+	}
+
+	maxAge := backendIntOption(authOpts, check, "stale_max_age", defaultStaleMaxAge)
+	if maxAge <= 0 {
+		log.Warningf("%s_stale_max_age must be positive, defaulting to %d", check, defaultStaleMaxAge)
+		maxAge = defaultStaleMaxAge
+	}
+
+	maxEntries := backendIntOption(authOpts, check, "stale_max_entries", defaultStaleMaxEntries)
+	if maxEntries <= 0 {
+		log.Warningf("%s_stale_max_entries must be positive, defaulting to %d", check, defaultStaleMaxEntries)
+		maxEntries = defaultStaleMaxEntries
+	}
+
+	p.maxAge = time.Duration(maxAge) * time.Second
+	p.maxEntries = maxEntries
+
+	// Expired decisions still count towards maxEntries until they're deleted, so don't wait too long to.
+	cleanup := p.maxAge
+	if cleanup > time.Minute {
+		cleanup = time.Minute
+	}
+	p.decisions = goCache.New(p.maxAge, cleanup)
+	log.Infof("%s checks answer with decisions up to %s old on backend errors, keeping up to %d of them", check, p.maxAge, p.maxEntries)
+
+	return p
+}
+
+// Action returns the policy's action as given in the options.
+func (p *ErrorPolicy) Action() string {
+	if p == nil {
+		return PolicyError.String()
+	}
+
+	return p.action.String()
+}
+
+// Remember keeps the decision backends made for the check identified by key. It's a no-op unless the action is stale.
+// Once maxEntries decisions are kept, those of other checks are only kept as older ones expire.
+func (p *ErrorPolicy) Remember(key string, granted bool) {
+	if p == nil || p.action != PolicyStale {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, kept := p.decisions.Get(key); !kept && p.decisions.ItemCount() >= p.maxEntries {
+		log.Debugf("%s_stale_max_entries reached, not keeping the decision for %s check", p.check, p.check)
+		return
+	}
+
+	p.decisions.Set(key, granted, goCache.DefaultExpiration)
+}
+
+// Resolve returns the answer for the check identified by key when backends failed with err.
+// When the action is stale but there's no recent enough decision, err is returned.
+func (p *ErrorPolicy) Resolve(key string, err error) (bool, error) {
+	if p == nil {
+		return false, err
+	}
+
+	switch p.action {
+	case PolicyDeny:
+		log.Warnf("denying %s check on backend error: %s", p.check, err)
+		return false, nil
+	case PolicyStale:
+		if granted, ok := p.decisions.Get(key); ok {
+			log.Warnf("using last known decision (granted = %t) for %s check on backend error: %s", granted, p.check, err)
+			return granted.(bool), nil
+		}
+		log.Debugf("no decision from the last %s for %s check", p.maxAge, p.check)
+	}
+
+	return false, err
+}
+
+// PolicyKey identifies a check by its parameters. They're hashed so no password is kept in clear.
+func PolicyKey(parts ...interface{}) string {
+	h := sha256.New()
+	for _, part := range parts {
+		// Length prefixes keep ("ab", "c") and ("a", "bc") apart.
+		s := fmt.Sprint(part)
+		h.Write([]byte(strconv.Itoa(len(s))))
+		h.Write([]byte{':'})
+		h.Write([]byte(s))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,154 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// flakySuperuserBackend says test1 is a superuser and fails every check while down.
+type flakySuperuserBackend struct {
+	flakyBackend
+}
+
+func (o *flakySuperuserBackend) GetSuperuser(username string) (bool, error) {
+	if o.down {
+		return false, errors.New("backend is down")
+	}
+	return username == "test1", nil
+}
+
+func TestErrorPolicy(t *testing.T) {
+	backendErr := errors.New("backend is down")
+
+	Convey("Unknown or missing policies should default to error", t, func() {
+		So(NewErrorPolicy(map[string]string{}, "user").Action(), ShouldEqual, "error")
+		So(NewErrorPolicy(map[string]string{"user_error_policy": "maybe"}, "user").Action(), ShouldEqual, "error")
+
+		var p *ErrorPolicy
+		granted, err := p.Resolve(PolicyKey("user", "test1"), backendErr)
+		So(granted, ShouldBeFalse)
+		So(err, ShouldEqual, backendErr)
+	})
+
+	Convey("The deny policy should reject the check without an error", t, func() {
+		p := NewErrorPolicy(map[string]string{"acl_error_policy": "deny"}, "acl")
+		So(p.Action(), ShouldEqual, "deny")
+
+		p.Remember(PolicyKey("acl", "test1"), true)
+
+		granted, err := p.Resolve(PolicyKey("acl", "test1"), backendErr)
+		So(granted, ShouldBeFalse)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given a stale policy", t, func() {
+		p := NewErrorPolicy(map[string]string{"user_error_policy": "stale", "stale_max_age": "1"}, "user")
+		So(p.Action(), ShouldEqual, "stale")
+		So(p.maxAge, ShouldEqual, time.Second)
+
+		Convey("It should answer with the last decision for the same check", func() {
+			p.Remember(PolicyKey("user", "test1", "test1"), true)
+			p.Remember(PolicyKey("user", "test2", "test2"), false)
+
+			granted, err := p.Resolve(PolicyKey("user", "test1", "test1"), backendErr)
+			So(granted, ShouldBeTrue)
+			So(err, ShouldBeNil)
+
+			granted, err = p.Resolve(PolicyKey("user", "test2", "test2"), backendErr)
+			So(granted, ShouldBeFalse)
+			So(err, ShouldBeNil)
+
+			granted, err = p.Resolve(PolicyKey("user", "test1", "wrong"), backendErr)
+			So(granted, ShouldBeFalse)
+			So(err, ShouldEqual, backendErr)
+		})
+
+		Convey("It should return the error once the decision is too old", func() {
+			p.Remember(PolicyKey("user", "test1", "test1"), true)
+			time.Sleep(1100 * time.Millisecond)
+
+			granted, err := p.Resolve(PolicyKey("user", "test1", "test1"), backendErr)
+			So(granted, ShouldBeFalse)
+			So(err, ShouldEqual, backendErr)
+		})
+	})
+
+	Convey("Check types should have their own max staleness", t, func() {
+		p := NewErrorPolicy(map[string]string{"acl_error_policy": "stale", "stale_max_age": "10", "acl_stale_max_age": "20"}, "acl")
+		So(p.maxAge, ShouldEqual, 20*time.Second)
+	})
+
+	Convey("The stale policy should keep a bounded number of decisions", t, func() {
+		p := NewErrorPolicy(map[string]string{"user_error_policy": "stale", "stale_max_age": "1", "user_stale_max_entries": "2"}, "user")
+		So(p.maxEntries, ShouldEqual, 2)
+
+		p.Remember(PolicyKey("user", "test1", "test1"), true)
+		p.Remember(PolicyKey("user", "test2", "test2"), true)
+		p.Remember(PolicyKey("user", "test3", "test3"), true)
+		So(p.decisions.ItemCount(), ShouldEqual, 2)
+
+		_, err := p.Resolve(PolicyKey("user", "test3", "test3"), backendErr)
+		So(err, ShouldEqual, backendErr)
+
+		// Kept decisions may still be updated.
+		p.Remember(PolicyKey("user", "test1", "test1"), false)
+		granted, err := p.Resolve(PolicyKey("user", "test1", "test1"), backendErr)
+		So(granted, ShouldBeFalse)
+		So(err, ShouldBeNil)
+
+		// Room is made as decisions expire.
+		time.Sleep(2100 * time.Millisecond)
+		p.Remember(PolicyKey("user", "test3", "test3"), true)
+		granted, err = p.Resolve(PolicyKey("user", "test3", "test3"), backendErr)
+		So(granted, ShouldBeTrue)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given a superuser backend going down with a stale superuser policy", t, func() {
+		flaky := &flakySuperuserBackend{}
+		b := &Backends{
+			backends:          map[string]ContextBackend{"flaky": NewLegacyBackend(flaky)},
+			breakers:          make(map[string]*breaker),
+			superuserCheckers: []string{"flaky"},
+			aclCheckers:       []string{"flaky"},
+			superuserPolicy:   NewErrorPolicy(map[string]string{"superuser_error_policy": "stale"}, "superuser"),
+		}
+
+		granted, err := b.AuthAclCheck(context.Background(), "clientid", "test1", "test/topic", 1)
+		So(granted, ShouldBeTrue)
+		So(err, ShouldBeNil)
+
+		flaky.down = true
+
+		Convey("Known superusers should still be granted", func() {
+			granted, err := b.AuthAclCheck(context.Background(), "clientid", "test1", "test/topic", 1)
+			So(granted, ShouldBeTrue)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Unknown users should get the error", func() {
+			granted, err := b.AuthAclCheck(context.Background(), "clientid", "test2", "test/topic", 1)
+			So(granted, ShouldBeFalse)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Dry runs should use the policy but not add to it", func() {
+			flaky.down = false
+			granted, err := b.AuthAclCheck(WithDryRun(context.Background()), "clientid", "test2", "test/topic", 1)
+			So(granted, ShouldBeFalse)
+			So(err, ShouldBeNil)
+			flaky.down = true
+
+			granted, err = b.AuthAclCheck(WithDryRun(context.Background()), "clientid", "test1", "test/topic", 1)
+			So(granted, ShouldBeTrue)
+			So(err, ShouldBeNil)
+
+			_, err = b.AuthAclCheck(context.Background(), "clientid", "test2", "test/topic", 1)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
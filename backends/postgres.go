@@ -1,11 +1,12 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strconv"
-	"strings"
 
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/jmoiron/sqlx"
@@ -25,6 +26,10 @@ type Postgres struct {
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
+	PskQuery       string
+	NetworkQuery   string
+	UserDenyQuery  string
+	AclDenyQuery   string
 	SSLMode        string
 	SSLCert        string
 	SSLKey         string
@@ -34,6 +39,12 @@ type Postgres struct {
 	connectTries int
 }
 
+func init() {
+	Register(postgresBackend, "pg", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewPostgres(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 func NewPostgres(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (Postgres, error) {
 
 	log.SetLevel(logLevel)
@@ -97,6 +108,22 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level, hasher hashing.
 		postgres.AclQuery = aclQuery
 	}
 
+	if pskQuery, ok := authOpts["pg_pskquery"]; ok {
+		postgres.PskQuery = pskQuery
+	}
+
+	if networkQuery, ok := authOpts["pg_networkquery"]; ok {
+		postgres.NetworkQuery = networkQuery
+	}
+
+	if userDenyQuery, ok := authOpts["pg_userdenyquery"]; ok {
+		postgres.UserDenyQuery = userDenyQuery
+	}
+
+	if aclDenyQuery, ok := authOpts["pg_acldenyquery"]; ok {
+		postgres.AclDenyQuery = aclDenyQuery
+	}
+
 	checkSSL := true
 
 	if sslmode, ok := authOpts["pg_sslmode"]; ok {
@@ -162,9 +189,14 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level, hasher hashing.
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Postgres) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding its queries.
+func (o Postgres) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
 
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -191,6 +223,11 @@ func (o Postgres) GetUser(username, password, clientid string) (bool, error) {
 
 //GetSuperuser checks that the username meets the superuser query.
 func (o Postgres) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding its queries.
+func (o Postgres) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
 
 	//If there's no superuser query, return false.
 	if o.SuperuserQuery == "" {
@@ -198,7 +235,7 @@ func (o Postgres) GetSuperuser(username string) (bool, error) {
 	}
 
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.DB.GetContext(ctx, &count, o.SuperuserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -225,6 +262,11 @@ func (o Postgres) GetSuperuser(username string) (bool, error) {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclContext(context.Background(), username, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding its queries.
+func (o Postgres) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
 
 	//If there's no acl query, assume all privileges for all users.
 	if o.AclQuery == "" {
@@ -233,7 +275,7 @@ func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) (bool, e
 
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.DB.SelectContext(ctx, &acls, o.AclQuery, username, acc)
 
 	if err != nil {
 		log.Debugf("PG check acl error: %s", err)
@@ -241,9 +283,8 @@ func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) (bool, e
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if topics.Match(aclTopic, topic) {
+		aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+		if ok && topics.Match(aclTopic, topic) {
 			return true, nil
 		}
 	}
@@ -252,6 +293,128 @@ func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) (bool, e
 
 }
 
+//Explain tells what the superuser query returned, or the row returned by the acl query that matched the topic.
+func (o Postgres) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	return explainQueries(ctx, o.DB, "pg", o.SuperuserQuery, o.AclQuery, check, username, topic, clientid, acc)
+}
+
+//GetPskKey returns the hex encoded pre-shared key for the given identity using the psk query.
+func (o Postgres) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+
+	//If there's no psk query, there are no keys to look for.
+	if o.PskQuery == "" {
+		return "", nil
+	}
+
+	var key sql.NullString
+	err := o.DB.GetContext(ctx, &key, o.PskQuery, identity)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("PG get psk key error: %s", err)
+		return "", err
+	}
+
+	if !key.Valid {
+		log.Debugf("PG get psk key error: identity %s not found", identity)
+		return "", nil
+	}
+
+	return key.String, nil
+
+}
+
+//GetPasswordHash returns the stored password hash for the given user using the user query.
+func (o Postgres) GetPasswordHash(ctx context.Context, username string) (string, error) {
+
+	var pwHash sql.NullString
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("PG get password hash error: %s", err)
+		return "", err
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("PG get password hash error: user %s not found", username)
+		return "", nil
+	}
+
+	return pwHash.String, nil
+
+}
+
+//ChecksNetworks tells whether there's a network query to keep users to some networks.
+func (o Postgres) ChecksNetworks() bool {
+	return o.NetworkQuery != ""
+}
+
+//GetNetworkRules returns the networks the user may log in from using the network query.
+func (o Postgres) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	rules, err := queryNetworks(ctx, o.DB, "pg", o.NetworkQuery, username)
+	if err != nil {
+		log.Debugf("PG get network rules error: %s", err)
+	}
+
+	return rules, err
+}
+
+//UserDenied denies users the user deny query returns a row for, whatever their password.
+func (o Postgres) UserDenied(ctx context.Context, username string) (Result, error) {
+	result, err := queryUserDeny(ctx, o.DB, "pg", o.UserDenyQuery, username)
+	if err != nil {
+		log.Debugf("PG user deny query error: %s", err)
+	}
+
+	return result, err
+}
+
+//UserVerdict denies users the user deny query returns a row for, and is GetUserContext otherwise.
+func (o Postgres) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+	result, err := o.UserDenied(ctx, username)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Verdict == Deny {
+		return result, nil
+	}
+
+	return resultOf(o.GetUserContext(ctx, username, password, clientid))
+}
+
+//SuperuserVerdict is GetSuperuserContext, there's no query to deny superusers.
+func (o Postgres) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return resultOf(o.GetSuperuserContext(ctx, username))
+}
+
+//AclVerdict denies topics matching a row returned by the acl deny query, and is CheckAclContext otherwise.
+func (o Postgres) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+	result, err := queryAclDeny(ctx, o.DB, "pg", o.AclDenyQuery, username, topic, clientid, acc)
+	if err != nil {
+		log.Debugf("PG acl deny query error: %s", err)
+		return result, err
+	}
+
+	if result.Verdict == Deny {
+		return result, nil
+	}
+
+	return resultOf(o.CheckAclContext(ctx, username, topic, clientid, acc))
+}
+
+//Ping checks that the database can be reached.
+func (o Postgres) Ping(ctx context.Context) error {
+	return o.DB.PingContext(ctx)
+}
+
 //GetName returns the backend's name
 func (o Postgres) GetName() string {
 	return "Postgres"
@@ -10,6 +10,7 @@ import (
 
 	goredis "github.com/go-redis/redis/v8"
 	. "github.com/iegomez/mosquitto-go-auth/backends/constants"
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	log "github.com/sirupsen/logrus"
@@ -24,7 +25,10 @@ type RedisClient interface {
 	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *goredis.StatusCmd
 	SAdd(ctx context.Context, key string, members ...interface{}) *goredis.IntCmd
 	Expire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd
+	Del(ctx context.Context, keys ...string) *goredis.IntCmd
+	Incr(ctx context.Context, key string) *goredis.IntCmd
 	ReloadState(ctx context.Context) error
+	ForEachMaster(ctx context.Context, fn func(ctx context.Context, client *goredis.Client) error) error
 }
 
 type SingleRedisClient struct {
@@ -37,6 +41,21 @@ func (c SingleRedisClient) ReloadState(ctx context.Context) error {
 	return SingleClientError
 }
 
+// ForEachMaster calls fn with the client itself, the only master there is.
+func (c SingleRedisClient) ForEachMaster(ctx context.Context, fn func(ctx context.Context, client *goredis.Client) error) error {
+	return fn(ctx, c.Client)
+}
+
+// ClusterRedisClient is a Redis Cluster client, whose state reloads can't fail.
+type ClusterRedisClient struct {
+	*goredis.ClusterClient
+}
+
+func (c ClusterRedisClient) ReloadState(ctx context.Context) error {
+	c.ClusterClient.ReloadState(ctx)
+	return nil
+}
+
 type Redis struct {
 	Host             string
 	Port             string
@@ -45,10 +64,17 @@ type Redis struct {
 	DB               int32
 	conn             RedisClient
 	disableSuperuser bool
+	checkNetworks    bool
 	ctx              context.Context
 	hasher           hashing.HashComparer
 }
 
+func init() {
+	Register(redisBackend, "redis", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewRedis(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 func NewRedis(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (Redis, error) {
 
 	log.SetLevel(logLevel)
@@ -66,6 +92,10 @@ func NewRedis(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 		redis.disableSuperuser = true
 	}
 
+	if authOpts["redis_check_networks"] == "true" {
+		redis.checkNetworks = true
+	}
+
 	if redisHost, ok := authOpts["redis_host"]; ok {
 		redis.Host = redisHost
 	}
@@ -103,7 +133,7 @@ func NewRedis(authOpts map[string]string, logLevel log.Level, hasher hashing.Has
 				Addrs:    addresses,
 				Password: redis.Password,
 			})
-		redis.conn = clusterClient
+		redis.conn = ClusterRedisClient{ClusterClient: clusterClient}
 	} else {
 		addr := fmt.Sprintf("%s:%s", redis.Host, redis.Port)
 
@@ -139,22 +169,27 @@ func isMovedError(err error) bool {
 }
 
 //GetUser checks that the username exists and the given password hashes to the same password.
-func (o Redis) GetUser(username, password, _ string) (bool, error) {
-	ok, err := o.getUser(username, password)
+func (o Redis) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding its commands.
+func (o Redis) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	ok, err := o.getUser(ctx, username, password)
 	if err == nil {
 		return ok, nil
 	}
 
 	//If using Redis Cluster, reload state and attempt once more.
 	if isMovedError(err) {
-		err = o.conn.ReloadState(o.ctx)
+		err = o.conn.ReloadState(ctx)
 		if err != nil {
 			log.Debugf("redis reload state error: %s", err)
 			return false, err
 		}
 
 		//Retry once.
-		ok, err = o.getUser(username, password)
+		ok, err = o.getUser(ctx, username, password)
 	}
 
 	if err != nil {
@@ -163,8 +198,8 @@ func (o Redis) GetUser(username, password, _ string) (bool, error) {
 	return ok, err
 }
 
-func (o Redis) getUser(username, password string) (bool, error) {
-	pwHash, err := o.conn.Get(o.ctx, username).Result()
+func (o Redis) getUser(ctx context.Context, username, password string) (bool, error) {
+	pwHash, err := o.conn.Get(ctx, username).Result()
 	if err == goredis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -180,25 +215,30 @@ func (o Redis) getUser(username, password string) (bool, error) {
 
 //GetSuperuser checks that the key username:su exists and has value "true".
 func (o Redis) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding its commands.
+func (o Redis) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
 	if o.disableSuperuser {
 		return false, nil
 	}
 
-	ok, err := o.getSuperuser(username)
+	ok, err := o.getSuperuser(ctx, username)
 	if err == nil {
 		return ok, nil
 	}
 
 	//If using Redis Cluster, reload state and attempt once more.
 	if isMovedError(err) {
-		err = o.conn.ReloadState(o.ctx)
+		err = o.conn.ReloadState(ctx)
 		if err != nil {
 			log.Debugf("redis reload state error: %s", err)
 			return false, err
 		}
 
 		//Retry once.
-		ok, err = o.getSuperuser(username)
+		ok, err = o.getSuperuser(ctx, username)
 	}
 
 	if err != nil {
@@ -208,8 +248,8 @@ func (o Redis) GetSuperuser(username string) (bool, error) {
 	return ok, err
 }
 
-func (o Redis) getSuperuser(username string) (bool, error) {
-	isSuper, err := o.conn.Get(o.ctx, fmt.Sprintf("%s:su", username)).Result()
+func (o Redis) getSuperuser(ctx context.Context, username string) (bool, error) {
+	isSuper, err := o.conn.Get(ctx, fmt.Sprintf("%s:su", username)).Result()
 	if err == goredis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -223,22 +263,28 @@ func (o Redis) getSuperuser(username string) (bool, error) {
 	return false, nil
 }
 
+//CheckAcl checks the acls stored for the user and the common ones against topic and acc.
 func (o Redis) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
-	ok, err := o.checkAcl(username, topic, clientid, acc)
+	return o.CheckAclContext(context.Background(), username, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding its commands.
+func (o Redis) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	ok, err := o.checkAcl(ctx, username, topic, clientid, acc)
 	if err == nil {
 		return ok, nil
 	}
 
 	//If using Redis Cluster, reload state and attempt once more.
 	if isMovedError(err) {
-		err = o.conn.ReloadState(o.ctx)
+		err = o.conn.ReloadState(ctx)
 		if err != nil {
 			log.Debugf("redis reload state error: %s", err)
 			return false, err
 		}
 
 		//Retry once.
-		ok, err = o.checkAcl(username, topic, clientid, acc)
+		ok, err = o.checkAcl(ctx, username, topic, clientid, acc)
 	}
 
 	if err != nil {
@@ -248,121 +294,373 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) (bool, erro
 }
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
-func (o Redis) checkAcl(username, topic, clientid string, acc int32) (bool, error) {
+func (o Redis) checkAcl(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	set, _, err := o.matchAcl(ctx, username, topic, clientid, acc)
+	if err != nil {
+		return false, err
+	}
 
-	var acls []string       //User specific acls.
-	var commonAcls []string //Common acls.
+	return set != "", nil
+}
 
+//aclSets returns the sets holding the user specific acls and the common ones for acc.
+func aclSets(username string, acc int32) ([]string, []string) {
 	//We need to check if client is subscribing, reading or publishing to get correct acls.
 	switch acc {
 	case MOSQ_ACL_SUBSCRIBE:
-		//Get all user subscribe acls.
-		var err error
-		acls, err = o.conn.SMembers(o.ctx, fmt.Sprintf("%s:sacls", username)).Result()
+		return []string{fmt.Sprintf("%s:sacls", username)}, []string{"common:sacls"}
+	case MOSQ_ACL_READ:
+		return []string{fmt.Sprintf("%s:racls", username), fmt.Sprintf("%s:rwacls", username)}, []string{"common:racls", "common:rwacls"}
+	case MOSQ_ACL_WRITE:
+		return []string{fmt.Sprintf("%s:wacls", username), fmt.Sprintf("%s:rwacls", username)}, []string{"common:wacls", "common:rwacls"}
+	}
+
+	return nil, nil
+}
+
+//matchAcl returns the set and the member in it matching topic, or empty strings when none does.
+//Common acls get their placeholders replaced, such as %c and %u by the clientid and username.
+func (o Redis) matchAcl(ctx context.Context, username, topic, clientid string, acc int32) (string, string, error) {
+	userSets, commonSets := aclSets(username, acc)
+
+	for _, set := range userSets {
+		acls, err := o.conn.SMembers(ctx, set).Result()
 		if err == goredis.Nil {
-			return false, nil
+			return "", "", nil
 		} else if err != nil {
-			return false, err
+			return "", "", err
 		}
 
-		//Get common subscribe acls.
-		commonAcls, err = o.conn.SMembers(o.ctx, "common:sacls").Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+		for _, acl := range acls {
+			if topics.Match(acl, topic) {
+				return set, acl, nil
+			}
 		}
+	}
 
-	case MOSQ_ACL_READ:
-		//Get all user read and readwrite acls.
-		urAcls, err := o.conn.SMembers(o.ctx, fmt.Sprintf("%s:racls", username)).Result()
+	for _, set := range commonSets {
+		acls, err := o.conn.SMembers(ctx, set).Result()
 		if err == goredis.Nil {
-			return false, nil
+			return "", "", nil
 		} else if err != nil {
-			return false, err
+			return "", "", err
 		}
-		urwAcls, err := o.conn.SMembers(o.ctx, fmt.Sprintf("%s:rwacls", username)).Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+
+		for _, acl := range acls {
+			aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+			if ok && topics.Match(aclTopic, topic) {
+				return set, acl, nil
+			}
 		}
+	}
 
-		//Get common read and readwrite acls
-		rAcls, err := o.conn.SMembers(o.ctx, "common:racls").Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+	return "", "", nil
+}
+
+//UserVerdict denies users whose key username:deny is set, its value telling why, and is GetUserContext otherwise.
+func (o Redis) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+	result, err := o.userVerdict(ctx, username, password)
+	if err == nil {
+		return result, nil
+	}
+
+	//If using Redis Cluster, reload state and attempt once more.
+	if isMovedError(err) {
+		err = o.conn.ReloadState(ctx)
+		if err != nil {
+			log.Debugf("redis reload state error: %s", err)
+			return Result{}, err
 		}
-		rwAcls, err := o.conn.SMembers(o.ctx, "common:rwacls").Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+
+		//Retry once.
+		result, err = o.userVerdict(ctx, username, password)
+	}
+
+	if err != nil {
+		log.Debugf("redis user verdict error: %s", err)
+	}
+	return result, err
+}
+
+func (o Redis) userVerdict(ctx context.Context, username, password string) (Result, error) {
+	result, err := o.userDenied(ctx, username)
+	if err != nil || result.Verdict == Deny {
+		return result, err
+	}
+
+	return resultOf(o.getUser(ctx, username, password))
+}
+
+//UserDenied denies users whose key username:deny is set, its value telling why, whatever their password.
+func (o Redis) UserDenied(ctx context.Context, username string) (Result, error) {
+	result, err := o.userDenied(ctx, username)
+	if err == nil {
+		return result, nil
+	}
+
+	//If using Redis Cluster, reload state and attempt once more.
+	if isMovedError(err) {
+		err = o.conn.ReloadState(ctx)
+		if err != nil {
+			log.Debugf("redis reload state error: %s", err)
+			return Result{}, err
 		}
 
-		acls = make([]string, len(urAcls)+len(urwAcls))
-		acls = append(acls, urAcls...)
-		acls = append(acls, urwAcls...)
+		//Retry once.
+		result, err = o.userDenied(ctx, username)
+	}
 
-		commonAcls = make([]string, len(rAcls)+len(rwAcls))
-		commonAcls = append(commonAcls, rAcls...)
-		commonAcls = append(commonAcls, rwAcls...)
-	case MOSQ_ACL_WRITE:
-		//Get all user write and readwrite acls.
-		uwAcls, err := o.conn.SMembers(o.ctx, fmt.Sprintf("%s:wacls", username)).Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+	if err != nil {
+		log.Debugf("redis user deny error: %s", err)
+	}
+	return result, err
+}
+
+func (o Redis) userDenied(ctx context.Context, username string) (Result, error) {
+	key := fmt.Sprintf("%s:deny", username)
+	reason, err := o.conn.Get(ctx, key).Result()
+	if err == goredis.Nil {
+		return Result{Verdict: Abstain}, nil
+	} else if err != nil {
+		return Result{}, err
+	}
+
+	if reason == "" {
+		reason = fmt.Sprintf("key %s is set", key)
+	}
+	return denied(reason), nil
+}
+
+//SuperuserVerdict is GetSuperuserContext, superusers can't be denied explicitly.
+func (o Redis) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return resultOf(o.GetSuperuserContext(ctx, username))
+}
+
+//AclVerdict denies topics matching a member of the username:dacls or common:dacls sets whatever the access,
+//and is CheckAclContext otherwise.
+func (o Redis) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+	result, err := o.aclVerdict(ctx, username, topic, clientid, acc)
+	if err == nil {
+		return result, nil
+	}
+
+	//If using Redis Cluster, reload state and attempt once more.
+	if isMovedError(err) {
+		err = o.conn.ReloadState(ctx)
+		if err != nil {
+			log.Debugf("redis reload state error: %s", err)
+			return Result{}, err
 		}
-		urwAcls, err := o.conn.SMembers(o.ctx, fmt.Sprintf("%s:rwacls", username)).Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+
+		//Retry once.
+		result, err = o.aclVerdict(ctx, username, topic, clientid, acc)
+	}
+
+	if err != nil {
+		log.Debugf("redis acl verdict error: %s", err)
+	}
+	return result, err
+}
+
+func (o Redis) aclVerdict(ctx context.Context, username, topic, clientid string, acc int32) (Result, error) {
+	userSet := fmt.Sprintf("%s:dacls", username)
+	acls, err := o.conn.SMembers(ctx, userSet).Result()
+	if err != nil && err != goredis.Nil {
+		return Result{}, err
+	}
+
+	for _, acl := range acls {
+		if topics.Match(acl, topic) {
+			return denied(fmt.Sprintf("member of %s matches: %s", userSet, acl)), nil
 		}
+	}
 
-		//Get common write and readwrite acls
-		wAcls, err := o.conn.SMembers(o.ctx, "common:wacls").Result()
-		if err == goredis.Nil {
-			return false, nil
-		} else if err != nil {
-			return false, err
+	acls, err = o.conn.SMembers(ctx, "common:dacls").Result()
+	if err != nil && err != goredis.Nil {
+		return Result{}, err
+	}
+
+	for _, acl := range acls {
+		aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+		if ok && topics.Match(aclTopic, topic) {
+			return denied(fmt.Sprintf("member of common:dacls matches: %s", acl)), nil
 		}
-		rwAcls, err := o.conn.SMembers(o.ctx, "common:rwacls").Result()
+	}
+
+	return resultOf(o.checkAcl(ctx, username, topic, clientid, acc))
+}
+
+//Explain tells the value of the superuser key for superuser checks, and the set member matching the topic for acl checks.
+func (o Redis) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	switch check {
+	case superuserCheck:
+		if o.disableSuperuser {
+			return "superusers disabled by redis_disable_superuser", nil
+		}
+
+		isSuper, err := o.conn.Get(ctx, fmt.Sprintf("%s:su", username)).Result()
 		if err == goredis.Nil {
-			return false, nil
+			return fmt.Sprintf("key %s:su is not set", username), nil
 		} else if err != nil {
-			return false, err
+			return "", err
+		}
+
+		return fmt.Sprintf("key %s:su is %q", username, isSuper), nil
+	case aclCheck:
+		set, member, err := o.matchAcl(ctx, username, topic, clientid, acc)
+		if err != nil {
+			return "", err
 		}
 
-		acls = make([]string, len(uwAcls)+len(urwAcls))
-		acls = append(acls, uwAcls...)
-		acls = append(acls, urwAcls...)
+		if set == "" {
+			userSets, commonSets := aclSets(username, acc)
+			return fmt.Sprintf("no member of sets %s matches", strings.Join(append(userSets, commonSets...), ", ")), nil
+		}
 
-		commonAcls = make([]string, len(wAcls)+len(rwAcls))
-		commonAcls = append(commonAcls, wAcls...)
-		commonAcls = append(commonAcls, rwAcls...)
+		return fmt.Sprintf("member %s of set %s matches", member, set), nil
 	}
 
-	//Now loop through acls looking for a match.
-	for _, acl := range acls {
-		if topics.Match(acl, topic) {
-			return true, nil
+	return "", nil
+}
+
+//GetPskKey returns the hex encoded pre-shared key stored at identity:psk.
+func (o Redis) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+	key, err := o.getPskKey(ctx, identity)
+	if err == nil {
+		return key, nil
+	}
+
+	//If using Redis Cluster, reload state and attempt once more.
+	if isMovedError(err) {
+		err = o.conn.ReloadState(ctx)
+		if err != nil {
+			log.Debugf("redis reload state error: %s", err)
+			return "", err
 		}
+
+		//Retry once.
+		key, err = o.getPskKey(ctx, identity)
 	}
 
-	for _, acl := range commonAcls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if topics.Match(aclTopic, topic) {
-			return true, nil
+	if err != nil {
+		log.Debugf("redis get psk key error: %s", err)
+	}
+
+	return key, err
+}
+
+func (o Redis) getPskKey(ctx context.Context, identity string) (string, error) {
+	key, err := o.conn.Get(ctx, fmt.Sprintf("%s:psk", identity)).Result()
+	if err == goredis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+//GetPasswordHash returns the password hash stored at username.
+func (o Redis) GetPasswordHash(ctx context.Context, username string) (string, error) {
+	pwHash, err := o.getPasswordHash(ctx, username)
+	if err == nil {
+		return pwHash, nil
+	}
+
+	//If using Redis Cluster, reload state and attempt once more.
+	if isMovedError(err) {
+		err = o.conn.ReloadState(ctx)
+		if err != nil {
+			log.Debugf("redis reload state error: %s", err)
+			return "", err
 		}
+
+		//Retry once.
+		pwHash, err = o.getPasswordHash(ctx, username)
 	}
 
-	return false, nil
+	if err != nil {
+		log.Debugf("redis get password hash error: %s", err)
+	}
+
+	return pwHash, err
+}
+
+func (o Redis) getPasswordHash(ctx context.Context, username string) (string, error) {
+	pwHash, err := o.conn.Get(ctx, username).Result()
+	if err == goredis.Nil {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return pwHash, nil
+}
+
+//ChecksNetworks tells whether redis_check_networks is enabled.
+func (o Redis) ChecksNetworks() bool {
+	return o.checkNetworks
+}
+
+//GetNetworkRules returns the ranges of the common:allow_cidrs and common:deny_cidrs sets, which apply to everyone,
+//and those of the username:allow_cidrs and username:deny_cidrs sets.
+func (o Redis) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	rules, err := o.getNetworkRules(ctx, username)
+	if err == nil {
+		return rules, nil
+	}
+
+	//If using Redis Cluster, reload state and attempt once more.
+	if isMovedError(err) {
+		err = o.conn.ReloadState(ctx)
+		if err != nil {
+			log.Debugf("redis reload state error: %s", err)
+			return nil, err
+		}
+
+		//Retry once.
+		rules, err = o.getNetworkRules(ctx, username)
+	}
+
+	if err != nil {
+		log.Debugf("redis get network rules error: %s", err)
+	}
+
+	return rules, err
+}
+
+func (o Redis) getNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	var rules []networks.Rules
+
+	for _, prefix := range []string{"common", username} {
+		var r networks.Rules
+
+		for _, rule := range []string{"allow", "deny"} {
+			set := fmt.Sprintf("%s:%s_cidrs", prefix, rule)
+
+			cidrs, err := o.conn.SMembers(ctx, set).Result()
+			if err == goredis.Nil {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			for _, cidr := range cidrs {
+				if err := r.Add(rule, cidr); err != nil {
+					return nil, fmt.Errorf("invalid member of set %s: %s", set, err)
+				}
+			}
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+//Ping checks that redis can be reached.
+func (o Redis) Ping(ctx context.Context) error {
+	return o.conn.Ping(ctx).Err()
 }
 
 //GetName returns the backend's name
@@ -188,6 +188,39 @@ func testRedis(ctx context.Context, t *testing.T, authOpts map[string]string) {
 	assert.True(t, tt1)
 	assert.False(t, tt2)
 
+	// Assert that users and topics can be denied explicitly.
+	redis.conn.Set(ctx, username+":deny", "banned", 0)
+	result, err := redis.UserVerdict(ctx, username, userPass, "")
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Verdict: Deny, Reason: "banned"}, result)
+
+	result, err = redis.UserVerdict(ctx, "wrong-user", userPass, "")
+	assert.Nil(t, err)
+	assert.Equal(t, Abstain, result.Verdict)
+
+	// Denies don't depend on the password, so they apply to SCRAM logins too.
+	result, err = redis.UserDenied(ctx, username)
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Verdict: Deny, Reason: "banned"}, result)
+
+	result, err = redis.UserDenied(ctx, "wrong-user")
+	assert.Nil(t, err)
+	assert.Equal(t, Abstain, result.Verdict)
+
+	redis.conn.SAdd(ctx, username+":dacls", "readable/#")
+	redis.conn.SAdd(ctx, "common:dacls", "denied/%c")
+	result, err = redis.AclVerdict(ctx, username, "readable/topic", clientID, MOSQ_ACL_READ, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Verdict: Deny, Reason: "member of test:dacls matches: readable/#"}, result)
+
+	result, err = redis.AclVerdict(ctx, "unknown", "denied/"+clientID, clientID, MOSQ_ACL_WRITE, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, Result{Verdict: Deny, Reason: "member of common:dacls matches: denied/%c"}, result)
+
+	result, err = redis.AclVerdict(ctx, username, "subscribable/topic", clientID, MOSQ_ACL_SUBSCRIBE, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, Allow, result.Verdict)
+
 	//Empty db
 	redis.conn.FlushDB(context.Background())
 	redis.Halt()
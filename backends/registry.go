@@ -0,0 +1,107 @@
+package backends
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/iegomez/mosquitto-go-auth/config"
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Factory builds a backend from the plugin options. hasher is the one set for the backend's options prefix
+// when it's registered as needing one, and nil otherwise.
+// Backends implementing only the original Backend interface may be returned wrapped with NewLegacyBackend.
+type Factory func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error)
+
+// Metadata describes what a registered backend supports.
+type Metadata struct {
+	// Checks lists the checks, among user, superuser and acl, the backend may be registered for.
+	// It supports all of them when empty.
+	Checks []string
+	// Options are the kinds of the options the backend takes, without their prefix, so that they're validated
+	// and known to config files. Options common to every backend, such as register or hasher ones, needn't be given.
+	Options map[string]config.Kind
+	// NeedsHasher tells whether the factory should be given a hasher to compare passwords.
+	NeedsHasher bool
+}
+
+type registration struct {
+	prefix  string
+	factory Factory
+	Metadata
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]registration)
+)
+
+// Register makes a backend available by name to the backends option, reading its options from the ones starting
+// with optsPrefix and an underscore, e.g. pg_host for the postgres backend. It's meant to be called from init
+// functions, both by the backends in this package and by packages built into the plugin that add their own.
+// Register panics if factory is nil, or the name is already taken or has a colon, which separates instance names.
+func Register(name, optsPrefix string, factory Factory, meta Metadata) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("backends: Register factory is nil for backend " + name)
+	}
+
+	if strings.Contains(name, ":") {
+		panic("backends: Register called with a colon in backend name " + name)
+	}
+
+	if _, ok := registry[name]; ok {
+		panic("backends: Register called twice for backend " + name)
+	}
+
+	for _, check := range meta.Checks {
+		if check != userCheck && check != superuserCheck && check != aclCheck {
+			panic(fmt.Sprintf("backends: unknown check %s for backend %s", check, name))
+		}
+	}
+
+	registry[name] = registration{prefix: optsPrefix, factory: factory, Metadata: meta}
+	config.AddBackend(name, optsPrefix, meta.Options)
+}
+
+// Registered returns the names of the registered backends, sorted.
+func Registered() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func lookupBackend(name string) (registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, ok := registry[name]
+	return r, ok
+}
+
+// supports tells whether the backend may be registered for check.
+func (r registration) supports(check string) bool {
+	if len(r.Checks) == 0 {
+		return true
+	}
+
+	for _, c := range r.Checks {
+		if c == check {
+			return true
+		}
+	}
+
+	return false
+}
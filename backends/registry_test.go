@@ -0,0 +1,113 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/iegomez/mosquitto-go-auth/config"
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// ruleHasher is the hasher the rule backend was built with.
+var ruleHasher hashing.HashComparer
+
+// The rule backend is registered as one from another package would be, only supporting superuser and acl checks.
+func init() {
+	Register("rule", "rule", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		if authOpts["rule_fail"] == "true" {
+			return nil, fmt.Errorf("rule_fail is set")
+		}
+		ruleHasher = hasher
+		return ruleBackend{}, nil
+	}, Metadata{
+		Checks:      []string{superuserCheck, aclCheck},
+		Options:     map[string]config.Kind{"fail": config.BoolKind},
+		NeedsHasher: true,
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+
+	Convey("Built in and registered backends should be listed", t, func() {
+		registered := Registered()
+		So(registered, ShouldContain, filesBackend)
+		So(registered, ShouldContain, pluginBackend)
+		So(registered, ShouldContain, "rule")
+		So(OptsPrefix(postgresBackend), ShouldEqual, "pg")
+	})
+
+	Convey("Registering a taken name, a nil factory or an unknown check should panic", t, func() {
+		factory := func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+			return ruleBackend{}, nil
+		}
+
+		So(func() { Register(filesBackend, "other", factory, Metadata{}) }, ShouldPanic)
+		So(func() { Register("nil", "nil", nil, Metadata{}) }, ShouldPanic)
+		So(func() { Register("unknown", "unknown", factory, Metadata{Checks: []string{"psk"}}) }, ShouldPanic)
+	})
+
+	Convey("Registered backends should be built from the backends option", t, func() {
+		authOpts := map[string]string{
+			"backends":            "files, rule",
+			"files_password_path": pwPath,
+			"rule_hasher":         "bcrypt",
+		}
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		So(ruleHasher, ShouldNotBeNil)
+
+		Convey("They should only be registered for the checks they support", func() {
+			checkers := b.Checkers()
+			So(checkers[userCheck], ShouldResemble, []string{filesBackend})
+			So(checkers[superuserCheck], ShouldResemble, []string{filesBackend, "rule"})
+			So(checkers[aclCheck], ShouldResemble, []string{filesBackend, "rule"})
+		})
+
+		Convey("They should be asked for their checks", func() {
+			granted, err := b.AuthAclCheck(context.Background(), "clientid", "someadmin", "any/topic", 1)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+		})
+	})
+
+	Convey("Registering a backend for a check it doesn't support should fail", t, func() {
+		authOpts := map[string]string{
+			"backends":      "rule",
+			"rule_register": "user, acl",
+		}
+
+		_, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "backend rule doesn't support user checks")
+	})
+
+	Convey("Factory errors and unknown backends should make Initialize fail", t, func() {
+		_, err := Initialize(map[string]string{"backends": "rule", "rule_fail": "true"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "rule_fail is set")
+
+		_, err = Initialize(map[string]string{"backends": "files, ldap"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "unknown backend ldap")
+	})
+
+	Convey("The options of registered backends should be validated", t, func() {
+		problems := config.Validate([]config.Option{
+			{Key: "backends", Value: "rule", File: "mosquitto.conf", Line: 1},
+			{Key: "rule_fail", Value: "maybe", File: "mosquitto.conf", Line: 2},
+			{Key: "rule_register", Value: "acl", File: "mosquitto.conf", Line: 3},
+		})
+
+		So(problems, ShouldHaveLength, 1)
+		So(problems[0].Key, ShouldEqual, "rule_fail")
+		So(problems[0].Message, ShouldContainSubstring, "must be true or false")
+	})
+}
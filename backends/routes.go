@@ -0,0 +1,312 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultSeparator ends username prefixes unless prefix_separator says otherwise.
+const defaultSeparator = "_"
+
+type listenerKey struct{}
+
+// WithListener returns a copy of ctx carrying the port of the listener the client a check is made for connected to.
+func WithListener(ctx context.Context, port int) context.Context {
+	return context.WithValue(ctx, listenerKey{}, port)
+}
+
+// ListenerFrom returns the listener port carried by ctx, or 0 if it's unknown.
+func ListenerFrom(ctx context.Context) int {
+	port, _ := ctx.Value(listenerKey{}).(int)
+	return port
+}
+
+// route sends the checks of the clients it matches to a single backend. Every condition given must match:
+// a username prefix, a username regex, a clientid regex and a listener port.
+type route struct {
+	backend string
+	// prefixes are the username prefixes routed to the backend, followed by separator in usernames.
+	prefixes  []string
+	separator string
+	username  *regexp.Regexp
+	clientid  *regexp.Regexp
+	listeners map[int]bool
+	// strip tells whether the matched prefix is removed from the username given to the backend.
+	strip bool
+}
+
+// match tells whether the route matches a check, returning the username to give the backend and the rule that matched.
+// Stripping removes the prefix, or when the route has no prefixes, the first group of the username regex is kept,
+// or what the regex matched is removed if it has no groups.
+func (r *route) match(username, clientid string, listener int) (bool, string, string) {
+	var rules []string
+	stripped := username
+
+	if len(r.prefixes) > 0 {
+		prefix, ok := r.prefix(username)
+		if !ok {
+			return false, "", ""
+		}
+		rules = append(rules, "prefix "+prefix)
+		if r.strip {
+			stripped = strings.TrimPrefix(username, prefix+r.separator)
+		}
+	}
+
+	if r.username != nil {
+		loc := r.username.FindStringSubmatchIndex(username)
+		if loc == nil {
+			return false, "", ""
+		}
+		rules = append(rules, fmt.Sprintf("username matches %s", r.username))
+		if r.strip && len(r.prefixes) == 0 {
+			if len(loc) > 2 && loc[2] >= 0 {
+				stripped = username[loc[2]:loc[3]]
+			} else {
+				stripped = username[:loc[0]] + username[loc[1]:]
+			}
+		}
+	}
+
+	if r.clientid != nil {
+		if !r.clientid.MatchString(clientid) {
+			return false, "", ""
+		}
+		rules = append(rules, fmt.Sprintf("clientid matches %s", r.clientid))
+	}
+
+	if len(r.listeners) > 0 {
+		if !r.listeners[listener] {
+			return false, "", ""
+		}
+		rules = append(rules, fmt.Sprintf("listener %d", listener))
+	}
+
+	return true, stripped, strings.Join(rules, ", ")
+}
+
+// prefix returns the route's prefix username starts with, followed by the separator.
+func (r *route) prefix(username string) (string, bool) {
+	for _, prefix := range r.prefixes {
+		if strings.HasPrefix(username, prefix+r.separator) {
+			return prefix, true
+		}
+	}
+
+	return "", false
+}
+
+// setRoutes reads the routes of the backends, in the order of the backends option. A backend's route is given by its
+// <prefix>_prefixes, <prefix>_username_regex, <prefix>_clientid_regex and <prefix>_listeners options, and by its item
+// of the prefixes option when check_prefix is true. Clients matching no route are checked by the backend of route_default
+// when it's given, and by every backend otherwise.
+func (b *Backends) setRoutes(authOpts map[string]string, backends []string) error {
+	b.routes = nil
+	b.defaultRoute = ""
+
+	legacy := legacyPrefixes(authOpts, backends)
+
+	for _, bename := range backends {
+		prefix := OptsPrefix(bename)
+		r := route{
+			backend:   bename,
+			prefixes:  splitOption(authOpts[prefix+"_prefixes"]),
+			separator: backendOption(authOpts, prefix, "prefix_separator", defaultSeparator),
+			listeners: make(map[int]bool),
+		}
+
+		if p, ok := legacy[bename]; ok {
+			r.prefixes = append(r.prefixes, p)
+		}
+
+		var err error
+		if r.username, err = routeRegexp(authOpts, prefix+"_username_regex"); err != nil {
+			return err
+		}
+		if r.clientid, err = routeRegexp(authOpts, prefix+"_clientid_regex"); err != nil {
+			return err
+		}
+
+		for _, item := range splitOption(authOpts[prefix+"_listeners"]) {
+			port, err := strconv.Atoi(item)
+			if err != nil || port < 1 {
+				return fmt.Errorf("invalid port %s found for %s_listeners", item, prefix)
+			}
+			r.listeners[port] = true
+		}
+
+		if len(r.prefixes) == 0 && r.username == nil && r.clientid == nil && len(r.listeners) == 0 {
+			continue
+		}
+
+		// JWT tokens aren't valid with their prefix, so it's stripped by default.
+		strip := backendOption(authOpts, prefix, "strip_prefix", strconv.FormatBool(backendType(bename) == jwtBackend))
+		r.strip = strip == "true"
+
+		log.Infof("checks of clients matching %s are routed to backend %s", r.describe(), bename)
+		b.routes = append(b.routes, r)
+	}
+
+	if name, ok := authOpts["route_default"]; ok && strings.TrimSpace(name) != "" {
+		name = strings.TrimSpace(name)
+		if _, ok := b.backends[name]; !ok {
+			return fmt.Errorf("backend %s of route_default isn't in backends", name)
+		}
+
+		log.Infof("checks of clients matching no route are routed to backend %s", name)
+		b.defaultRoute = name
+	}
+
+	return nil
+}
+
+// legacyPrefixes returns the prefix given for each backend by the prefixes option when check_prefix is true,
+// which must have one prefix per backend in the same order.
+func legacyPrefixes(authOpts map[string]string, backends []string) map[string]string {
+	checkPrefix, ok := authOpts["check_prefix"]
+	if !ok || strings.Replace(checkPrefix, " ", "", -1) != "true" {
+		return nil
+	}
+
+	prefixesStr, ok := authOpts["prefixes"]
+	if !ok {
+		log.Warn("Error: prefixes enabled but no options given, defaulting to prefixes disabled.")
+		return nil
+	}
+
+	prefixes := strings.Split(strings.Replace(prefixesStr, " ", "", -1), ",")
+	if len(prefixes) != len(backends) {
+		log.Errorf("Error: got %d backends and %d prefixes, defaulting to prefixes disabled.", len(backends), len(prefixes))
+		return nil
+	}
+
+	legacy := make(map[string]string, len(backends))
+	for i, backend := range backends {
+		legacy[backend] = prefixes[i]
+	}
+
+	return legacy
+}
+
+// routeRegexp compiles the regex given by option, returning nil when it's not given.
+func routeRegexp(authOpts map[string]string, option string) (*regexp.Regexp, error) {
+	expr := strings.TrimSpace(authOpts[option])
+	if expr == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", option, err)
+	}
+
+	return re, nil
+}
+
+// backendOption returns the backend's own option if given (e.g. jwt_strip_prefix), else the general one, else the default.
+func backendOption(authOpts map[string]string, prefix, name, def string) string {
+	if value, ok := authOpts[fmt.Sprintf("%s_%s", prefix, name)]; ok && strings.TrimSpace(value) != "" {
+		return strings.TrimSpace(value)
+	}
+
+	if value, ok := authOpts[name]; ok && strings.TrimSpace(value) != "" {
+		return strings.TrimSpace(value)
+	}
+
+	return def
+}
+
+// splitOption returns the items of a comma separated option, without blanks.
+func splitOption(option string) []string {
+	var items []string
+	for _, item := range strings.Split(option, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// describe tells the conditions of the route.
+func (r *route) describe() string {
+	var conditions []string
+	if len(r.prefixes) > 0 {
+		conditions = append(conditions, fmt.Sprintf("prefixes %s followed by %q", strings.Join(r.prefixes, ", "), r.separator))
+	}
+	if r.username != nil {
+		conditions = append(conditions, fmt.Sprintf("username %s", r.username))
+	}
+	if r.clientid != nil {
+		conditions = append(conditions, fmt.Sprintf("clientid %s", r.clientid))
+	}
+	if len(r.listeners) > 0 {
+		ports := make([]int, 0, len(r.listeners))
+		for port := range r.listeners {
+			ports = append(ports, port)
+		}
+		sort.Ints(ports)
+		conditions = append(conditions, fmt.Sprintf("listeners %v", ports))
+	}
+
+	return strings.Join(conditions, ", ")
+}
+
+// routing tells whether checks may be routed to a single backend.
+func (b *Backends) routing() bool {
+	return len(b.routes) > 0 || b.defaultRoute != ""
+}
+
+// lookupRoute returns the backend the checks of username and clientid are routed to, along with the username to give it,
+// or an empty backend name if routing is disabled or no route matches and there's no default one, so every backend is asked.
+func (b *Backends) lookupRoute(ctx context.Context, username, clientid string) (string, string) {
+	if !b.routing() {
+		return "", username
+	}
+
+	for i := range b.routes {
+		r := &b.routes[i]
+		if ok, stripped, rule := r.match(username, clientid, ListenerFrom(ctx)); ok {
+			log.Debugf("user %s matches %s, using backend %s.", username, rule, r.backend)
+			explainRoute(ctx, r.backend, rule, stripped)
+			return r.backend, stripped
+		}
+	}
+
+	if b.defaultRoute != "" {
+		log.Debugf("user %s matches no route, using default backend %s.", username, b.defaultRoute)
+		explainRoute(ctx, b.defaultRoute, "default route", username)
+		return b.defaultRoute, username
+	}
+
+	explainRoute(ctx, "", "", username)
+	return "", username
+}
+
+// RoutesByClientID tells whether checks may be routed depending on the clientid.
+func (b *Backends) RoutesByClientID() bool {
+	for _, r := range b.routes {
+		if r.clientid != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RoutesByListener tells whether checks may be routed depending on the listener the client connected to.
+func (b *Backends) RoutesByListener() bool {
+	for _, r := range b.routes {
+		if len(r.listeners) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+package backends
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRoutes(t *testing.T) {
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+
+	Convey("Routes should match when every condition given does", t, func() {
+		r := route{
+			backend:   "files",
+			prefixes:  []string{"dev", "device"},
+			separator: ":",
+			clientid:  regexp.MustCompile("^sensor-"),
+			listeners: map[int]bool{8883: true},
+		}
+
+		ok, username, rule := r.match("device:test1", "sensor-1", 8883)
+		So(ok, ShouldBeTrue)
+		So(username, ShouldEqual, "device:test1")
+		So(rule, ShouldEqual, "prefix device, clientid matches ^sensor-, listener 8883")
+
+		ok, _, _ = r.match("device_test1", "sensor-1", 8883)
+		So(ok, ShouldBeFalse)
+
+		ok, _, _ = r.match("dev:test1", "other-1", 8883)
+		So(ok, ShouldBeFalse)
+
+		ok, _, _ = r.match("dev:test1", "sensor-1", 1883)
+		So(ok, ShouldBeFalse)
+
+		// Listeners aren't known to the legacy plugin interface.
+		ok, _, _ = r.match("dev:test1", "sensor-1", 0)
+		So(ok, ShouldBeFalse)
+
+		r.strip = true
+		_, username, _ = r.match("dev:test1", "sensor-1", 8883)
+		So(username, ShouldEqual, "test1")
+	})
+
+	Convey("Stripping with a username regex should keep its first group, or remove what it matched", t, func() {
+		r := route{backend: "files", username: regexp.MustCompile(`^(.+)@devices$`), strip: true}
+
+		ok, username, rule := r.match("test1@devices", "", 0)
+		So(ok, ShouldBeTrue)
+		So(username, ShouldEqual, "test1")
+		So(rule, ShouldEqual, "username matches ^(.+)@devices$")
+
+		r.username = regexp.MustCompile(`^admin-`)
+		_, username, _ = r.match("admin-test1", "", 0)
+		So(username, ShouldEqual, "test1")
+
+		r.strip = false
+		_, username, _ = r.match("admin-test1", "", 0)
+		So(username, ShouldEqual, "admin-test1")
+	})
+
+	Convey("Given two instances of the files backend with routes", t, func() {
+		authOpts := map[string]string{
+			"backends":                    "files:users, files:acls",
+			"files_users_register":        "user",
+			"files_users_password_path":   pwPath,
+			"files_users_prefixes":        "u, user",
+			"files_users_strip_prefix":    "true",
+			"files_acls_register":         "acl",
+			"files_acls_acl_path":         aclPath,
+			"files_acls_clientid_regex":   "^acl-",
+			"files_acls_listeners":        "8883",
+			"files_acls_prefix_separator": ":",
+		}
+
+		Convey("Checks should be routed to the backend of the first route matching", func() {
+			b, err := Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer b.Halt()
+
+			So(b.RoutesByClientID(), ShouldBeTrue)
+			So(b.RoutesByListener(), ShouldBeTrue)
+
+			ctx, explanation := WithExplanation(context.Background())
+			ctx, decision := WithDecision(ctx)
+			granted, err := b.AuthUnpwdCheck(ctx, "user_test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldEqual, "files:users")
+			So(explanation.Route, ShouldEqual, "prefix user")
+			So(explanation.Username, ShouldEqual, "test1")
+
+			bename, username := b.lookupRoute(WithListener(context.Background(), 8883), "test1", "acl-1")
+			So(bename, ShouldEqual, "files:acls")
+			So(username, ShouldEqual, "test1")
+
+			bename, _ = b.lookupRoute(WithListener(context.Background(), 1883), "test1", "acl-1")
+			So(bename, ShouldBeEmpty)
+
+			granted, err = b.AuthAclCheck(WithListener(context.Background(), 8883), "acl-1", "test1", "test/topic/1", 2)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+
+			// Routed to the users instance, which isn't registered to check acls.
+			_, err = b.AuthAclCheck(context.Background(), "clientid", "u_test1", "test/topic/1", 2)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Checks matching no route should go to the default one when given", func() {
+			authOpts["route_default"] = "files:users"
+			b, err := Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer b.Halt()
+
+			ctx, explanation := WithExplanation(context.Background())
+			ctx, decision := WithDecision(ctx)
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldEqual, "files:users")
+			So(explanation.Route, ShouldEqual, "default route")
+		})
+
+		Convey("Legacy prefixes should be added to the routes of their backends", func() {
+			authOpts["check_prefix"] = "true"
+			authOpts["prefixes"] = "legacy, a"
+			b, err := Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+			defer b.Halt()
+
+			bename, username := b.lookupRoute(context.Background(), "legacy_test1", "clientid")
+			So(bename, ShouldEqual, "files:users")
+			So(username, ShouldEqual, "test1")
+
+			// The acls instance has its own separator.
+			bename, _ = b.lookupRoute(WithListener(context.Background(), 8883), "a:test1", "acl-1")
+			So(bename, ShouldEqual, "files:acls")
+
+			bename, _ = b.lookupRoute(WithListener(context.Background(), 8883), "a_test1", "acl-1")
+			So(bename, ShouldBeEmpty)
+		})
+
+		Convey("Wrong routes should be reported", func() {
+			authOpts["files_acls_clientid_regex"] = "^acl-(("
+			_, err := Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid files_acls_clientid_regex")
+
+			delete(authOpts, "files_acls_clientid_regex")
+			authOpts["files_acls_listeners"] = "tls"
+			_, err = Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "invalid port tls found for files_acls_listeners")
+
+			authOpts["files_acls_listeners"] = "8883"
+			authOpts["route_default"] = "redis"
+			_, err = Initialize(authOpts, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "backend redis of route_default isn't in backends")
+		})
+	})
+}
@@ -1,10 +1,11 @@
 package backends
 
 import (
+	"context"
 	"database/sql"
 	"strconv"
-	"strings"
 
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
 	"github.com/iegomez/mosquitto-go-auth/backends/topics"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
 	"github.com/jmoiron/sqlx"
@@ -20,11 +21,21 @@ type Sqlite struct {
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
+	PskQuery       string
+	NetworkQuery   string
+	UserDenyQuery  string
+	AclDenyQuery   string
 	hasher         hashing.HashComparer
 
 	connectTries int
 }
 
+func init() {
+	Register(sqliteBackend, "sqlite", func(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (ContextBackend, error) {
+		return NewSqlite(authOpts, logLevel, hasher)
+	}, Metadata{NeedsHasher: true})
+}
+
 func NewSqlite(authOpts map[string]string, logLevel log.Level, hasher hashing.HashComparer) (Sqlite, error) {
 
 	log.SetLevel(logLevel)
@@ -62,6 +73,22 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level, hasher hashing.Ha
 		sqlite.AclQuery = aclQuery
 	}
 
+	if pskQuery, ok := authOpts["sqlite_pskquery"]; ok {
+		sqlite.PskQuery = pskQuery
+	}
+
+	if networkQuery, ok := authOpts["sqlite_networkquery"]; ok {
+		sqlite.NetworkQuery = networkQuery
+	}
+
+	if userDenyQuery, ok := authOpts["sqlite_userdenyquery"]; ok {
+		sqlite.UserDenyQuery = userDenyQuery
+	}
+
+	if aclDenyQuery, ok := authOpts["sqlite_acldenyquery"]; ok {
+		sqlite.AclDenyQuery = aclDenyQuery
+	}
+
 	//Exit if any mandatory option is missing.
 	if !sqliteOk {
 		return sqlite, errors.Errorf("sqlite backend error: missing options: %s", missingOptions)
@@ -96,9 +123,14 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level, hasher hashing.Ha
 
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Sqlite) GetUser(username, password, clientid string) (bool, error) {
+	return o.GetUserContext(context.Background(), username, password, clientid)
+}
+
+//GetUserContext is GetUser with ctx bounding its queries.
+func (o Sqlite) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
 
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -125,6 +157,11 @@ func (o Sqlite) GetUser(username, password, clientid string) (bool, error) {
 
 //GetSuperuser checks that the username meets the superuser query.
 func (o Sqlite) GetSuperuser(username string) (bool, error) {
+	return o.GetSuperuserContext(context.Background(), username)
+}
+
+//GetSuperuserContext is GetSuperuser with ctx bounding its queries.
+func (o Sqlite) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
 
 	//If there's no superuser query, return false.
 	if o.SuperuserQuery == "" {
@@ -132,7 +169,7 @@ func (o Sqlite) GetSuperuser(username string) (bool, error) {
 	}
 
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err := o.DB.GetContext(ctx, &count, o.SuperuserQuery, username)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -159,6 +196,11 @@ func (o Sqlite) GetSuperuser(username string) (bool, error) {
 
 //CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
 func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) (bool, error) {
+	return o.CheckAclContext(context.Background(), username, topic, clientid, acc)
+}
+
+//CheckAclContext is CheckAcl with ctx bounding its queries.
+func (o Sqlite) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
 	//If there's no acl query, assume all privileges for all users.
 	if o.AclQuery == "" {
 		return true, nil
@@ -166,7 +208,7 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) (bool, err
 
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err := o.DB.SelectContext(ctx, &acls, o.AclQuery, username, acc)
 
 	if err != nil {
 		log.Debugf("sqlite check acl error: %s", err)
@@ -174,9 +216,8 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) (bool, err
 	}
 
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if topics.Match(aclTopic, topic) {
+		aclTopic, ok := replacePlaceholders(ctx, acl, username, clientid)
+		if ok && topics.Match(aclTopic, topic) {
 			return true, nil
 		}
 	}
@@ -185,6 +226,128 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) (bool, err
 
 }
 
+//Explain tells what the superuser query returned, or the row returned by the acl query that matched the topic.
+func (o Sqlite) Explain(ctx context.Context, check, username, topic, clientid string, acc int32) (string, error) {
+	return explainQueries(ctx, o.DB, "sqlite", o.SuperuserQuery, o.AclQuery, check, username, topic, clientid, acc)
+}
+
+//GetPskKey returns the hex encoded pre-shared key for the given identity using the psk query.
+func (o Sqlite) GetPskKey(ctx context.Context, hint, identity string) (string, error) {
+
+	//If there's no psk query, there are no keys to look for.
+	if o.PskQuery == "" {
+		return "", nil
+	}
+
+	var key sql.NullString
+	err := o.DB.GetContext(ctx, &key, o.PskQuery, identity)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("SQlite get psk key error: %s", err)
+		return "", err
+	}
+
+	if !key.Valid {
+		log.Debugf("SQlite get psk key error: identity %s not found", identity)
+		return "", nil
+	}
+
+	return key.String, nil
+
+}
+
+//GetPasswordHash returns the stored password hash for the given user using the user query.
+func (o Sqlite) GetPasswordHash(ctx context.Context, username string) (string, error) {
+
+	var pwHash sql.NullString
+	err := o.DB.GetContext(ctx, &pwHash, o.UserQuery, username)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+
+		log.Debugf("SQlite get password hash error: %s", err)
+		return "", err
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("SQlite get password hash error: user %s not found", username)
+		return "", nil
+	}
+
+	return pwHash.String, nil
+
+}
+
+//ChecksNetworks tells whether there's a network query to keep users to some networks.
+func (o Sqlite) ChecksNetworks() bool {
+	return o.NetworkQuery != ""
+}
+
+//GetNetworkRules returns the networks the user may log in from using the network query.
+func (o Sqlite) GetNetworkRules(ctx context.Context, username string) ([]networks.Rules, error) {
+	rules, err := queryNetworks(ctx, o.DB, "sqlite", o.NetworkQuery, username)
+	if err != nil {
+		log.Debugf("Sqlite get network rules error: %s", err)
+	}
+
+	return rules, err
+}
+
+//UserDenied denies users the user deny query returns a row for, whatever their password.
+func (o Sqlite) UserDenied(ctx context.Context, username string) (Result, error) {
+	result, err := queryUserDeny(ctx, o.DB, "sqlite", o.UserDenyQuery, username)
+	if err != nil {
+		log.Debugf("Sqlite user deny query error: %s", err)
+	}
+
+	return result, err
+}
+
+//UserVerdict denies users the user deny query returns a row for, and is GetUserContext otherwise.
+func (o Sqlite) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+	result, err := o.UserDenied(ctx, username)
+	if err != nil {
+		return result, err
+	}
+
+	if result.Verdict == Deny {
+		return result, nil
+	}
+
+	return resultOf(o.GetUserContext(ctx, username, password, clientid))
+}
+
+//SuperuserVerdict is GetSuperuserContext, there's no query to deny superusers.
+func (o Sqlite) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return resultOf(o.GetSuperuserContext(ctx, username))
+}
+
+//AclVerdict denies topics matching a row returned by the acl deny query, and is CheckAclContext otherwise.
+func (o Sqlite) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+	result, err := queryAclDeny(ctx, o.DB, "sqlite", o.AclDenyQuery, username, topic, clientid, acc)
+	if err != nil {
+		log.Debugf("Sqlite acl deny query error: %s", err)
+		return result, err
+	}
+
+	if result.Verdict == Deny {
+		return result, nil
+	}
+
+	return resultOf(o.CheckAclContext(ctx, username, topic, clientid, acc))
+}
+
+//Ping checks that the database can be reached.
+func (o Sqlite) Ping(ctx context.Context) error {
+	return o.DB.PingContext(ctx)
+}
+
 //GetName returns the backend's name
 func (o Sqlite) GetName() string {
 	return "Sqlite"
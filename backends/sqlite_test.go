@@ -1,6 +1,7 @@
 package backends
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -226,6 +227,27 @@ func TestFileSqlite(t *testing.T) {
 			So(tt1, ShouldBeFalse)
 		})
 
+		Convey("Given deny queries, verdicts should deny the users and topics they return rows for", func() {
+			sqlite.UserDenyQuery = "SELECT 'admins may not connect' FROM test_user WHERE username = ? AND is_admin = 1"
+			sqlite.AclDenyQuery = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ? AND test_acl.topic = 'test/topic/1'"
+
+			result, err := sqlite.UserVerdict(context.Background(), username, userPass, clientID)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "admins may not connect"})
+
+			result, err = sqlite.UserVerdict(context.Background(), wrongUsername, userPass, clientID)
+			So(err, ShouldBeNil)
+			So(result.Verdict, ShouldEqual, Abstain)
+
+			result, err = sqlite.AclVerdict(context.Background(), username, "test/topic/1", clientID, MOSQ_ACL_READ, nil)
+			So(err, ShouldBeNil)
+			So(result, ShouldResemble, Result{Verdict: Deny, Reason: "row 1 returned by sqlite_acldenyquery matches: test/topic/1"})
+
+			result, err = sqlite.AclVerdict(context.Background(), username, "other/topic", clientID, MOSQ_ACL_READ, nil)
+			So(err, ShouldBeNil)
+			So(result.Verdict, ShouldEqual, Abstain)
+		})
+
 		//Empty db
 		sqlite.DB.MustExec("delete from test_user where 1 = 1")
 		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
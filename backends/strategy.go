@@ -0,0 +1,205 @@
+package backends
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Strategies combining the answers of the backends registered for a check, set with <check>_strategy, e.g. acl_strategy.
+const (
+	// anyStrategy grants the check as soon as a backend grants it. It's the default.
+	anyStrategy = "any"
+	// allStrategy grants the check only when every backend grants it, rejecting it as soon as one doesn't.
+	allStrategy = "all"
+	// quorumStrategy grants the check when at least <check>_quorum backends grant it, a majority by default.
+	quorumStrategy = "quorum"
+	// firstMatchStrategy lets the first backend with an opinion, allowing or denying the check, decide it.
+	// Backends abstaining or failing are skipped.
+	firstMatchStrategy = "first-match"
+)
+
+type strategy struct {
+	name string
+	// quorum is how many backends must grant the check with the quorum strategy.
+	quorum int
+}
+
+func (s strategy) String() string {
+	if s.name == quorumStrategy {
+		return fmt.Sprintf("%s(%d)", s.name, s.quorum)
+	}
+
+	return s.name
+}
+
+// newStrategy reads the strategy of check given by the <check>_strategy and <check>_quorum options for the backends
+// registered for it. Unlike most options, unknown values are an error, as falling back to any could grant checks
+// meant to be held to every backend.
+func newStrategy(authOpts map[string]string, check string, checkers []string) (strategy, error) {
+	opt := fmt.Sprintf("%s_strategy", check)
+	s := strategy{name: strings.TrimSpace(authOpts[opt])}
+
+	switch s.name {
+	case "":
+		s.name = anyStrategy
+	case anyStrategy, allStrategy, firstMatchStrategy:
+	case quorumStrategy:
+		s.quorum = len(checkers)/2 + 1
+
+		quorumOpt := fmt.Sprintf("%s_quorum", check)
+		if value, ok := authOpts[quorumOpt]; ok {
+			quorum, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || quorum < 1 {
+				return s, fmt.Errorf("invalid %s %q, must be a positive integer", quorumOpt, value)
+			}
+			if quorum > len(checkers) {
+				return s, fmt.Errorf("%s is %d but only %d backends are registered for %s checks", quorumOpt, quorum, len(checkers), check)
+			}
+			s.quorum = quorum
+		}
+	default:
+		return s, fmt.Errorf("unknown %s %q, must be one of any, all, quorum or first-match", opt, s.name)
+	}
+
+	if s.name != anyStrategy {
+		log.Infof("%s checks combined with strategy %s", check, s)
+	}
+
+	return s, nil
+}
+
+func (b *Backends) setStrategies(authOpts map[string]string) error {
+	b.strategies = make(map[string]strategy)
+
+	for check, checkers := range b.Checkers() {
+		s, err := newStrategy(authOpts, check, checkers)
+		if err != nil {
+			return err
+		}
+		b.strategies[check] = s
+	}
+
+	return nil
+}
+
+// combine asks the backends registered for check in order, combining their answers with the check's strategy and
+// stopping as soon as the outcome is settled. It returns the backend whose answer alone decided the check, if any:
+// the one granting it with any or first-match, and the one rejecting it with all.
+// A backend denying the check explicitly rejects it with every strategy and decides it. Unless the strategy is
+// first-match, backends that may deny the check are still asked once it's granted, so they can't be overridden.
+// Failures are returned only when the other answers don't settle the check without them, or when the backend failing
+// may deny the check, as it leaves any grant in doubt.
+func (b *Backends) combine(check string, checkers []string, ask func(bename string) (Result, error)) (Result, string, error) {
+	s, ok := b.strategies[check]
+	if !ok {
+		s = strategy{name: anyStrategy}
+	}
+
+	log.Debugf("combining %s checks of backends %s with strategy %s", check, strings.Join(checkers, ", "), s)
+
+	var err, denyErr error
+	granted, rejected, failed := 0, 0, 0
+	// Once the check is granted, only the backends that may deny it are asked.
+	settled := false
+	decidedBy := ""
+	for i, bename := range checkers {
+		if settled && !b.denies(bename, check) {
+			continue
+		}
+
+		result, askErr := ask(bename)
+		if askErr != nil {
+			if err == nil {
+				err = askErr
+			}
+			if denyErr == nil && b.denies(bename, check) {
+				denyErr = askErr
+			}
+			failed++
+			continue
+		}
+
+		if result.Verdict == Deny {
+			log.Debugf("%s check denied by backend %s with strategy %s: %s", check, bename, s, result.Reason)
+			return result, bename, nil
+		}
+
+		if settled {
+			continue
+		}
+
+		ok := result.Verdict == Allow
+		if ok {
+			granted++
+		} else {
+			rejected++
+		}
+
+		switch s.name {
+		case anyStrategy:
+			if ok {
+				settled, decidedBy = true, bename
+			}
+		case allStrategy:
+			if !ok {
+				log.Debugf("%s check rejected by backend %s with strategy %s", check, bename, s)
+				return result, bename, nil
+			}
+		case firstMatchStrategy:
+			// Backends abstaining have no opinion, the first one allowing the check decides it.
+			if ok && denyErr == nil {
+				log.Debugf("%s check decided by backend %s with strategy %s", check, bename, s)
+				return result, bename, nil
+			}
+			if ok {
+				return Result{Verdict: Abstain}, "", denyErr
+			}
+		case quorumStrategy:
+			if granted >= s.quorum {
+				log.Debugf("%s check granted by %d backends with strategy %s", check, granted, s)
+				settled = true
+			} else if granted+failed+len(checkers)-i-1 < s.quorum {
+				// The quorum can't be reached even if the backends left, and the failed ones, granted the check.
+				log.Debugf("%s check rejected by %d backends with strategy %s", check, rejected, s)
+				return Result{Verdict: Abstain}, "", nil
+			}
+		}
+	}
+
+	// Every backend granted the check with all.
+	if s.name == allStrategy && granted > 0 && failed == 0 {
+		settled = true
+	}
+
+	if settled && denyErr != nil {
+		return Result{Verdict: Abstain}, "", denyErr
+	}
+
+	if settled {
+		return Result{Verdict: Allow}, decidedBy, nil
+	}
+
+	return Result{Verdict: Abstain}, "", err
+}
+
+// StrategyKey tells apart the answers to check given with strategies other than the default ones, which caches must not
+// mistake for each other, e.g. when a Redis cache is shared across configurations. It's empty when the strategies are
+// the default ones. For acl checks it covers the strategy of superuser checks too.
+func (b *Backends) StrategyKey(check string) string {
+	checks := []string{check}
+	if check == aclCheck && !b.disableSuperuser {
+		checks = []string{superuserCheck, aclCheck}
+	}
+
+	var key []string
+	for _, c := range checks {
+		if s, ok := b.strategies[c]; ok && s.name != anyStrategy {
+			key = append(key, fmt.Sprintf("%s=%s", c, s))
+		}
+	}
+
+	return strings.Join(key, " ")
+}
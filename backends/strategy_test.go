@@ -0,0 +1,207 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// voteBackend gives the same answer to every check, counting how many times it's asked.
+type voteBackend struct {
+	granted bool
+	err     error
+	asked   int
+}
+
+func (o *voteBackend) vote() (bool, error) {
+	o.asked++
+	return o.granted, o.err
+}
+
+func (o *voteBackend) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return o.vote()
+}
+
+func (o *voteBackend) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return o.vote()
+}
+
+func (o *voteBackend) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return o.vote()
+}
+
+func (o *voteBackend) GetName() string {
+	return "Vote"
+}
+
+func (o *voteBackend) Halt() {}
+
+func TestStrategies(t *testing.T) {
+	// votes builds backends named yes, also, no and fail, asked in the order given, combined with strategies.
+	votes := func(order []string, strategies map[string]strategy) (*Backends, map[string]*voteBackend) {
+		voters := map[string]*voteBackend{
+			"yes":  {granted: true},
+			"no":   {},
+			"fail": {err: errors.New("backend down")},
+			"also": {granted: true},
+		}
+
+		b := &Backends{
+			backends:          make(map[string]ContextBackend),
+			breakers:          make(map[string]*breaker),
+			timeouts:          make(map[string]time.Duration),
+			userCheckers:      order,
+			superuserCheckers: []string{},
+			aclCheckers:       order,
+			strategies:        strategies,
+		}
+		for name, voter := range voters {
+			b.backends[name] = voter
+		}
+
+		return b, voters
+	}
+
+	Convey("Without strategies the first backend granting a check should decide it", t, func() {
+		b, voters := votes([]string{"no", "fail", "yes", "also"}, nil)
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(decision.Backend, ShouldEqual, "yes")
+		So(voters["also"].asked, ShouldEqual, 0)
+	})
+
+	Convey("With the all strategy", t, func() {
+		all := map[string]strategy{userCheck: {name: allStrategy}, aclCheck: {name: allStrategy}}
+
+		Convey("Every backend should have to grant the check", func() {
+			b, _ := votes([]string{"yes", "also"}, all)
+
+			ctx, decision := WithDecision(context.Background())
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldBeEmpty)
+		})
+
+		Convey("The first backend rejecting it should decide it", func() {
+			b, voters := votes([]string{"yes", "no", "also"}, all)
+
+			ctx, decision := WithDecision(context.Background())
+			granted, err := b.AuthAclCheck(ctx, "clientid", "test1", "test/topic", 1)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+			So(decision.Backend, ShouldEqual, "no")
+			So(voters["also"].asked, ShouldEqual, 0)
+		})
+
+		Convey("A failing backend should fail it", func() {
+			b, _ := votes([]string{"yes", "fail"}, all)
+
+			granted, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+			So(err, ShouldNotBeNil)
+			So(granted, ShouldBeFalse)
+		})
+	})
+
+	Convey("With the quorum strategy", t, func() {
+		quorum := map[string]strategy{userCheck: {name: quorumStrategy, quorum: 2}}
+
+		Convey("The check should be granted once enough backends grant it", func() {
+			b, voters := votes([]string{"yes", "no", "also", "fail"}, quorum)
+
+			ctx, decision := WithDecision(context.Background())
+			granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(decision.Backend, ShouldBeEmpty)
+			So(voters["fail"].asked, ShouldEqual, 0)
+		})
+
+		Convey("The check should be rejected as soon as the quorum can't be reached", func() {
+			b, voters := votes([]string{"no", "no", "yes", "also"}, map[string]strategy{userCheck: {name: quorumStrategy, quorum: 3}})
+
+			granted, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeFalse)
+			So(voters["no"].asked, ShouldEqual, 2)
+			So(voters["yes"].asked, ShouldEqual, 0)
+		})
+
+		Convey("Failures should fail the check when they may have reached the quorum", func() {
+			b, _ := votes([]string{"yes", "fail", "no"}, quorum)
+
+			granted, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+			So(err, ShouldNotBeNil)
+			So(granted, ShouldBeFalse)
+		})
+	})
+
+	Convey("With the first-match strategy the first backend granting the check should decide it, skipping those failing or not knowing about it", t, func() {
+		b, voters := votes([]string{"fail", "no", "yes", "also"}, map[string]strategy{aclCheck: {name: firstMatchStrategy}})
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err := b.AuthAclCheck(ctx, "clientid", "test1", "test/topic", 1)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(decision.Backend, ShouldEqual, "yes")
+		So(voters["also"].asked, ShouldEqual, 0)
+	})
+
+	Convey("Strategies should be read from the options", t, func() {
+		checkers := []string{"files", "redis", "postgres"}
+
+		s, err := newStrategy(map[string]string{}, aclCheck, checkers)
+		So(err, ShouldBeNil)
+		So(s.name, ShouldEqual, anyStrategy)
+
+		s, err = newStrategy(map[string]string{"acl_strategy": "quorum"}, aclCheck, checkers)
+		So(err, ShouldBeNil)
+		So(s.quorum, ShouldEqual, 2)
+		So(s.String(), ShouldEqual, "quorum(2)")
+
+		s, err = newStrategy(map[string]string{"acl_strategy": "quorum", "acl_quorum": "3"}, aclCheck, checkers)
+		So(err, ShouldBeNil)
+		So(s.quorum, ShouldEqual, 3)
+
+		_, err = newStrategy(map[string]string{"acl_strategy": "quorum", "acl_quorum": "4"}, aclCheck, checkers)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "acl_quorum is 4 but only 3 backends are registered for acl checks")
+
+		_, err = newStrategy(map[string]string{"acl_strategy": "quorum", "acl_quorum": "0"}, aclCheck, checkers)
+		So(err, ShouldNotBeNil)
+
+		_, err = newStrategy(map[string]string{"user_strategy": "most"}, userCheck, checkers)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, `unknown user_strategy "most", must be one of any, all, quorum or first-match`)
+	})
+
+	Convey("An unknown strategy should make Initialize fail", t, func() {
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+
+		_, err := Initialize(map[string]string{"backends": "files", "files_password_path": pwPath, "acl_strategy": "most"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown acl_strategy")
+	})
+
+	Convey("Strategy keys should tell apart checks combined with strategies other than the default ones", t, func() {
+		b, _ := votes([]string{"yes"}, map[string]strategy{
+			userCheck:      {name: anyStrategy},
+			superuserCheck: {name: allStrategy},
+			aclCheck:       {name: quorumStrategy, quorum: 2},
+		})
+
+		So(b.StrategyKey(userCheck), ShouldBeEmpty)
+		So(b.StrategyKey(aclCheck), ShouldEqual, "superuser=all acl=quorum(2)")
+
+		b.disableSuperuser = true
+		So(b.StrategyKey(aclCheck), ShouldEqual, "acl=quorum(2)")
+	})
+}
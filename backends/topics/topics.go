@@ -24,3 +24,45 @@ func match(route []string, topic []string) bool {
 
 	return false
 }
+
+// Replace replaces the placeholders of an acl topic: %c and %u by clientid and username, and %{name} by the
+// field of that name, such as the fields of the client's certificate.
+// ok is false when the topic refers to a field that's missing, empty or that would change the topic's levels
+// or wildcards, in which case the acl must not match anything.
+func Replace(savedTopic, username, clientid string, fields map[string]string) (string, bool) {
+	var replaced strings.Builder
+
+	for i := 0; i < len(savedTopic); i++ {
+		if savedTopic[i] != '%' || i+1 == len(savedTopic) {
+			replaced.WriteByte(savedTopic[i])
+			continue
+		}
+
+		switch savedTopic[i+1] {
+		case 'c':
+			replaced.WriteString(clientid)
+			i++
+		case 'u':
+			replaced.WriteString(username)
+			i++
+		case '{':
+			end := strings.IndexByte(savedTopic[i:], '}')
+			if end < 0 {
+				replaced.WriteByte(savedTopic[i])
+				continue
+			}
+
+			value, ok := fields[savedTopic[i+2:i+end]]
+			if !ok || value == "" || strings.ContainsAny(value, "/+#") {
+				return "", false
+			}
+
+			replaced.WriteString(value)
+			i += end
+		default:
+			replaced.WriteByte(savedTopic[i])
+		}
+	}
+
+	return replaced.String(), true
+}
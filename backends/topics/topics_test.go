@@ -0,0 +1,52 @@
+package topics
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReplace(t *testing.T) {
+	Convey("Given certificate fields", t, func() {
+		fields := map[string]string{
+			"cn":       "sensor-1",
+			"san_dns":  "sensor-1.example.com",
+			"san_uri":  "spiffe://example.com/sensor",
+			"wildcard": "+",
+		}
+
+		Convey("Username, clientid and field placeholders should be replaced", func() {
+			topic, ok := Replace("devices/%u/%c/%{cn}/%{san_dns}", "user", "client", fields)
+			So(ok, ShouldBeTrue)
+			So(topic, ShouldEqual, "devices/user/client/sensor-1/sensor-1.example.com")
+		})
+
+		Convey("Topics without placeholders should be kept as they are", func() {
+			topic, ok := Replace("devices/100%/{cn}/%", "user", "client", nil)
+			So(ok, ShouldBeTrue)
+			So(topic, ShouldEqual, "devices/100%/{cn}/%")
+		})
+
+		Convey("Unclosed field placeholders should be kept as they are", func() {
+			topic, ok := Replace("devices/%{cn", "user", "client", fields)
+			So(ok, ShouldBeTrue)
+			So(topic, ShouldEqual, "devices/%{cn")
+		})
+
+		Convey("Missing fields should make the topic unusable", func() {
+			_, ok := Replace("devices/%{fingerprint}", "user", "client", fields)
+			So(ok, ShouldBeFalse)
+
+			_, ok = Replace("devices/%{cn}", "user", "client", nil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Fields with levels or wildcards should make the topic unusable", func() {
+			_, ok := Replace("devices/%{san_uri}", "user", "client", fields)
+			So(ok, ShouldBeFalse)
+
+			_, ok = Replace("devices/%{wildcard}/#", "user", "client", fields)
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
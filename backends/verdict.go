@@ -0,0 +1,128 @@
+package backends
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Verdict is a backend's answer to a check.
+type Verdict int
+
+const (
+	// Abstain is given when the backend has no opinion on the check, e.g. it doesn't know the user.
+	Abstain Verdict = iota
+	// Allow grants the check.
+	Allow
+	// Deny rejects the check explicitly, whatever other backends answer.
+	Deny
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	}
+
+	return "abstain"
+}
+
+// Result is a backend's verdict on a check, along with why it was given, when the backend tells.
+type Result struct {
+	Verdict Verdict
+	Reason  string
+}
+
+// VerdictBackend is implemented by backends that can deny checks explicitly, telling a user or topic they forbid
+// apart from one they don't know about. A deny stops the check, so it can't be overridden by another backend granting it.
+// Backends are only asked for verdicts on the checks listed by their <prefix>_deny option, e.g. files_deny acl,
+// and answer the bool checks of ContextBackend otherwise.
+type VerdictBackend interface {
+	UserVerdict(ctx context.Context, username, password, clientid string) (Result, error)
+	SuperuserVerdict(ctx context.Context, username string) (Result, error)
+	AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error)
+}
+
+// UserDenier is implemented by verdict backends whose user denies don't depend on the password, so they can be applied
+// to logins that don't give one, like SCRAM ones. UserDenied denies username or abstains.
+type UserDenier interface {
+	UserDenied(ctx context.Context, username string) (Result, error)
+}
+
+// resultOf turns the answer of a check that can't be denied explicitly into a Result, allowing or abstaining.
+func resultOf(ok bool, err error) (Result, error) {
+	if err != nil {
+		return Result{}, err
+	}
+
+	if ok {
+		return Result{Verdict: Allow}, nil
+	}
+
+	return Result{Verdict: Abstain}, nil
+}
+
+// allowed turns a Result back into the answer of a bool check, which is only granted when allowed.
+func allowed(result Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	return result.Verdict == Allow, nil
+}
+
+// denied returns a Result denying a check for reason.
+func denied(reason string) Result {
+	return Result{Verdict: Deny, Reason: reason}
+}
+
+// setDeniers reads the checks each backend may deny explicitly from its <prefix>_deny option.
+// Backends must implement VerdictBackend and be registered for the checks they deny.
+func (b *Backends) setDeniers(authOpts map[string]string) error {
+	b.deniers = make(map[string]map[string]bool)
+	registered := b.Checkers()
+
+	for name, backend := range b.backends {
+		opt := fmt.Sprintf("%s_deny", OptsPrefix(name))
+		option, ok := authOpts[opt]
+		if !ok || strings.TrimSpace(option) == "" {
+			continue
+		}
+
+		if _, ok := backend.(VerdictBackend); !ok {
+			return fmt.Errorf("backend %s can't deny checks explicitly", name)
+		}
+
+		checks := make(map[string]bool)
+		for _, check := range strings.Split(strings.Replace(option, " ", "", -1), ",") {
+			// There are no superuser checks to deny when superusers are disabled.
+			if check == superuserCheck && b.disableSuperuser {
+				continue
+			}
+
+			checkers, ok := registered[check]
+			if !ok {
+				return fmt.Errorf("unsupported check %s found for %s", check, opt)
+			}
+
+			if !checkRegistered(name, checkers) {
+				return fmt.Errorf("backend %s isn't registered for %s checks it should deny", name, check)
+			}
+
+			checks[check] = true
+			log.Infof("backend %s may deny %s checks explicitly", name, check)
+		}
+		b.deniers[name] = checks
+	}
+
+	return nil
+}
+
+// denies tells whether the named backend may deny check explicitly.
+func (b *Backends) denies(bename, check string) bool {
+	return b.deniers[bename][check]
+}
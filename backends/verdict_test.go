@@ -0,0 +1,324 @@
+package backends
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// verdictBackend gives the same verdict on every check, counting how many times it's asked.
+type verdictBackend struct {
+	result Result
+	err    error
+	asked  int
+}
+
+func (o *verdictBackend) verdict() (Result, error) {
+	o.asked++
+	return o.result, o.err
+}
+
+func (o *verdictBackend) UserVerdict(ctx context.Context, username, password, clientid string) (Result, error) {
+	return o.verdict()
+}
+
+func (o *verdictBackend) SuperuserVerdict(ctx context.Context, username string) (Result, error) {
+	return o.verdict()
+}
+
+func (o *verdictBackend) AclVerdict(ctx context.Context, username, topic, clientid string, acc int32, msg *AclMessage) (Result, error) {
+	return o.verdict()
+}
+
+func (o *verdictBackend) GetUserContext(ctx context.Context, username, password, clientid string) (bool, error) {
+	return allowed(o.verdict())
+}
+
+func (o *verdictBackend) GetSuperuserContext(ctx context.Context, username string) (bool, error) {
+	return allowed(o.verdict())
+}
+
+func (o *verdictBackend) CheckAclContext(ctx context.Context, username, topic, clientid string, acc int32) (bool, error) {
+	return allowed(o.verdict())
+}
+
+func (o *verdictBackend) GetName() string {
+	return "Verdict"
+}
+
+func (o *verdictBackend) Halt() {}
+
+// userDenierBackend is a verdictBackend telling its user verdict without a password.
+type userDenierBackend struct {
+	*verdictBackend
+}
+
+func (o *userDenierBackend) UserDenied(ctx context.Context, username string) (Result, error) {
+	result, err := o.verdict()
+	if result.Verdict != Deny {
+		result = Result{Verdict: Abstain}
+	}
+
+	return result, err
+}
+
+// hashBackend stores the same password hash for every user.
+type hashBackend struct {
+	voteBackend
+	hash string
+}
+
+func (o *hashBackend) GetPasswordHash(ctx context.Context, username string) (string, error) {
+	return o.hash, nil
+}
+
+func TestVerdicts(t *testing.T) {
+	// verdicts builds backends named yes, no and fail, which can't deny checks, and deny, dyes and dfail,
+	// which may deny every check, asked in the order given and combined with strategies.
+	verdicts := func(order []string, strategies map[string]strategy) (*Backends, map[string]*voteBackend, map[string]*verdictBackend) {
+		voters := map[string]*voteBackend{
+			"yes":  {granted: true},
+			"no":   {},
+			"fail": {err: errors.New("backend down")},
+		}
+		deniers := map[string]*verdictBackend{
+			"deny":  {result: denied("banned")},
+			"dyes":  {result: Result{Verdict: Allow}},
+			"dfail": {err: errors.New("backend down")},
+		}
+
+		b := &Backends{
+			backends:          make(map[string]ContextBackend),
+			breakers:          make(map[string]*breaker),
+			timeouts:          make(map[string]time.Duration),
+			userCheckers:      order,
+			superuserCheckers: []string{},
+			aclCheckers:       order,
+			strategies:        strategies,
+			deniers:           make(map[string]map[string]bool),
+		}
+		for name, voter := range voters {
+			b.backends[name] = voter
+		}
+		for name, denier := range deniers {
+			b.backends[name] = denier
+			b.deniers[name] = map[string]bool{userCheck: true, superuserCheck: true, aclCheck: true}
+		}
+
+		return b, voters, deniers
+	}
+
+	Convey("Answers of checks that can't be denied should allow or abstain", t, func() {
+		result, err := resultOf(true, nil)
+		So(err, ShouldBeNil)
+		So(result.Verdict, ShouldEqual, Allow)
+
+		result, err = resultOf(false, nil)
+		So(err, ShouldBeNil)
+		So(result.Verdict, ShouldEqual, Abstain)
+
+		_, err = resultOf(true, errors.New("backend down"))
+		So(err, ShouldNotBeNil)
+
+		granted, err := allowed(denied("banned"), nil)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+
+		So(Deny.String(), ShouldEqual, "deny")
+	})
+
+	Convey("A deny should stop the check", t, func() {
+		b, voters, _ := verdicts([]string{"no", "deny", "yes"}, nil)
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+		So(decision.Backend, ShouldEqual, "deny")
+		So(decision.Denied, ShouldBeTrue)
+		So(decision.Reason, ShouldEqual, "banned")
+		So(voters["yes"].asked, ShouldEqual, 0)
+	})
+
+	Convey("A deny should override a grant of a backend asked before", t, func() {
+		b, voters, _ := verdicts([]string{"yes", "no", "deny"}, nil)
+
+		ctx, explanation := WithExplanation(context.Background())
+		granted, err := b.AuthAclCheck(ctx, "clientid", "test1", "test/topic", 1)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+		So(voters["no"].asked, ShouldEqual, 0)
+
+		So(explanation.Steps, ShouldHaveLength, 2)
+		So(explanation.Steps[0].Granted, ShouldBeTrue)
+		So(explanation.Steps[1].Denied, ShouldBeTrue)
+		So(explanation.Steps[1].Reason, ShouldEqual, "banned")
+	})
+
+	Convey("A grant should stand when the backends that may deny it don't", t, func() {
+		b, _, deniers := verdicts([]string{"no", "yes", "dyes"}, nil)
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err := b.AuthUnpwdCheck(ctx, "test1", "test1", "clientid")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(decision.Backend, ShouldEqual, "yes")
+		So(decision.Denied, ShouldBeFalse)
+		So(deniers["dyes"].asked, ShouldEqual, 1)
+	})
+
+	Convey("A failing backend that may deny the check should leave a grant in doubt", t, func() {
+		b, _, _ := verdicts([]string{"yes", "dfail"}, nil)
+
+		granted, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(err, ShouldNotBeNil)
+		So(granted, ShouldBeFalse)
+
+		// Failures of backends that can't deny the check don't.
+		b, _, _ = verdicts([]string{"fail", "yes"}, nil)
+
+		granted, err = b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+	})
+
+	Convey("With the first-match strategy the first backend allowing the check should decide it", t, func() {
+		b, _, deniers := verdicts([]string{"no", "yes", "deny"}, map[string]strategy{aclCheck: {name: firstMatchStrategy}})
+
+		granted, err := b.AuthAclCheck(context.Background(), "clientid", "test1", "test/topic", 1)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(deniers["deny"].asked, ShouldEqual, 0)
+	})
+
+	Convey("Denies should stop checks combined with the all and quorum strategies", t, func() {
+		b, _, _ := verdicts([]string{"yes", "dyes", "deny"}, map[string]strategy{
+			userCheck: {name: allStrategy},
+			aclCheck:  {name: quorumStrategy, quorum: 2},
+		})
+
+		granted, err := b.AuthUnpwdCheck(context.Background(), "test1", "test1", "clientid")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err = b.AuthAclCheck(ctx, "clientid", "test1", "test/topic", 1)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+		So(decision.Denied, ShouldBeTrue)
+	})
+
+	Convey("A superuser deny should only stop the superuser check", t, func() {
+		b, _, _ := verdicts([]string{"yes"}, nil)
+		b.superuserCheckers = []string{"deny"}
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err := b.AuthAclCheck(ctx, "clientid", "test1", "test/topic", 1)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(decision.Backend, ShouldEqual, "yes")
+		So(decision.Superuser, ShouldBeFalse)
+	})
+
+	Convey("The checks backends may deny should be read from their deny option", t, func() {
+		pwPath, _ := filepath.Abs("../test-files/passwords")
+		aclPath, _ := filepath.Abs("../test-files/acls")
+		authOpts := map[string]string{
+			"backends":            "files",
+			"files_password_path": pwPath,
+			"files_acl_path":      aclPath,
+		}
+
+		b, err := Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(b.denies(filesBackend, aclCheck), ShouldBeFalse)
+		b.Halt()
+
+		authOpts["files_deny"] = "acl"
+		b, err = Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(b.denies(filesBackend, aclCheck), ShouldBeTrue)
+		So(b.denies(filesBackend, userCheck), ShouldBeFalse)
+
+		ctx, decision := WithDecision(context.Background())
+		granted, err := b.AuthAclCheck(ctx, "clientid", "test3", "test/denied", 1)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+		So(decision.Denied, ShouldBeTrue)
+		So(decision.Reason, ShouldEqual, fmt.Sprintf("acl file %s line 14 denies: topic deny test/denied", aclPath))
+		b.Halt()
+
+		authOpts["files_deny"] = "psk"
+		_, err = Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unsupported check psk found for files_deny")
+
+		authOpts["files_deny"] = "user"
+		authOpts["files_register"] = "acl"
+		_, err = Initialize(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "backend files isn't registered for user checks it should deny")
+
+		b, _, _ = verdicts([]string{"yes"}, nil)
+		So(b.setDeniers(map[string]string{"files_deny": "acl"}), ShouldBeNil)
+
+		b.backends[filesBackend] = &voteBackend{}
+		b.aclCheckers = []string{filesBackend}
+		err = b.setDeniers(map[string]string{"files_deny": "acl"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "backend files can't deny checks explicitly")
+	})
+	Convey("SCRAM lookups should be denied as password logins are", t, func() {
+		verifier, err := hashing.NewScramHasher(16, 4096, hashing.SHA256).Hash("scram-password")
+		So(err, ShouldBeNil)
+
+		b, _, deniers := verdicts(nil, nil)
+		b.backends["hashes"] = &hashBackend{hash: verifier}
+		for _, name := range []string{"deny", "dyes", "dfail"} {
+			b.backends["s"+name] = &userDenierBackend{deniers[name]}
+			b.deniers["s"+name] = b.deniers[name]
+		}
+
+		b.userCheckers = []string{"hashes", "sdyes"}
+		scramVerifier, err := b.AuthScramVerifierGet(context.Background(), hashing.ScramSHA256, "test1")
+		So(err, ShouldBeNil)
+		So(scramVerifier, ShouldNotBeNil)
+
+		b.userCheckers = []string{"hashes", "sdeny"}
+		ctx, decision := WithDecision(context.Background())
+		scramVerifier, err = b.AuthScramVerifierGet(ctx, hashing.ScramSHA256, "test1")
+		So(err, ShouldBeNil)
+		So(scramVerifier, ShouldBeNil)
+		So(decision.Backend, ShouldEqual, "sdeny")
+		So(decision.Denied, ShouldBeTrue)
+		So(decision.Reason, ShouldEqual, "banned")
+
+		// A failing denier leaves the login in doubt, and one needing the password can't tell.
+		b.userCheckers = []string{"hashes", "sdfail"}
+		scramVerifier, err = b.AuthScramVerifierGet(context.Background(), hashing.ScramSHA256, "test1")
+		So(err, ShouldNotBeNil)
+		So(scramVerifier, ShouldBeNil)
+
+		b.userCheckers = []string{"hashes", "dyes"}
+		scramVerifier, err = b.AuthScramVerifierGet(context.Background(), hashing.ScramSHA256, "test1")
+		So(err, ShouldNotBeNil)
+		So(scramVerifier, ShouldBeNil)
+
+		Convey("They should be refused with user strategies other than any", func() {
+			b.userCheckers = []string{"hashes", "sdyes"}
+			b.strategies = map[string]strategy{userCheck: {name: allStrategy}}
+
+			scramVerifier, err := b.AuthScramVerifierGet(context.Background(), hashing.ScramSHA256, "test1")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "SCRAM logins aren't supported with user_strategy all")
+			So(scramVerifier, ShouldBeNil)
+		})
+	})
+}
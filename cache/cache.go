@@ -46,6 +46,10 @@ type Store interface {
 	CheckAuthRecord(ctx context.Context, username, password string) (bool, bool)
 	SetACLRecord(ctx context.Context, username, topic, clientid string, acc int, granted string) error
 	CheckACLRecord(ctx context.Context, username, topic, clientid string, acc int) (bool, bool)
+	SetPskRecord(ctx context.Context, hint, identity, key string) error
+	CheckPskRecord(ctx context.Context, hint, identity string) (bool, string)
+	Flush(ctx context.Context) error
+	FlushUser(ctx context.Context, username string) error
 	Connect(ctx context.Context, reset bool) bool
 	Close()
 }
@@ -80,7 +84,7 @@ func NewSingleRedisStore(host, port, password string, db int, authExpiration, ac
 		authJitter:        authJitter,
 		aclJitter:         aclJitter,
 		refreshExpiration: refreshExpiration,
-		client:            bes.SingleRedisClient{redisClient},
+		client:            bes.SingleRedisClient{Client: redisClient},
 		h:                 sha1.New(),
 	}
 }
@@ -99,7 +103,7 @@ func NewRedisClusterStore(password string, addresses []string, authExpiration, a
 		authJitter:        authJitter,
 		aclJitter:         aclJitter,
 		refreshExpiration: refreshExpiration,
-		client:            clusterClient,
+		client:            bes.ClusterRedisClient{ClusterClient: clusterClient},
 		h:                 sha1.New(),
 	}
 }
@@ -107,13 +111,38 @@ func NewRedisClusterStore(password string, addresses []string, authExpiration, a
 func toAuthRecord(username, password string, h hash.Hash) string {
 	sum := h.Sum([]byte(fmt.Sprintf("auth-%s-%s", username, password)))
 	log.Debugf("to auth record: %v\n", sum)
-	return b64.StdEncoding.EncodeToString(sum)
+	return userPrefix(username) + b64.StdEncoding.EncodeToString(sum)
 }
 
 func toACLRecord(username, topic, clientid string, acc int, h hash.Hash) string {
 	sum := h.Sum([]byte(fmt.Sprintf("acl-%s-%s-%s-%d", username, topic, clientid, acc)))
 	log.Debugf("to auth record: %v\n", sum)
-	return b64.StdEncoding.EncodeToString(sum)
+	return userPrefix(username) + b64.StdEncoding.EncodeToString(sum)
+}
+
+func toPskRecord(hint, identity string, h hash.Hash) string {
+	sum := h.Sum([]byte(fmt.Sprintf("psk-%s-%s", hint, identity)))
+	log.Debugf("to psk record: %v\n", sum)
+	return userPrefix(identity) + b64.StdEncoding.EncodeToString(sum)
+}
+
+// userPrefix starts every record for the given user (or PSK identity) so they may be flushed together.
+// It's a Redis hash tag, which keeps them all in the same Redis Cluster slot.
+func userPrefix(username string) string {
+	return fmt.Sprintf("{%x}:", sha1.Sum([]byte(username)))
+}
+
+// recordsPattern matches the keys of every record and index, which start with a user prefix.
+var recordsPattern = "{" + strings.Repeat("[0-9a-f]", 2*sha1.Size) + "}:*"
+
+// userIndex is the Redis set holding the records of the given user.
+func userIndex(username string) string {
+	return userPrefix(username) + "records"
+}
+
+// recordIndex is the index of the user the given record belongs to.
+func recordIndex(record string) string {
+	return record[:strings.Index(record, ":")+1] + "records"
 }
 
 // Checks if an error was caused by a moved record in a Redis Cluster.
@@ -161,8 +190,11 @@ func (s *redisStore) Connect(ctx context.Context, reset bool) bool {
 		log.Infoln("started redis cache")
 		//Check if cache must be reset
 		if reset {
-			s.client.FlushDB(ctx)
-			log.Infoln("flushed redis cache")
+			if err := s.Flush(ctx); err != nil {
+				log.Errorf("couldn't flush redis cache: %s", err)
+			} else {
+				log.Infoln("flushed redis cache")
+			}
 		}
 	}
 	return true
@@ -172,6 +204,53 @@ func (s *goStore) Close() {
 	//TODO: support serializing cache for re hydration.
 }
 
+// Flush removes every record.
+func (s *goStore) Flush(ctx context.Context) error {
+	s.client.Flush()
+	return nil
+}
+
+// FlushUser removes every record for the given user.
+func (s *goStore) FlushUser(ctx context.Context, username string) error {
+	prefix := userPrefix(username)
+	for record := range s.client.Items() {
+		if strings.HasPrefix(record, prefix) {
+			s.client.Delete(record)
+		}
+	}
+
+	return nil
+}
+
+// Flush removes every record, along with the users' indexes, scanning every master of a cluster for them.
+// Other keys in the database are left alone.
+func (s *redisStore) Flush(ctx context.Context) error {
+	return s.client.ForEachMaster(ctx, func(ctx context.Context, client *goredis.Client) error {
+		iter := client.Scan(ctx, 0, recordsPattern, 100).Iterator()
+		for iter.Next(ctx) {
+			// Keys are deleted one at a time since a cluster node won't delete keys of different slots at once.
+			if err := client.Del(ctx, iter.Val()).Err(); err != nil {
+				return err
+			}
+		}
+
+		return iter.Err()
+	})
+}
+
+// FlushUser removes every record for the given user, as listed in the user's index.
+func (s *redisStore) FlushUser(ctx context.Context, username string) error {
+	index := userIndex(username)
+
+	records, err := s.client.SMembers(ctx, index).Result()
+	if err != nil {
+		return err
+	}
+
+	// Records share the user's hash tag, so they can be deleted at once even in a cluster.
+	return s.client.Del(ctx, append(records, index)...).Err()
+}
+
 func (s *redisStore) Close() {
 	s.client.Close()
 }
@@ -205,6 +284,27 @@ func (s *goStore) checkRecord(ctx context.Context, record string, expirationTime
 	return present, granted
 }
 
+// CheckPskRecord checks if a key for the hint/identity pair is present in the cache. Return if it's present and, if so, the key.
+func (s *goStore) CheckPskRecord(ctx context.Context, hint, identity string) (bool, string) {
+	record := toPskRecord(hint, identity, s.h)
+	v, present := s.client.Get(record)
+
+	if !present {
+		return false, ""
+	}
+
+	key, ok := v.(string)
+	if !ok {
+		return false, ""
+	}
+
+	if s.refreshExpiration {
+		s.client.Set(record, key, expirationWithJitter(s.authExpiration, s.authJitter))
+	}
+
+	return true, key
+}
+
 // CheckAuthRecord checks if the username/password pair is present in the cache. Return if it's present and, if so, if it was granted privileges
 func (s *redisStore) CheckAuthRecord(ctx context.Context, username, password string) (bool, bool) {
 	record := toAuthRecord(username, password, s.h)
@@ -243,23 +343,66 @@ func (s *redisStore) checkRecord(ctx context.Context, record string, expirationT
 }
 
 func (s *redisStore) getAndRefresh(ctx context.Context, record string, expirationTime time.Duration) (bool, bool, error) {
-	val, err := s.client.Get(ctx, record).Result()
+	val, err := s.getValueAndRefresh(ctx, record, expirationTime)
 	if err != nil {
 		return false, false, err
 	}
 
+	if val == "true" {
+		return true, true, nil
+	}
+
+	return true, false, nil
+}
+
+func (s *redisStore) getValueAndRefresh(ctx context.Context, record string, expirationTime time.Duration) (string, error) {
+	val, err := s.client.Get(ctx, record).Result()
+	if err != nil {
+		return "", err
+	}
+
 	if s.refreshExpiration {
 		_, err = s.client.Expire(ctx, record, expirationTime).Result()
 		if err != nil {
-			return false, false, err
+			return "", err
+		}
+
+		if err = s.expireIndex(ctx, recordIndex(record)); err != nil {
+			return "", err
 		}
 	}
 
-	if val == "true" {
-		return true, true, nil
+	return val, nil
+}
+
+// CheckPskRecord checks if a key for the hint/identity pair is present in the cache. Return if it's present and, if so, the key.
+func (s *redisStore) CheckPskRecord(ctx context.Context, hint, identity string) (bool, string) {
+	record := toPskRecord(hint, identity, s.h)
+
+	key, err := s.getValueAndRefresh(ctx, record, s.authExpiration)
+	if err == nil {
+		return true, key
 	}
 
-	return true, false, nil
+	if isMovedError(err) {
+		err = s.client.ReloadState(ctx)
+		// This should not happen, ever!
+		if err == bes.SingleClientError {
+			return false, ""
+		}
+
+		//Retry once.
+		key, err = s.getValueAndRefresh(ctx, record, s.authExpiration)
+		if err == nil {
+			return true, key
+		}
+	}
+
+	if err != goredis.Nil {
+		log.Debugf("check psk cache error: %s", err)
+	}
+
+	return false, ""
 }
 
 // SetAuthRecord sets a pair, granted option and expiration time.
@@ -278,20 +421,34 @@ func (s *goStore) SetACLRecord(ctx context.Context, username, topic, clientid st
 	return nil
 }
 
+// SetPskRecord sets a hint/identity pair's key with the auth expiration time.
+func (s *goStore) SetPskRecord(ctx context.Context, hint, identity, key string) error {
+	record := toPskRecord(hint, identity, s.h)
+	s.client.Set(record, key, expirationWithJitter(s.authExpiration, s.authJitter))
+
+	return nil
+}
+
 // SetAuthRecord sets a pair, granted option and expiration time.
 func (s *redisStore) SetAuthRecord(ctx context.Context, username, password string, granted string) error {
 	record := toAuthRecord(username, password, s.h)
-	return s.setRecord(ctx, record, granted, expirationWithJitter(s.authExpiration, s.authJitter))
+	return s.setRecord(ctx, username, record, granted, expirationWithJitter(s.authExpiration, s.authJitter))
 }
 
 //SetAclCache sets a mix, granted option and expiration time.
 func (s *redisStore) SetACLRecord(ctx context.Context, username, topic, clientid string, acc int, granted string) error {
 	record := toACLRecord(username, topic, clientid, acc, s.h)
-	return s.setRecord(ctx, record, granted, expirationWithJitter(s.aclExpiration, s.aclJitter))
+	return s.setRecord(ctx, username, record, granted, expirationWithJitter(s.aclExpiration, s.aclJitter))
+}
+
+// SetPskRecord sets a hint/identity pair's key with the auth expiration time.
+func (s *redisStore) SetPskRecord(ctx context.Context, hint, identity, key string) error {
+	record := toPskRecord(hint, identity, s.h)
+	return s.setRecord(ctx, identity, record, key, expirationWithJitter(s.authExpiration, s.authJitter))
 }
 
-func (s *redisStore) setRecord(ctx context.Context, record, granted string, expirationTime time.Duration) error {
-	err := s.set(ctx, record, granted, expirationTime)
+func (s *redisStore) setRecord(ctx context.Context, username, record, granted string, expirationTime time.Duration) error {
+	err := s.set(ctx, username, record, granted, expirationTime)
 
 	if err == nil {
 		return nil
@@ -305,12 +462,37 @@ func (s *redisStore) setRecord(ctx context.Context, record, granted string, expi
 		}
 
 		//Retry once.
-		err = s.set(ctx, record, granted, expirationTime)
+		err = s.set(ctx, username, record, granted, expirationTime)
 	}
 
 	return err
 }
 
-func (s *redisStore) set(ctx context.Context, record string, granted string, expirationTime time.Duration) error {
-	return s.client.Set(ctx, record, granted, expirationTime).Err()
+func (s *redisStore) set(ctx context.Context, username, record string, granted string, expirationTime time.Duration) error {
+	if err := s.client.Set(ctx, record, granted, expirationTime).Err(); err != nil {
+		return err
+	}
+
+	// Index the record so the user's records may be flushed. The index outlives any of them, unless expiration is refreshed,
+	// in which case it's refreshed too when records are checked.
+	index := userIndex(username)
+	if err := s.client.SAdd(ctx, index, record).Err(); err != nil {
+		return err
+	}
+
+	return s.expireIndex(ctx, index)
+}
+
+// expireIndex sets the index to expire after the longest a user's record may last, if records expire at all.
+func (s *redisStore) expireIndex(ctx context.Context, index string) error {
+	expiration := s.authExpiration + s.authJitter
+	if aclExpiration := s.aclExpiration + s.aclJitter; aclExpiration > expiration {
+		expiration = aclExpiration
+	}
+
+	if expiration <= 0 {
+		return nil
+	}
+
+	return s.client.Expire(ctx, index, expiration).Err()
 }
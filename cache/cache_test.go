@@ -156,6 +156,49 @@ func TestGoStore(t *testing.T) {
 	assert.True(t, granted)
 }
 
+func TestGoStorePsk(t *testing.T) {
+	authExpiration := 100 * time.Millisecond
+	aclExpiration := 100 * time.Millisecond
+	authJitter := 10 * time.Millisecond
+	aclJitter := 10 * time.Millisecond
+
+	store := NewGoStore(authExpiration, aclExpiration, authJitter, aclJitter, false)
+
+	ctx := context.Background()
+
+	assert.True(t, store.Connect(ctx, false))
+
+	hint := "test-hint"
+	identity := "test-identity"
+	key := "0123456789abcdef"
+
+	present, cachedKey := store.CheckPskRecord(ctx, hint, identity)
+
+	assert.False(t, present)
+	assert.Equal(t, "", cachedKey)
+
+	err := store.SetPskRecord(ctx, hint, identity, key)
+	assert.Nil(t, err)
+
+	present, cachedKey = store.CheckPskRecord(ctx, hint, identity)
+
+	assert.True(t, present)
+	assert.Equal(t, key, cachedKey)
+
+	// Another hint shouldn't share the record.
+	present, _ = store.CheckPskRecord(ctx, "other-hint", identity)
+
+	assert.False(t, present)
+
+	// Wait for it to expire.
+	time.Sleep(150 * time.Millisecond)
+
+	present, cachedKey = store.CheckPskRecord(ctx, hint, identity)
+
+	assert.False(t, present)
+	assert.Equal(t, "", cachedKey)
+}
+
 func TestRedisSingleStore(t *testing.T) {
 	authExpiration := 1000 * time.Millisecond
 	aclExpiration := 1000 * time.Millisecond
@@ -345,3 +388,87 @@ func TestRedisClusterStore(t *testing.T) {
 	assert.True(t, present)
 	assert.True(t, granted)
 }
+
+func TestGoStoreFlush(t *testing.T) {
+	store := NewGoStore(time.Minute, time.Minute, 0, 0, false)
+
+	testFlush(t, store)
+}
+
+func TestRedisSingleStoreFlush(t *testing.T) {
+	store := NewSingleRedisStore("localhost", "6379", "", 3, time.Minute, time.Minute, 0, 0, true)
+
+	assert.True(t, store.Connect(context.Background(), false))
+
+	testRedisFlush(t, store)
+
+	store.Close()
+}
+
+func TestRedisClusterStoreFlush(t *testing.T) {
+	addresses := []string{"localhost:7000", "localhost:7001", "localhost:7002"}
+	store := NewRedisClusterStore("", addresses, time.Minute, time.Minute, 0, 0, true)
+
+	assert.True(t, store.Connect(context.Background(), false))
+
+	testRedisFlush(t, store)
+
+	store.Close()
+}
+
+// testRedisFlush checks that flushing a Redis store leaves alone keys which aren't records.
+func testRedisFlush(t *testing.T, store *redisStore) {
+	ctx := context.Background()
+
+	assert.Nil(t, store.client.Set(ctx, "not-cached", "value", 0).Err())
+
+	testFlush(t, store)
+
+	value, err := store.client.Get(ctx, "not-cached").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.Nil(t, store.client.Del(ctx, "not-cached").Err())
+}
+
+func testFlush(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	for _, username := range []string{"test-user", "other-user"} {
+		assert.Nil(t, store.SetAuthRecord(ctx, username, "test-password", "true"))
+		assert.Nil(t, store.SetACLRecord(ctx, username, "test/topic", "test-client", 1, "true"))
+		assert.Nil(t, store.SetPskRecord(ctx, "test-hint", username, "0123456789abcdef"))
+	}
+
+	// Flushing a user should only remove their records.
+	assert.Nil(t, store.FlushUser(ctx, "test-user"))
+
+	present, _ := store.CheckAuthRecord(ctx, "test-user", "test-password")
+	assert.False(t, present)
+
+	present, _ = store.CheckACLRecord(ctx, "test-user", "test/topic", "test-client", 1)
+	assert.False(t, present)
+
+	present, _ = store.CheckPskRecord(ctx, "test-hint", "test-user")
+	assert.False(t, present)
+
+	present, granted := store.CheckAuthRecord(ctx, "other-user", "test-password")
+	assert.True(t, present)
+	assert.True(t, granted)
+
+	present, granted = store.CheckACLRecord(ctx, "other-user", "test/topic", "test-client", 1)
+	assert.True(t, present)
+	assert.True(t, granted)
+
+	// Flushing an unknown user is fine.
+	assert.Nil(t, store.FlushUser(ctx, "unknown-user"))
+
+	// Flushing everything should remove the rest.
+	assert.Nil(t, store.Flush(ctx))
+
+	present, _ = store.CheckAuthRecord(ctx, "other-user", "test-password")
+	assert.False(t, present)
+
+	present, _ = store.CheckPskRecord(ctx, "test-hint", "other-user")
+	assert.False(t, present)
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// New creates the store given by the plugin's cache options: a Redis one when cache_type is redis, in cluster mode
+// when cache_mode is true, or a local go-cache one otherwise. Wrong expiration options are warned about and defaulted.
+// It doesn't connect the store.
+func New(authOpts map[string]string) (Store, error) {
+
+	var aclCacheSeconds int64 = 30
+	var authCacheSeconds int64 = 30
+	var authJitterSeconds int64 = 0
+	var aclJitterSeconds int64 = 0
+
+	if authCacheSec, ok := authOpts["auth_cache_seconds"]; ok {
+		authSec, err := strconv.ParseInt(authCacheSec, 10, 64)
+		if err == nil {
+			authCacheSeconds = authSec
+		} else {
+			log.Warningf("couldn't parse authCacheSeconds (err: %s), defaulting to %d", err, authCacheSeconds)
+		}
+	}
+
+	if authJitterSec, ok := authOpts["auth_jitter_seconds"]; ok {
+		authSec, err := strconv.ParseInt(authJitterSec, 10, 64)
+		if err == nil {
+			authJitterSeconds = authSec
+		} else {
+			log.Warningf("couldn't parse authJitterSeconds (err: %s), defaulting to %d", err, authJitterSeconds)
+		}
+	}
+
+	if authJitterSeconds > authCacheSeconds {
+		authJitterSeconds = authCacheSeconds
+		log.Warningf("authJitterSeconds is larger than authCacheSeconds, defaulting to %d", authJitterSeconds)
+	}
+
+	if aclCacheSec, ok := authOpts["acl_cache_seconds"]; ok {
+		aclSec, err := strconv.ParseInt(aclCacheSec, 10, 64)
+		if err == nil {
+			aclCacheSeconds = aclSec
+		} else {
+			log.Warningf("couldn't parse aclCacheSeconds (err: %s), defaulting to %d", err, aclCacheSeconds)
+		}
+	}
+
+	if aclJitterSec, ok := authOpts["acl_jitter_seconds"]; ok {
+		aclSec, err := strconv.ParseInt(aclJitterSec, 10, 64)
+		if err == nil {
+			aclJitterSeconds = aclSec
+		} else {
+			log.Warningf("couldn't parse aclJitterSeconds (err: %s), defaulting to %d", err, aclJitterSeconds)
+		}
+	}
+
+	if aclJitterSeconds > aclCacheSeconds {
+		aclJitterSeconds = aclCacheSeconds
+		log.Warningf("aclJitterSeconds is larger than aclCacheSeconds, defaulting to %d", aclJitterSeconds)
+	}
+
+	refreshExpiration := false
+	if refresh, ok := authOpts["cache_refresh"]; ok && refresh == "true" {
+		refreshExpiration = true
+	}
+
+	if authOpts["cache_type"] != "redis" {
+		return NewGoStore(
+			time.Duration(authCacheSeconds)*time.Second,
+			time.Duration(aclCacheSeconds)*time.Second,
+			time.Duration(authJitterSeconds)*time.Second,
+			time.Duration(aclJitterSeconds)*time.Second,
+			refreshExpiration,
+		), nil
+	}
+
+	host := "localhost"
+	port := "6379"
+	db := 3
+	password := ""
+
+	if cachePassword, ok := authOpts["cache_password"]; ok {
+		password = cachePassword
+	}
+
+	if authOpts["cache_mode"] == "true" {
+		addressesOpt := authOpts["redis_cluster_addresses"]
+		if addressesOpt == "" {
+			return nil, errors.New("cache Redis cluster addresses missing")
+		}
+
+		// Take the given addresses and trim spaces from them.
+		addresses := strings.Split(addressesOpt, ",")
+		for i := 0; i < len(addresses); i++ {
+			addresses[i] = strings.TrimSpace(addresses[i])
+		}
+
+		return NewRedisClusterStore(
+			password,
+			addresses,
+			time.Duration(authCacheSeconds)*time.Second,
+			time.Duration(aclCacheSeconds)*time.Second,
+			time.Duration(authJitterSeconds)*time.Second,
+			time.Duration(aclJitterSeconds)*time.Second,
+			refreshExpiration,
+		), nil
+	}
+
+	if cacheHost, ok := authOpts["cache_host"]; ok {
+		host = cacheHost
+	}
+
+	if cachePort, ok := authOpts["cache_port"]; ok {
+		port = cachePort
+	}
+
+	if cacheDB, ok := authOpts["cache_db"]; ok {
+		parsedDB, err := strconv.ParseInt(cacheDB, 10, 32)
+		if err == nil {
+			db = int(parsedDB)
+		} else {
+			log.Warningf("couldn't parse cache db (err: %s), defaulting to %d", err, db)
+		}
+	}
+
+	return NewSingleRedisStore(
+		host,
+		port,
+		password,
+		db,
+		time.Duration(authCacheSeconds)*time.Second,
+		time.Duration(aclCacheSeconds)*time.Second,
+		time.Duration(authJitterSeconds)*time.Second,
+		time.Duration(aclJitterSeconds)*time.Second,
+		refreshExpiration,
+	), nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/backends/constants"
+	"github.com/iegomez/mosquitto-go-auth/cache"
+	"github.com/iegomez/mosquitto-go-auth/config"
+	"github.com/iegomez/mosquitto-go-auth/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// explain runs a user check and/or an acl check against the backends of a mosquitto configuration file,
+// printing how they're evaluated. It returns the exit status: 0 when every check is granted, 1 when one
+// is rejected and 2 when one fails or the checks can't be run.
+func explain(args []string) int {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	path := flags.String("c", "/etc/mosquitto/mosquitto.conf", "mosquitto configuration file")
+	username := flags.String("u", "", "username")
+	password := flags.String("p", "", "password, the user check is skipped when it's not given")
+	clientid := flags.String("i", "", "client id")
+	ip := flags.String("ip", "", "IP address the client connects from, unknown when it's not given")
+	listener := flags.Int("listener", 0, "port of the listener the client connects to, unknown when it's not given")
+	topic := flags.String("t", "", "topic, the acl check is skipped when it's not given")
+	accName := flags.String("a", "read", "access to check the topic for: read, write, subscribe or its mosquitto value")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long the checks may take")
+	flags.Parse(args)
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	if *username == "" || (!given["p"] && *topic == "") {
+		fmt.Fprintln(os.Stderr, "explain needs a username (-u), and a password (-p) and/or a topic (-t) to check")
+		flags.Usage()
+		return 2
+	}
+
+	acc, err := parseAcc(*accName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	opts, err := config.Parse(*path)
+	if err == nil {
+		opts, err = config.Expand(opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	authOpts, err := secrets.Resolve(config.Map(opts))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	limitConnectTries(authOpts)
+	log.SetLevel(log.ErrorLevel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if *ip != "" {
+		ctx = bes.WithAddress(ctx, *ip)
+	}
+
+	if *listener > 0 {
+		ctx = bes.WithListener(ctx, *listener)
+	}
+
+	backends, err := bes.Initialize(authOpts, log.ErrorLevel)
+	if err != nil {
+		fmt.Printf("error: backends: %s\n", err)
+		return 2
+	}
+	defer backends.Halt()
+
+	store := openCache(ctx, authOpts)
+	if store != nil {
+		defer store.Close()
+	}
+
+	status := 0
+
+	if given["p"] {
+		fmt.Printf("user check for %s\n", *username)
+		if store != nil {
+			// The plugin keeps logins from a known address, and answers combined with other strategies
+			// or routed by clientid or listener, apart in the cache.
+			recordPassword := *password
+			if *ip != "" {
+				recordPassword = fmt.Sprintf("%s\x00%s", *password, *ip)
+			}
+			if backends.RoutesByClientID() {
+				recordPassword = fmt.Sprintf("%s\x00%s", recordPassword, *clientid)
+			}
+			if backends.RoutesByListener() {
+				recordPassword = fmt.Sprintf("%s\x00%d", recordPassword, *listener)
+			}
+			if strategy := backends.StrategyKey("user"); strategy != "" {
+				recordPassword = fmt.Sprintf("%s\x00%s", recordPassword, strategy)
+			}
+			printCached(store.CheckAuthRecord(ctx, *username, recordPassword))
+		}
+
+		checkCtx, explanation := bes.WithExplanation(ctx)
+		checkCtx, decision := bes.WithDecision(checkCtx)
+		granted, err := backends.AuthUnpwdCheck(checkCtx, *username, *password, *clientid)
+		if code := printExplanation(explanation, decision, granted, err); code > status {
+			status = code
+		}
+	}
+
+	if *topic != "" {
+		fmt.Printf("acl check for %s on %s with access %s\n", *username, *topic, *accName)
+		if store != nil {
+			recordTopic := *topic
+			if strategy := backends.StrategyKey("acl"); strategy != "" {
+				recordTopic = fmt.Sprintf("%s\x00%s", *topic, strategy)
+			}
+			if backends.RoutesByListener() {
+				recordTopic = fmt.Sprintf("%s\x00%d", recordTopic, *listener)
+			}
+			printCached(store.CheckACLRecord(ctx, *username, recordTopic, *clientid, acc))
+		}
+
+		checkCtx, explanation := bes.WithExplanation(ctx)
+		checkCtx, decision := bes.WithDecision(checkCtx)
+		granted, err := backends.AuthAclCheck(checkCtx, *clientid, *username, *topic, acc)
+		if code := printExplanation(explanation, decision, granted, err); code > status {
+			status = code
+		}
+	}
+
+	return status
+}
+
+func parseAcc(name string) (int, error) {
+	switch name {
+	case "read":
+		return constants.MOSQ_ACL_READ, nil
+	case "write":
+		return constants.MOSQ_ACL_WRITE, nil
+	case "subscribe":
+		return constants.MOSQ_ACL_SUBSCRIBE, nil
+	}
+
+	acc, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown access %q, must be read, write, subscribe or a number", name)
+	}
+
+	return acc, nil
+}
+
+// openCache prints the cache the plugin is set to use, returning it when its records can be looked up from here,
+// which is only the case for Redis ones.
+func openCache(ctx context.Context, authOpts map[string]string) cache.Store {
+	if authOpts["cache"] != "true" {
+		fmt.Println("cache: disabled")
+		return nil
+	}
+
+	if authOpts["cache_type"] != "redis" {
+		fmt.Println("cache: go-cache, its records are kept in the broker's memory and can't be looked up from here")
+		return nil
+	}
+
+	// Looking records up must not extend them.
+	cacheOpts := make(map[string]string, len(authOpts))
+	for key, value := range authOpts {
+		cacheOpts[key] = value
+	}
+	delete(cacheOpts, "cache_refresh")
+
+	store, err := cache.New(cacheOpts)
+	if err != nil {
+		fmt.Printf("cache: redis, %s\n", err)
+		return nil
+	}
+
+	if !store.Connect(ctx, false) {
+		fmt.Println("cache: redis, couldn't connect")
+		return nil
+	}
+
+	fmt.Println("cache: redis")
+
+	return store
+}
+
+func printCached(cached, granted bool) {
+	switch {
+	case !cached:
+		fmt.Println("  cache: no record")
+	case granted:
+		fmt.Println("  cache: granted, the plugin answers from the cache until the record expires")
+	default:
+		fmt.Println("  cache: rejected, the plugin answers from the cache until the record expires")
+	}
+}
+
+// printExplanation prints the routing, the backends asked and the decision of a check, returning
+// the exit status for it.
+func printExplanation(explanation *bes.Explanation, decision *bes.Decision, granted bool, err error) int {
+	switch {
+	case !explanation.Routes:
+		fmt.Println("  routes: disabled")
+	case explanation.RouteBackend == "":
+		fmt.Println("  routes: no route matches, asking every backend")
+	default:
+		fmt.Printf("  routes: %s routes to backend %s as %s\n", explanation.Route, explanation.RouteBackend, explanation.Username)
+	}
+
+	if len(explanation.Steps) == 0 {
+		fmt.Println("  no backend asked")
+	}
+
+	for i, step := range explanation.Steps {
+		result := "rejected"
+		if step.Err != nil {
+			result = "error: " + step.Err.Error()
+		} else if step.Granted {
+			result = "granted"
+		} else if step.Denied {
+			result = "denied"
+			if step.Reason != "" {
+				result += ": " + step.Reason
+			}
+		}
+
+		fmt.Printf("  %d. %s check with %s: %s (%s)\n", i+1, step.Check, step.Backend, result, step.Duration.Round(time.Microsecond))
+		if step.Rule != "" {
+			fmt.Printf("     %s\n", step.Rule)
+		}
+		if step.RuleErr != nil {
+			fmt.Printf("     couldn't tell the rule: %s\n", step.RuleErr)
+		}
+	}
+
+	switch {
+	case err != nil:
+		// The plugin would retry and then apply the error policy.
+		fmt.Printf("  decision: error: %s\n", err)
+		return 2
+	case decision.Denied && decision.Reason != "":
+		fmt.Printf("  decision: denied by %s: %s\n", decision.Backend, decision.Reason)
+		return 1
+	case decision.Denied:
+		fmt.Printf("  decision: denied by %s\n", decision.Backend)
+		return 1
+	case !granted && decision.Backend != "":
+		fmt.Printf("  decision: rejected by %s\n", decision.Backend)
+		return 1
+	case !granted:
+		fmt.Println("  decision: rejected")
+		return 1
+	case decision.Backend == "" && decision.Superuser:
+		fmt.Println("  decision: granted, as a superuser")
+	case decision.Backend == "":
+		fmt.Println("  decision: granted")
+	case decision.Superuser:
+		fmt.Printf("  decision: granted by %s, as a superuser\n", decision.Backend)
+	default:
+		fmt.Printf("  decision: granted by %s\n", decision.Backend)
+	}
+
+	return 0
+}
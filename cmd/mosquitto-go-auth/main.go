@@ -0,0 +1,35 @@
+// Command mosquitto-go-auth helps setting the plugin up without running mosquitto.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: mosquitto-go-auth <command> [arguments]
+
+commands:
+  validate    check the plugin options in a mosquitto configuration file
+  explain     run user and acl checks, printing how the backends evaluate them
+
+Run mosquitto-go-auth <command> -h for a command's arguments.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(validate(os.Args[2:]))
+	case "explain":
+		os.Exit(explain(os.Args[2:]))
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
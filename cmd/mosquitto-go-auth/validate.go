@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/config"
+	"github.com/iegomez/mosquitto-go-auth/secrets"
+	log "github.com/sirupsen/logrus"
+)
+
+// validate checks the plugin options in a mosquitto configuration file, returning the exit status:
+// 0 when it's valid, 1 when there are errors and 2 when the file can't be read.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("c", "/etc/mosquitto/mosquitto.conf", "mosquitto configuration file")
+	connect := flags.Bool("connect", false, "also start the backends and check they can reach their databases and services")
+	timeout := flags.Duration("timeout", 10*time.Second, "how long connectivity checks may take")
+	flags.Parse(args)
+
+	opts, err := config.Parse(*path)
+	if err == nil {
+		opts, err = config.Expand(opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if len(opts) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no auth_opt_ options found\n", *path)
+		return 1
+	}
+
+	errorCount := 0
+	for _, problem := range config.Validate(opts) {
+		fmt.Println(problem)
+		if !problem.Warning {
+			errorCount++
+		}
+	}
+
+	// Backends can't be started with wrong options, and would only repeat the errors above.
+	if *connect && errorCount == 0 {
+		errorCount += checkConnectivity(config.Map(opts), *timeout)
+	}
+
+	if errorCount > 0 {
+		fmt.Printf("%d errors found in %s\n", errorCount, *path)
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", *path)
+
+	return 0
+}
+
+// checkConnectivity starts the backends as the plugin would and pings them, returning how many failed.
+func checkConnectivity(authOpts map[string]string, timeout time.Duration) int {
+	authOpts, err := secrets.Resolve(authOpts)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		return 1
+	}
+
+	limitConnectTries(authOpts)
+	log.SetLevel(log.ErrorLevel)
+
+	backends, err := bes.Initialize(authOpts, log.ErrorLevel)
+	if err != nil {
+		fmt.Printf("error: backends: %s\n", err)
+		return 1
+	}
+	defer backends.Halt()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	health := backends.Health(ctx)
+
+	names := make([]string, 0, len(health))
+	for name := range health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := 0
+	for _, name := range names {
+		if err := health[name]; err != nil {
+			fmt.Printf("error: backend %s: %s\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("backend %s: ok\n", name)
+	}
+
+	return failed
+}
+
+// limitConnectTries makes database backends try connecting once unless told otherwise, as they retry forever by default.
+// Named instances take the option with their own prefix, e.g. pg_legacy_connect_tries.
+func limitConnectTries(authOpts map[string]string) {
+	for _, name := range strings.Split(authOpts["backends"], ",") {
+		prefix := bes.OptsPrefix(strings.TrimSpace(name))
+		if prefix == "" {
+			continue
+		}
+
+		for _, option := range []string{"connect_tries", "pg_connect_tries", "mysql_connect_tries"} {
+			if _, ok := authOpts[prefix+"_"+option]; !ok {
+				authOpts[prefix+"_"+option] = "1"
+			}
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func writeFile(path, content string) {
+	So(ioutil.WriteFile(path, []byte(content), 0600), ShouldBeNil)
+}
+
+func TestParse(t *testing.T) {
+	Convey("Given a mosquitto configuration with an include_dir", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		confDir := filepath.Join(dir, "conf.d")
+		So(os.Mkdir(confDir, 0700), ShouldBeNil)
+
+		path := filepath.Join(dir, "mosquitto.conf")
+		writeFile(path, strings.Join([]string{
+			"# auth_opt_commented out",
+			"listener 1883",
+			"auth_plugin /mosquitto/go-auth.so",
+			"auth_opt_backends files, redis",
+			"  auth_opt_pg_userquery   SELECT password_hash FROM test_user WHERE username = $1 limit 1  ",
+			"include_dir " + confDir,
+			"plugin_opt_log_level debug",
+		}, "\n"))
+		writeFile(filepath.Join(confDir, "b.conf"), "auth_opt_redis_host localhost\n")
+		writeFile(filepath.Join(confDir, "a.conf"), "auth_opt_files_password_path /etc/mosquitto/passwords\n")
+		writeFile(filepath.Join(confDir, "ignored.txt"), "auth_opt_ignored true\n")
+
+		Convey("It should read options in order with their values and lines", func() {
+			opts, err := Parse(path)
+			So(err, ShouldBeNil)
+			So(opts, ShouldHaveLength, 5)
+
+			So(opts[0], ShouldResemble, Option{Key: "backends", Value: "files, redis", File: path, Line: 4})
+			So(opts[1].Value, ShouldEqual, "SELECT password_hash FROM test_user WHERE username = $1 limit 1")
+			So(opts[2].Key, ShouldEqual, "files_password_path")
+			So(opts[2].File, ShouldEqual, filepath.Join(confDir, "a.conf"))
+			So(opts[3].Key, ShouldEqual, "redis_host")
+			So(opts[4], ShouldResemble, Option{Key: "log_level", Value: "debug", File: path, Line: 7})
+		})
+
+		Convey("Options without a value should be reported", func() {
+			writeFile(path, "auth_opt_backends\n")
+
+			_, err := Parse(path)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("A missing file should be reported", t, func() {
+		_, err := Parse("/nonexistent/mosquitto.conf")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Given options for the files backend", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		passwords := filepath.Join(dir, "passwords")
+		writeFile(passwords, "test1:hash\n")
+
+		opts := []Option{
+			{Key: "backends", Value: "files", File: "mosquitto.conf", Line: 1},
+			{Key: "files_register", Value: "user, acl", File: "mosquitto.conf", Line: 2},
+			{Key: "files_password_path", Value: passwords, File: "mosquitto.conf", Line: 3},
+			{Key: "log_level", Value: "debug", File: "mosquitto.conf", Line: 4},
+		}
+
+		Convey("They should be valid", func() {
+			So(Validate(opts), ShouldBeEmpty)
+		})
+
+		Convey("Unknown options should be reported, suggesting the closest one", func() {
+			opts = append(opts,
+				Option{Key: "pg_sslroot", Value: "/etc/ssl/ca.pem", File: "mosquitto.conf", Line: 5},
+				Option{Key: "auth_cahce_seconds", Value: "30", File: "mosquitto.conf", Line: 6},
+				Option{Key: "something_else", Value: "true", File: "mosquitto.conf", Line: 7},
+			)
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 3)
+			So(problems[0].Key, ShouldEqual, "pg_sslroot")
+			So(problems[0].Message, ShouldContainSubstring, "did you mean pg_sslrootcert?")
+			So(problems[0].String(), ShouldStartWith, "mosquitto.conf:5: error: pg_sslroot:")
+			So(problems[1].Message, ShouldContainSubstring, "did you mean auth_cache_seconds?")
+			So(problems[2].Message, ShouldEqual, "unknown option")
+		})
+
+		Convey("Wrong values should be reported", func() {
+			opts[0].Value = "files, postgress"
+			opts[1].Value = "user, acls"
+			opts[2].Value = filepath.Join(dir, "missing")
+			opts = append(opts,
+				Option{Key: "retry_count", Value: "three", File: "mosquitto.conf", Line: 5},
+				Option{Key: "disable_superuser", Value: "yes", File: "mosquitto.conf", Line: 6},
+				Option{Key: "tracing_sample_ratio", Value: "1.5", File: "mosquitto.conf", Line: 7},
+				Option{Key: "network_allow", Value: "10.0.0.0/8, 10.300.0.0/16", File: "mosquitto.conf", Line: 8},
+			)
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 7)
+			So(problems[0].Message, ShouldContainSubstring, `"postgress", did you mean postgres?`)
+			So(problems[1].Message, ShouldContainSubstring, `"acls", did you mean acl?`)
+			So(problems[2].Key, ShouldEqual, "files_password_path")
+			So(problems[3].Key, ShouldEqual, "retry_count")
+			So(problems[4].Key, ShouldEqual, "disable_superuser")
+			So(problems[5].Key, ShouldEqual, "tracing_sample_ratio")
+			So(problems[6].Key, ShouldEqual, "network_allow")
+			So(problems[6].Message, ShouldContainSubstring, "10.300.0.0/16")
+		})
+
+		Convey("Missing options should be reported after the others, all at once", func() {
+			opts[0].Value = "files, postgres, jwt"
+			opts = append(opts,
+				Option{Key: "pg_dbname", Value: "go_auth_test", File: "mosquitto.conf", Line: 5},
+				Option{Key: "jwt_mode", Value: "remote", File: "mosquitto.conf", Line: 6},
+				Option{Key: "check_prefix", Value: "true", File: "mosquitto.conf", Line: 7},
+				Option{Key: "prefixes", Value: "files, pg", File: "mosquitto.conf", Line: 8},
+				Option{Key: "admin_listen", Value: ":9101", File: "mosquitto.conf", Line: 9},
+				Option{Key: "audit_sinks", Value: "webhook", File: "mosquitto.conf", Line: 10},
+			)
+
+			var missing []string
+			problems := Validate(opts)
+			for _, problem := range problems {
+				if problem.File == "" {
+					missing = append(missing, problem.Key)
+				}
+			}
+
+			So(problems[0].Key, ShouldEqual, "prefixes")
+			So(problems[0].Message, ShouldEqual, "2 prefixes given for 3 backends")
+			So(missing, ShouldResemble, []string{
+				"jwt_host", "jwt_port", "jwt_getuser_uri", "jwt_aclcheck_uri",
+				"pg_user", "pg_password", "pg_userquery",
+				"audit_key", "audit_webhook_url",
+				"admin_token",
+			})
+		})
+
+		Convey("Check orders should only list backends in backends", func() {
+			opts = append(opts,
+				Option{Key: "acl_order", Value: "files", File: "mosquitto.conf", Line: 5},
+				Option{Key: "user_order", Value: "redis, files", File: "mosquitto.conf", Line: 6},
+			)
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 1)
+			So(problems[0].Key, ShouldEqual, "user_order")
+			So(problems[0].Message, ShouldEqual, "backend redis isn't in backends")
+		})
+
+		Convey("Routes should have valid regexes and ports, and route to a backend in backends", func() {
+			opts = append(opts,
+				Option{Key: "files_prefixes", Value: "dev, device", File: "mosquitto.conf", Line: 5},
+				Option{Key: "files_username_regex", Value: "^admin-(.+$", File: "mosquitto.conf", Line: 6},
+				Option{Key: "files_clientid_regex", Value: "^sensor-", File: "mosquitto.conf", Line: 7},
+				Option{Key: "files_listeners", Value: "8883, http", File: "mosquitto.conf", Line: 8},
+				Option{Key: "route_default", Value: "redis", File: "mosquitto.conf", Line: 9},
+			)
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 3)
+			So(problems[0].Key, ShouldEqual, "files_username_regex")
+			So(problems[0].Message, ShouldContainSubstring, "missing closing )")
+			So(problems[1].Key, ShouldEqual, "files_listeners")
+			So(problems[1].Message, ShouldEqual, `"http" isn't a port number`)
+			So(problems[2].Key, ShouldEqual, "route_default")
+			So(problems[2].Message, ShouldEqual, "backend redis isn't in backends")
+		})
+
+		Convey("Options for other backends and overridden ones should only be warned about", func() {
+			opts = append(opts,
+				Option{Key: "redis_host", Value: "localhost", File: "mosquitto.conf", Line: 5},
+				Option{Key: "log_level", Value: "info", File: "mosquitto.conf", Line: 6},
+			)
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 2)
+			So(problems[0].Warning, ShouldBeTrue)
+			So(problems[0].Message, ShouldEqual, "option of the redis backend, which isn't in backends")
+			So(problems[1].Warning, ShouldBeTrue)
+			So(problems[1].Message, ShouldEqual, "overrides the value given at mosquitto.conf:4")
+		})
+
+		Convey("Referenced secrets should be checked in place of the references", func() {
+			os.Setenv("GO_AUTH_TEST_RETRIES", "three")
+			defer os.Unsetenv("GO_AUTH_TEST_RETRIES")
+
+			opts = append(opts,
+				Option{Key: "retry_count", Value: "env:GO_AUTH_TEST_RETRIES", File: "mosquitto.conf", Line: 5},
+				Option{Key: "redis_password", Value: "env:GO_AUTH_TEST_MISSING", File: "mosquitto.conf", Line: 6},
+				Option{Key: "jwt_secret", Value: "exec:vault read secret", File: "mosquitto.conf", Line: 7},
+				Option{Key: "admin_token", Value: "file:" + passwords, File: "mosquitto.conf", Line: 8},
+			)
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 5)
+			So(problems[0].Message, ShouldEqual, `"three" isn't an integer`)
+			So(problems[1].Warning, ShouldBeTrue)
+			So(problems[2].Message, ShouldEqual, "environment variable GO_AUTH_TEST_MISSING is not set")
+			So(problems[3].Warning, ShouldBeTrue)
+			So(problems[4].Message, ShouldEqual, "exec references need secrets_exec to be true")
+		})
+
+		Convey("Backends registered only for superuser checks should be reported", func() {
+			opts[1].Value = "superuser"
+
+			problems := Validate(opts)
+			So(problems, ShouldHaveLength, 1)
+			So(problems[0].Message, ShouldEqual, "no backend is registered for user or acl checks")
+		})
+	})
+
+	Convey("Named instances should be validated with their own options", t, func() {
+		opts := []Option{
+			{Key: "backends", Value: "postgres:legacy, postgres:platform, http:billing, http:", File: "mosquitto.conf", Line: 1},
+			{Key: "pg_legacy_dbname", Value: "legacy", File: "mosquitto.conf", Line: 2},
+			{Key: "pg_legacy_user", Value: "legacy", File: "mosquitto.conf", Line: 3},
+			{Key: "pg_legacy_password", Value: "legacy", File: "mosquitto.conf", Line: 4},
+			{Key: "pg_legacy_userquery", Value: "select password_hash from users where username = $1", File: "mosquitto.conf", Line: 5},
+			{Key: "pg_legacy_port", Value: "five", File: "mosquitto.conf", Line: 6},
+			{Key: "pg_platform_hots", Value: "localhost", File: "mosquitto.conf", Line: 7},
+			{Key: "pg_host", Value: "localhost", File: "mosquitto.conf", Line: 8},
+			{Key: "http_billing_register", Value: "user", File: "mosquitto.conf", Line: 9},
+			{Key: "acl_order", Value: "postgres:platform, postgres:legacy", File: "mosquitto.conf", Line: 10},
+		}
+
+		var missing []string
+		problems := Validate(opts)
+		for _, problem := range problems {
+			if problem.File == "" {
+				missing = append(missing, problem.Key)
+			}
+		}
+
+		So(problems[0].Message, ShouldContainSubstring, `invalid instance name in "http:"`)
+		So(problems[1].Key, ShouldEqual, "pg_legacy_port")
+		So(problems[2].Message, ShouldEqual, "unknown option, did you mean pg_platform_host?")
+		So(problems[3].Warning, ShouldBeTrue)
+		So(problems[3].Message, ShouldEqual, "option of the postgres backend, which isn't in backends")
+		So(missing, ShouldResemble, []string{
+			"http_billing_host", "http_billing_port", "http_billing_getuser_uri", "http_billing_aclcheck_uri",
+			"pg_platform_dbname", "pg_platform_user", "pg_platform_password", "pg_platform_userquery",
+		})
+	})
+
+	Convey("Missing backends should be reported", t, func() {
+		problems := Validate([]Option{{Key: "log_level", Value: "debug"}})
+		So(problems, ShouldHaveLength, 1)
+		So(problems[0].Key, ShouldEqual, "backends")
+	})
+}
+
+func TestReadFile(t *testing.T) {
+	Convey("Given a YAML config file with sections and lists", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "go-auth.yaml")
+		writeFile(path, strings.Join([]string{
+			"backends: [postgres, jwt]",
+			"log:",
+			"  level: debug",
+			"cache:",
+			"  enabled: true",
+			"  type: redis",
+			"postgres:",
+			"  host: localhost",
+			"  port: 5432",
+			"  register:",
+			"    - user",
+			"    - acl",
+			"jwt:",
+			"  mode: local",
+			"  postgres:",
+			"    dbname: jwt",
+			"grpc:",
+			"  ca_cert: |",
+			"    -----BEGIN CERTIFICATE-----",
+			"    -----END CERTIFICATE-----",
+			"",
+		}, "\n"))
+
+		Convey("It should map onto flat options with their lines", func() {
+			opts, err := ReadFile(path)
+			So(err, ShouldBeNil)
+			So(opts, ShouldHaveLength, 10)
+			So(opts[0], ShouldResemble, Option{Key: "backends", Value: "postgres, jwt", File: path, Line: 1})
+			So(opts[1].Key, ShouldEqual, "log_level")
+			So(opts[2], ShouldResemble, Option{Key: "cache", Value: "true", File: path, Line: 5})
+			So(opts[3].Key, ShouldEqual, "cache_type")
+			So(opts[4].Key, ShouldEqual, "pg_host")
+			So(opts[5].Value, ShouldEqual, "5432")
+			So(opts[6], ShouldResemble, Option{Key: "pg_register", Value: "user, acl", File: path, Line: 10})
+			So(opts[7].Key, ShouldEqual, "jwt_mode")
+			So(opts[8].Key, ShouldEqual, "jwt_pg_dbname")
+			So(opts[9].Key, ShouldEqual, "grpc_ca_cert")
+			So(opts[9].Value, ShouldEqual, "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n")
+		})
+
+		Convey("Sections of named instances should take their prefix", func() {
+			writeFile(path, "backends: [postgres:legacy]\npostgres:legacy:\n  host: legacy.local\n")
+
+			opts, err := ReadFile(path)
+			So(err, ShouldBeNil)
+			So(Map(opts), ShouldResemble, map[string]string{
+				"backends":       "postgres:legacy",
+				"pg_legacy_host": "legacy.local",
+			})
+		})
+
+		Convey("Missing values and nested lists should be reported with their line", func() {
+			writeFile(path, "backends: [files]\nfiles:\n  password_path:\n")
+
+			_, err := ReadFile(path)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, path+":3: files_password_path: missing value")
+
+			writeFile(path, "backends: [[files]]\n")
+
+			_, err = ReadFile(path)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, path+":1: backends: list items must be values")
+		})
+
+		Convey("JSON documents should be read too", func() {
+			writeFile(path, `{"backends": ["files"], "files": {"password_path": "/etc/mosquitto/passwords"}}`)
+
+			opts, err := ReadFile(path)
+			So(err, ShouldBeNil)
+			So(Map(opts), ShouldResemble, map[string]string{
+				"backends":            "files",
+				"files_password_path": "/etc/mosquitto/passwords",
+			})
+		})
+	})
+}
+
+func TestLoad(t *testing.T) {
+	Convey("Given options pointing to a config file", t, func() {
+		dir, err := ioutil.TempDir("", "config")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "go-auth.yaml")
+		writeFile(path, "backends: [files]\nlog_level: debug\nfiles:\n  register: [user, acl]\n  password_path: "+path+"\n")
+
+		authOpts := map[string]string{
+			"config_file": path,
+			"log_level":   "info",
+		}
+
+		Convey("The file's options should be added, the ones given directly taking precedence", func() {
+			loaded, err := Load(authOpts)
+			So(err, ShouldBeNil)
+			So(loaded["backends"], ShouldEqual, "files")
+			So(loaded["files_register"], ShouldEqual, "user, acl")
+			So(loaded["log_level"], ShouldEqual, "info")
+		})
+
+		Convey("Errors in the file's options should be reported at once", func() {
+			writeFile(path, "backends: [files]\nlog_level: verbose\nfiles:\n  register: [user, acl]\n  pasword_path: /etc/mosquitto/passwords\n")
+
+			_, err := Load(authOpts)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, path+":2: error: log_level:")
+			So(err.Error(), ShouldContainSubstring, path+":5: error: files_pasword_path: unknown option, did you mean files_password_path?")
+		})
+
+		Convey("Options without a config file should be left as they are", func() {
+			delete(authOpts, "config_file")
+
+			loaded, err := Load(authOpts)
+			So(err, ShouldBeNil)
+			So(loaded, ShouldResemble, authOpts)
+		})
+	})
+}
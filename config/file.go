@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadFile reads the options of a YAML or JSON config file, as given by auth_opt_config_file.
+// Sections nest options, their names being joined with underscores: a backend's name stands for its options
+// prefix, so host in a postgres section is pg_host, and enabled stands for the section's own option, so enabled
+// in a cache section is cache. Lists are joined with commas.
+func ReadFile(path string) ([]Option, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	// An empty document has no options.
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	r := &fileReader{path: path}
+	root := resolveAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		return nil, r.errorf(root, "expected a mapping of options")
+	}
+
+	if err := r.read(root, ""); err != nil {
+		return nil, err
+	}
+
+	return r.opts, nil
+}
+
+type fileReader struct {
+	path string
+	opts []Option
+}
+
+func (r *fileReader) errorf(node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", r.path, node.Line, fmt.Sprintf(format, args...))
+}
+
+// read adds the options of a mapping, prefixing their keys with the section they're in.
+func (r *fileReader) read(mapping *yaml.Node, prefix string) error {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		keyNode, value := mapping.Content[i], resolveAlias(mapping.Content[i+1])
+		key := joinKey(prefix, keyNode.Value)
+
+		switch value.Kind {
+		case yaml.MappingNode:
+			name := keyNode.Value
+			backend, instance := splitBackend(name)
+			if schema, ok := backendSchemas[backend]; ok {
+				name = schema.prefix
+				if instance != "" {
+					name += "_" + instance
+				}
+			}
+			if err := r.read(value, joinKey(prefix, name)); err != nil {
+				return err
+			}
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(value.Content))
+			for _, item := range value.Content {
+				item = resolveAlias(item)
+				if item.Kind != yaml.ScalarNode || item.Tag == "!!null" || item.Value == "" {
+					return r.errorf(item, "%s: list items must be values", key)
+				}
+				items = append(items, item.Value)
+			}
+			if len(items) == 0 {
+				return r.errorf(value, "%s: empty list", key)
+			}
+			r.add(keyNode, key, strings.Join(items, ", "))
+		default:
+			if value.Tag == "!!null" || value.Value == "" {
+				return r.errorf(keyNode, "%s: missing value", key)
+			}
+			if keyNode.Value == "enabled" && prefix != "" {
+				key = prefix
+			}
+			r.add(keyNode, key, value.Value)
+		}
+	}
+
+	return nil
+}
+
+func (r *fileReader) add(keyNode *yaml.Node, key, value string) {
+	r.opts = append(r.opts, Option{Key: key, Value: value, File: r.path, Line: keyNode.Line})
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	return node
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+
+	return prefix + "_" + key
+}
+
+// Expand returns opts preceded by the options of the config file given by config_file, if any,
+// so options given directly take precedence over the file's.
+func Expand(opts []Option) ([]Option, error) {
+	path, ok := Map(opts)["config_file"]
+	if !ok {
+		return opts, nil
+	}
+
+	fileOpts, err := ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(fileOpts, opts...), nil
+}
+
+// Load returns authOpts along with the options of the config file given by config_file, if any, the ones in
+// authOpts taking precedence. The file's options are validated, and every error found in them is returned at once.
+func Load(authOpts map[string]string) (map[string]string, error) {
+	path, ok := authOpts["config_file"]
+	if !ok {
+		return authOpts, nil
+	}
+
+	opts := make([]Option, 0, len(authOpts))
+	for key, value := range authOpts {
+		opts = append(opts, Option{Key: key, Value: value})
+	}
+
+	opts, err := Expand(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []string
+	for _, problem := range Validate(opts) {
+		if problem.File != path {
+			continue
+		}
+
+		if problem.Warning {
+			log.Warn(problem)
+			continue
+		}
+		failed = append(failed, problem.String())
+	}
+
+	if len(failed) > 0 {
+		return nil, errors.Errorf("invalid config file: %s", strings.Join(failed, "; "))
+	}
+
+	return Map(opts), nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Option is a plugin option as given in a mosquitto configuration file.
+type Option struct {
+	Key   string
+	Value string
+	File  string
+	Line  int
+}
+
+// Parse reads the plugin options given as auth_opt_ (or mosquitto 2's plugin_opt_) lines in the mosquitto
+// configuration file at path, following include_dir directives the way mosquitto does.
+func Parse(path string) ([]Option, error) {
+	var opts []Option
+	if err := parseFile(path, &opts); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+func parseFile(path string, opts *[]Option) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open configuration")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	// Options such as gRPC certificates may be long.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimRight(strings.TrimLeft(scanner.Text(), " \t"), " \t\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// Like mosquitto, the value is the rest of the line after the option's name.
+		name, value := text, ""
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			name, value = text[:i], strings.TrimLeft(text[i:], " \t")
+		}
+
+		switch {
+		case strings.HasPrefix(name, "auth_opt_") || strings.HasPrefix(name, "plugin_opt_"):
+			key := strings.TrimPrefix(strings.TrimPrefix(name, "auth_opt_"), "plugin_opt_")
+			if key == "" || value == "" {
+				return errors.Errorf("%s:%d: empty %s value", path, line, name)
+			}
+
+			*opts = append(*opts, Option{Key: key, Value: value, File: path, Line: line})
+		case name == "include_dir":
+			if err := parseDir(value, opts); err != nil {
+				return errors.Wrapf(err, "%s:%d", path, line)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.Wrapf(err, "couldn't read %s", path)
+	}
+
+	return nil
+}
+
+// parseDir reads the .conf files in dir in alphabetical order.
+func parseDir(dir string, opts *[]Option) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "couldn't read include_dir")
+	}
+
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".conf") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := parseFile(filepath.Join(dir, name), opts); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Map returns the options as the plugin gets them from mosquitto, later ones overriding earlier ones.
+func Map(opts []Option) map[string]string {
+	authOpts := make(map[string]string, len(opts))
+	for _, opt := range opts {
+		authOpts[opt.Key] = opt.Value
+	}
+
+	return authOpts
+}
@@ -0,0 +1,536 @@
+package config
+
+import (
+	"sort"
+	"strings"
+)
+
+// Kind is the kind of value an option takes.
+type Kind int
+
+const (
+	TextKind Kind = iota
+	IntKind
+	BoolKind
+	// RatioKind is a number between 0 and 1.
+	RatioKind
+	ListKind
+	// FileKind is the path of a file that must exist.
+	FileKind
+	// NetworksKind is a list of CIDR ranges or single addresses.
+	NetworksKind
+	// RegexKind is a regular expression.
+	RegexKind
+	// PortsKind is a list of port numbers.
+	PortsKind
+	// backendsKind is a list of backend names, which are only all known once every backend is added.
+	backendsKind
+)
+
+// spec describes the value an option takes. values, when given, lists what a text option,
+// or each item of a list, may be.
+type spec struct {
+	kind   Kind
+	values []string
+}
+
+func text() spec                   { return spec{kind: TextKind} }
+func integer() spec                { return spec{kind: IntKind} }
+func boolean() spec                { return spec{kind: BoolKind} }
+func ratio() spec                  { return spec{kind: RatioKind} }
+func file() spec                   { return spec{kind: FileKind} }
+func oneOf(values ...string) spec  { return spec{kind: TextKind, values: values} }
+func listOf(values ...string) spec { return spec{kind: ListKind, values: values} }
+func cidrs() spec                  { return spec{kind: NetworksKind} }
+func regex() spec                  { return spec{kind: RegexKind} }
+func ports() spec                  { return spec{kind: PortsKind} }
+func backendList() spec            { return spec{kind: backendsKind} }
+
+func merge(maps ...map[string]spec) map[string]spec {
+	merged := make(map[string]spec)
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
+// prefixed returns the options of m with the given prefix prepended to their names.
+func prefixed(prefix string, m map[string]spec) map[string]spec {
+	p := make(map[string]spec, len(m))
+	for k, v := range m {
+		p[prefix+"_"+k] = v
+	}
+
+	return p
+}
+
+var hasherOptions = map[string]spec{
+	"hasher":               oneOf("pbkdf2", "argon2id", "bcrypt", "scram"),
+	"hasher_salt_size":     integer(),
+	"hasher_iterations":    integer(),
+	"hasher_keylen":        integer(),
+	"hasher_algorithm":     oneOf("sha256", "sha512"),
+	"hasher_salt_encoding": oneOf("utf-8", "base64"),
+	"hasher_cost":          integer(),
+	"hasher_memory":        integer(),
+	"hasher_parallelism":   integer(),
+}
+
+// checkOptions may be given for every backend with its prefix, or for all of them without it.
+var checkOptions = map[string]spec{
+	"check_timeout":     integer(),
+	"breaker_threshold": integer(),
+	"breaker_timeout":   integer(),
+	"breaker_successes": integer(),
+}
+
+var generalOptions = merge(hasherOptions, checkOptions, map[string]spec{
+	"backends":             backendList(),
+	"user_order":           backendList(),
+	"superuser_order":      backendList(),
+	"acl_order":            backendList(),
+	"user_strategy":        oneOf("any", "all", "quorum", "first-match"),
+	"superuser_strategy":   oneOf("any", "all", "quorum", "first-match"),
+	"acl_strategy":         oneOf("any", "all", "quorum", "first-match"),
+	"user_quorum":          integer(),
+	"superuser_quorum":     integer(),
+	"acl_quorum":           integer(),
+	"config_file":          file(),
+	"log_level":            oneOf("debug", "info", "warn", "error", "fatal", "panic"),
+	"log_dest":             oneOf("stdout", "file"),
+	"log_file":             text(),
+	"retry_count":          integer(),
+	"retry_backoff_ms":     integer(),
+	"retry_backoff_max_ms": integer(),
+	"disable_superuser":    boolean(),
+	"check_prefix":         boolean(),
+	"prefixes":             listOf(),
+	"prefix_separator":     text(),
+	"strip_prefix":         boolean(),
+	"route_default":        backendList(),
+	"cert_auth":            boolean(),
+	"cert_username":        listOf(),
+	"cert_placeholders":    boolean(),
+	"network_allow":        cidrs(),
+	"network_deny":         cidrs(),
+
+	"user_error_policy":       oneOf("error", "deny", "stale"),
+	"acl_error_policy":        oneOf("error", "deny", "stale"),
+	"superuser_error_policy":  oneOf("error", "deny", "stale"),
+	"stale_max_age":           integer(),
+	"user_stale_max_age":      integer(),
+	"acl_stale_max_age":       integer(),
+	"superuser_stale_max_age": integer(),
+
+	"stale_max_entries":           integer(),
+	"user_stale_max_entries":      integer(),
+	"acl_stale_max_entries":       integer(),
+	"superuser_stale_max_entries": integer(),
+
+	"cache":               boolean(),
+	"cache_type":          oneOf("redis", "go-cache"),
+	"cache_reset":         boolean(),
+	"cache_refresh":       boolean(),
+	"cache_host":          text(),
+	"cache_port":          integer(),
+	"cache_db":            integer(),
+	"cache_password":      text(),
+	"cache_mode":          boolean(),
+	"auth_cache_seconds":  integer(),
+	"acl_cache_seconds":   integer(),
+	"auth_jitter_seconds": integer(),
+	"acl_jitter_seconds":  integer(),
+	"psk_cache":           boolean(),
+	// Read by the redis backend and by the cache in cluster mode.
+	"redis_cluster_addresses": listOf(),
+
+	"metrics_listen": text(),
+
+	"audit_sinks":            listOf("file", "syslog", "webhook", "clickhouse"),
+	"audit_key":              text(),
+	"audit_results":          listOf("granted", "rejected", "error"),
+	"audit_checks":           listOf("user", "acl", "psk", "scram"),
+	"audit_sample_rate":      ratio(),
+	"audit_buffer_size":      integer(),
+	"audit_file":             text(),
+	"audit_file_max_size_mb": integer(),
+	"audit_file_max_backups": integer(),
+	"audit_syslog_network":   oneOf("udp", "tcp"),
+	"audit_syslog_address":   text(),
+	"audit_syslog_tag":       text(),
+	"audit_webhook_url":      text(),
+	"audit_webhook_timeout":  integer(),
+	"audit_clickhouse_dsn":   text(),
+	"audit_clickhouse_table": text(),
+
+	"audit_clickhouse_batch_size":    integer(),
+	"audit_clickhouse_flush_seconds": integer(),
+	// Read by the clickhouse backend and by the clickhouse audit sink.
+	"clickhouse_dsn": text(),
+
+	"admin_listen":     text(),
+	"admin_token":      text(),
+	"admin_tls_cert":   file(),
+	"admin_tls_key":    file(),
+	"admin_readyz_ttl": integer(),
+
+	"throttle":                 boolean(),
+	"throttle_keys":            listOf("username", "clientid", "ip"),
+	"throttle_max_failures":    integer(),
+	"throttle_lockout_seconds": integer(),
+	"throttle_delay_ms":        integer(),
+	"throttle_max_delay_ms":    integer(),
+	"throttle_window_seconds":  integer(),
+	"throttle_store":           oneOf("memory", "redis"),
+	"throttle_redis_host":      text(),
+	"throttle_redis_port":      integer(),
+	"throttle_redis_password":  text(),
+	"throttle_redis_db":        integer(),
+	"throttle_redis_mode":      oneOf("cluster"),
+	"throttle_redis_addresses": listOf(),
+
+	"tracing_exporter":      oneOf("stdout", "file", "otlp"),
+	"tracing_file":          text(),
+	"tracing_otlp_endpoint": text(),
+	"tracing_otlp_insecure": boolean(),
+	"tracing_sample_ratio":  ratio(),
+	"tracing_service_name":  text(),
+
+	"secrets_exec":            boolean(),
+	"secrets_exec_timeout_ms": integer(),
+})
+
+func backendNames() []string {
+	names := make([]string, 0, len(backendSchemas))
+	for name := range backendSchemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+var pgOptions = map[string]spec{
+	"host":          text(),
+	"port":          integer(),
+	"dbname":        text(),
+	"user":          text(),
+	"password":      text(),
+	"userquery":     text(),
+	"superquery":    text(),
+	"aclquery":      text(),
+	"pskquery":      text(),
+	"sslmode":       oneOf("disable", "allow", "prefer", "require", "verify-ca", "verify-full"),
+	"sslcert":       file(),
+	"sslkey":        file(),
+	"sslrootcert":   file(),
+	"connect_tries": integer(),
+}
+
+var mysqlOptions = map[string]spec{
+	"host":                   text(),
+	"port":                   integer(),
+	"dbname":                 text(),
+	"user":                   text(),
+	"password":               text(),
+	"userquery":              text(),
+	"superquery":             text(),
+	"aclquery":               text(),
+	"pskquery":               text(),
+	"protocol":               oneOf("tcp", "unix"),
+	"socket":                 text(),
+	"sslmode":                oneOf("true", "false", "skip-verify", "preferred", "custom"),
+	"sslcert":                file(),
+	"sslkey":                 file(),
+	"sslrootcert":            file(),
+	"allow_native_passwords": boolean(),
+	"connect_tries":          integer(),
+}
+
+var remoteOptions = map[string]spec{
+	"host":          text(),
+	"port":          integer(),
+	"getuser_uri":   text(),
+	"superuser_uri": text(),
+	"aclcheck_uri":  text(),
+	"with_tls":      boolean(),
+	"verify_peer":   boolean(),
+	"response_mode": oneOf("status", "text", "json"),
+	"params_mode":   oneOf("json", "form"),
+}
+
+var jsOptions = map[string]spec{
+	"stack_depth_limit":     integer(),
+	"ms_max_duration":       integer(),
+	"user_script_path":      file(),
+	"superuser_script_path": file(),
+	"acl_script_path":       file(),
+}
+
+// backendSchema declares a backend's options, without their prefix.
+type backendSchema struct {
+	prefix  string
+	options map[string]spec
+	// required returns the options, with their prefix, the backend can't start without given the others.
+	required func(authOpts map[string]string) []string
+}
+
+var backendSchemas = withCommonOptions(map[string]backendSchema{
+	"postgres": {
+		prefix:  "pg",
+		options: merge(pgOptions, map[string]spec{"networkquery": text(), "userdenyquery": text(), "acldenyquery": text()}),
+		required: func(authOpts map[string]string) []string {
+			return []string{"pg_dbname", "pg_user", "pg_password", "pg_userquery"}
+		},
+	},
+	"mysql": {
+		prefix:  "mysql",
+		options: merge(mysqlOptions, map[string]spec{"networkquery": text(), "userdenyquery": text(), "acldenyquery": text()}),
+		required: func(authOpts map[string]string) []string {
+			required := []string{"mysql_dbname", "mysql_user", "mysql_password", "mysql_userquery"}
+			if authOpts["mysql_protocol"] == "unix" {
+				required = append(required, "mysql_socket")
+			}
+			return required
+		},
+	},
+	"sqlite": {
+		prefix: "sqlite",
+		options: map[string]spec{
+			"source":        text(),
+			"userquery":     text(),
+			"superquery":    text(),
+			"aclquery":      text(),
+			"pskquery":      text(),
+			"networkquery":  text(),
+			"userdenyquery": text(),
+			"acldenyquery":  text(),
+			"connect_tries": integer(),
+		},
+		required: func(authOpts map[string]string) []string {
+			return []string{"sqlite_source", "sqlite_userquery"}
+		},
+	},
+	"clickhouse": {
+		prefix: "clickhouse",
+		options: map[string]spec{
+			"userquery":     text(),
+			"superquery":    text(),
+			"aclquery":      text(),
+			"pskquery":      text(),
+			"networkquery":  text(),
+			"connect_tries": integer(),
+		},
+		required: func(authOpts map[string]string) []string {
+			return []string{"clickhouse_userquery"}
+		},
+	},
+	"jwt": {
+		prefix: "jwt",
+		options: merge(remoteOptions, prefixed("js", jsOptions), prefixed("pg", pgOptions), prefixed("mysql", mysqlOptions), map[string]spec{
+			"mode":                 oneOf("local", "remote", "js", "files"),
+			"secret":               text(),
+			"userfield":            oneOf("Username", "Subject"),
+			"parse_token":          boolean(),
+			"skip_user_expiration": boolean(),
+			"skip_acl_expiration":  boolean(),
+			"db":                   oneOf("postgres", "mysql"),
+			"userquery":            text(),
+			"acl_path":             file(),
+		}),
+		required: func(authOpts map[string]string) []string {
+			switch authOpts["jwt_mode"] {
+			case "local":
+				if authOpts["jwt_db"] == "mysql" {
+					return []string{"jwt_secret", "jwt_userquery", "jwt_mysql_dbname", "jwt_mysql_user", "jwt_mysql_password"}
+				}
+				return []string{"jwt_secret", "jwt_userquery", "jwt_pg_dbname", "jwt_pg_user", "jwt_pg_password"}
+			case "remote":
+				return []string{"jwt_host", "jwt_port", "jwt_getuser_uri", "jwt_aclcheck_uri"}
+			case "js":
+				return []string{"jwt_js_user_script_path", "jwt_js_superuser_script_path", "jwt_js_acl_script_path"}
+			case "files":
+				return []string{"jwt_acl_path"}
+			default:
+				return []string{"jwt_mode"}
+			}
+		},
+	},
+	"http": {
+		prefix: "http",
+		options: merge(remoteOptions, map[string]spec{
+			"psk_uri": text(),
+			"timeout": integer(),
+		}),
+		required: func(authOpts map[string]string) []string {
+			return []string{"http_host", "http_port", "http_getuser_uri", "http_aclcheck_uri"}
+		},
+	},
+	"files": {
+		prefix: "files",
+		options: map[string]spec{
+			"password_path": file(),
+			"acl_path":      file(),
+			"psk_path":      file(),
+			"network_path":  file(),
+		},
+		required: func(authOpts map[string]string) []string {
+			// Like the backend, only ask for passwords when explicitly registered for user checks.
+			if strings.Contains(authOpts["files_register"], "user") {
+				return []string{"files_password_path"}
+			}
+			return nil
+		},
+	},
+	"redis": {
+		prefix: "redis",
+		options: map[string]spec{
+			"host":              text(),
+			"port":              integer(),
+			"password":          text(),
+			"db":                integer(),
+			"mode":              oneOf("cluster"),
+			"disable_superuser": boolean(),
+			"check_networks":    boolean(),
+		},
+		required: func(authOpts map[string]string) []string {
+			if authOpts["redis_mode"] == "cluster" {
+				return []string{"redis_cluster_addresses"}
+			}
+			return nil
+		},
+	},
+	"mongo": {
+		prefix: "mongo",
+		options: map[string]spec{
+			"host":                 text(),
+			"port":                 integer(),
+			"username":             text(),
+			"password":             text(),
+			"dbname":               text(),
+			"authsource":           text(),
+			"users":                text(),
+			"acls":                 text(),
+			"use_tls":              boolean(),
+			"insecure_skip_verify": boolean(),
+			"disable_superuser":    boolean(),
+			"check_networks":       boolean(),
+		},
+	},
+	"grpc": {
+		prefix: "grpc",
+		options: map[string]spec{
+			"host":              text(),
+			"port":              integer(),
+			"ca_cert":           text(),
+			"tls_cert":          text(),
+			"tls_key":           text(),
+			"disable_superuser": boolean(),
+		},
+		required: func(authOpts map[string]string) []string {
+			return []string{"grpc_host", "grpc_port"}
+		},
+	},
+	"js": {
+		prefix:  "js",
+		options: jsOptions,
+		required: func(authOpts map[string]string) []string {
+			return []string{"js_user_script_path", "js_superuser_script_path", "js_acl_script_path"}
+		},
+	},
+	"plugin": {
+		prefix: "plugin",
+		options: map[string]spec{
+			"path": file(),
+		},
+		required: func(authOpts map[string]string) []string {
+			return []string{"plugin_path"}
+		},
+	},
+})
+
+// splitBackend splits a backend given in the backends option into the backend and the name of the instance,
+// which is empty for unnamed ones, e.g. postgres:legacy is the legacy instance of postgres.
+func splitBackend(name string) (string, string) {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	return name, ""
+}
+
+// validInstance tells whether an instance name, which is part of the prefix of the instance's options,
+// only has letters, digits and underscores.
+func validInstance(instance string) bool {
+	if instance == "" {
+		return false
+	}
+
+	for _, r := range instance {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// instanceOptions returns the options a named instance is built from, as the backends do: its own options prefixed
+// with prefix given as those of its backend, prefixed with backendPrefix, in place of the ones given for the backend.
+func instanceOptions(authOpts map[string]string, backendPrefix, prefix string) map[string]string {
+	opts := make(map[string]string, len(authOpts))
+	for key, value := range authOpts {
+		if !strings.HasPrefix(key, backendPrefix+"_") {
+			opts[key] = value
+		}
+	}
+
+	for key, value := range authOpts {
+		if strings.HasPrefix(key, prefix+"_") {
+			opts[backendPrefix+"_"+strings.TrimPrefix(key, prefix+"_")] = value
+		}
+	}
+
+	return opts
+}
+
+// AddBackend lets Validate and config files know a backend that isn't built in, such as one given to
+// backends.Register by another package, from its options prefix and the kinds of the options it takes,
+// without their prefix. Backends already known are left as they are.
+// It's meant to be called from init functions, before options are validated.
+func AddBackend(name, prefix string, options map[string]Kind) {
+	if _, ok := backendSchemas[name]; ok {
+		return
+	}
+
+	schema := backendSchema{prefix: prefix, options: make(map[string]spec, len(options))}
+	for key, kind := range options {
+		schema.options[key] = spec{kind: kind}
+	}
+
+	for name, schema := range withCommonOptions(map[string]backendSchema{name: schema}) {
+		backendSchemas[name] = schema
+	}
+}
+
+// withCommonOptions adds the options every backend may be given: its own hasher, checks to register, checks to deny and check options.
+func withCommonOptions(schemas map[string]backendSchema) map[string]backendSchema {
+	for name, schema := range schemas {
+		schema.options = merge(schema.options, hasherOptions, checkOptions, map[string]spec{
+			"register":         listOf("user", "superuser", "acl"),
+			"deny":             listOf("user", "superuser", "acl"),
+			"prefixes":         listOf(),
+			"prefix_separator": text(),
+			"strip_prefix":     boolean(),
+			"username_regex":   regex(),
+			"clientid_regex":   regex(),
+			"listeners":        ports(),
+		})
+		schemas[name] = schema
+	}
+
+	return schemas
+}
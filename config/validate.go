@@ -0,0 +1,504 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/backends/networks"
+	"github.com/iegomez/mosquitto-go-auth/secrets"
+)
+
+// Problem is something wrong with the options found by Validate.
+type Problem struct {
+	// Option is the offending option. Its File is empty when the problem isn't about a given line,
+	// e.g. when it's missing.
+	Option
+	Message string
+	// Warning is set for problems the plugin starts with anyway, such as an option given twice.
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+
+	if p.File == "" {
+		return fmt.Sprintf("%s: %s: %s", level, p.Key, p.Message)
+	}
+
+	return fmt.Sprintf("%s:%d: %s: %s: %s", p.File, p.Line, level, p.Key, p.Message)
+}
+
+type validator struct {
+	authOpts map[string]string
+	// last holds the line giving each option its value.
+	last     map[string]Option
+	backends map[string]bool
+	secrets  *secrets.Resolver
+	problems []Problem
+}
+
+// Validate checks the options against the ones the plugin and its backends take, and against what the backends
+// need to start, reporting every problem found instead of stopping at the first one.
+func Validate(opts []Option) []Problem {
+	v := &validator{
+		authOpts: Map(opts),
+		last:     make(map[string]Option),
+		backends: make(map[string]bool),
+	}
+	v.secrets = secrets.NewResolver(v.authOpts)
+
+	for _, name := range splitList(v.authOpts["backends"]) {
+		v.backends[name] = true
+	}
+
+	for _, opt := range opts {
+		if prev, ok := v.last[opt.Key]; ok {
+			v.warn(opt, fmt.Sprintf("overrides the value given at %s:%d", prev.File, prev.Line))
+		}
+		v.last[opt.Key] = opt
+	}
+
+	for _, opt := range opts {
+		v.checkOption(opt)
+	}
+
+	v.checkBackends()
+	v.checkGeneral()
+
+	// List problems in the order of the lines they're about, followed by missing options.
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		if (a.File == "") != (b.File == "") {
+			return b.File == ""
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+
+	return v.problems
+}
+
+func (v *validator) fail(opt Option, msg string) {
+	v.problems = append(v.problems, Problem{Option: opt, Message: msg})
+}
+
+func (v *validator) warn(opt Option, msg string) {
+	v.problems = append(v.problems, Problem{Option: opt, Message: msg, Warning: true})
+}
+
+// require reports key as missing if it's not given, telling why it's needed.
+func (v *validator) require(key, reason string) {
+	if _, ok := v.authOpts[key]; !ok {
+		v.fail(Option{Key: key}, "missing option, needed "+reason)
+	}
+}
+
+// lookup returns the spec of the option named key and the backend it belongs to, if any.
+func lookup(key string) (spec, string, bool) {
+	if s, ok := generalOptions[key]; ok {
+		return s, "", true
+	}
+
+	for name, schema := range backendSchemas {
+		if s, ok := schema.options[strings.TrimPrefix(key, schema.prefix+"_")]; ok && strings.HasPrefix(key, schema.prefix+"_") {
+			return s, name, true
+		}
+	}
+
+	// Custom plugins get every option and may read their own.
+	if strings.HasPrefix(key, "plugin_") {
+		return text(), "plugin", true
+	}
+
+	return spec{}, "", false
+}
+
+// lookup returns the spec of the option named key and the backend it belongs to, if any, telling apart
+// the options of named instances, e.g. pg_legacy_host for postgres:legacy.
+func (v *validator) lookup(key string) (spec, string, bool) {
+	for _, name := range v.instances() {
+		backend, instance := splitBackend(name)
+		schema := backendSchemas[backend]
+		prefix := schema.prefix + "_" + instance + "_"
+		if s, ok := schema.options[strings.TrimPrefix(key, prefix)]; ok && strings.HasPrefix(key, prefix) {
+			return s, name, true
+		}
+	}
+
+	return lookup(key)
+}
+
+// instances returns the named instances of known backends given in the backends option, sorted.
+func (v *validator) instances() []string {
+	var names []string
+	for name := range v.backends {
+		backend, instance := splitBackend(name)
+		if _, ok := backendSchemas[backend]; ok && instance != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (v *validator) checkOption(opt Option) {
+	s, backend, ok := v.lookup(opt.Key)
+	if !ok {
+		known := knownOptions()
+		for _, name := range v.instances() {
+			backend, instance := splitBackend(name)
+			schema := backendSchemas[backend]
+			for key := range schema.options {
+				known = append(known, schema.prefix+"_"+instance+"_"+key)
+			}
+		}
+
+		msg := "unknown option"
+		if suggestion := suggest(opt.Key, known); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %s?", suggestion)
+		}
+		v.fail(opt, msg)
+		return
+	}
+
+	if backend != "" && len(v.backends) > 0 && !v.backends[backend] {
+		v.warn(opt, fmt.Sprintf("option of the %s backend, which isn't in backends", backend))
+	}
+
+	// Referenced secrets are checked in place of the reference, except for the output of commands, which aren't run.
+	if provider, _ := secrets.Reference(opt.Key, opt.Value); provider == "exec" {
+		if v.authOpts["secrets_exec"] != "true" {
+			v.fail(opt, "exec references need secrets_exec to be true")
+		}
+		return
+	} else if provider != "" {
+		value, err := v.secrets.Value(opt.Key, opt.Value)
+		if err != nil {
+			v.fail(opt, err.Error())
+			return
+		}
+		opt.Value = value
+	}
+
+	switch s.kind {
+	case IntKind:
+		if _, err := strconv.Atoi(opt.Value); err != nil {
+			v.fail(opt, fmt.Sprintf("%q isn't an integer", opt.Value))
+		}
+	case BoolKind:
+		if opt.Value != "true" && opt.Value != "false" {
+			v.fail(opt, fmt.Sprintf("%q must be true or false", opt.Value))
+		}
+	case RatioKind:
+		if r, err := strconv.ParseFloat(opt.Value, 64); err != nil || r < 0 || r > 1 {
+			v.fail(opt, fmt.Sprintf("%q must be a number between 0 and 1", opt.Value))
+		}
+	case FileKind:
+		if _, err := os.Stat(opt.Value); err != nil {
+			v.fail(opt, err.Error())
+		}
+	case ListKind:
+		items := splitList(opt.Value)
+		if len(items) == 0 {
+			v.fail(opt, "empty list")
+		}
+		for _, item := range items {
+			v.checkValue(opt, s, item)
+		}
+	case backendsKind:
+		v.checkBackendList(opt)
+	case NetworksKind:
+		items := splitList(opt.Value)
+		if len(items) == 0 {
+			v.fail(opt, "empty list")
+		}
+		for _, item := range items {
+			if _, err := networks.Parse(item); err != nil {
+				v.fail(opt, err.Error())
+			}
+		}
+	case RegexKind:
+		if _, err := regexp.Compile(opt.Value); err != nil {
+			v.fail(opt, err.Error())
+		}
+	case PortsKind:
+		items := splitList(opt.Value)
+		if len(items) == 0 {
+			v.fail(opt, "empty list")
+		}
+		for _, item := range items {
+			if port, err := strconv.Atoi(item); err != nil || port < 1 || port > 65535 {
+				v.fail(opt, fmt.Sprintf("%q isn't a port number", item))
+			}
+		}
+	default:
+		v.checkValue(opt, s, opt.Value)
+	}
+}
+
+// checkBackendList reports the items of opt that aren't known backends or named instances of one, e.g. postgres:legacy.
+func (v *validator) checkBackendList(opt Option) {
+	s := listOf(backendNames()...)
+	items := splitList(opt.Value)
+	if len(items) == 0 {
+		v.fail(opt, "empty list")
+	}
+
+	for _, item := range items {
+		backend, instance := splitBackend(item)
+		if strings.Contains(item, ":") && !validInstance(instance) {
+			v.fail(opt, fmt.Sprintf("invalid instance name in %q, only letters, digits and underscores are allowed", item))
+			continue
+		}
+
+		v.checkValue(opt, s, backend)
+	}
+}
+
+// checkValue reports value if it's not one of the values the spec allows.
+func (v *validator) checkValue(opt Option, s spec, value string) {
+	if len(s.values) == 0 {
+		return
+	}
+
+	for _, allowed := range s.values {
+		if value == allowed {
+			return
+		}
+	}
+
+	msg := fmt.Sprintf("unknown value %q, must be one of %s", value, strings.Join(s.values, ", "))
+	if suggestion := suggest(value, s.values); suggestion != "" {
+		msg = fmt.Sprintf("unknown value %q, did you mean %s?", value, suggestion)
+	}
+	v.fail(opt, msg)
+}
+
+// checkBackends reports what would keep the backends from starting.
+func (v *validator) checkBackends() {
+	if len(v.backends) == 0 {
+		v.fail(Option{Key: "backends"}, "missing option")
+		return
+	}
+
+	names := make([]string, 0, len(v.backends))
+	for name := range v.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	registered := false
+	for _, name := range names {
+		backend, instance := splitBackend(name)
+		schema, ok := backendSchemas[backend]
+		if !ok || strings.Contains(name, ":") && !validInstance(instance) {
+			continue
+		}
+
+		// Named instances are held to the same requirements with their own options.
+		prefix, opts := schema.prefix, v.authOpts
+		if instance != "" {
+			prefix = schema.prefix + "_" + instance
+			opts = instanceOptions(v.authOpts, schema.prefix, prefix)
+		}
+
+		if schema.required != nil {
+			for _, key := range schema.required(opts) {
+				v.require(prefix+strings.TrimPrefix(key, schema.prefix), "by the "+name+" backend")
+			}
+		}
+
+		checks, ok := v.authOpts[prefix+"_register"]
+		for _, check := range splitList(checks) {
+			if check == "user" || check == "acl" {
+				registered = true
+			}
+		}
+		if !ok {
+			registered = true
+		}
+	}
+
+	if !registered {
+		v.fail(v.option("backends"), "no backend is registered for user or acl checks")
+	}
+
+	for _, key := range []string{"user_order", "superuser_order", "acl_order", "route_default"} {
+		for _, name := range splitList(v.authOpts[key]) {
+			if !v.backends[name] {
+				v.fail(v.option(key), fmt.Sprintf("backend %s isn't in backends", name))
+			}
+		}
+	}
+
+	if count := len(splitList(v.authOpts["route_default"])); count > 1 {
+		v.fail(v.option("route_default"), fmt.Sprintf("%d backends given, only one may be", count))
+	}
+
+	if v.authOpts["check_prefix"] != "true" {
+		return
+	}
+
+	v.require("prefixes", "when check_prefix is true")
+	if prefixes, ok := v.authOpts["prefixes"]; ok {
+		if count, backends := len(splitList(prefixes)), len(splitList(v.authOpts["backends"])); count != backends {
+			v.fail(v.option("prefixes"), fmt.Sprintf("%d prefixes given for %d backends", count, backends))
+		}
+	}
+}
+
+// checkGeneral reports missing options that other ones need.
+func (v *validator) checkGeneral() {
+	if v.authOpts["log_dest"] == "file" {
+		v.require("log_file", "when log_dest is file")
+	}
+
+	if v.authOpts["cache"] == "true" && v.authOpts["cache_type"] == "redis" && v.authOpts["cache_mode"] == "true" {
+		v.require("redis_cluster_addresses", "by the Redis cluster cache")
+	}
+
+	sinks := splitList(v.authOpts["audit_sinks"])
+	if len(sinks) > 0 {
+		v.require("audit_key", "to sign audit events")
+	}
+	for _, sink := range sinks {
+		switch sink {
+		case "file":
+			v.require("audit_file", "by the file audit sink")
+		case "webhook":
+			v.require("audit_webhook_url", "by the webhook audit sink")
+		case "clickhouse":
+			if _, ok := v.authOpts["audit_clickhouse_dsn"]; !ok {
+				v.require("clickhouse_dsn", "by the clickhouse audit sink when audit_clickhouse_dsn isn't given")
+			}
+		}
+	}
+
+	if v.authOpts["throttle"] == "true" && v.authOpts["throttle_store"] == "redis" && v.authOpts["throttle_redis_mode"] == "cluster" {
+		v.require("throttle_redis_addresses", "by the Redis cluster throttle store")
+	}
+
+	if v.authOpts["tracing_exporter"] == "file" {
+		v.require("tracing_file", "by the file tracing exporter")
+	}
+
+	if _, ok := v.authOpts["admin_listen"]; ok {
+		v.require("admin_token", "by the admin API")
+	}
+	if _, ok := v.authOpts["admin_tls_cert"]; ok {
+		v.require("admin_tls_key", "with admin_tls_cert")
+	}
+	if _, ok := v.authOpts["admin_tls_key"]; ok {
+		v.require("admin_tls_cert", "with admin_tls_key")
+	}
+
+	backoff, _ := strconv.Atoi(v.authOpts["retry_backoff_ms"])
+	backoffMax, err := strconv.Atoi(v.authOpts["retry_backoff_max_ms"])
+	if err == nil && backoffMax < backoff {
+		v.warn(v.option("retry_backoff_max_ms"), "lower than retry_backoff_ms, which is used instead")
+	}
+}
+
+// option returns the line giving key its value, or just the key if it's not given.
+func (v *validator) option(key string) Option {
+	if opt, ok := v.last[key]; ok {
+		return opt
+	}
+
+	return Option{Key: key}
+}
+
+// knownOptions returns the names of every option, with backend options prefixed.
+func knownOptions() []string {
+	var known []string
+	for key := range generalOptions {
+		known = append(known, key)
+	}
+
+	for _, schema := range backendSchemas {
+		for key := range schema.options {
+			known = append(known, schema.prefix+"_"+key)
+		}
+	}
+	sort.Strings(known)
+
+	return known
+}
+
+// suggest returns the candidate closest to the misspelled s, or an empty string when none is close enough.
+// A candidate that s is the beginning of, or the other way around, is considered closest, e.g. pg_sslrootcert for pg_sslroot.
+func suggest(s string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		distance := levenshtein(s, candidate)
+		if isAbbreviation(s, candidate) || isAbbreviation(candidate, s) {
+			distance = 1
+		}
+
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+
+	return best
+}
+
+// isAbbreviation tells whether short is the beginning of long, and most of it.
+func isAbbreviation(short, long string) bool {
+	return strings.HasPrefix(long, short) && 3*len(short) >= 2*len(long)
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+
+	return m
+}
+
+// splitList splits a comma separated option, ignoring spaces and empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
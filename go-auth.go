@@ -3,21 +3,41 @@ package main
 import "C"
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
+	"github.com/iegomez/mosquitto-go-auth/admin"
+	"github.com/iegomez/mosquitto-go-auth/audit"
 	bes "github.com/iegomez/mosquitto-go-auth/backends"
 	"github.com/iegomez/mosquitto-go-auth/cache"
+	"github.com/iegomez/mosquitto-go-auth/config"
 	"github.com/iegomez/mosquitto-go-auth/hashing"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/iegomez/mosquitto-go-auth/scram"
+	"github.com/iegomez/mosquitto-go-auth/secrets"
+	"github.com/iegomez/mosquitto-go-auth/throttle"
+	"github.com/iegomez/mosquitto-go-auth/tracing"
+	goCache "github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AuthPlugin struct {
 	backends   *bes.Backends
 	useCache   bool
+	pskCache   bool
 	logLevel   log.Level
 	logDest    string
 	logFile    string
@@ -25,6 +45,21 @@ type AuthPlugin struct {
 	cache      cache.Store
 	hasher     hashing.HashComparer
 	retryCount int
+
+	// Retries wait an exponentially growing, jittered delay between these bounds.
+	retryBackoff    time.Duration
+	retryBackoffMax time.Duration
+
+	// What user and acl checks answer when backends fail even after retrying.
+	userPolicy *bes.ErrorPolicy
+	aclPolicy  *bes.ErrorPolicy
+
+	// The log_file this instance logs to, nil unless logging to a file.
+	logOutput *os.File
+
+	// Checks hold a read lock on the instance they use so it's only halted once they're done.
+	inUse  sync.RWMutex
+	halted bool
 }
 
 // errors to signal mosquitto
@@ -32,10 +67,24 @@ const (
 	AuthRejected = 0
 	AuthGranted  = 1
 	AuthError    = 2
+	AuthContinue = 3
+	AuthDefer    = 4
 )
 
-var authOpts map[string]string //Options passed by mosquitto.
-var authPlugin AuthPlugin      //General struct with options and conf.
+// clientInfo holds the connection details mosquitto's v5 plugin interface gives us besides username and clientid.
+type clientInfo struct {
+	address         string
+	protocolVersion int
+	listenerPort    int
+	certificate     *bes.Certificate
+}
+
+var authOpts map[string]string    //Options passed by mosquitto.
+var authPlugin atomic.Value       //Current *AuthPlugin with options and conf, swapped on reload.
+var scramServer *scram.Server     //Kept across reloads so handshakes in progress survive them.
+var throttler *throttle.Throttler //Kept across reloads so lockouts survive them, nil unless throttle is set.
+var auditLog *audit.Logger        //Kept across reloads so the audit trail is a single chain, nil unless audit_sinks is set.
+var logFile *os.File              //Log file in use, reused by reloads that keep its path and closed by those that don't.
 
 //export AuthPluginInit
 func AuthPluginInit(keys []string, values []string, authOptsNum int) {
@@ -43,42 +92,132 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		FullTimestamp: true,
 	})
 
-	//Initialize auth plugin struct with default and given values.
-	authPlugin = AuthPlugin{
-		logLevel: log.InfoLevel,
-		ctx:      context.Background(),
+	var err error
+	authOpts, err = loadAuthOpts(keys, values, authOptsNum)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	authOpts = make(map[string]string)
+	plugin, err := newAuthPlugin(authOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auditLog, err = audit.New(authOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scramServer, err = scram.NewServer(scramVerifierGet, 0)
+	if err != nil {
+		log.Fatalf("error initializing scram server: %s", err)
+	}
+
+	throttler, err = throttle.New(authOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authPlugin.Store(plugin)
+	logFile = plugin.logOutput
+
+	if addr, ok := authOpts["metrics_listen"]; ok && addr != "" {
+		if err := metrics.Start(addr); err != nil {
+			log.Errorf("couldn't start metrics server on %s: %s", addr, err)
+		}
+	}
+
+	if err := tracing.Setup(authOpts); err != nil {
+		log.Errorf("couldn't set tracing up: %s", err)
+	}
+
+	if addr, ok := authOpts["admin_listen"]; ok && addr != "" {
+		if err := admin.Start(authOpts, adminTarget); err != nil {
+			log.Errorf("couldn't start admin server on %s: %s", addr, err)
+		}
+	}
+}
+
+// copyAuthOpts builds the options map. The strings point to memory owned by mosquitto,
+// which is freed when the configuration is reloaded, so they're copied.
+func copyAuthOpts(keys []string, values []string, authOptsNum int) map[string]string {
+	opts := make(map[string]string)
 	for i := 0; i < authOptsNum; i++ {
-		authOpts[keys[i]] = values[i]
+		opts[string([]byte(keys[i]))] = string([]byte(values[i]))
+	}
+
+	return opts
+}
+
+// loadAuthOpts copies the options given by mosquitto, adding those of the config file given by config_file,
+// and resolves the secrets they refer to.
+func loadAuthOpts(keys []string, values []string, authOptsNum int) (map[string]string, error) {
+	opts, err := config.Load(copyAuthOpts(keys, values, authOptsNum))
+	if err != nil {
+		return nil, err
+	}
+
+	return secrets.Resolve(opts)
+}
+
+// newAuthPlugin builds a plugin instance with its backends and cache from the given options.
+func newAuthPlugin(authOpts map[string]string) (*AuthPlugin, error) {
+	//Initialize auth plugin struct with default and given values.
+	plugin := &AuthPlugin{
+		logLevel:        log.InfoLevel,
+		ctx:             context.Background(),
+		retryBackoff:    100 * time.Millisecond,
+		retryBackoffMax: time.Second,
 	}
 
 	if retryCount, ok := authOpts["retry_count"]; ok {
 		retry, err := strconv.ParseInt(retryCount, 10, 64)
 		if err == nil {
-			authPlugin.retryCount = int(retry)
+			plugin.retryCount = int(retry)
 		} else {
 			log.Warningf("couldn't parse retryCount (err: %s), defaulting to 0", err)
 		}
 	}
 
+	if backoff, ok := authOpts["retry_backoff_ms"]; ok {
+		ms, err := strconv.ParseInt(backoff, 10, 64)
+		if err == nil {
+			plugin.retryBackoff = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Warningf("couldn't parse retryBackoff (err: %s), defaulting to %s", err, plugin.retryBackoff)
+		}
+	}
+
+	if backoffMax, ok := authOpts["retry_backoff_max_ms"]; ok {
+		ms, err := strconv.ParseInt(backoffMax, 10, 64)
+		if err == nil {
+			plugin.retryBackoffMax = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Warningf("couldn't parse retryBackoffMax (err: %s), defaulting to %s", err, plugin.retryBackoffMax)
+		}
+	}
+
+	if plugin.retryBackoffMax < plugin.retryBackoff {
+		plugin.retryBackoffMax = plugin.retryBackoff
+		log.Warningf("retryBackoffMax is lower than retryBackoff, defaulting to %s", plugin.retryBackoffMax)
+	}
+
 	//Check if log level is given. Set level if any valid option is given.
 	if logLevel, ok := authOpts["log_level"]; ok {
 		logLevel = strings.Replace(logLevel, " ", "", -1)
 		switch logLevel {
 		case "debug":
-			authPlugin.logLevel = log.DebugLevel
+			plugin.logLevel = log.DebugLevel
 		case "info":
-			authPlugin.logLevel = log.InfoLevel
+			plugin.logLevel = log.InfoLevel
 		case "warn":
-			authPlugin.logLevel = log.WarnLevel
+			plugin.logLevel = log.WarnLevel
 		case "error":
-			authPlugin.logLevel = log.ErrorLevel
+			plugin.logLevel = log.ErrorLevel
 		case "fatal":
-			authPlugin.logLevel = log.FatalLevel
+			plugin.logLevel = log.FatalLevel
 		case "panic":
-			authPlugin.logLevel = log.PanicLevel
+			plugin.logLevel = log.PanicLevel
 		default:
 			log.Info("log_level unkwown, using default info level")
 		}
@@ -89,9 +228,12 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		case "stdout":
 			log.SetOutput(os.Stdout)
 		case "file":
-			if logFile, ok := authOpts["log_file"]; ok {
-				file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-				if err == nil {
+			if path, ok := authOpts["log_file"]; ok {
+				if logFile != nil && logFile.Name() == path {
+					plugin.logOutput = logFile
+					log.SetOutput(logFile)
+				} else if file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+					plugin.logOutput = file
 					log.SetOutput(file)
 				} else {
 					log.Errorf("failed to log to file, using default stderr: %s", err)
@@ -102,193 +244,268 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		}
 	}
 
+	plugin.userPolicy = bes.NewErrorPolicy(authOpts, "user")
+	plugin.aclPolicy = bes.NewErrorPolicy(authOpts, "acl")
+
 	var err error
 
-	authPlugin.backends, err = bes.Initialize(authOpts, authPlugin.logLevel)
+	plugin.backends, err = bes.Initialize(authOpts, plugin.logLevel)
 	if err != nil {
-		log.Fatalf("error initializing backends: %s", err)
+		// Don't leak a log file opened for this instance, the caller sets the previous output back.
+		if plugin.logOutput != nil && plugin.logOutput != logFile {
+			plugin.logOutput.Close()
+		}
+		return nil, fmt.Errorf("error initializing backends: %s", err)
 	}
 
 	if cache, ok := authOpts["cache"]; ok && strings.Replace(cache, " ", "", -1) == "true" {
 		log.Info("redisCache activated")
-		authPlugin.useCache = true
+		plugin.useCache = true
 	} else {
 		log.Info("No cache set.")
-		authPlugin.useCache = false
+		plugin.useCache = false
 	}
 
-	if authPlugin.useCache {
-		setCache(authOpts)
+	if plugin.useCache {
+		plugin.setCache(authOpts)
 	}
-}
 
-func setCache(authOpts map[string]string) {
+	// Keys are secrets, so unlike decisions they're only cached when asked to.
+	if pskCache, ok := authOpts["psk_cache"]; ok && strings.Replace(pskCache, " ", "", -1) == "true" && plugin.useCache {
+		log.Info("psk keys cache activated")
+		plugin.pskCache = true
+	}
 
-	var aclCacheSeconds int64 = 30
-	var authCacheSeconds int64 = 30
-	var authJitterSeconds int64 = 0
-	var aclJitterSeconds int64 = 0
+	return plugin, nil
+}
 
-	if authCacheSec, ok := authOpts["auth_cache_seconds"]; ok {
-		authSec, err := strconv.ParseInt(authCacheSec, 10, 64)
-		if err == nil {
-			authCacheSeconds = authSec
-		} else {
-			log.Warningf("couldn't parse authCacheSeconds (err: %s), defaulting to %d", err, authCacheSeconds)
+// currentPlugin returns the plugin instance in use, read locked so a reload doesn't halt it
+// while a check runs. Callers must release it when done.
+func currentPlugin() *AuthPlugin {
+	for {
+		plugin := authPlugin.Load().(*AuthPlugin)
+		plugin.inUse.RLock()
+		// A halted instance was swapped out in the meantime, unless the plugin is shutting down.
+		if !plugin.halted || plugin == authPlugin.Load().(*AuthPlugin) {
+			return plugin
 		}
+		plugin.inUse.RUnlock()
 	}
+}
 
-	if authJitterSec, ok := authOpts["auth_jitter_seconds"]; ok {
-		authSec, err := strconv.ParseInt(authJitterSec, 10, 64)
-		if err == nil {
-			authJitterSeconds = authSec
-		} else {
-			log.Warningf("couldn't parse authJitterSeconds (err: %s), defaulting to %d", err, authJitterSeconds)
-		}
+func (o *AuthPlugin) release() {
+	o.inUse.RUnlock()
+}
+
+// adminTarget hands the admin API the backends and cache of the plugin instance in use.
+func adminTarget() (admin.Target, func()) {
+	plugin := currentPlugin()
+
+	target := admin.Target{Backends: plugin.backends}
+	if plugin.cache != nil {
+		target.Cache = plugin.cache
+	}
+	if throttler != nil {
+		target.Throttle = throttler
 	}
 
-	if authJitterSeconds > authCacheSeconds {
-		authJitterSeconds = authCacheSeconds
-		log.Warningf("authJitterSeconds is larger than authCacheSeconds, defaulting to %d", authJitterSeconds)
+	return target, plugin.release
+}
+
+// backoff counts a retry of the given check type and sleeps before it: the delay doubles on every try
+// up to the maximum, and half of it is random so clients that failed together don't retry together.
+func (o *AuthPlugin) backoff(check string, try int) {
+	if try == 0 {
+		return
 	}
 
-	if aclCacheSec, ok := authOpts["acl_cache_seconds"]; ok {
-		aclSec, err := strconv.ParseInt(aclCacheSec, 10, 64)
-		if err == nil {
-			aclCacheSeconds = aclSec
-		} else {
-			log.Warningf("couldn't parse aclCacheSeconds (err: %s), defaulting to %d", err, aclCacheSeconds)
-		}
+	metrics.ObserveRetry(check)
+
+	if o.retryBackoff <= 0 {
+		return
 	}
 
-	if aclJitterSec, ok := authOpts["acl_jitter_seconds"]; ok {
-		aclSec, err := strconv.ParseInt(aclJitterSec, 10, 64)
-		if err == nil {
-			aclJitterSeconds = aclSec
-		} else {
-			log.Warningf("couldn't parse aclJitterSeconds (err: %s), defaulting to %d", err, aclJitterSeconds)
-		}
+	delay := o.retryBackoff
+	for i := 1; i < try && delay < o.retryBackoffMax; i++ {
+		delay *= 2
 	}
 
-	if aclJitterSeconds > aclCacheSeconds {
-		aclJitterSeconds = aclCacheSeconds
-		log.Warningf("aclJitterSeconds is larger than aclCacheSeconds, defaulting to %d", aclJitterSeconds)
+	if delay > o.retryBackoffMax {
+		delay = o.retryBackoffMax
 	}
 
+	half := int64(delay / 2)
+	time.Sleep(time.Duration(half + rand.Int63n(half+1)))
+}
+
+// halt waits for checks in flight to finish and then closes the cache and halts the backends.
+func (o *AuthPlugin) halt() {
+	o.inUse.Lock()
+	defer o.inUse.Unlock()
+
+	o.halted = true
+
+	//If cache is set, close cache connection.
+	if o.cache != nil {
+		o.cache.Close()
+	}
+
+	o.backends.Halt()
+}
+
+func (o *AuthPlugin) setCache(authOpts map[string]string) {
+	store, err := cache.New(authOpts)
+	if err != nil {
+		log.Errorf("%s, defaulting to no cache.", err)
+		o.useCache = false
+		return
+	}
+	o.cache = store
+
 	reset := false
 	if cacheReset, ok := authOpts["cache_reset"]; ok && cacheReset == "true" {
 		reset = true
 	}
 
-	refreshExpiration := false
-	if refresh, ok := authOpts["cache_refresh"]; ok && refresh == "true" {
-		refreshExpiration = true
+	if !o.cache.Connect(o.ctx, reset) {
+		o.cache = nil
+		o.useCache = false
+		log.Infoln("couldn't start cache, defaulting to no cache")
 	}
 
-	switch authOpts["cache_type"] {
-	case "redis":
-		host := "localhost"
-		port := "6379"
-		db := 3
-		password := ""
-		cluster := false
+}
 
-		if authOpts["cache_mode"] == "true" {
-			cluster = true
-		}
+//export AuthUnpwdCheck
+func AuthUnpwdCheck(username, password, clientid string) uint8 {
+	plugin := currentPlugin()
+	defer plugin.release()
 
-		if cachePassword, ok := authOpts["cache_password"]; ok {
-			password = cachePassword
-		}
+	return plugin.checkUnpwd(username, password, clientid, nil)
+}
 
-		if cluster {
+//export AuthUnpwdCheckV5
+func AuthUnpwdCheckV5(username, password, clientid, address string, protocolVersion, listenerPort int, certificate []byte) uint8 {
+	client := newClientInfo(clientid, address, protocolVersion, listenerPort, certificate)
+	log.Debugf("checking user %s (clientid %s) connecting from %s with protocol version %d on port %d", username, clientid, client.address, client.protocolVersion, client.listenerPort)
 
-			addressesOpt := authOpts["redis_cluster_addresses"]
-			if addressesOpt == "" {
-				log.Errorln("cache Redis cluster addresses missing, defaulting to no cache.")
-				authPlugin.useCache = false
-				return
-			}
+	plugin := currentPlugin()
+	defer plugin.release()
 
-			// Take the given addresses and trim spaces from them.
-			addresses := strings.Split(addressesOpt, ",")
-			for i := 0; i < len(addresses); i++ {
-				addresses[i] = strings.TrimSpace(addresses[i])
-			}
+	return plugin.checkUnpwd(username, password, clientid, client)
+}
 
-			authPlugin.cache = cache.NewRedisClusterStore(
-				password,
-				addresses,
-				time.Duration(authCacheSeconds)*time.Second,
-				time.Duration(aclCacheSeconds)*time.Second,
-				time.Duration(authJitterSeconds)*time.Second,
-				time.Duration(aclJitterSeconds)*time.Second,
-				refreshExpiration,
-			)
+// newClientInfo copies the client context received from mosquitto, along with the client's certificate if one was given.
+func newClientInfo(clientid, address string, protocolVersion, listenerPort int, certificate []byte) *clientInfo {
+	client := &clientInfo{
+		address:         address,
+		protocolVersion: protocolVersion,
+		listenerPort:    listenerPort,
+	}
 
-		} else {
-			if cacheHost, ok := authOpts["cache_host"]; ok {
-				host = cacheHost
-			}
+	if len(certificate) > 0 {
+		client.certificate = clientCertificate(clientid, certificate)
+	}
 
-			if cachePort, ok := authOpts["cache_port"]; ok {
-				port = cachePort
-			}
+	return client
+}
 
-			if cacheDB, ok := authOpts["cache_db"]; ok {
-				parsedDB, err := strconv.ParseInt(cacheDB, 10, 32)
-				if err == nil {
-					db = int(parsedDB)
-				} else {
-					log.Warningf("couldn't parse cache db (err: %s), defaulting to %d", err, db)
-				}
-			}
+// clientCertificates keeps the parsed certificate of connected clients by clientid, so it's parsed once per connection
+// rather than on every check. Entries are dropped on disconnect, and expire for brokers that don't tell about those.
+var clientCertificates = goCache.New(time.Hour, 10*time.Minute)
 
-			authPlugin.cache = cache.NewSingleRedisStore(
-				host,
-				port,
-				password,
-				db,
-				time.Duration(authCacheSeconds)*time.Second,
-				time.Duration(aclCacheSeconds)*time.Second,
-				time.Duration(authJitterSeconds)*time.Second,
-				time.Duration(aclJitterSeconds)*time.Second,
-				refreshExpiration,
-			)
-		}
+type parsedCertificate struct {
+	der  []byte
+	cert *bes.Certificate
+}
 
-	default:
-		authPlugin.cache = cache.NewGoStore(
-			time.Duration(authCacheSeconds)*time.Second,
-			time.Duration(aclCacheSeconds)*time.Second,
-			time.Duration(authJitterSeconds)*time.Second,
-			time.Duration(aclJitterSeconds)*time.Second,
-			refreshExpiration,
-		)
+// clientCertificate returns the certificate parsed from the DER encoded one mosquitto gave, nil if it's invalid.
+func clientCertificate(clientid string, der []byte) *bes.Certificate {
+	// A client taking over the clientid of another one may have a different certificate.
+	if cached, ok := clientCertificates.Get(clientid); ok && bytes.Equal(cached.(*parsedCertificate).der, der) {
+		return cached.(*parsedCertificate).cert
 	}
 
-	if !authPlugin.cache.Connect(authPlugin.ctx, reset) {
-		authPlugin.cache = nil
-		authPlugin.useCache = false
-		log.Infoln("couldn't start cache, defaulting to no cache")
+	// The certificate buffer is released by the C side after the check, so don't keep references to it.
+	parsed := &parsedCertificate{der: append([]byte(nil), der...)}
+	cert, err := x509.ParseCertificate(parsed.der)
+	if err != nil {
+		log.Warnf("couldn't parse client certificate: %s", err)
+	} else {
+		parsed.cert = bes.NewCertificate(cert)
 	}
 
+	clientCertificates.SetDefault(clientid, parsed)
+
+	return parsed.cert
 }
 
-//export AuthUnpwdCheck
-func AuthUnpwdCheck(username, password, clientid string) uint8 {
+// checkUnpwd checks a login. client is nil when mosquitto doesn't give the client's details.
+func (o *AuthPlugin) checkUnpwd(username, password, clientid string, client *clientInfo) uint8 {
 	var ok bool
 	var err error
 
-	for try := 0; try <= authPlugin.retryCount; try++ {
-		ok, err = authUnpwdCheck(username, password, clientid)
+	start := time.Now()
+	ctx, decision := bes.WithDecision(o.ctx)
+	ctx, span := tracing.Start(ctx, "AuthUnpwdCheck",
+		attribute.String("mqtt.username", username),
+		attribute.String("mqtt.clientid", clientid),
+	)
+
+	event := &audit.Event{
+		Check:    "user",
+		Username: username,
+		ClientID: clientid,
+	}
+
+	attempt := throttle.Attempt{Username: username, ClientID: clientid}
+	if client != nil {
+		attempt.IP = client.address
+		ctx = bes.WithAddress(ctx, client.address)
+		if client.listenerPort > 0 {
+			ctx = bes.WithListener(ctx, client.listenerPort)
+		}
+		if client.certificate != nil {
+			ctx = bes.WithCertificate(ctx, client.certificate)
+		}
+	}
+
+	if throttleErr := throttler.Check(ctx, attempt); throttleErr != nil {
+		log.Warn(throttleErr)
+		event.Error = throttleErr.Error()
+		o.record(event, decision, start, false, nil)
+		span.SetAttributes(attribute.Bool("auth.throttled", true))
+		endSpan(span, decision, false, nil)
+		return AuthRejected
+	}
+
+	for try := 0; try <= o.retryCount; try++ {
+		if try > 0 {
+			span.AddEvent("retry")
+		}
+		o.backoff("user", try)
+		ok, err = o.authUnpwdCheck(ctx, username, password, clientid)
 		if err == nil {
 			break
 		}
 	}
 
+	// Only actual answers count, not those given by the error policy.
+	if err == nil && ok {
+		throttler.Succeeded(ctx, attempt)
+	} else if err == nil {
+		throttler.Failed(ctx, attempt)
+	}
+
 	if err != nil {
 		log.Error(err)
+		event.Error = err.Error()
+		ok, err = o.userPolicy.Resolve(o.userPolicyKey(ctx, username, password, clientid), err)
+	}
+
+	o.record(event, decision, start, ok, err)
+	endSpan(span, decision, ok, err)
+
+	if err != nil {
 		return AuthError
 	}
 
@@ -299,50 +516,199 @@ func AuthUnpwdCheck(username, password, clientid string) uint8 {
 	return AuthRejected
 }
 
-func authUnpwdCheck(username, password, clientid string) (bool, error) {
+func (o *AuthPlugin) authUnpwdCheck(ctx context.Context, username, password, clientid string) (bool, error) {
 	var authenticated bool
 	var cached bool
 	var granted bool
 	var err error
-	if authPlugin.useCache {
+
+	// Certificate logins have no password to tell them apart from others in the cache or the error policy.
+	if password == "" && o.backends.CertificateAuth() && bes.CertificateFrom(ctx) != nil {
+		return o.backends.AuthUnpwdCheck(ctx, username, password, clientid)
+	}
+
+	if o.useCache {
 		log.Debugf("checking auth cache for %s", username)
-		cached, granted = authPlugin.cache.CheckAuthRecord(authPlugin.ctx, username, password)
+		cacheCtx, cacheSpan := tracing.Start(ctx, "cache.lookup", attribute.String("auth.check", "user"))
+		cached, granted = o.cache.CheckAuthRecord(cacheCtx, username, o.authRecordPassword(ctx, password, clientid))
+		cacheSpan.SetAttributes(attribute.Bool("cache.hit", cached))
+		cacheSpan.End()
+		metrics.ObserveCache("user", cached)
 		if cached {
+			bes.DecisionFrom(ctx).Cached = true
 			log.Debugf("found in cache: %s", username)
 			return granted, nil
 		}
 	}
 
-	authenticated, err = authPlugin.backends.AuthUnpwdCheck(username, password, clientid)
+	authenticated, err = o.backends.AuthUnpwdCheck(ctx, username, password, clientid)
+	if err == nil {
+		o.userPolicy.Remember(o.userPolicyKey(ctx, username, password, clientid), authenticated)
+	}
 
-	if authPlugin.useCache && err == nil {
+	// Failing to cache the decision doesn't change it.
+	if o.useCache && err == nil {
 		authGranted := "false"
 		if authenticated {
 			authGranted = "true"
 		}
 		log.Debugf("setting auth cache for %s", username)
-		if setAuthErr := authPlugin.cache.SetAuthRecord(authPlugin.ctx, username, password, authGranted); setAuthErr != nil {
+		if setAuthErr := o.cache.SetAuthRecord(ctx, username, o.authRecordPassword(ctx, password, clientid), authGranted); setAuthErr != nil {
 			log.Errorf("set auth cache: %s", setAuthErr)
-			return false, setAuthErr
+			metrics.ObserveCacheSetError("user")
 		}
 	}
 	return authenticated, err
 }
 
+// authRecordPassword returns the password identifying a login in the cache. Network rules and backends
+// that are sent the client's address may answer differently depending on it, so it must be part of the record.
+// So must the strategy combining the backends' answers, when it isn't the default one, and the clientid and listener
+// when checks are routed by them. Passwords can't contain NUL characters.
+func (o *AuthPlugin) authRecordPassword(ctx context.Context, password, clientid string) string {
+	if address := bes.AddressFrom(ctx); address != "" {
+		password = fmt.Sprintf("%s\x00%s", password, address)
+	}
+
+	if strategy := o.backends.StrategyKey("user"); strategy != "" {
+		password = fmt.Sprintf("%s\x00%s", password, strategy)
+	}
+
+	if o.backends.RoutesByClientID() {
+		password = fmt.Sprintf("%s\x00%s", password, clientid)
+	}
+
+	if o.backends.RoutesByListener() {
+		password = fmt.Sprintf("%s\x00%d", password, bes.ListenerFrom(ctx))
+	}
+
+	return password
+}
+
+func (o *AuthPlugin) userPolicyKey(ctx context.Context, username, password, clientid string) string {
+	return bes.PolicyKey("user", username, o.authRecordPassword(ctx, password, clientid))
+}
+
+// record counts the answer given to a check in the metrics and completes its audit event.
+func (o *AuthPlugin) record(event *audit.Event, decision *bes.Decision, start time.Time, granted bool, err error) {
+	event.Result = metrics.Result(granted, err)
+	metrics.ObserveCheck(event.Check, event.Result)
+
+	if decision != nil {
+		event.Backend = decision.Backend
+		event.Superuser = decision.Superuser
+		event.Denied = decision.Denied
+		event.Reason = decision.Reason
+		event.Cached = decision.Cached
+	}
+	event.Latency = time.Since(start)
+
+	auditLog.Record(event)
+}
+
+// endSpan completes the span of a check with how it was decided.
+func endSpan(span trace.Span, decision *bes.Decision, granted bool, err error) {
+	span.SetAttributes(
+		attribute.String("auth.backend", decision.Backend),
+		attribute.Bool("auth.superuser", decision.Superuser),
+		attribute.Bool("auth.denied", decision.Denied),
+		attribute.Bool("auth.cached", decision.Cached),
+	)
+	tracing.End(span, granted, err)
+}
+
 //export AuthAclCheck
-func AuthAclCheck(clientid, username, topic string, acc int) uint8 {
+func AuthAclCheck(clientid, username, topic string, acc int, payloadLen int64, qos int32, retain bool) uint8 {
+	plugin := currentPlugin()
+	defer plugin.release()
+
+	return plugin.checkAcl(clientid, username, topic, acc, newAclMessage(payloadLen, qos, retain), nil)
+}
+
+//export AuthAclCheckV5
+func AuthAclCheckV5(clientid, username, topic string, acc int, payloadLen int64, qos int32, retain bool, address string, protocolVersion, listenerPort int, certificate []byte) uint8 {
+	client := newClientInfo(clientid, address, protocolVersion, listenerPort, certificate)
+	log.Debugf("checking acl for user %s (clientid %s) connected from %s with protocol version %d on port %d", username, clientid, client.address, client.protocolVersion, client.listenerPort)
+
+	plugin := currentPlugin()
+	defer plugin.release()
+
+	return plugin.checkAcl(clientid, username, topic, acc, newAclMessage(payloadLen, qos, retain), client)
+}
+
+// newAclMessage returns the message details for an acl check, or nil if mosquitto gave none (signaled by a negative payload length).
+func newAclMessage(payloadLen int64, qos int32, retain bool) *bes.AclMessage {
+	if payloadLen < 0 {
+		return nil
+	}
+
+	return &bes.AclMessage{
+		PayloadLen: payloadLen,
+		Qos:        qos,
+		Retain:     retain,
+	}
+}
+
+// checkAcl checks a topic access. client is nil when mosquitto doesn't give the client's details.
+func (o *AuthPlugin) checkAcl(clientid, username, topic string, acc int, msg *bes.AclMessage, client *clientInfo) uint8 {
 	var ok bool
 	var err error
 
-	for try := 0; try <= authPlugin.retryCount; try++ {
-		ok, err = authAclCheck(clientid, username, topic, acc)
+	start := time.Now()
+	ctx, decision := bes.WithDecision(o.ctx)
+
+	// Acls may refer to the certificate's fields, and clients that logged in with one
+	// and no username are known by the username it maps to.
+	if client != nil {
+		ctx = bes.WithAddress(ctx, client.address)
+		if client.listenerPort > 0 {
+			ctx = bes.WithListener(ctx, client.listenerPort)
+		}
+	}
+
+	if client != nil && client.certificate != nil {
+		ctx = bes.WithCertificate(ctx, client.certificate)
+		if identity, mapped := o.backends.CertificateUsername(client.certificate); mapped && username == "" {
+			username = identity
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, "AuthAclCheck",
+		attribute.String("mqtt.username", username),
+		attribute.String("mqtt.clientid", clientid),
+		attribute.String("mqtt.topic", topic),
+		attribute.Int("mqtt.acc", acc),
+	)
+
+	for try := 0; try <= o.retryCount; try++ {
+		if try > 0 {
+			span.AddEvent("retry")
+		}
+		o.backoff("acl", try)
+		ok, err = o.authAclCheck(ctx, clientid, username, topic, acc, msg)
 		if err == nil {
 			break
 		}
 	}
 
+	event := &audit.Event{
+		Check:    "acl",
+		Username: username,
+		ClientID: clientid,
+		Topic:    topic,
+		Acc:      acc,
+	}
+
 	if err != nil {
 		log.Error(err)
+		event.Error = err.Error()
+		ok, err = o.aclPolicy.Resolve(o.aclPolicyKey(ctx, clientid, username, topic, acc, msg), err)
+	}
+
+	o.record(event, decision, start, ok, err)
+	endSpan(span, decision, ok, err)
+
+	if err != nil {
 		return AuthError
 	}
 
@@ -353,31 +719,43 @@ func AuthAclCheck(clientid, username, topic string, acc int) uint8 {
 	return AuthRejected
 }
 
-func authAclCheck(clientid, username, topic string, acc int) (bool, error) {
+func (o *AuthPlugin) authAclCheck(ctx context.Context, clientid, username, topic string, acc int, msg *bes.AclMessage) (bool, error) {
 	var aclCheck bool
 	var cached bool
 	var granted bool
 	var err error
-	if authPlugin.useCache {
+
+	cacheTopic := o.aclRecordTopic(ctx, topic, msg)
+
+	if o.useCache {
 		log.Debugf("checking acl cache for %s", username)
-		cached, granted = authPlugin.cache.CheckACLRecord(authPlugin.ctx, username, topic, clientid, acc)
+		cacheCtx, cacheSpan := tracing.Start(ctx, "cache.lookup", attribute.String("auth.check", "acl"))
+		cached, granted = o.cache.CheckACLRecord(cacheCtx, username, cacheTopic, clientid, acc)
+		cacheSpan.SetAttributes(attribute.Bool("cache.hit", cached))
+		cacheSpan.End()
+		metrics.ObserveCache("acl", cached)
 		if cached {
+			bes.DecisionFrom(ctx).Cached = true
 			log.Debugf("found in cache: %s", username)
 			return granted, nil
 		}
 	}
 
-	aclCheck, err = authPlugin.backends.AuthAclCheck(clientid, username, topic, acc)
+	aclCheck, err = o.backends.AuthAclCheckMessage(ctx, clientid, username, topic, acc, msg)
+	if err == nil {
+		o.aclPolicy.Remember(o.aclPolicyKey(ctx, clientid, username, topic, acc, msg), aclCheck)
+	}
 
-	if authPlugin.useCache && err == nil {
+	// Failing to cache the decision doesn't change it.
+	if o.useCache && err == nil {
 		authGranted := "false"
 		if aclCheck {
 			authGranted = "true"
 		}
 		log.Debugf("setting acl cache (granted = %s) for %s", authGranted, username)
-		if setACLErr := authPlugin.cache.SetACLRecord(authPlugin.ctx, username, topic, clientid, acc, authGranted); setACLErr != nil {
+		if setACLErr := o.cache.SetACLRecord(ctx, username, cacheTopic, clientid, acc, authGranted); setACLErr != nil {
 			log.Errorf("set acl cache: %s", setACLErr)
-			return false, setACLErr
+			metrics.ObserveCacheSetError("acl")
 		}
 	}
 
@@ -385,20 +763,273 @@ func authAclCheck(clientid, username, topic string, acc int) (bool, error) {
 	return aclCheck, err
 }
 
+// aclRecordTopic returns the topic identifying an acl check in the cache.
+// When backends look at message details the result may change from one message to the next,
+// so those details must be part of the record. So must the client certificate's fingerprint,
+// as acls may refer to its fields, the strategies combining the backends' answers when they aren't
+// the default ones, and the listener when checks are routed by it. Topics can't contain NUL characters.
+func (o *AuthPlugin) aclRecordTopic(ctx context.Context, topic string, msg *bes.AclMessage) string {
+	if msg != nil && o.backends.ChecksMessages() {
+		topic = fmt.Sprintf("%s\x00%d-%d-%t", topic, msg.PayloadLen, msg.Qos, msg.Retain)
+	}
+
+	if cert := bes.CertificateFrom(ctx); cert != nil {
+		topic = fmt.Sprintf("%s\x00%s", topic, cert.Fingerprint)
+	}
+
+	if strategy := o.backends.StrategyKey("acl"); strategy != "" {
+		topic = fmt.Sprintf("%s\x00%s", topic, strategy)
+	}
+
+	if o.backends.RoutesByListener() {
+		topic = fmt.Sprintf("%s\x00%d", topic, bes.ListenerFrom(ctx))
+	}
+
+	return topic
+}
+
+func (o *AuthPlugin) aclPolicyKey(ctx context.Context, clientid, username, topic string, acc int, msg *bes.AclMessage) string {
+	return bes.PolicyKey("acl", username, o.aclRecordTopic(ctx, topic, msg), clientid, acc)
+}
+
 //export AuthPskKeyGet
-func AuthPskKeyGet() bool {
-	return true
+func AuthPskKeyGet(hint, identity string, key []byte) uint8 {
+	var pskKey string
+	var err error
+
+	plugin := currentPlugin()
+	defer plugin.release()
+
+	start := time.Now()
+
+	for try := 0; try <= plugin.retryCount; try++ {
+		plugin.backoff("psk", try)
+		pskKey, err = plugin.authPskKeyGet(hint, identity)
+		if err == nil {
+			break
+		}
+	}
+
+	event := &audit.Event{
+		Check:    "psk",
+		Username: identity,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	plugin.record(event, nil, start, pskKey != "", err)
+
+	if err != nil {
+		log.Error(err)
+		return AuthError
+	}
+
+	if pskKey == "" {
+		log.Debugf("no psk key found for identity %s", identity)
+		return AuthRejected
+	}
+
+	if _, err := hex.DecodeString(pskKey); err != nil {
+		log.Errorf("psk key for identity %s is not hex encoded: %s", identity, err)
+		return AuthError
+	}
+
+	// key is mosquitto's own buffer, the hex key must fit in it along with the NUL terminator.
+	if len(pskKey) >= len(key) {
+		log.Errorf("psk key for identity %s exceeds the maximum length of %d", identity, len(key)-1)
+		return AuthError
+	}
+
+	copy(key, pskKey)
+	key[len(pskKey)] = 0
+
+	return AuthGranted
+}
+
+func (o *AuthPlugin) authPskKeyGet(hint, identity string) (string, error) {
+	if o.pskCache {
+		log.Debugf("checking psk cache for %s", identity)
+		cached, key := o.cache.CheckPskRecord(o.ctx, hint, identity)
+		metrics.ObserveCache("psk", cached)
+		if cached {
+			log.Debugf("found in cache: %s", identity)
+			return key, nil
+		}
+	}
+
+	key, err := o.backends.AuthPskKeyGet(o.ctx, hint, identity)
+
+	if o.pskCache && err == nil && key != "" {
+		log.Debugf("setting psk cache for %s", identity)
+		if setPskErr := o.cache.SetPskRecord(o.ctx, hint, identity, key); setPskErr != nil {
+			log.Errorf("set psk cache: %s", setPskErr)
+			metrics.ObserveCacheSetError("psk")
+		}
+	}
+
+	return key, err
+}
+
+//export AuthExtAuth
+func AuthExtAuth(start bool, clientid, method, address string, dataIn []byte) (status uint8, dataOut unsafe.Pointer, dataOutLen int, username *C.char) {
+	// dataOut and username are allocated with malloc, the C side copies them and frees them.
+	started := time.Now()
+
+	if !scram.Supported(method) {
+		log.Debugf("authentication method %s for client %s is not supported", method, clientid)
+		return AuthDefer, nil, 0, nil
+	}
+
+	// Verifiers are only given to clients whose address the network rules allow.
+	ctx := context.Background()
+	if address != "" {
+		ctx = bes.WithAddress(ctx, address)
+	}
+	attempt := throttle.Attempt{ClientID: clientid, IP: address}
+
+	if start {
+		// Throttled clients are rejected before their credentials are looked up, as with password logins.
+		attempt.Username, _ = scram.Username(dataIn)
+		if throttleErr := throttler.Check(ctx, attempt); throttleErr != nil {
+			log.Warn(throttleErr)
+			recordExtAuth(started, clientid, attempt.Username, false, nil, throttleErr)
+			return AuthRejected, nil, 0, nil
+		}
+
+		serverFirst, err := scramServer.Start(ctx, clientid, method, dataIn)
+		if err != nil {
+			if _, ok := err.(*scram.LookupError); ok {
+				log.Error(err)
+				recordExtAuth(started, clientid, attempt.Username, false, err, nil)
+				return AuthError, nil, 0, nil
+			}
+			log.Warnf("%s authentication for client %s failed: %s", method, clientid, err)
+			throttler.Failed(ctx, attempt)
+			recordExtAuth(started, clientid, attempt.Username, false, nil, nil)
+			return AuthRejected, nil, 0, nil
+		}
+
+		return AuthContinue, C.CBytes(serverFirst), len(serverFirst), nil
+	}
+
+	user, serverFinal, err := scramServer.Continue(clientid, method, dataIn)
+	attempt.Username = user
+	if err != nil {
+		log.Warnf("%s authentication for client %s failed: %s", method, clientid, err)
+		throttler.Failed(ctx, attempt)
+		recordExtAuth(started, clientid, user, false, nil, nil)
+		return AuthRejected, nil, 0, nil
+	}
+
+	log.Debugf("client %s authenticated as %s with %s", clientid, user, method)
+	throttler.Succeeded(ctx, attempt)
+	recordExtAuth(started, clientid, user, true, nil, nil)
+
+	return AuthGranted, C.CBytes(serverFinal), len(serverFinal), C.CString(user)
+}
+
+// recordExtAuth counts and audits the outcome of an enhanced authentication. throttleErr is given when it was
+// rejected because of throttling, and started is when mosquitto called the plugin for the step it ended on.
+func recordExtAuth(started time.Time, clientid, username string, granted bool, err, throttleErr error) {
+	plugin := currentPlugin()
+	defer plugin.release()
+
+	event := &audit.Event{
+		Check:    "scram",
+		Username: username,
+		ClientID: clientid,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	} else if throttleErr != nil {
+		event.Error = throttleErr.Error()
+	}
+
+	plugin.record(event, nil, started, granted, err)
+}
+
+func scramVerifierGet(ctx context.Context, mechanism, username string) (*hashing.ScramVerifier, error) {
+	var verifier *hashing.ScramVerifier
+	var err error
+
+	plugin := currentPlugin()
+	defer plugin.release()
+
+	for try := 0; try <= plugin.retryCount; try++ {
+		plugin.backoff("scram", try)
+		verifier, err = plugin.backends.AuthScramVerifierGet(ctx, mechanism, username)
+		if err == nil {
+			break
+		}
+	}
+
+	return verifier, err
+}
+
+//export AuthCertificateNeeded
+func AuthCertificateNeeded() bool {
+	plugin := currentPlugin()
+	defer plugin.release()
+
+	return plugin.backends.CertificateNeeded()
+}
+
+//export AuthClientDisconnect
+func AuthClientDisconnect(clientid, username string, reason int32) {
+	log.Debugf("client %s (user %s) disconnected with reason %d", clientid, username, reason)
+
+	// Drop any unfinished enhanced authentication for the client.
+	scramServer.Abort(clientid)
+	clientCertificates.Delete(clientid)
+}
+
+//export AuthPluginReload
+func AuthPluginReload(keys []string, values []string, authOptsNum int) {
+	log.Info("reloading plugin configuration")
+
+	// The config file is read and secrets are resolved again, so changes to them and rotated secrets are picked up.
+	opts, err := loadAuthOpts(keys, values, authOptsNum)
+	if err != nil {
+		log.Errorf("couldn't reload plugin configuration, keeping the current one: %s", err)
+		return
+	}
+
+	current := authPlugin.Load().(*AuthPlugin)
+	logOutput := log.StandardLogger().Out
+
+	plugin, err := newAuthPlugin(opts)
+	if err != nil {
+		log.SetOutput(logOutput)
+		log.SetLevel(current.logLevel)
+		log.Errorf("couldn't reload plugin configuration, keeping the current one: %s", err)
+		return
+	}
+
+	authOpts = opts
+	authPlugin.Store(plugin)
+	auditLog.Reloaded()
+
+	// Logging already goes to the new instance's output, so a log file it doesn't use any longer can be closed.
+	if logFile != nil && logFile != plugin.logOutput {
+		logFile.Close()
+	}
+	logFile = plugin.logOutput
+
+	// Checks already running keep using the old instance, it's halted once they finish.
+	go current.halt()
+
+	log.Info("plugin configuration reloaded")
 }
 
 //export AuthPluginCleanup
 func AuthPluginCleanup() {
 	log.Info("Cleaning up plugin")
-	//If cache is set, close cache connection.
-	if authPlugin.cache != nil {
-		authPlugin.cache.Close()
-	}
-
-	authPlugin.backends.Halt()
+	metrics.Stop()
+	admin.Stop()
+	authPlugin.Load().(*AuthPlugin).halt()
+	throttler.Close()
+	auditLog.Close()
+	tracing.Shutdown()
 }
 
 func main() {}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// passwords are test-files/passwords entries, each user's password being its username.
+var passwords = map[string]string{
+	"test1": "test1:PBKDF2$sha512$100000$2WQHK5rjNN+oOT+TZAsWAw==$TDf4Y6J+9BdnjucFQ0ZUWlTwzncTjOOeE00W4Qm8lfPQyPCZACCjgfdK353jdGFwJjAf6vPAYaba9+z4GWK7Gg==",
+	"test2": "test2:PBKDF2$sha512$100000$o513B9FfaKTL6xalU+UUwA==$mAUtjVg1aHkDpudOnLKUQs8ddGtKKyu+xi07tftd5umPKQKnJeXf1X7RpoL/Gj/ZRdpuBu5GWZ+NZ2rYyAsi1g==",
+}
+
+// writePasswords writes a files backend password file with the given users to dir.
+func writePasswords(dir, name string, users ...string) string {
+	var lines []string
+	for _, user := range users {
+		lines = append(lines, passwords[user])
+	}
+
+	path := filepath.Join(dir, name)
+	So(ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644), ShouldBeNil)
+
+	return path
+}
+
+// pluginOpts splits authOpts into the keys and values mosquitto passes.
+func pluginOpts(authOpts map[string]string) ([]string, []string, int) {
+	var keys, values []string
+	for k, v := range authOpts {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+
+	return keys, values, len(keys)
+}
+
+// halted tells whether plugin was halted, waiting up to a second for it. Readers can't get the lock while
+// halt waits for checks in flight, the plugin isn't halted yet then.
+func halted(plugin *AuthPlugin) bool {
+	for i := 0; i < 100; i++ {
+		if plugin.inUse.TryRLock() {
+			done := plugin.halted
+			plugin.inUse.RUnlock()
+
+			if done {
+				return true
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestReload(t *testing.T) {
+	Convey("Given a plugin using the files backend", t, func() {
+		dir, err := ioutil.TempDir("", "go-auth")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		authOpts := map[string]string{
+			"backends":            "files",
+			"files_password_path": writePasswords(dir, "passwords", "test1", "test2"),
+			"log_level":           "debug",
+			"log_dest":            "file",
+			"log_file":            filepath.Join(dir, "go-auth.log"),
+		}
+
+		AuthPluginInit(pluginOpts(authOpts))
+		defer AuthPluginCleanup()
+		defer log.SetOutput(os.Stderr)
+
+		initial := authPlugin.Load().(*AuthPlugin)
+		So(AuthUnpwdCheck("test2", "test2", "clientid"), ShouldEqual, AuthGranted)
+
+		Convey("A reload should swap the instance checks use at once", func() {
+			authOpts["files_password_path"] = writePasswords(dir, "passwords-reloaded", "test1")
+
+			// Users known before and after the reload must be granted all along.
+			stop := make(chan struct{})
+			var checks, granted int64
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							if AuthUnpwdCheck("test1", "test1", "clientid") == AuthGranted {
+								atomic.AddInt64(&granted, 1)
+							}
+							atomic.AddInt64(&checks, 1)
+						}
+					}
+				}()
+			}
+
+			// Let checks run both before and after the reload.
+			waitChecks := func(n int64) {
+				for atomic.LoadInt64(&checks) < n {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			waitChecks(4)
+			AuthPluginReload(pluginOpts(authOpts))
+			waitChecks(atomic.LoadInt64(&checks) + 8)
+			close(stop)
+			wg.Wait()
+
+			So(granted, ShouldEqual, checks)
+
+			So(authPlugin.Load().(*AuthPlugin), ShouldNotEqual, initial)
+			So(AuthUnpwdCheck("test2", "test2", "clientid"), ShouldEqual, AuthRejected)
+			So(halted(initial), ShouldBeTrue)
+		})
+
+		Convey("A failed reload should keep the previous configuration and log level", func() {
+			authOpts["files_password_path"] = filepath.Join(dir, "missing")
+			authOpts["log_level"] = "error"
+
+			AuthPluginReload(pluginOpts(authOpts))
+
+			So(authPlugin.Load().(*AuthPlugin), ShouldEqual, initial)
+			So(authOpts["files_password_path"], ShouldNotEqual, filepath.Join(dir, "passwords"))
+			So(log.GetLevel(), ShouldEqual, log.DebugLevel)
+			So(AuthUnpwdCheck("test2", "test2", "clientid"), ShouldEqual, AuthGranted)
+			So(halted(initial), ShouldBeFalse)
+		})
+
+		Convey("Checks in flight on the replaced instance should finish before it's halted", func() {
+			inFlight := currentPlugin()
+			So(inFlight, ShouldEqual, initial)
+
+			AuthPluginReload(pluginOpts(authOpts))
+			So(authPlugin.Load().(*AuthPlugin), ShouldNotEqual, initial)
+
+			// The check still holds the old instance, so its backends must keep working.
+			So(inFlight.checkUnpwd("test2", "test2", "clientid", nil), ShouldEqual, AuthGranted)
+			So(halted(initial), ShouldBeFalse)
+
+			inFlight.release()
+			So(halted(initial), ShouldBeTrue)
+		})
+
+		Convey("Reloads should reuse the log file while its path doesn't change and close it otherwise", func() {
+			file := logFile
+			So(file, ShouldNotBeNil)
+
+			AuthPluginReload(pluginOpts(authOpts))
+			So(logFile, ShouldEqual, file)
+
+			authOpts["log_file"] = filepath.Join(dir, "go-auth-reloaded.log")
+			AuthPluginReload(pluginOpts(authOpts))
+			So(logFile, ShouldNotEqual, file)
+			So(logFile.Name(), ShouldEqual, authOpts["log_file"])
+
+			_, err := file.WriteString("closed\n")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -31,7 +31,9 @@ type GetUserRequest struct {
 	// Plain text password.
 	Password string `protobuf:"bytes,2,opt,name=password,proto3" json:"password,omitempty"`
 	// The client connection's id.
-	Clientid             string   `protobuf:"bytes,3,opt,name=clientid,proto3" json:"clientid,omitempty"`
+	Clientid string `protobuf:"bytes,3,opt,name=clientid,proto3" json:"clientid,omitempty"`
+	// The client's IP address, empty when unknown.
+	Ip                   string   `protobuf:"bytes,4,opt,name=ip,proto3" json:"ip,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -83,6 +85,13 @@ func (m *GetUserRequest) GetClientid() string {
 	return ""
 }
 
+func (m *GetUserRequest) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
 type GetSuperuserRequest struct {
 	// Username.
 	Username             string   `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
@@ -131,7 +140,15 @@ type CheckAclRequest struct {
 	// The client connection's id.
 	Clientid string `protobuf:"bytes,3,opt,name=clientid,proto3" json:"clientid,omitempty"`
 	// Topic access.
-	Acc                  int32    `protobuf:"varint,4,opt,name=acc,proto3" json:"acc,omitempty"`
+	Acc int32 `protobuf:"varint,4,opt,name=acc,proto3" json:"acc,omitempty"`
+	// Length of the message's payload, zero when unknown.
+	Payloadlen int64 `protobuf:"varint,5,opt,name=payloadlen,proto3" json:"payloadlen,omitempty"`
+	// Message QoS, zero when unknown.
+	Qos int32 `protobuf:"varint,6,opt,name=qos,proto3" json:"qos,omitempty"`
+	// Whether the message is retained.
+	Retain bool `protobuf:"varint,7,opt,name=retain,proto3" json:"retain,omitempty"`
+	// The client's IP address, empty when unknown.
+	Ip                   string   `protobuf:"bytes,8,opt,name=ip,proto3" json:"ip,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -190,9 +207,90 @@ func (m *CheckAclRequest) GetAcc() int32 {
 	return 0
 }
 
+func (m *CheckAclRequest) GetPayloadlen() int64 {
+	if m != nil {
+		return m.Payloadlen
+	}
+	return 0
+}
+
+func (m *CheckAclRequest) GetQos() int32 {
+	if m != nil {
+		return m.Qos
+	}
+	return 0
+}
+
+func (m *CheckAclRequest) GetRetain() bool {
+	if m != nil {
+		return m.Retain
+	}
+	return false
+}
+
+func (m *CheckAclRequest) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
+type GetPskKeyRequest struct {
+	// The hint given by the listener.
+	Hint string `protobuf:"bytes,1,opt,name=hint,proto3" json:"hint,omitempty"`
+	// The identity given by the client.
+	Identity             string   `protobuf:"bytes,2,opt,name=identity,proto3" json:"identity,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetPskKeyRequest) Reset()         { *m = GetPskKeyRequest{} }
+func (m *GetPskKeyRequest) String() string { return proto.CompactTextString(m) }
+func (*GetPskKeyRequest) ProtoMessage()    {}
+func (*GetPskKeyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8bbd6f3875b0e874, []int{3}
+}
+
+func (m *GetPskKeyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetPskKeyRequest.Unmarshal(m, b)
+}
+func (m *GetPskKeyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetPskKeyRequest.Marshal(b, m, deterministic)
+}
+func (m *GetPskKeyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetPskKeyRequest.Merge(m, src)
+}
+func (m *GetPskKeyRequest) XXX_Size() int {
+	return xxx_messageInfo_GetPskKeyRequest.Size(m)
+}
+func (m *GetPskKeyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetPskKeyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetPskKeyRequest proto.InternalMessageInfo
+
+func (m *GetPskKeyRequest) GetHint() string {
+	if m != nil {
+		return m.Hint
+	}
+	return ""
+}
+
+func (m *GetPskKeyRequest) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
 type AuthResponse struct {
 	// If the user is authorized/authenticated.
-	Ok                   bool     `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	Ok bool `protobuf:"varint,1,opt,name=ok,proto3" json:"ok,omitempty"`
+	// If the check is explicitly denied, which other backends can't override. Ignored when ok is set.
+	Deny bool `protobuf:"varint,2,opt,name=deny,proto3" json:"deny,omitempty"`
+	// Why the check was denied, optional.
+	Reason               string   `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -202,7 +300,7 @@ func (m *AuthResponse) Reset()         { *m = AuthResponse{} }
 func (m *AuthResponse) String() string { return proto.CompactTextString(m) }
 func (*AuthResponse) ProtoMessage()    {}
 func (*AuthResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_8bbd6f3875b0e874, []int{3}
+	return fileDescriptor_8bbd6f3875b0e874, []int{4}
 }
 
 func (m *AuthResponse) XXX_Unmarshal(b []byte) error {
@@ -230,6 +328,20 @@ func (m *AuthResponse) GetOk() bool {
 	return false
 }
 
+func (m *AuthResponse) GetDeny() bool {
+	if m != nil {
+		return m.Deny
+	}
+	return false
+}
+
+func (m *AuthResponse) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
 type NameResponse struct {
 	// The name of the gRPC backend.
 	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
@@ -242,7 +354,7 @@ func (m *NameResponse) Reset()         { *m = NameResponse{} }
 func (m *NameResponse) String() string { return proto.CompactTextString(m) }
 func (*NameResponse) ProtoMessage()    {}
 func (*NameResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_8bbd6f3875b0e874, []int{4}
+	return fileDescriptor_8bbd6f3875b0e874, []int{5}
 }
 
 func (m *NameResponse) XXX_Unmarshal(b []byte) error {
@@ -270,39 +382,89 @@ func (m *NameResponse) GetName() string {
 	return ""
 }
 
+type PskKeyResponse struct {
+	// The hex encoded key, empty if the identity is unknown.
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PskKeyResponse) Reset()         { *m = PskKeyResponse{} }
+func (m *PskKeyResponse) String() string { return proto.CompactTextString(m) }
+func (*PskKeyResponse) ProtoMessage()    {}
+func (*PskKeyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_8bbd6f3875b0e874, []int{6}
+}
+
+func (m *PskKeyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_PskKeyResponse.Unmarshal(m, b)
+}
+func (m *PskKeyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_PskKeyResponse.Marshal(b, m, deterministic)
+}
+func (m *PskKeyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PskKeyResponse.Merge(m, src)
+}
+func (m *PskKeyResponse) XXX_Size() int {
+	return xxx_messageInfo_PskKeyResponse.Size(m)
+}
+func (m *PskKeyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_PskKeyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PskKeyResponse proto.InternalMessageInfo
+
+func (m *PskKeyResponse) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*GetUserRequest)(nil), "grpc.GetUserRequest")
 	proto.RegisterType((*GetSuperuserRequest)(nil), "grpc.GetSuperuserRequest")
 	proto.RegisterType((*CheckAclRequest)(nil), "grpc.CheckAclRequest")
+	proto.RegisterType((*GetPskKeyRequest)(nil), "grpc.GetPskKeyRequest")
 	proto.RegisterType((*AuthResponse)(nil), "grpc.AuthResponse")
 	proto.RegisterType((*NameResponse)(nil), "grpc.NameResponse")
+	proto.RegisterType((*PskKeyResponse)(nil), "grpc.PskKeyResponse")
 }
 
 func init() { proto.RegisterFile("auth.proto", fileDescriptor_8bbd6f3875b0e874) }
 
 var fileDescriptor_8bbd6f3875b0e874 = []byte{
-	// 333 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x52, 0x4d, 0x4f, 0xc2, 0x40,
-	0x14, 0x84, 0x52, 0x14, 0x9f, 0x04, 0xcd, 0x8a, 0xa6, 0x62, 0x62, 0xc8, 0x9e, 0x38, 0x95, 0xa8,
-	0x31, 0x7a, 0x33, 0xc4, 0x18, 0x3c, 0x79, 0x28, 0xf1, 0x07, 0x94, 0xe5, 0x09, 0x0d, 0x85, 0x5d,
-	0xf6, 0x43, 0xe3, 0xcf, 0xf2, 0x1f, 0x9a, 0xed, 0xd2, 0xa6, 0x92, 0xd4, 0x70, 0xdb, 0x99, 0xd9,
-	0xd9, 0x37, 0x9d, 0x3e, 0x80, 0xd8, 0xe8, 0x45, 0x28, 0x24, 0xd7, 0x9c, 0xf8, 0x73, 0x29, 0x58,
-	0xef, 0x6a, 0xce, 0xf9, 0x3c, 0xc5, 0x61, 0xc6, 0x4d, 0xcd, 0xc7, 0x10, 0x57, 0x42, 0x7f, 0xbb,
-	0x2b, 0x74, 0x06, 0x9d, 0x31, 0xea, 0x77, 0x85, 0x32, 0xc2, 0x8d, 0x41, 0xa5, 0x49, 0x0f, 0x5a,
-	0x46, 0xa1, 0x5c, 0xc7, 0x2b, 0x0c, 0xea, 0xfd, 0xfa, 0xe0, 0x28, 0x2a, 0xb0, 0xd5, 0x44, 0xac,
-	0xd4, 0x17, 0x97, 0xb3, 0xc0, 0x73, 0x5a, 0x8e, 0xad, 0xc6, 0xd2, 0x04, 0xd7, 0x3a, 0x99, 0x05,
-	0x0d, 0xa7, 0xe5, 0x98, 0xde, 0xc0, 0xd9, 0x18, 0xf5, 0xc4, 0x08, 0x94, 0x66, 0xbf, 0x51, 0x74,
-	0x03, 0x27, 0xcf, 0x0b, 0x64, 0xcb, 0x11, 0x4b, 0xf7, 0x49, 0xd6, 0x85, 0xa6, 0xe6, 0x22, 0x61,
-	0xdb, 0x58, 0x0e, 0xfc, 0x97, 0x89, 0x9c, 0x42, 0x23, 0x66, 0x2c, 0xf0, 0xfb, 0xf5, 0x41, 0x33,
-	0xb2, 0x47, 0x7a, 0x0d, 0xed, 0x91, 0xd1, 0x8b, 0x08, 0x95, 0xe0, 0x6b, 0x85, 0xa4, 0x03, 0x1e,
-	0x5f, 0x66, 0x93, 0x5a, 0x91, 0xc7, 0x97, 0x94, 0x42, 0xfb, 0x2d, 0x5e, 0x61, 0xa1, 0x13, 0xf0,
-	0x4b, 0x59, 0xb2, 0xf3, 0xed, 0x8f, 0x07, 0xc7, 0xf6, 0x91, 0x09, 0xca, 0xcf, 0x84, 0x21, 0xb9,
-	0x87, 0xc3, 0x6d, 0xbf, 0xa4, 0x1b, 0xda, 0xdf, 0x11, 0xfe, 0xad, 0xbb, 0x47, 0x1c, 0x5b, 0x1e,
-	0x4c, 0x6b, 0xe4, 0x09, 0xda, 0xe5, 0xc2, 0xc8, 0x65, 0xe1, 0xdd, 0x2d, 0xb1, 0xe2, 0x81, 0x07,
-	0x68, 0xe5, 0xf5, 0x91, 0x73, 0x77, 0x63, 0xa7, 0xce, 0x4a, 0xa3, 0x0d, 0x6c, 0xbf, 0x93, 0x5c,
-	0x84, 0x6e, 0x73, 0xc2, 0x7c, 0x73, 0xc2, 0x17, 0xbb, 0x39, 0xb9, 0xb1, 0xdc, 0x05, 0xad, 0x91,
-	0x47, 0xf0, 0x5f, 0xe3, 0x54, 0x57, 0xba, 0x2a, 0x78, 0x5a, 0x9b, 0x1e, 0x64, 0xcc, 0xdd, 0x6f,
-	0x00, 0x00, 0x00, 0xff, 0xff, 0x83, 0x08, 0xf7, 0xf9, 0xbb, 0x02, 0x00, 0x00,
+	// 460 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8d, 0x53, 0xdd, 0x4a, 0xdc, 0x40,
+	0x14, 0x76, 0x7f, 0x8d, 0xa7, 0xcb, 0x2a, 0xe3, 0x2a, 0xe9, 0x16, 0x8a, 0xe4, 0xca, 0xab, 0x48,
+	0x2b, 0x62, 0xa1, 0x17, 0xb2, 0x96, 0xa2, 0x58, 0x28, 0x25, 0xd2, 0x07, 0x18, 0xb3, 0xc7, 0xdd,
+	0xb0, 0x31, 0x33, 0x66, 0x26, 0x96, 0x3c, 0xa3, 0xef, 0xd2, 0x67, 0x70, 0x7e, 0x43, 0x56, 0x58,
+	0xf1, 0xee, 0xfc, 0x7d, 0x73, 0xbe, 0xf3, 0x9d, 0x33, 0x00, 0xb4, 0x92, 0xcb, 0x98, 0x97, 0x4c,
+	0x32, 0xd2, 0x5f, 0x94, 0x3c, 0x9d, 0x7e, 0x5a, 0x30, 0xb6, 0xc8, 0xf1, 0xc4, 0xc4, 0xee, 0xaa,
+	0xfb, 0x13, 0x7c, 0xe0, 0xb2, 0xb6, 0x25, 0x91, 0x84, 0xf1, 0x15, 0xca, 0xbf, 0x02, 0xcb, 0x04,
+	0x1f, 0x2b, 0x14, 0x92, 0x4c, 0x21, 0xa8, 0x94, 0x5b, 0xd0, 0x07, 0x0c, 0x3b, 0x47, 0x9d, 0xe3,
+	0x9d, 0xa4, 0xf1, 0x75, 0x8e, 0x53, 0x21, 0xfe, 0xb1, 0x72, 0x1e, 0x76, 0x6d, 0xce, 0xfb, 0x3a,
+	0x97, 0xe6, 0x19, 0x16, 0x32, 0x9b, 0x87, 0x3d, 0x9b, 0xf3, 0x3e, 0x19, 0x43, 0x37, 0xe3, 0x61,
+	0xdf, 0x44, 0x95, 0x15, 0x7d, 0x81, 0x7d, 0xd5, 0xf5, 0xb6, 0xe2, 0x58, 0x56, 0xef, 0x6b, 0x1d,
+	0x3d, 0x77, 0x60, 0xf7, 0xc7, 0x12, 0xd3, 0xd5, 0x2c, 0xcd, 0xdf, 0x43, 0x75, 0x02, 0x03, 0xc9,
+	0x78, 0x96, 0x3a, 0x9e, 0xd6, 0x79, 0x93, 0xe4, 0x1e, 0xf4, 0x68, 0x9a, 0x1a, 0x96, 0x83, 0x44,
+	0x9b, 0xe4, 0x33, 0x00, 0xa7, 0x75, 0xce, 0xe8, 0x3c, 0xc7, 0x22, 0x1c, 0xa8, 0x44, 0x2f, 0x69,
+	0x45, 0x34, 0xe2, 0x91, 0x89, 0x70, 0x68, 0x11, 0xca, 0x24, 0x87, 0x30, 0x2c, 0x51, 0xd2, 0xac,
+	0x08, 0xb7, 0x55, 0x30, 0x48, 0x9c, 0xe7, 0x04, 0x08, 0x1a, 0x01, 0x2e, 0x61, 0x4f, 0x09, 0xf0,
+	0x47, 0xac, 0x7e, 0x61, 0xed, 0xa7, 0x21, 0xd0, 0x5f, 0x66, 0x85, 0x74, 0x93, 0x18, 0x5b, 0xf3,
+	0xcd, 0xe6, 0x9a, 0x9e, 0xac, 0xbd, 0xe0, 0xde, 0x8f, 0x6e, 0x60, 0x34, 0x53, 0xbb, 0x4e, 0x50,
+	0x70, 0x56, 0x08, 0xd4, 0x3d, 0xd8, 0xca, 0xa0, 0x83, 0x44, 0x59, 0xfa, 0x3d, 0x55, 0x6a, 0x71,
+	0x41, 0x62, 0x6c, 0xcb, 0x8f, 0x0a, 0x56, 0xb8, 0xe9, 0x9d, 0x17, 0x45, 0x30, 0xfa, 0xad, 0x54,
+	0x6b, 0xde, 0x52, 0xd8, 0x96, 0xaa, 0xc6, 0x56, 0x35, 0x63, 0x4f, 0xd8, 0x55, 0xa9, 0xf9, 0x57,
+	0x58, 0xbb, 0x22, 0x6d, 0x7e, 0xfd, 0xdf, 0x85, 0x0f, 0x9a, 0xd4, 0x2d, 0x96, 0x4f, 0x59, 0x8a,
+	0xe4, 0x0c, 0xb6, 0xdd, 0x79, 0x91, 0x49, 0xac, 0xaf, 0x31, 0x5e, 0xbf, 0xb6, 0x29, 0xb1, 0xd1,
+	0xf6, 0x20, 0xd1, 0x16, 0xb9, 0x80, 0x51, 0xfb, 0x3e, 0xc8, 0xc7, 0x06, 0xfb, 0xfa, 0x66, 0x36,
+	0x3c, 0x70, 0x0e, 0x81, 0x3f, 0x16, 0x72, 0x60, 0x2b, 0x5e, 0x1d, 0xcf, 0x06, 0xe0, 0x77, 0xd8,
+	0x69, 0x16, 0x43, 0x0e, 0x9b, 0xb6, 0x6b, 0x9b, 0x9a, 0xba, 0x51, 0xd6, 0xd5, 0x30, 0x5d, 0xf5,
+	0xb4, 0x5a, 0x48, 0x0d, 0x35, 0xbf, 0x2e, 0xf6, 0xbf, 0x2e, 0xfe, 0xa9, 0x7f, 0x9d, 0xef, 0xda,
+	0x16, 0x5b, 0x01, 0xbf, 0x41, 0xff, 0x9a, 0xe6, 0x72, 0x23, 0x6a, 0x43, 0x3c, 0xda, 0xba, 0x1b,
+	0x9a, 0xc8, 0xe9, 0x0b, 0x4d, 0x84, 0xc9, 0x99, 0xf7, 0x03, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -323,6 +485,8 @@ type AuthServiceClient interface {
 	GetSuperuser(ctx context.Context, in *GetSuperuserRequest, opts ...grpc.CallOption) (*AuthResponse, error)
 	// CheckAcl checks user's authorization for the given topic.
 	CheckAcl(ctx context.Context, in *CheckAclRequest, opts ...grpc.CallOption) (*AuthResponse, error)
+	// GetPskKey retrieves the hex encoded pre-shared key for a TLS-PSK identity.
+	GetPskKey(ctx context.Context, in *GetPskKeyRequest, opts ...grpc.CallOption) (*PskKeyResponse, error)
 	// GetName retrieves the name of the backend.
 	GetName(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*NameResponse, error)
 	// Halt signals the backend to halt.
@@ -364,6 +528,15 @@ func (c *authServiceClient) CheckAcl(ctx context.Context, in *CheckAclRequest, o
 	return out, nil
 }
 
+func (c *authServiceClient) GetPskKey(ctx context.Context, in *GetPskKeyRequest, opts ...grpc.CallOption) (*PskKeyResponse, error) {
+	out := new(PskKeyResponse)
+	err := c.cc.Invoke(ctx, "/grpc.AuthService/GetPskKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *authServiceClient) GetName(ctx context.Context, in *empty.Empty, opts ...grpc.CallOption) (*NameResponse, error) {
 	out := new(NameResponse)
 	err := c.cc.Invoke(ctx, "/grpc.AuthService/GetName", in, out, opts...)
@@ -390,6 +563,8 @@ type AuthServiceServer interface {
 	GetSuperuser(context.Context, *GetSuperuserRequest) (*AuthResponse, error)
 	// CheckAcl checks user's authorization for the given topic.
 	CheckAcl(context.Context, *CheckAclRequest) (*AuthResponse, error)
+	// GetPskKey retrieves the hex encoded pre-shared key for a TLS-PSK identity.
+	GetPskKey(context.Context, *GetPskKeyRequest) (*PskKeyResponse, error)
 	// GetName retrieves the name of the backend.
 	GetName(context.Context, *empty.Empty) (*NameResponse, error)
 	// Halt signals the backend to halt.
@@ -409,6 +584,9 @@ func (*UnimplementedAuthServiceServer) GetSuperuser(ctx context.Context, req *Ge
 func (*UnimplementedAuthServiceServer) CheckAcl(ctx context.Context, req *CheckAclRequest) (*AuthResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method CheckAcl not implemented")
 }
+func (*UnimplementedAuthServiceServer) GetPskKey(ctx context.Context, req *GetPskKeyRequest) (*PskKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPskKey not implemented")
+}
 func (*UnimplementedAuthServiceServer) GetName(ctx context.Context, req *empty.Empty) (*NameResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetName not implemented")
 }
@@ -474,6 +652,24 @@ func _AuthService_CheckAcl_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _AuthService_GetPskKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPskKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AuthServiceServer).GetPskKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc.AuthService/GetPskKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AuthServiceServer).GetPskKey(ctx, req.(*GetPskKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _AuthService_GetName_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(empty.Empty)
 	if err := dec(in); err != nil {
@@ -526,6 +722,10 @@ var _AuthService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "CheckAcl",
 			Handler:    _AuthService_CheckAcl_Handler,
 		},
+		{
+			MethodName: "GetPskKey",
+			Handler:    _AuthService_GetPskKey_Handler,
+		},
 		{
 			MethodName: "GetName",
 			Handler:    _AuthService_GetName_Handler,
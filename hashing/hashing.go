@@ -23,6 +23,7 @@ const (
 	Pbkdf2Opt   = "pbkdf2"
 	Argon2IDOpt = "argon2id"
 	BcryptOpt   = "bcrypt"
+	ScramOpt    = "scram"
 
 	// defaults
 	defaultBcryptCost = 10
@@ -37,6 +38,10 @@ const (
 	defaultPBKDF2Iterations = 100000
 	defaultPBKDF2KeyLen     = 32
 	defaultPBKDF2Algorithm  = SHA512
+
+	defaultScramSaltSize   = 16
+	defaultScramIterations = 4096
+	defaultScramAlgorithm  = SHA256
 )
 
 var saltEncodings = map[string]struct{}{
@@ -119,6 +124,21 @@ func NewHasher(authOpts map[string]string, backend string) HashComparer {
 			keyLen = int(v)
 		}
 		return NewArgon2IDHasher(saltSize, iterations, keyLen, memory, parallelism)
+	case ScramOpt:
+		log.Debugf("new hasher: %s", ScramOpt)
+		saltSize := defaultScramSaltSize
+		if v, err := strconv.ParseInt(opts["hasher_salt_size"], 10, 64); err == nil {
+			saltSize = int(v)
+		}
+		iterations := defaultScramIterations
+		if v, err := strconv.ParseInt(opts["hasher_iterations"], 10, 64); err == nil {
+			iterations = int(v)
+		}
+		algorithm := defaultScramAlgorithm
+		if opts["hasher_algorithm"] == SHA512 {
+			algorithm = SHA512
+		}
+		return NewScramHasher(saltSize, iterations, algorithm)
 	case Pbkdf2Opt:
 		log.Debugf("new hasher: %s", Pbkdf2Opt)
 	default:
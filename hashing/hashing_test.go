@@ -1,6 +1,8 @@
 package hashing
 
 import (
+	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -99,6 +101,31 @@ func TestNewHasher(t *testing.T) {
 	bHasher, ok = hasher.(bcryptHasher)
 	assert.True(t, ok)
 	assert.Equal(t, 15, bHasher.cost)
+
+	authOpts = make(map[string]string)
+	authOpts["hasher"] = ScramOpt
+	hasher = NewHasher(authOpts, "")
+
+	sHasher, ok := hasher.(scramHasher)
+	assert.True(t, ok)
+	assert.Equal(t, defaultScramAlgorithm, sHasher.algorithm)
+	assert.Equal(t, defaultScramIterations, sHasher.iterations)
+	assert.Equal(t, defaultScramSaltSize, sHasher.saltSize)
+
+	// Check that options are set correctly.
+	authOpts = map[string]string{
+		"hasher":            ScramOpt,
+		"hasher_algorithm":  SHA512,
+		"hasher_iterations": "8192",
+		"hasher_salt_size":  "24",
+	}
+	hasher = NewHasher(authOpts, "")
+
+	sHasher, ok = hasher.(scramHasher)
+	assert.True(t, ok)
+	assert.Equal(t, SHA512, sHasher.algorithm)
+	assert.Equal(t, 8192, sHasher.iterations)
+	assert.Equal(t, 24, sHasher.saltSize)
 }
 
 func TestBcrypt(t *testing.T) {
@@ -145,3 +172,39 @@ func TestPBKDF2(t *testing.T) {
 	assert.True(t, hasher.Compare(password, passwordHash))
 	assert.False(t, hasher.Compare("other", passwordHash))
 }
+
+func TestScram(t *testing.T) {
+	password := "test-password"
+
+	hasher := NewScramHasher(defaultScramSaltSize, defaultScramIterations, SHA256)
+
+	passwordHash, err := hasher.Hash(password)
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(passwordHash, ScramSHA256+"$4096:"))
+	assert.True(t, hasher.Compare(password, passwordHash))
+	assert.False(t, hasher.Compare("other", passwordHash))
+
+	hasher = NewScramHasher(defaultScramSaltSize, defaultScramIterations, SHA512)
+
+	passwordHash, err = hasher.Hash(password)
+
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(passwordHash, ScramSHA512+"$4096:"))
+	assert.True(t, hasher.Compare(password, passwordHash))
+	assert.False(t, hasher.Compare("other", passwordHash))
+
+	// RFC 7677 test vector: user "user", password "pencil".
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	assert.Nil(t, err)
+
+	verifier := NewScramVerifier(ScramSHA256, "pencil", salt, 4096)
+	parsed, err := ParseScramVerifier(verifier.String())
+
+	assert.Nil(t, err)
+	assert.Equal(t, verifier, parsed)
+	assert.True(t, hasher.Compare("pencil", verifier.String()))
+
+	_, err = ParseScramVerifier("PBKDF2$sha512$100000$salt$hash")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,172 @@
+package hashing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SCRAM mechanism names as advertised in the MQTT v5 authentication method.
+const (
+	ScramSHA256 = "SCRAM-SHA-256"
+	ScramSHA512 = "SCRAM-SHA-512"
+)
+
+type scramHasher struct {
+	saltSize   int
+	iterations int
+	algorithm  string
+}
+
+// ScramVerifier holds the credentials a server needs to run a SCRAM exchange
+// without knowing the password: salt, iteration count, StoredKey and ServerKey.
+type ScramVerifier struct {
+	Mechanism  string
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramHasher returns a hasher that produces SCRAM verifiers for the given algorithm (sha256 or sha512).
+func NewScramHasher(saltSize int, iterations int, algorithm string) HashComparer {
+	return scramHasher{
+		saltSize:   saltSize,
+		iterations: iterations,
+		algorithm:  algorithm,
+	}
+}
+
+// Hash returns a verifier in the RFC 5803 format:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+func (h scramHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("read random bytes error: %s", err)
+	}
+
+	mechanism := ScramSHA512
+	if h.algorithm == SHA256 {
+		mechanism = ScramSHA256
+	}
+
+	return NewScramVerifier(mechanism, password, salt, h.iterations).String(), nil
+}
+
+// Compare checks a plain password against a stored SCRAM verifier.
+func (h scramHasher) Compare(password string, passwordHash string) bool {
+	verifier, err := ParseScramVerifier(passwordHash)
+	if err != nil {
+		log.Errorf("invalid SCRAM verifier: %s", err)
+		return false
+	}
+
+	computed := NewScramVerifier(verifier.Mechanism, password, verifier.Salt, verifier.Iterations)
+
+	return hmac.Equal(computed.StoredKey, verifier.StoredKey) && hmac.Equal(computed.ServerKey, verifier.ServerKey)
+}
+
+// NewScramVerifier derives StoredKey and ServerKey from the password as described in RFC 5802.
+func NewScramVerifier(mechanism, password string, salt []byte, iterations int) *ScramVerifier {
+	h := ScramHash(mechanism)
+
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	clientKey := ScramHMAC(h, saltedPassword, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+
+	return &ScramVerifier{
+		Mechanism:  mechanism,
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  ScramHMAC(h, saltedPassword, []byte("Server Key")),
+	}
+}
+
+// ParseScramVerifier parses a verifier in the RFC 5803 format.
+func ParseScramVerifier(passwordHash string) (*ScramVerifier, error) {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expected 3 parts, got %d", len(parts))
+	}
+
+	mechanism := parts[0]
+	if mechanism != ScramSHA256 && mechanism != ScramSHA512 {
+		return nil, fmt.Errorf("unknown mechanism %s", mechanism)
+	}
+
+	iterSalt := strings.SplitN(parts[1], ":", 2)
+	keys := strings.SplitN(parts[2], ":", 2)
+	if len(iterSalt) != 2 || len(keys) != 2 {
+		return nil, fmt.Errorf("malformed verifier")
+	}
+
+	iterations, err := strconv.Atoi(iterSalt[0])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("invalid iterations %s", iterSalt[0])
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(iterSalt[1])
+	if err != nil {
+		return nil, fmt.Errorf("base64 salt error: %s", err)
+	}
+
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil {
+		return nil, fmt.Errorf("base64 stored key error: %s", err)
+	}
+
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	if err != nil {
+		return nil, fmt.Errorf("base64 server key error: %s", err)
+	}
+
+	size := ScramHash(mechanism)().Size()
+	if len(storedKey) != size || len(serverKey) != size {
+		return nil, fmt.Errorf("invalid key length for %s", mechanism)
+	}
+
+	return &ScramVerifier{
+		Mechanism:  mechanism,
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	}, nil
+}
+
+// String encodes the verifier in the RFC 5803 format.
+func (v *ScramVerifier) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s",
+		v.Mechanism,
+		v.Iterations,
+		base64.StdEncoding.EncodeToString(v.Salt),
+		base64.StdEncoding.EncodeToString(v.StoredKey),
+		base64.StdEncoding.EncodeToString(v.ServerKey),
+	)
+}
+
+// ScramHash returns the hash function for the given mechanism, defaulting to SHA-512.
+func ScramHash(mechanism string) func() hash.Hash {
+	if mechanism == ScramSHA256 {
+		return sha256.New
+	}
+	return sha512.New
+}
+
+// ScramHMAC computes HMAC(key, data) with the given hash function.
+func ScramHMAC(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "mosquitto_auth"
+
+// Results a check may have.
+const (
+	Granted  = "granted"
+	Rejected = "rejected"
+	Error    = "error"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	checks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checks_total",
+		Help:      "Checks answered by the plugin, by check type and result.",
+	}, []string{"check", "result"})
+
+	backendChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_checks_total",
+		Help:      "Checks made to each backend, by check type and result.",
+	}, []string{"backend", "check", "result"})
+
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_check_duration_seconds",
+		Help:      "Time taken by each backend to answer a check.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "check"})
+
+	backendCircuit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backend_circuit_state",
+		Help:      "State of each backend's circuit breaker: 0 is closed, 1 open and 2 half-open.",
+	}, []string{"backend"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by check type and result (hit or miss).",
+	}, []string{"check", "result"})
+
+	cacheSetErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_set_errors_total",
+		Help:      "Errors storing a decision in the cache, by check type.",
+	}, []string{"check"})
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Checks retried after a backend error, by check type.",
+	}, []string{"check"})
+
+	auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_dropped_total",
+		Help:      "Audit events dropped because the audit buffer was full.",
+	})
+
+	throttled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "throttled_total",
+		Help:      "Logins rejected because of too many recent failures, by the key that was throttled.",
+	}, []string{"key"})
+)
+
+var (
+	serverMu sync.Mutex
+	server   *http.Server
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		checks,
+		backendChecks,
+		backendDuration,
+		backendCircuit,
+		cacheRequests,
+		cacheSetErrors,
+		retries,
+		auditDropped,
+		throttled,
+	)
+}
+
+// Result returns the result label for a check's outcome.
+func Result(granted bool, err error) string {
+	if err != nil {
+		return Error
+	}
+
+	if granted {
+		return Granted
+	}
+
+	return Rejected
+}
+
+// ObserveCheck counts the answer the plugin gave to a check.
+func ObserveCheck(check, result string) {
+	checks.WithLabelValues(check, result).Inc()
+}
+
+// ObserveBackendCheck counts a check made to a backend and records how long it took.
+func ObserveBackendCheck(backend, check string, duration time.Duration, granted bool, err error) {
+	backendChecks.WithLabelValues(backend, check, Result(granted, err)).Inc()
+	backendDuration.WithLabelValues(backend, check).Observe(duration.Seconds())
+}
+
+// SetCircuitState records the state of a backend's circuit breaker.
+func SetCircuitState(backend string, state int) {
+	backendCircuit.WithLabelValues(backend).Set(float64(state))
+}
+
+// ObserveCache counts a cache lookup for the given check type.
+func ObserveCache(check string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	cacheRequests.WithLabelValues(check, result).Inc()
+}
+
+// ObserveCacheSetError counts a failure to store a decision in the cache.
+func ObserveCacheSetError(check string) {
+	cacheSetErrors.WithLabelValues(check).Inc()
+}
+
+// ObserveRetry counts a retried check.
+func ObserveRetry(check string) {
+	retries.WithLabelValues(check).Inc()
+}
+
+// ObserveAuditDropped counts an audit event that couldn't be queued.
+func ObserveAuditDropped() {
+	auditDropped.Inc()
+}
+
+// ObserveThrottled counts a login rejected because the given key (username, clientid or ip) was throttled.
+func ObserveThrottled(key string) {
+	throttled.WithLabelValues(key).Inc()
+}
+
+// Start serves the metrics at /metrics on the given address until Stop is called.
+func Start(addr string) error {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server != nil {
+		return nil
+	}
+
+	// Listen right away so a wrong address is reported to the caller.
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server = &http.Server{Handler: mux}
+
+	go func(srv *http.Server) {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("metrics server error: %s", err)
+		}
+	}(server)
+
+	log.Infof("serving metrics on %s", listener.Addr())
+
+	return nil
+}
+
+// Stop shuts the metrics server down, waiting a few seconds for scrapes in flight.
+func Stop() {
+	serverMu.Lock()
+	defer serverMu.Unlock()
+
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("metrics server shutdown error: %s", err)
+	}
+
+	server = nil
+}
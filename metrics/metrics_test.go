@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResult(t *testing.T) {
+	Convey("Results should tell errors, grants and rejections apart", t, func() {
+		So(Result(true, nil), ShouldEqual, Granted)
+		So(Result(false, nil), ShouldEqual, Rejected)
+		So(Result(true, errors.New("error")), ShouldEqual, Error)
+	})
+}
+
+func TestServer(t *testing.T) {
+	Convey("Given a metrics server", t, func() {
+		// Get a free port.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		addr := listener.Addr().String()
+		listener.Close()
+
+		So(Start(addr), ShouldBeNil)
+		defer Stop()
+
+		ObserveCheck("user", Granted)
+		ObserveBackendCheck("postgres", "acl", 10*time.Millisecond, false, errors.New("error"))
+		ObserveCache("acl", true)
+		ObserveCacheSetError("user")
+		ObserveRetry("acl")
+		SetCircuitState("postgres", 1)
+		ObserveThrottled("username")
+
+		Convey("It should expose the recorded metrics", func() {
+			resp, err := http.Get("http://" + addr + "/metrics")
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_checks_total{check="user",result="granted"}`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_backend_checks_total{backend="postgres",check="acl",result="error"} 1`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_backend_check_duration_seconds_count{backend="postgres",check="acl"} 1`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_cache_requests_total{check="acl",result="hit"} 1`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_cache_set_errors_total{check="user"} 1`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_retries_total{check="acl"} 1`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_backend_circuit_state{backend="postgres"} 1`)
+			So(string(body), ShouldContainSubstring, `mosquitto_auth_throttled_total{key="username"} 1`)
+		})
+
+		Convey("It should stop listening when stopped", func() {
+			Stop()
+
+			_, err := http.Get("http://" + addr + "/metrics")
+			So(err, ShouldNotBeNil)
+
+			Convey("And it should be possible to start it again", func() {
+				So(Start(addr), ShouldBeNil)
+			})
+		})
+	})
+}
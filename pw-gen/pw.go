@@ -9,9 +9,9 @@ import (
 
 func main() {
 
-	var hasher = flag.String("h", "pbkdf2", "hasher: pbkdf2, argon2 or bcrypt")
+	var hasher = flag.String("h", "pbkdf2", "hasher: pbkdf2, argon2, bcrypt or scram")
 	var algorithm = flag.String("a", "sha512", "algorithm: sha256 or sha512")
-	var iterations = flag.Int("i", 100000, "hash iterations: defaults to 100000 for pbkdf2, please set to a reasonable value for argon2")
+	var iterations = flag.Int("i", 100000, "hash iterations: defaults to 100000 for pbkdf2, please set to a reasonable value for argon2 and scram (clients repeat them on every connection, 4096 is the usual minimum)")
 	var password = flag.String("p", "", "password")
 	var saltSize = flag.Int("s", 16, "salt size")
 	var saltEncoding = flag.String("e", "base64", "salt encoding")
@@ -43,6 +43,8 @@ func main() {
 		hashComparer = hashing.NewArgon2IDHasher(*saltSize, *iterations, shaSize, uint32(*memory), uint8(*parallelism))
 	case hashing.BcryptOpt:
 		hashComparer = hashing.NewBcryptHashComparer(*cost)
+	case hashing.ScramOpt:
+		hashComparer = hashing.NewScramHasher(*saltSize, *iterations, *algorithm)
 	case hashing.Pbkdf2Opt:
 		hashComparer = hashing.NewPBKDF2Hasher(*saltSize, *iterations, *algorithm, *saltEncoding, shaSize)
 	default:
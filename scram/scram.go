@@ -0,0 +1,334 @@
+// Package scram implements the server side of SCRAM-SHA-256 and SCRAM-SHA-512 (RFC 5802, RFC 7677)
+// for MQTT v5 enhanced authentication. Conversations are keyed by client id so concurrent handshakes
+// don't step on each other.
+package scram
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nonceSize = 24
+
+	defaultTimeout = 30 * time.Second
+
+	// Iterations advertised for unknown users, so they can't be told apart from known ones.
+	fakeIterations = 4096
+)
+
+// ErrUnsupportedMechanism is returned when the client asks for an authentication method other than SCRAM.
+var ErrUnsupportedMechanism = errors.New("unsupported mechanism")
+
+// LookupError is returned by Start when the stored credentials couldn't be fetched,
+// as opposed to the client sending a bad message.
+type LookupError struct {
+	Err error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("get verifier error: %s", e.Err)
+}
+
+// VerifierGetter returns the stored verifier for a username and mechanism, or nil if there's none
+// or the client the conversation is started for, as carried by ctx, may not log in as username.
+type VerifierGetter func(ctx context.Context, mechanism, username string) (*hashing.ScramVerifier, error)
+
+type conversation struct {
+	mechanism       string
+	username        string
+	verifier        *hashing.ScramVerifier
+	clientFirstBare string
+	serverFirst     string
+	gs2Header       string
+	nonce           string
+	started         time.Time
+}
+
+// Server keeps the state of in flight SCRAM conversations.
+type Server struct {
+	sync.Mutex
+	conversations map[string]*conversation
+	getVerifier   VerifierGetter
+	timeout       time.Duration
+	fakeSecret    []byte
+}
+
+// NewServer returns a SCRAM server that looks up credentials with getVerifier.
+// Conversations that don't complete within timeout are discarded; a zero timeout uses the default.
+func NewServer(getVerifier VerifierGetter, timeout time.Duration) (*Server, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "read random bytes error")
+	}
+
+	return &Server{
+		conversations: make(map[string]*conversation),
+		getVerifier:   getVerifier,
+		timeout:       timeout,
+		fakeSecret:    secret,
+	}, nil
+}
+
+// Supported tells whether the given authentication method is handled by the server.
+func Supported(mechanism string) bool {
+	return mechanism == hashing.ScramSHA256 || mechanism == hashing.ScramSHA512
+}
+
+// Start handles the client-first-message and returns the server-first-message. ctx is handed to the verifier getter.
+// Any previous conversation for the same client id is discarded.
+func (s *Server) Start(ctx context.Context, clientid, mechanism string, clientFirst []byte) ([]byte, error) {
+	if !Supported(mechanism) {
+		return nil, ErrUnsupportedMechanism
+	}
+
+	s.Abort(clientid)
+
+	gs2Header, username, clientNonce, bare, err := parseClientFirst(string(clientFirst))
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := s.getVerifier(ctx, mechanism, username)
+	if err != nil {
+		return nil, &LookupError{Err: err}
+	}
+
+	if verifier == nil {
+		// Carry on with made up but stable credentials and fail at the end.
+		log.Debugf("no %s verifier for user %s", mechanism, username)
+	}
+
+	serverNonce := make([]byte, nonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, errors.Wrap(err, "read random bytes error")
+	}
+
+	c := &conversation{
+		mechanism:       mechanism,
+		username:        username,
+		verifier:        verifier,
+		clientFirstBare: bare,
+		gs2Header:       gs2Header,
+		nonce:           clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce),
+		started:         time.Now(),
+	}
+
+	salt, iterations := s.fakeSalt(mechanism, username), fakeIterations
+	if verifier != nil {
+		salt, iterations = verifier.Salt, verifier.Iterations
+	}
+
+	c.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", c.nonce, base64.StdEncoding.EncodeToString(salt), iterations)
+
+	s.Lock()
+	s.sweep()
+	s.conversations[clientid] = c
+	s.Unlock()
+
+	return []byte(c.serverFirst), nil
+}
+
+// Username returns the username a client-first-message is sent for, so the client may be throttled before the conversation starts.
+func Username(clientFirst []byte) (string, error) {
+	_, username, _, _, err := parseClientFirst(string(clientFirst))
+	return username, err
+}
+
+// Continue handles the client-final-message. On success it returns the authenticated username
+// and the server-final-message. On failure the username the conversation was started for is still returned,
+// unless there was none in progress. The conversation is finished either way.
+func (s *Server) Continue(clientid, mechanism string, clientFinal []byte) (string, []byte, error) {
+	s.Lock()
+	c, ok := s.conversations[clientid]
+	delete(s.conversations, clientid)
+	s.Unlock()
+
+	if !ok {
+		return "", nil, errors.New("no conversation in progress")
+	}
+
+	if time.Since(c.started) > s.timeout {
+		return c.username, nil, errors.New("conversation timed out")
+	}
+
+	if mechanism != c.mechanism {
+		return c.username, nil, errors.Errorf("mechanism changed from %s to %s", c.mechanism, mechanism)
+	}
+
+	channelBinding, nonce, proof, withoutProof, err := parseClientFinal(string(clientFinal))
+	if err != nil {
+		return c.username, nil, err
+	}
+
+	if channelBinding != base64.StdEncoding.EncodeToString([]byte(c.gs2Header)) {
+		return c.username, nil, errors.New("channel binding mismatch")
+	}
+
+	if nonce != c.nonce {
+		return c.username, nil, errors.New("nonce mismatch")
+	}
+
+	if c.verifier == nil {
+		return c.username, nil, errors.Errorf("unknown user %s", c.username)
+	}
+
+	h := hashing.ScramHash(c.mechanism)
+	authMessage := []byte(c.clientFirstBare + "," + c.serverFirst + "," + withoutProof)
+
+	clientSignature := hashing.ScramHMAC(h, c.verifier.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return c.username, nil, errors.New("invalid proof length")
+	}
+
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), c.verifier.StoredKey) {
+		return c.username, nil, errors.Errorf("invalid proof for user %s", c.username)
+	}
+
+	serverSignature := hashing.ScramHMAC(h, c.verifier.ServerKey, authMessage)
+
+	return c.username, []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// Abort drops any conversation in progress for the client id.
+func (s *Server) Abort(clientid string) {
+	s.Lock()
+	delete(s.conversations, clientid)
+	s.Unlock()
+}
+
+// sweep removes stale conversations. Caller must hold the lock.
+func (s *Server) sweep() {
+	for clientid, c := range s.conversations {
+		if time.Since(c.started) > s.timeout {
+			delete(s.conversations, clientid)
+		}
+	}
+}
+
+func (s *Server) fakeSalt(mechanism, username string) []byte {
+	return hashing.ScramHMAC(hashing.ScramHash(mechanism), s.fakeSecret, []byte(mechanism+":"+username))[:16]
+}
+
+// parseClientFirst parses "gs2-header client-first-message-bare", e.g. "n,,n=user,r=nonce".
+func parseClientFirst(msg string) (gs2Header, username, nonce, bare string, err error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return "", "", "", "", errors.New("malformed client-first-message")
+	}
+
+	switch {
+	case parts[0] == "n" || parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return "", "", "", "", errors.New("channel binding is not supported")
+	default:
+		return "", "", "", "", errors.New("malformed gs2 header")
+	}
+
+	gs2Header = parts[0] + "," + parts[1] + ","
+	bare = parts[2]
+
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 {
+		return "", "", "", "", errors.New("malformed client-first-message")
+	}
+
+	if strings.HasPrefix(attrs[0], "m=") {
+		return "", "", "", "", errors.New("mandatory extensions are not supported")
+	}
+
+	if !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return "", "", "", "", errors.New("malformed client-first-message")
+	}
+
+	username, err = decodeSaslName(attrs[0][2:])
+	if err != nil {
+		return "", "", "", "", err
+	}
+
+	if parts[1] != "" {
+		authzid, err := decodeSaslName(strings.TrimPrefix(parts[1], "a="))
+		if err != nil || !strings.HasPrefix(parts[1], "a=") || authzid != username {
+			return "", "", "", "", errors.New("authorization identity must match the username")
+		}
+	}
+
+	nonce = attrs[1][2:]
+	if username == "" || nonce == "" {
+		return "", "", "", "", errors.New("empty username or nonce")
+	}
+
+	return gs2Header, username, nonce, bare, nil
+}
+
+// parseClientFinal parses "c=biws,r=nonce,p=proof" and returns the message without the proof,
+// which is part of the AuthMessage.
+func parseClientFinal(msg string) (channelBinding, nonce string, proof []byte, withoutProof string, err error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return "", "", nil, "", errors.New("missing proof")
+	}
+
+	withoutProof = msg[:i]
+	proof, err = base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return "", "", nil, "", errors.Wrap(err, "base64 proof error")
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return "", "", nil, "", errors.New("malformed client-final-message")
+	}
+
+	return attrs[0][2:], attrs[1][2:], proof, withoutProof, nil
+}
+
+// decodeSaslName replaces the =2C and =3D escapes with ',' and '='.
+func decodeSaslName(name string) (string, error) {
+	if !strings.Contains(name, "=") {
+		return name, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+3 > len(name) {
+			return "", errors.New("invalid escape in username")
+		}
+		switch name[i+1 : i+3] {
+		case "2C":
+			b.WriteByte(',')
+		case "3D":
+			b.WriteByte('=')
+		default:
+			return "", errors.New("invalid escape in username")
+		}
+		i += 2
+	}
+
+	return b.String(), nil
+}
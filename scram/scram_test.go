@@ -0,0 +1,216 @@
+package scram
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/hashing"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	scramUsername = "user"
+	scramPassword = "pencil"
+	scramSalt     = "W22ZaJ0SNY7soEsUEjb6gQ=="
+)
+
+func newTestServer(t *testing.T, timeout time.Duration) *Server {
+	salt, err := base64.StdEncoding.DecodeString(scramSalt)
+	assert.Nil(t, err)
+
+	verifiers := map[string]*hashing.ScramVerifier{
+		hashing.ScramSHA256: hashing.NewScramVerifier(hashing.ScramSHA256, scramPassword, salt, 4096),
+		hashing.ScramSHA512: hashing.NewScramVerifier(hashing.ScramSHA512, scramPassword, salt, 4096),
+	}
+
+	s, err := NewServer(func(ctx context.Context, mechanism, username string) (*hashing.ScramVerifier, error) {
+		if username != scramUsername {
+			return nil, nil
+		}
+		return verifiers[mechanism], nil
+	}, timeout)
+	assert.Nil(t, err)
+
+	return s
+}
+
+// clientFinal builds the client-final-message and the expected server signature the way a client would.
+func clientFinal(mechanism, password, clientFirstBare, serverFirst string) (string, string) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			fmt.Sscanf(attr[2:], "%d", &iterations)
+		}
+	}
+
+	h := hashing.ScramHash(mechanism)
+	rawSalt, _ := base64.StdEncoding.DecodeString(salt)
+	saltedPassword := pbkdf2.Key([]byte(password), rawSalt, iterations, h().Size(), h)
+	clientKey := hashing.ScramHMAC(h, saltedPassword, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+	clientSignature := hashing.ScramHMAC(h, storedKey.Sum(nil), authMessage)
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverKey := hashing.ScramHMAC(h, saltedPassword, []byte("Server Key"))
+	serverSignature := hashing.ScramHMAC(h, serverKey, authMessage)
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+func TestScramConversation(t *testing.T) {
+	s := newTestServer(t, 0)
+
+	for _, mechanism := range []string{hashing.ScramSHA256, hashing.ScramSHA512} {
+		bare := "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+		serverFirst, err := s.Start(context.Background(), "client", mechanism, []byte("n,,"+bare))
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(serverFirst), "r=rOprNGfwEbeRWgbNEkqO"))
+		assert.Contains(t, string(serverFirst), ",s="+scramSalt+",i=4096")
+
+		final, signature := clientFinal(mechanism, scramPassword, bare, string(serverFirst))
+
+		username, serverFinal, err := s.Continue("client", mechanism, []byte(final))
+		assert.Nil(t, err)
+		assert.Equal(t, scramUsername, username)
+		assert.Equal(t, signature, string(serverFinal))
+
+		// The conversation is done, so continuing again should fail.
+		_, _, err = s.Continue("client", mechanism, []byte(final))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestScramFailures(t *testing.T) {
+	s := newTestServer(t, 0)
+	bare := "n=user,r=clientnonce"
+
+	// Wrong password.
+	serverFirst, err := s.Start(context.Background(), "client", hashing.ScramSHA256, []byte("n,,"+bare))
+	assert.Nil(t, err)
+	final, _ := clientFinal(hashing.ScramSHA256, "wrong", bare, string(serverFirst))
+	username, _, err := s.Continue("client", hashing.ScramSHA256, []byte(final))
+	assert.NotNil(t, err)
+	assert.Equal(t, scramUsername, username)
+
+	// Unknown users get a stable made up salt and fail at the end.
+	unknown := "n=unknown,r=clientnonce"
+	first, err := s.Start(context.Background(), "client", hashing.ScramSHA256, []byte("n,,"+unknown))
+	assert.Nil(t, err)
+	second, err := s.Start(context.Background(), "client", hashing.ScramSHA256, []byte("n,,"+unknown))
+	assert.Nil(t, err)
+	assert.Equal(t, strings.SplitN(string(first), ",", 2)[1], strings.SplitN(string(second), ",", 2)[1])
+	final, _ = clientFinal(hashing.ScramSHA256, scramPassword, unknown, string(second))
+	_, _, err = s.Continue("client", hashing.ScramSHA256, []byte(final))
+	assert.NotNil(t, err)
+
+	// Tampered nonce.
+	serverFirst, err = s.Start(context.Background(), "client", hashing.ScramSHA256, []byte("n,,"+bare))
+	assert.Nil(t, err)
+	final, _ = clientFinal(hashing.ScramSHA256, scramPassword, bare, string(serverFirst))
+	_, _, err = s.Continue("client", hashing.ScramSHA256, []byte(strings.Replace(final, "r=clientnonce", "r=othernonce", 1)))
+	assert.NotNil(t, err)
+
+	// Malformed or unsupported client-first-messages.
+	for _, msg := range []string{"", "n,,r=nonce", "p=tls-unique,,n=user,r=nonce", "n,a=other,n=user,r=nonce", "n,,m=ext,n=user,r=nonce", "n,,n=us=ZZer,r=nonce"} {
+		_, err = s.Start(context.Background(), "client", hashing.ScramSHA256, []byte(msg))
+		assert.NotNil(t, err, msg)
+	}
+
+	_, err = s.Start(context.Background(), "client", "PLAIN", []byte("n,,"+bare))
+	assert.Equal(t, ErrUnsupportedMechanism, err)
+
+	// No conversation.
+	username, _, err = s.Continue("other", hashing.ScramSHA256, []byte(final))
+	assert.NotNil(t, err)
+	assert.Empty(t, username)
+}
+
+func TestScramUsername(t *testing.T) {
+	username, err := Username([]byte("n,,n=us=2Cer,r=clientnonce"))
+	assert.Nil(t, err)
+	assert.Equal(t, "us,er", username)
+
+	_, err = Username([]byte("n,,r=clientnonce"))
+	assert.NotNil(t, err)
+}
+
+func TestScramLookupError(t *testing.T) {
+	s, err := NewServer(func(ctx context.Context, mechanism, username string) (*hashing.ScramVerifier, error) {
+		return nil, fmt.Errorf("backend down")
+	}, 0)
+	assert.Nil(t, err)
+
+	_, err = s.Start(context.Background(), "client", hashing.ScramSHA256, []byte("n,,n=user,r=clientnonce"))
+	_, ok := err.(*LookupError)
+	assert.True(t, ok)
+}
+
+func TestScramTimeout(t *testing.T) {
+	s := newTestServer(t, 50*time.Millisecond)
+	bare := "n=user,r=clientnonce"
+
+	serverFirst, err := s.Start(context.Background(), "client", hashing.ScramSHA256, []byte("n,,"+bare))
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	final, _ := clientFinal(hashing.ScramSHA256, scramPassword, bare, string(serverFirst))
+	_, _, err = s.Continue("client", hashing.ScramSHA256, []byte(final))
+	assert.NotNil(t, err)
+}
+
+func TestScramConcurrentConversations(t *testing.T) {
+	s := newTestServer(t, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			clientid := fmt.Sprintf("client-%d", i)
+			bare := fmt.Sprintf("n=user,r=nonce%d", i)
+
+			serverFirst, err := s.Start(context.Background(), clientid, hashing.ScramSHA256, []byte("n,,"+bare))
+			assert.Nil(t, err)
+
+			final, _ := clientFinal(hashing.ScramSHA256, scramPassword, bare, string(serverFirst))
+			username, _, err := s.Continue(clientid, hashing.ScramSHA256, []byte(final))
+			assert.Nil(t, err)
+			assert.Equal(t, scramUsername, username)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, len(s.conversations))
+}
+
+func TestDecodeSaslName(t *testing.T) {
+	name, err := decodeSaslName("a=2Cb=3Dc")
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b=c", name)
+
+	_, err = decodeSaslName("a=2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,166 @@
+// Package secrets resolves option values referring to secrets kept out of the mosquitto configuration:
+//
+//	env:VAR                  the value of the environment variable VAR
+//	file:/run/secrets/name   the contents of the file, with surrounding whitespace trimmed
+//	exec:command args        the output of the command, with surrounding whitespace trimmed
+//
+// exec references are only resolved when secrets_exec is true.
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	envProvider  = "env"
+	fileProvider = "file"
+	execProvider = "exec"
+
+	defaultExecTimeout = 5 * time.Second
+)
+
+// fileURIOptions take file: URIs of their own, so file references aren't resolved in them.
+var fileURIOptions = map[string]bool{
+	"sqlite_source": true,
+}
+
+// Reference returns the provider (env, file or exec) of the reference given as the value of option key
+// and what it refers to, or empty strings when the value isn't a reference.
+func Reference(key, value string) (string, string) {
+	idx := strings.Index(value, ":")
+	if idx < 0 {
+		return "", ""
+	}
+
+	provider, ref := value[:idx], value[idx+1:]
+	switch provider {
+	case envProvider, execProvider:
+	case fileProvider:
+		if fileURIOptions[key] {
+			return "", ""
+		}
+	default:
+		return "", ""
+	}
+
+	return provider, ref
+}
+
+// Resolver resolves references, remembering the output of commands so one referenced by several options runs once.
+type Resolver struct {
+	exec    bool
+	timeout time.Duration
+	outputs map[string]string
+}
+
+// NewResolver returns a resolver set by the secrets_exec and secrets_exec_timeout_ms options.
+func NewResolver(authOpts map[string]string) *Resolver {
+	r := &Resolver{
+		exec:    authOpts["secrets_exec"] == "true",
+		timeout: defaultExecTimeout,
+		outputs: make(map[string]string),
+	}
+
+	if timeout, ok := authOpts["secrets_exec_timeout_ms"]; ok {
+		ms, err := strconv.Atoi(timeout)
+		if err == nil && ms > 0 {
+			r.timeout = time.Duration(ms) * time.Millisecond
+		} else {
+			log.Warningf("invalid secrets exec timeout %s, defaulting to %s", timeout, r.timeout)
+		}
+	}
+
+	return r
+}
+
+// Value returns the secret the value of option key refers to, or the value itself when it's not a reference.
+func (r *Resolver) Value(key, value string) (string, error) {
+	provider, ref := Reference(key, value)
+
+	switch provider {
+	case envProvider:
+		secret, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", errors.Errorf("environment variable %s is not set", ref)
+		}
+		return secret, nil
+	case fileProvider:
+		content, err := ioutil.ReadFile(ref)
+		if err != nil {
+			return "", errors.Wrap(err, "couldn't read secret file")
+		}
+		return strings.TrimSpace(string(content)), nil
+	case execProvider:
+		return r.run(ref)
+	}
+
+	return value, nil
+}
+
+// run runs command without a shell, returning its trimmed output.
+func (r *Resolver) run(command string) (string, error) {
+	if !r.exec {
+		return "", errors.New("exec references are disabled, set secrets_exec to true to allow them")
+	}
+
+	if output, ok := r.outputs[command]; ok {
+		return output, nil
+	}
+
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	// Neither the output nor stderr are reported, as they may hold the secret.
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "command %s failed", args[0])
+	}
+
+	r.outputs[command] = strings.TrimSpace(string(output))
+
+	return r.outputs[command], nil
+}
+
+// Resolve returns a copy of authOpts with every reference replaced by the secret it refers to.
+// The error tells every option that couldn't be resolved, but never their values.
+func Resolve(authOpts map[string]string) (map[string]string, error) {
+	keys := make([]string, 0, len(authOpts))
+	for key := range authOpts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	r := NewResolver(authOpts)
+	resolved := make(map[string]string, len(authOpts))
+
+	var failed []string
+	for _, key := range keys {
+		value, err := r.Value(key, authOpts[key])
+		if err != nil {
+			failed = append(failed, key+": "+err.Error())
+			continue
+		}
+		resolved[key] = value
+	}
+
+	if len(failed) > 0 {
+		return nil, errors.Errorf("couldn't resolve secrets: %s", strings.Join(failed, "; "))
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,66 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResolve(t *testing.T) {
+	Convey("Given options referring to secrets", t, func() {
+		dir, err := ioutil.TempDir("", "secrets")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "pg_password")
+		So(ioutil.WriteFile(path, []byte("from file\n"), 0600), ShouldBeNil)
+
+		os.Setenv("GO_AUTH_TEST_SECRET", "from env")
+		defer os.Unsetenv("GO_AUTH_TEST_SECRET")
+
+		authOpts := map[string]string{
+			"backends":       "postgres, sqlite",
+			"pg_password":    "file:" + path,
+			"redis_password": "env:GO_AUTH_TEST_SECRET",
+			"sqlite_source":  "file:test.db?cache=shared",
+			"http_host":      "localhost:8080",
+		}
+
+		Convey("Env and file references should be replaced, leaving other values as they are", func() {
+			resolved, err := Resolve(authOpts)
+			So(err, ShouldBeNil)
+			So(resolved["pg_password"], ShouldEqual, "from file")
+			So(resolved["redis_password"], ShouldEqual, "from env")
+			So(resolved["sqlite_source"], ShouldEqual, "file:test.db?cache=shared")
+			So(resolved["http_host"], ShouldEqual, "localhost:8080")
+			So(authOpts["pg_password"], ShouldEqual, "file:"+path)
+		})
+
+		Convey("Exec references should only be run when enabled", func() {
+			authOpts["jwt_secret"] = "exec:echo  from exec "
+
+			_, err := Resolve(authOpts)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "jwt_secret: exec references are disabled")
+
+			authOpts["secrets_exec"] = "true"
+
+			resolved, err := Resolve(authOpts)
+			So(err, ShouldBeNil)
+			So(resolved["jwt_secret"], ShouldEqual, "from exec")
+		})
+
+		Convey("Every option that can't be resolved should be reported", func() {
+			authOpts["pg_password"] = "file:" + filepath.Join(dir, "missing")
+			authOpts["redis_password"] = "env:GO_AUTH_TEST_MISSING"
+
+			_, err := Resolve(authOpts)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "pg_password: couldn't read secret file")
+			So(err.Error(), ShouldContainSubstring, "redis_password: environment variable GO_AUTH_TEST_MISSING is not set")
+		})
+	})
+}
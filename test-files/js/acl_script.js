@@ -1,4 +1,4 @@
-function checkAcl(username, topic, clientid, acc) {
+function checkAcl(username, topic, clientid, acc, payloadlen, qos, retain) {
     if(username != "correct") {
         return false;
     }
@@ -15,7 +15,16 @@ function checkAcl(username, topic, clientid, acc) {
         return false;
     }
 
+    // Message details are null when unknown.
+    if(retain === true) {
+        return false;
+    }
+
+    if(qos !== null && qos > 1) {
+        return false;
+    }
+
     return true;
 }
 
-checkAcl(username, topic, clientid, acc);
+checkAcl(username, topic, clientid, acc, payloadlen, qos, retain);
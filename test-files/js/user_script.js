@@ -1,8 +1,16 @@
-function checkUser(username, password, clientid) {
+function checkUser(username, password, clientid, ip) {
+    // Clients from the documentation range are rejected.
+    if(ip != null && ip.indexOf("192.0.2.") == 0) {
+        return false;
+    }
     if(username == "correct" && password == "good") {
         return true;
     }
+    // Banned users are denied explicitly.
+    if(username == "banned") {
+        return {deny: true, reason: "banned user"};
+    }
     return false;
 }
 
-checkUser(username, password, clientid);
+checkUser(username, password, clientid, ip);
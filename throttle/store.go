@@ -0,0 +1,167 @@
+package throttle
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	goCache "github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+// memoryStore keeps the state in memory, so it's only shared by checks made by this plugin instance.
+type memoryStore struct {
+	mu     sync.Mutex
+	states *goCache.Cache
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		states: goCache.New(goCache.NoExpiration, time.Minute),
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, _ := s.states.Get(key)
+	if state == nil {
+		return State{}, nil
+	}
+
+	return state.(State), nil
+}
+
+func (s *memoryStore) Fail(ctx context.Context, key string, at time.Time, ttl time.Duration) (State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var state State
+	if current, ok := s.states.Get(key); ok {
+		state = current.(State)
+	}
+
+	state.Failures++
+	state.Last = at
+	s.states.Set(key, state, ttl)
+
+	return state, nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context, key string) error {
+	s.states.Delete(key)
+	return nil
+}
+
+func (s *memoryStore) Close() {}
+
+// redisStore keeps the state in Redis, so limits hold across every broker sharing it.
+// A key's failures are counted in one Redis key and the time of the last one stored in another,
+// both sharing a hash tag so they live in the same Redis Cluster slot.
+type redisStore struct {
+	client bes.RedisClient
+}
+
+func newRedisStore(authOpts map[string]string) (*redisStore, error) {
+	password := authOpts["throttle_redis_password"]
+
+	var client bes.RedisClient
+	if authOpts["throttle_redis_mode"] == "cluster" {
+		var addresses []string
+		for _, address := range strings.Split(authOpts["throttle_redis_addresses"], ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+
+		if len(addresses) == 0 {
+			return nil, errors.New("throttle error: missing options: throttle_redis_addresses")
+		}
+
+		client = bes.ClusterRedisClient{ClusterClient: goredis.NewClusterClient(&goredis.ClusterOptions{
+			Addrs:    addresses,
+			Password: password,
+		})}
+	} else {
+		host := "localhost"
+		if value, ok := authOpts["throttle_redis_host"]; ok {
+			host = value
+		}
+
+		port := "6379"
+		if value, ok := authOpts["throttle_redis_port"]; ok {
+			port = value
+		}
+
+		client = bes.SingleRedisClient{Client: goredis.NewClient(&goredis.Options{
+			Addr:     fmt.Sprintf("%s:%s", host, port),
+			Password: password,
+			DB:       intOption(authOpts, "throttle_redis_db", 4, 0),
+		})}
+	}
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "throttle error: couldn't connect to redis")
+	}
+
+	return &redisStore{client: client}, nil
+}
+
+func redisKeys(key string) (string, string) {
+	tag := fmt.Sprintf("throttle:{%x}", sha1.Sum([]byte(key)))
+	return tag + ":failures", tag + ":last"
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (State, error) {
+	failuresKey, lastKey := redisKeys(key)
+
+	failures, err := s.client.Get(ctx, failuresKey).Int()
+	if err == goredis.Nil {
+		return State{}, nil
+	} else if err != nil {
+		return State{}, err
+	}
+
+	last, err := s.client.Get(ctx, lastKey).Int64()
+	if err != nil && err != goredis.Nil {
+		return State{}, err
+	}
+
+	return State{Failures: failures, Last: time.Unix(0, last)}, nil
+}
+
+func (s *redisStore) Fail(ctx context.Context, key string, at time.Time, ttl time.Duration) (State, error) {
+	failuresKey, lastKey := redisKeys(key)
+
+	failures, err := s.client.Incr(ctx, failuresKey).Result()
+	if err != nil {
+		return State{}, err
+	}
+
+	if err := s.client.Expire(ctx, failuresKey, ttl).Err(); err != nil {
+		return State{}, err
+	}
+
+	if err := s.client.Set(ctx, lastKey, strconv.FormatInt(at.UnixNano(), 10), ttl).Err(); err != nil {
+		return State{}, err
+	}
+
+	return State{Failures: int(failures), Last: at}, nil
+}
+
+func (s *redisStore) Reset(ctx context.Context, key string) error {
+	failuresKey, lastKey := redisKeys(key)
+	return s.client.Del(ctx, failuresKey, lastKey).Err()
+}
+
+func (s *redisStore) Close() {
+	s.client.Close()
+}
@@ -0,0 +1,284 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Keys login attempts may be throttled by.
+const (
+	Username = "username"
+	ClientID = "clientid"
+	IP       = "ip"
+)
+
+const (
+	defaultMaxFailures    = 5
+	defaultLockoutSeconds = 300
+	defaultDelayMs        = 1000
+	defaultMaxDelayMs     = 30000
+	defaultWindowSeconds  = 900
+)
+
+// Attempt identifies a login attempt. Empty fields, such as the IP when mosquitto doesn't give it, are ignored.
+type Attempt struct {
+	Username string
+	ClientID string
+	IP       string
+}
+
+// State is what's known about the recent failures for a key.
+type State struct {
+	Failures int
+	Last     time.Time
+}
+
+// Store keeps the failure state of each key. Keys are forgotten after ttl without failures.
+type Store interface {
+	Get(ctx context.Context, key string) (State, error)
+	Fail(ctx context.Context, key string, at time.Time, ttl time.Duration) (State, error)
+	Reset(ctx context.Context, key string) error
+	Close()
+}
+
+// ErrThrottled is returned for attempts made before the wait imposed on one of their keys is over.
+type ErrThrottled struct {
+	Key   string
+	Value string
+	Wait  time.Duration
+}
+
+func (e ErrThrottled) Error() string {
+	return fmt.Sprintf("too many failed logins for %s %s, retry in %s", e.Key, e.Value, e.Wait.Round(time.Second))
+}
+
+// Throttler tracks failed logins per key. After a failure, the next attempt for the same key is rejected
+// until a delay that doubles with every failure is over, and after max failures the key is locked out.
+// Throttled attempts are rejected right away, without asking the backends, and don't count as failures.
+type Throttler struct {
+	store       Store
+	keys        []string
+	maxFailures int
+	lockout     time.Duration
+	delay       time.Duration
+	maxDelay    time.Duration
+	window      time.Duration
+	now         func() time.Time
+}
+
+// New builds a throttler from the throttle options, or returns nil when throttle isn't set to true.
+func New(authOpts map[string]string) (*Throttler, error) {
+	if strings.Replace(authOpts["throttle"], " ", "", -1) != "true" {
+		return nil, nil
+	}
+
+	t := &Throttler{
+		keys:        []string{Username, ClientID, IP},
+		maxFailures: intOption(authOpts, "throttle_max_failures", defaultMaxFailures, 1),
+		lockout:     time.Duration(intOption(authOpts, "throttle_lockout_seconds", defaultLockoutSeconds, 0)) * time.Second,
+		delay:       time.Duration(intOption(authOpts, "throttle_delay_ms", defaultDelayMs, 0)) * time.Millisecond,
+		maxDelay:    time.Duration(intOption(authOpts, "throttle_max_delay_ms", defaultMaxDelayMs, 0)) * time.Millisecond,
+		window:      time.Duration(intOption(authOpts, "throttle_window_seconds", defaultWindowSeconds, 1)) * time.Second,
+		now:         time.Now,
+	}
+
+	if keysOpt, ok := authOpts["throttle_keys"]; ok {
+		t.keys = nil
+		for _, key := range strings.Split(keysOpt, ",") {
+			key = strings.TrimSpace(key)
+			switch key {
+			case Username, ClientID, IP:
+				t.keys = append(t.keys, key)
+			case "":
+			default:
+				return nil, errors.Errorf("throttle error: unknown key %s", key)
+			}
+		}
+
+		if len(t.keys) == 0 {
+			return nil, errors.New("throttle error: throttle_keys is empty")
+		}
+	}
+
+	var err error
+	switch authOpts["throttle_store"] {
+	case "redis":
+		t.store, err = newRedisStore(authOpts)
+	case "", "memory":
+		t.store = newMemoryStore()
+	default:
+		err = errors.Errorf("throttle error: unknown store %s", authOpts["throttle_store"])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("login throttling enabled by %s: %d failures lock out for %s", strings.Join(t.keys, ", "), t.maxFailures, t.lockout)
+
+	return t, nil
+}
+
+func intOption(authOpts map[string]string, name string, def, min int) int {
+	value, ok := authOpts[name]
+	if !ok {
+		return def
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min {
+		log.Warningf("couldn't parse %s %s, defaulting to %d", name, value, def)
+		return def
+	}
+
+	return parsed
+}
+
+// Check returns an ErrThrottled if the attempt must wait before being evaluated. Store errors are logged
+// and let the attempt through, so an unavailable store doesn't lock everyone out. It's safe to call on a nil throttler.
+func (t *Throttler) Check(ctx context.Context, attempt Attempt) error {
+	if t == nil {
+		return nil
+	}
+
+	for _, key := range t.keys {
+		value := attempt.value(key)
+		if value == "" {
+			continue
+		}
+
+		state, err := t.store.Get(ctx, storeKey(key, value))
+		if err != nil {
+			log.Errorf("throttle error: couldn't get state for %s %s: %s", key, value, err)
+			continue
+		}
+
+		if wait := t.wait(state); wait > 0 {
+			metrics.ObserveThrottled(key)
+			return ErrThrottled{Key: key, Value: value, Wait: wait}
+		}
+	}
+
+	return nil
+}
+
+// Failed counts a rejected attempt against each of its keys. It's safe to call on a nil throttler.
+func (t *Throttler) Failed(ctx context.Context, attempt Attempt) {
+	if t == nil {
+		return
+	}
+
+	// Keep the state around for as long as a lockout lasts, even if that's longer than the window.
+	ttl := t.window
+	if t.lockout > ttl {
+		ttl = t.lockout
+	}
+
+	now := t.now()
+	for _, key := range t.keys {
+		value := attempt.value(key)
+		if value == "" {
+			continue
+		}
+
+		state, err := t.store.Fail(ctx, storeKey(key, value), now, ttl)
+		if err != nil {
+			log.Errorf("throttle error: couldn't count failure for %s %s: %s", key, value, err)
+			continue
+		}
+
+		if state.Failures == t.maxFailures {
+			log.Warnf("too many failed logins for %s %s, locked out for %s", key, value, t.lockout)
+		}
+	}
+}
+
+// Succeeded forgets the failures of the attempt's username, so users mistyping their password now and then
+// aren't locked out. Client ids and IPs keep their failures, as a client may log in as any user it knows.
+// It's safe to call on a nil throttler.
+func (t *Throttler) Succeeded(ctx context.Context, attempt Attempt) {
+	if t == nil || attempt.Username == "" || !t.uses(Username) {
+		return
+	}
+
+	if err := t.store.Reset(ctx, storeKey(Username, attempt.Username)); err != nil {
+		log.Errorf("throttle error: couldn't reset state for username %s: %s", attempt.Username, err)
+	}
+}
+
+// Unlock forgets the failures of the given key (username, clientid or ip) and value.
+func (t *Throttler) Unlock(ctx context.Context, key, value string) error {
+	switch key {
+	case Username, ClientID, IP:
+	default:
+		return errors.Errorf("unknown throttle key %s", key)
+	}
+
+	log.Infof("unlocking %s %s", key, value)
+
+	return t.store.Reset(ctx, storeKey(key, value))
+}
+
+// Close closes the store. It's safe to call on a nil throttler.
+func (t *Throttler) Close() {
+	if t == nil {
+		return
+	}
+
+	t.store.Close()
+}
+
+// wait returns how long is left before an attempt may be evaluated given the key's state.
+func (t *Throttler) wait(state State) time.Duration {
+	if state.Failures == 0 {
+		return 0
+	}
+
+	var wait time.Duration
+	if state.Failures >= t.maxFailures {
+		wait = t.lockout
+	} else {
+		wait = t.delay
+		for i := 1; i < state.Failures && wait < t.maxDelay; i++ {
+			wait *= 2
+		}
+
+		if wait > t.maxDelay {
+			wait = t.maxDelay
+		}
+	}
+
+	return state.Last.Add(wait).Sub(t.now())
+}
+
+func (t *Throttler) uses(key string) bool {
+	for _, k := range t.keys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a Attempt) value(key string) string {
+	switch key {
+	case Username:
+		return a.Username
+	case ClientID:
+		return a.ClientID
+	default:
+		return a.IP
+	}
+}
+
+func storeKey(key, value string) string {
+	return key + ":" + value
+}
@@ -0,0 +1,163 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestThrottler(t *testing.T) {
+	Convey("Given a throttler locking out after 3 failures", t, func() {
+		authOpts := map[string]string{
+			"throttle":                 "true",
+			"throttle_max_failures":    "3",
+			"throttle_lockout_seconds": "60",
+			"throttle_delay_ms":        "1000",
+			"throttle_max_delay_ms":    "1500",
+		}
+
+		th, err := New(authOpts)
+		So(err, ShouldBeNil)
+		defer th.Close()
+
+		now := time.Now()
+		th.now = func() time.Time { return now }
+
+		ctx := context.Background()
+		attempt := Attempt{Username: "test1", ClientID: "client1", IP: "10.0.0.1"}
+
+		So(th.Check(ctx, attempt), ShouldBeNil)
+
+		Convey("A failure should delay the next attempt, doubling up to the max delay", func() {
+			th.Failed(ctx, attempt)
+
+			err := th.Check(ctx, attempt)
+			So(err, ShouldNotBeNil)
+			So(err.(ErrThrottled).Key, ShouldEqual, Username)
+			So(err.(ErrThrottled).Wait, ShouldEqual, time.Second)
+
+			now = now.Add(time.Second)
+			So(th.Check(ctx, attempt), ShouldBeNil)
+
+			th.Failed(ctx, attempt)
+			So(th.Check(ctx, attempt).(ErrThrottled).Wait, ShouldEqual, 1500*time.Millisecond)
+
+			Convey("Other keys of the attempt should be throttled too", func() {
+				So(th.Check(ctx, Attempt{Username: "test2", ClientID: "client1"}), ShouldNotBeNil)
+				So(th.Check(ctx, Attempt{Username: "test2", IP: "10.0.0.1"}), ShouldNotBeNil)
+				So(th.Check(ctx, Attempt{Username: "test2", ClientID: "client2", IP: "10.0.0.2"}), ShouldBeNil)
+			})
+
+			Convey("Reaching max failures should lock the key out", func() {
+				now = now.Add(2 * time.Second)
+				th.Failed(ctx, attempt)
+
+				err := th.Check(ctx, attempt)
+				So(err, ShouldNotBeNil)
+				So(err.(ErrThrottled).Wait, ShouldEqual, time.Minute)
+
+				now = now.Add(time.Minute)
+				So(th.Check(ctx, attempt), ShouldBeNil)
+			})
+
+			Convey("Unlocking every key should let the attempt through", func() {
+				So(th.Unlock(ctx, Username, "test1"), ShouldBeNil)
+				So(th.Check(ctx, attempt), ShouldNotBeNil)
+
+				So(th.Unlock(ctx, ClientID, "client1"), ShouldBeNil)
+				So(th.Unlock(ctx, IP, "10.0.0.1"), ShouldBeNil)
+				So(th.Check(ctx, attempt), ShouldBeNil)
+
+				So(th.Unlock(ctx, "unknown", "test1"), ShouldNotBeNil)
+			})
+
+			Convey("A successful login should only reset the username", func() {
+				th.Succeeded(ctx, attempt)
+
+				So(th.Check(ctx, Attempt{Username: "test1"}), ShouldBeNil)
+				So(th.Check(ctx, Attempt{ClientID: "client1"}), ShouldNotBeNil)
+			})
+		})
+
+		Convey("Only the configured keys should be throttled", func() {
+			authOpts["throttle_keys"] = "ip"
+			th, err := New(authOpts)
+			So(err, ShouldBeNil)
+			th.now = func() time.Time { return now }
+
+			th.Failed(ctx, attempt)
+
+			So(th.Check(ctx, Attempt{Username: "test1", ClientID: "client1"}), ShouldBeNil)
+			So(th.Check(ctx, Attempt{IP: "10.0.0.1"}), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Wrong options should be reported", t, func() {
+		_, err := New(map[string]string{"throttle": "true", "throttle_keys": "username, password"})
+		So(err, ShouldNotBeNil)
+
+		_, err = New(map[string]string{"throttle": "true", "throttle_store": "unknown"})
+		So(err, ShouldNotBeNil)
+
+		_, err = New(map[string]string{"throttle": "true", "throttle_store": "redis", "throttle_redis_mode": "cluster"})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Without throttle there should be no throttler, and a nil one should let everything through", t, func() {
+		th, err := New(map[string]string{})
+		So(err, ShouldBeNil)
+		So(th, ShouldBeNil)
+
+		ctx := context.Background()
+		attempt := Attempt{Username: "test1"}
+
+		th.Failed(ctx, attempt)
+		So(th.Check(ctx, attempt), ShouldBeNil)
+		th.Succeeded(ctx, attempt)
+		th.Close()
+	})
+}
+
+func TestRedisStore(t *testing.T) {
+	Convey("Given a Redis store", t, func() {
+		store, err := newRedisStore(map[string]string{
+			"throttle_redis_host": "localhost",
+			"throttle_redis_port": "6379",
+		})
+		So(err, ShouldBeNil)
+		defer store.Close()
+
+		ctx := context.Background()
+		now := time.Now()
+
+		So(store.Reset(ctx, "username:test1"), ShouldBeNil)
+
+		state, err := store.Get(ctx, "username:test1")
+		So(err, ShouldBeNil)
+		So(state.Failures, ShouldEqual, 0)
+
+		Convey("It should count failures and keep the last one's time", func() {
+			_, err := store.Fail(ctx, "username:test1", now.Add(-time.Second), time.Minute)
+			So(err, ShouldBeNil)
+
+			state, err := store.Fail(ctx, "username:test1", now, time.Minute)
+			So(err, ShouldBeNil)
+			So(state.Failures, ShouldEqual, 2)
+
+			state, err = store.Get(ctx, "username:test1")
+			So(err, ShouldBeNil)
+			So(state.Failures, ShouldEqual, 2)
+			So(state.Last.UnixNano(), ShouldEqual, now.UnixNano())
+
+			Convey("Resetting should forget them", func() {
+				So(store.Reset(ctx, "username:test1"), ShouldBeNil)
+
+				state, err := store.Get(ctx, "username:test1")
+				So(err, ShouldBeNil)
+				So(state.Failures, ShouldEqual, 0)
+			})
+		})
+	})
+}
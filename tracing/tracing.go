@@ -0,0 +1,279 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	instrumentationName = "github.com/iegomez/mosquitto-go-auth"
+	defaultServiceName  = "mosquitto-go-auth"
+)
+
+var (
+	providerMu sync.Mutex
+	provider   *sdktrace.TracerProvider
+	output     io.Closer
+)
+
+// Setup starts exporting spans with the exporter given in tracing_exporter: stdout, file or otlp.
+// Nothing is exported when it's not set, and spans are then no-ops.
+func Setup(authOpts map[string]string) error {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+
+	if provider != nil {
+		return nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch authOpts["tracing_exporter"] {
+	case "":
+		return nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		path := authOpts["tracing_file"]
+		if path == "" {
+			return errors.New("tracing error: missing options: tracing_file")
+		}
+
+		file, openErr := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if openErr != nil {
+			return errors.Wrap(openErr, "tracing error")
+		}
+		output = file
+
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case "otlp":
+		opts := []otlptracehttp.Option{}
+		if endpoint, ok := authOpts["tracing_otlp_endpoint"]; ok {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if authOpts["tracing_otlp_insecure"] == "true" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return errors.Errorf("tracing error: unknown exporter %s", authOpts["tracing_exporter"])
+	}
+
+	if err != nil {
+		closeOutput()
+		return errors.Wrap(err, "tracing error")
+	}
+
+	ratio := 1.0
+	if value, ok := authOpts["tracing_sample_ratio"]; ok {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			log.Warningf("couldn't parse tracing_sample_ratio %s, defaulting to %g", value, ratio)
+		} else {
+			ratio = parsed
+		}
+	}
+
+	serviceName := defaultServiceName
+	if name, ok := authOpts["tracing_service_name"]; ok && name != "" {
+		serviceName = name
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		closeOutput()
+		return errors.Wrap(err, "tracing error")
+	}
+
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	log.Infof("tracing enabled with %s exporter, sampling %g of checks", authOpts["tracing_exporter"], ratio)
+
+	return nil
+}
+
+// Shutdown exports pending spans, waiting a few seconds at most, and stops exporting.
+func Shutdown() {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+
+	if provider == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := provider.Shutdown(ctx); err != nil {
+		log.Errorf("tracing shutdown error: %s", err)
+	}
+
+	closeOutput()
+	provider = nil
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+}
+
+func closeOutput() {
+	if output == nil {
+		return
+	}
+
+	if err := output.Close(); err != nil {
+		log.Errorf("tracing error: couldn't close file: %s", err)
+	}
+	output = nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span as a child of the one in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartBackend starts the span of a check made to the given backend.
+func StartBackend(ctx context.Context, backend, check string) (context.Context, trace.Span) {
+	return Start(ctx, "backend."+check, attribute.String("auth.backend", backend))
+}
+
+// End records the outcome of a check in span and ends it.
+func End(span trace.Span, granted bool, err error) {
+	span.SetAttributes(attribute.String("auth.result", metrics.Result(granted, err)))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// transport traces requests and propagates their trace context in W3C headers.
+type transport struct {
+	base http.RoundTripper
+}
+
+// NewTransport wraps base, or the default transport if nil, so requests are traced
+// and carry the trace context of their own context.
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return transport{base: base}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+		),
+	)
+	defer span.End()
+
+	// A RoundTripper mustn't change the request it's given.
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// UnaryClientInterceptor traces gRPC calls and propagates their trace context in W3C metadata.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := tracer().Start(ctx, strings.TrimPrefix(method, "/"),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("rpc.system", "grpc"),
+				attribute.String("rpc.method", method),
+			),
+		)
+		defer span.End()
+
+		md, ok := metadata.FromOutgoingContext(ctx)
+		if ok {
+			md = md.Copy()
+		} else {
+			md = metadata.MD{}
+		}
+		otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+
+		err := invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return err
+	}
+}
+
+// metadataCarrier lets propagators read and write gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTracing(t *testing.T) {
+	Convey("Given tracing to a file", t, func() {
+		dir, err := ioutil.TempDir("", "tracing")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "spans.json")
+		So(Setup(map[string]string{"tracing_exporter": "file", "tracing_file": path}), ShouldBeNil)
+		defer Shutdown()
+
+		ctx, parent := Start(context.Background(), "AuthAclCheck", attribute.String("mqtt.username", "test1"))
+		traceID := parent.SpanContext().TraceID().String()
+
+		Convey("Spans should be written when shut down", func() {
+			_, span := Start(ctx, "backend.acl", attribute.String("auth.backend", "postgres"))
+			End(span, false, errors.New("backend is down"))
+			End(parent, true, nil)
+
+			Shutdown()
+
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"Name":"AuthAclCheck"`)
+			So(string(data), ShouldContainSubstring, `"Name":"backend.acl"`)
+			So(string(data), ShouldContainSubstring, "backend is down")
+			So(strings.Count(string(data), traceID), ShouldBeGreaterThanOrEqualTo, 2)
+		})
+
+		Convey("HTTP requests should carry the trace context", func() {
+			var traceparent string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				traceparent = r.Header.Get("traceparent")
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+			So(err, ShouldBeNil)
+
+			client := &http.Client{Transport: NewTransport(nil)}
+			resp, err := client.Do(req.WithContext(ctx))
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+
+			So(traceparent, ShouldStartWith, "00-"+traceID+"-")
+			So(req.Header.Get("traceparent"), ShouldEqual, "")
+		})
+
+		Convey("gRPC calls should carry the trace context", func() {
+			var traceparent string
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				md, _ := metadata.FromOutgoingContext(ctx)
+				traceparent = metadataCarrier(md).Get("traceparent")
+				return nil
+			}
+
+			ctx := metadata.AppendToOutgoingContext(ctx, "key", "value")
+			So(UnaryClientInterceptor()(ctx, "/grpc.AuthService/CheckAcl", nil, nil, nil, invoker), ShouldBeNil)
+
+			So(traceparent, ShouldStartWith, "00-"+traceID+"-")
+
+			md, _ := metadata.FromOutgoingContext(ctx)
+			So(md.Get("traceparent"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Without an exporter spans should be no-ops", t, func() {
+		So(Setup(map[string]string{}), ShouldBeNil)
+
+		_, span := Start(context.Background(), "AuthUnpwdCheck")
+		So(span.SpanContext().IsValid(), ShouldBeFalse)
+		End(span, true, nil)
+	})
+
+	Convey("Wrong options should be reported", t, func() {
+		So(Setup(map[string]string{"tracing_exporter": "unknown"}), ShouldNotBeNil)
+		So(Setup(map[string]string{"tracing_exporter": "file"}), ShouldNotBeNil)
+	})
+}